@@ -15,22 +15,22 @@
 package cmd
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
-	"path/filepath"
-	"runtime"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/uber/makisu/lib/api"
 	"github.com/uber/makisu/lib/builder"
-	"github.com/uber/makisu/lib/context"
-	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/events"
 	"github.com/uber/makisu/lib/log"
-	"github.com/uber/makisu/lib/pathutils"
-	"github.com/uber/makisu/lib/storage"
+	"github.com/uber/makisu/lib/registry"
+	"github.com/uber/makisu/lib/shell"
 	"github.com/uber/makisu/lib/tario"
 	"github.com/uber/makisu/lib/utils"
-	"github.com/uber/makisu/lib/utils/stringset"
 
 	"github.com/spf13/cobra"
 )
@@ -47,10 +47,26 @@ type buildCmd struct {
 	destination    string
 
 	target        string
+	platform      string
+	format        string
+	lockFile      string
+	frozen        bool
 	buildArgs     []string
 	allowModifyFS bool
+	rootfsDir     string
+	fullScan      bool
 	commit        string
 	blacklists    []string
+	squash        string
+	network       string
+	labels        []string
+	ociLabels     bool
+
+	runTimeout       time.Duration
+	runMaxOpenFiles  uint64
+	runMaxProcesses  uint64
+	runMaxCPUSeconds uint64
+	runEnv           []string
 
 	localCacheTTL      time.Duration
 	redisCacheAddress  string
@@ -67,7 +83,22 @@ type buildCmd struct {
 	storageDir       string
 	compressionLevel string
 
+	reproducible    bool
+	sourceDateEpoch string
+	normalizeOwners bool
+
 	preserveRoot bool
+
+	reportPath     string
+	eventsFile     string
+	eventsFD       int
+	debugOnFailure string
+
+	// Parsed from the flags above.
+	registryConfigs registry.Map
+	tarConfig       *tario.Config
+	eventSink       events.Sink
+	eventsOut       *os.File
 }
 
 func getBuildCmd() *buildCmd {
@@ -105,10 +136,27 @@ func getBuildCmd() *buildCmd {
 	buildCmd.PersistentFlags().StringVar(&buildCmd.destination, "dest", "", "Destination of the image tar")
 
 	buildCmd.PersistentFlags().StringVar(&buildCmd.target, "target", "", "Set the target build stage to build.")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.format, "format", "docker", "Format of the image manifest, could be 'docker' or 'oci'")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.platform, "platform", "", "Platform of the image, with format <os>/<arch>[/<variant>]. Picks the matching base images from manifest lists. RUN steps require it to match the host. Default to the platform of the host")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.lockFile, "lock-file", "", "Pull the images of FROM and 'COPY --from=<image>' by the digests pinned in this file. Images missing from it are resolved and added to it after a successful build")
+	buildCmd.PersistentFlags().BoolVar(&buildCmd.frozen, "frozen", false, "Fail if an image is missing from the lock file, instead of adding it. Requires lock-file")
 	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.buildArgs, "build-arg", nil, "Argument to the dockerfile as per the spec of ARG. Format is \"--build-arg <arg>=<value>\"")
 	buildCmd.PersistentFlags().BoolVar(&buildCmd.allowModifyFS, "modifyfs", false, "Allow makisu to modify files outside of its internal storage dir")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.rootfsDir, "rootfs-dir", "", "Build in this directory instead of /, and chroot into it to execute RUN steps. Relative paths are under the storage dir. Cannot be used with modifyfs")
+	buildCmd.PersistentFlags().Lookup("rootfs-dir").NoOptDefVal = "rootfs"
+	buildCmd.PersistentFlags().BoolVar(&buildCmd.fullScan, "full-scan", false, "List every directory when scanning the file system after a step, instead of reusing the listings of directories whose mtime didn't change. Use it on file systems that don't update directory mtimes reliably")
 	buildCmd.PersistentFlags().StringVar(&buildCmd.commit, "commit", "implicit", "Set to explicit to only commit at steps with '#!COMMIT' annotations; Set to implicit to commit at every ADD/COPY/RUN step")
 	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.blacklists, "blacklist", nil, "Makisu will ignore all changes to these locations in the resulting docker images")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.squash, "squash", "", "Squash the layers built on top of the base image into one layer. Set to 'all' to also squash the layers of the base image")
+	buildCmd.PersistentFlags().Lookup("squash").NoOptDefVal = string(builder.SquashStage)
+	buildCmd.PersistentFlags().StringVar(&buildCmd.network, "network", "host", "Network mode of RUN steps, could be 'host' or 'none'. Can be overridden per step with 'RUN --network=<mode>'")
+	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.labels, "label", nil, "Set a label on the image, without changing cache IDs. Format is \"--label <key>=<value>\"")
+	buildCmd.PersistentFlags().BoolVar(&buildCmd.ociLabels, "oci-labels", false, "Set the standard OCI labels org.opencontainers.image.created, revision, source and version. Revision, source and version are read from the git checkout of the context. Can be overridden with --label")
+	buildCmd.PersistentFlags().DurationVar(&buildCmd.runTimeout, "run-timeout", 0, "Maximum duration of RUN steps, 0 means no limit. Can be overridden per step with 'RUN --timeout=<duration>'")
+	buildCmd.PersistentFlags().Uint64Var(&buildCmd.runMaxOpenFiles, "run-max-open-files", 0, "Maximum number of open files of RUN commands, 0 means no limit")
+	buildCmd.PersistentFlags().Uint64Var(&buildCmd.runMaxProcesses, "run-max-processes", 0, "Maximum number of processes of the user running RUN commands, 0 means no limit. Ignored for root")
+	buildCmd.PersistentFlags().Uint64Var(&buildCmd.runMaxCPUSeconds, "run-max-cpu-seconds", 0, "Maximum CPU time in seconds of each RUN command process, 0 means no limit")
+	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.runEnv, "run-env", nil, "Name of an environment variable of makisu passed to RUN commands. By default RUN commands only get the env of the image and the stage")
 
 	buildCmd.PersistentFlags().DurationVar(&buildCmd.localCacheTTL, "local-cache-ttl", time.Hour*336, "Time-To-Live for local cache")
 	buildCmd.PersistentFlags().StringVar(&buildCmd.redisCacheAddress, "redis-cache-addr", "", "The address of a redis server for cacheID to layer sha mapping")
@@ -125,8 +173,17 @@ func getBuildCmd() *buildCmd {
 	buildCmd.PersistentFlags().StringVar(&buildCmd.storageDir, "storage", "", "Directory that makisu uses for temp files and cached layers. Mount this path for better caching performance. If modifyfs is set, default to /makisu-storage; Otherwise default to /tmp/makisu-storage")
 	buildCmd.PersistentFlags().StringVar(&buildCmd.compressionLevel, "compression", "default", "Image compression level, could be 'no', 'speed', 'size', 'default'")
 
+	buildCmd.PersistentFlags().BoolVar(&buildCmd.reproducible, "reproducible", false, "Produce byte-identical layers and image config across builds, by clamping mtimes and timestamps to the source date epoch")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.sourceDateEpoch, "source-date-epoch", utils.DefaultEnv("SOURCE_DATE_EPOCH", "0"), "Unix timestamp used by --reproducible as the latest mtime of files and as the image creation time")
+	buildCmd.PersistentFlags().BoolVar(&buildCmd.normalizeOwners, "normalize-owners", false, "Set the owner of all files in the image layers to root. Only used with --reproducible")
+
 	buildCmd.PersistentFlags().BoolVar(&buildCmd.preserveRoot, "preserve-root", false, "Copy / in the storage dir and copy it back after build.")
 
+	buildCmd.PersistentFlags().StringVar(&buildCmd.reportPath, "report", "", "Write a json report of the build to this path, whether the build succeeds or not")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.eventsFile, "events-file", "", "Stream build events as json lines to this file")
+	buildCmd.PersistentFlags().IntVar(&buildCmd.eventsFD, "events-fd", -1, "Stream build events as json lines to this file descriptor")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.debugOnFailure, "debug-on-failure", "", "If a step fails, save the file system of its stage as an image, either to this path if it ends with '.tar', or pushed to this image name \"<registry>/<repo>:<tag>\"")
+
 	buildCmd.MarkFlagRequired("tag")
 	buildCmd.Flags().SortFlags = false
 	buildCmd.PersistentFlags().SortFlags = false
@@ -135,168 +192,170 @@ func getBuildCmd() *buildCmd {
 }
 
 func (cmd *buildCmd) processFlags() error {
-	if err := maybeBlacklistVarRun(); err != nil {
-		return fmt.Errorf("failed to extend blacklist: %s", err)
+	var err error
+	if cmd.eventSink, err = cmd.newEventSink(); err != nil {
+		return fmt.Errorf("init event sink: %s", err)
 	}
 
-	if len(cmd.blacklists) != 0 {
-		newBlacklist := append(pathutils.DefaultBlacklist, cmd.blacklists...)
-		pathutils.DefaultBlacklist = stringset.FromSlice(newBlacklist).ToSlice()
-		log.Infof("Added %d new items to blacklist: %v", len(cmd.blacklists), cmd.blacklists)
+	cmd.tarConfig = tario.NewConfig()
+	if err := cmd.tarConfig.SetCompressionLevel(cmd.compressionLevel); err != nil {
+		return fmt.Errorf("set compression level: %s", err)
 	}
 
-	if err := tario.SetCompressionLevel(cmd.compressionLevel); err != nil {
-		return fmt.Errorf("set compression level: %s", err)
+	if cmd.reproducible {
+		epoch, err := strconv.ParseInt(cmd.sourceDateEpoch, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid source date epoch %s: %s", cmd.sourceDateEpoch, err)
+		}
+		cmd.tarConfig.SetSourceDateEpoch(epoch)
+		cmd.tarConfig.NormalizeOwners = cmd.normalizeOwners
+	} else if cmd.normalizeOwners {
+		return errors.New("normalize-owners requires reproducible")
 	}
 
 	if cmd.commit != "explicit" && cmd.commit != "implicit" {
 		return fmt.Errorf("invalid commit option: %s", cmd.commit)
 	}
 
-	if err := initRegistryConfig(cmd.registryConfig); err != nil {
-		return fmt.Errorf("failed to initialize registry configuration: %s", err)
-	}
-
-	// If modifyfs is true, verify it's not running on Mac.
-	if cmd.allowModifyFS && runtime.GOOS == "darwin" {
-		return fmt.Errorf("modifyfs option could erase fs and is not allowed on Mac")
-	}
-
-	// Configure default storage dir.
-	if cmd.storageDir == "" {
-		if cmd.allowModifyFS {
-			cmd.storageDir = pathutils.DefaultStorageDir
-		} else {
-			cmd.storageDir = "/tmp/makisu-storage"
+	for _, label := range cmd.labels {
+		if _, _, err := parseLabel(label); err != nil {
+			return fmt.Errorf("invalid label option: %s", err)
 		}
 	}
 
-	// Verify storage dir is not child of internal dir.
-	if pathutils.IsDescendantOfAny(cmd.storageDir, []string{pathutils.DefaultInternalDir}) {
-		return fmt.Errorf("storage dir cannot be under internal dir %s",
-			pathutils.DefaultInternalDir)
+	if cmd.registryConfig != "" {
+		if cmd.registryConfigs, err = registry.ParseConfig(os.ExpandEnv(cmd.registryConfig)); err != nil {
+			return fmt.Errorf("failed to initialize registry configuration: %s", err)
+		}
 	}
 	return nil
 }
 
-func (cmd *buildCmd) newBuildPlan(
-	buildContext *context.BuildContext, imageName image.Name,
-	replicas []image.Name) (*builder.BuildPlan, error) {
+// buildOptions returns the options of the build of the given context dir.
+func (cmd *buildCmd) buildOptions(contextDir string) (api.BuildOptions, error) {
+	buildArgs := make(map[string]string)
+	for _, pair := range cmd.buildArgs {
+		parts := strings.Split(pair, "=")
+		if len(parts) != 2 {
+			return api.BuildOptions{}, fmt.Errorf("failed to parse build-arg %s", pair)
+		}
+		buildArgs[parts[0]] = parts[1]
+	}
 
-	// Read in and parse dockerfile.
-	dockerfile, err := cmd.getDockerfile(buildContext.ContextDir)
+	labels, err := cmd.getLabels(contextDir)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get dockerfile: %s", err)
+		return api.BuildOptions{}, fmt.Errorf("failed to get labels: %s", err)
 	}
 
-	// Remove image manifest if an image with the same name already exists.
-	if err := cleanManifest(buildContext, imageName); err != nil {
-		return nil, fmt.Errorf("failed to clean manifest: %s", err)
-	}
-	for _, replica := range replicas {
-		if err := cleanManifest(buildContext, replica); err != nil {
-			return nil, fmt.Errorf("failed to clean manifest: %s", err)
+	var runEnv []string
+	for _, name := range cmd.runEnv {
+		if value, ok := os.LookupEnv(name); ok {
+			runEnv = append(runEnv, name+"="+value)
 		}
 	}
 
-	// Init cache manager.
-	cacheMgr := cmd.newCacheManager(buildContext, imageName)
-
-	// forceCommit will make every step attempt to commit a layer.
-	// Commit is noop for steps other than ADD/COPY/RUN if they are not after an
-	// uncommitted RUN, so this won't generate extra empty layers.
-	forceCommit := cmd.commit == "implicit"
-
-	// Create BuildPlan and validate it.
-	return builder.NewBuildPlan(
-		buildContext, imageName, replicas, cacheMgr, dockerfile, cmd.allowModifyFS, forceCommit, cmd.target)
+	return api.BuildOptions{
+		ContextDir:     contextDir,
+		DockerfilePath: cmd.dockerfilePath,
+		Tag:            cmd.tag,
+		BuildArgs:      buildArgs,
+		Target:         cmd.target,
+		Platform:       cmd.platform,
+		Format:         cmd.format,
+		Labels:         labels,
+
+		PushRegistries: cmd.pushRegistries,
+		Replicas:       cmd.replicas,
+		RegistryConfig: cmd.registryConfigs,
+		Destination:    cmd.destination,
+
+		Load:          cmd.doLoad,
+		DockerHost:    cmd.dockerHost,
+		DockerVersion: cmd.dockerVersion,
+		DockerScheme:  cmd.dockerScheme,
+
+		StorageDir:     cmd.storageDir,
+		AllowModifyFS:  cmd.allowModifyFS,
+		RootfsDir:      cmd.rootfsDir,
+		FullScan:       cmd.fullScan,
+		PreserveRoot:   cmd.preserveRoot,
+		ExplicitCommit: cmd.commit == "explicit",
+		Blacklist:      cmd.blacklists,
+		Squash:         builder.SquashMode(cmd.squash),
+
+		Network:    shell.NetworkMode(cmd.network),
+		RunTimeout: cmd.runTimeout,
+		RunRlimits: shell.Rlimits{
+			NoFile: cmd.runMaxOpenFiles,
+			NProc:  cmd.runMaxProcesses,
+			CPU:    cmd.runMaxCPUSeconds,
+		},
+		RunEnv: runEnv,
+
+		LockFile: cmd.lockFile,
+		Frozen:   cmd.frozen,
+
+		LocalCacheTTL:      cmd.localCacheTTL,
+		RedisCacheAddress:  cmd.redisCacheAddress,
+		RedisCachePassword: cmd.redisCachePassword,
+		RedisCacheTTL:      cmd.redisCacheTTL,
+		HTTPCacheAddress:   cmd.httpCacheAddress,
+		HTTPCacheHeaders:   cmd.httpCacheHeaders,
+
+		TarConfig:      cmd.tarConfig,
+		Events:         cmd.eventSink,
+		DebugOnFailure: cmd.debugOnFailure,
+	}, nil
 }
 
 // Build image from the specified dockerfile.
 // If --push is specified, will also push the image to those registries.
 // If --load is specified, will load the image into the local docker daemon.
 func (cmd *buildCmd) Build(contextDir string) error {
-	log.Infof("Starting Makisu build (version=%s)", utils.BuildHash)
-
-	// Create BuildContext.
-	contextDirAbs, err := filepath.Abs(contextDir)
+	opts, err := cmd.buildOptions(contextDir)
 	if err != nil {
-		return fmt.Errorf("failed to resolve context dir: %s", err)
+		return err
 	}
-	if contextDirAbs == "/" {
-		return fmt.Errorf("the absolute path for context directory %s is /. Cannot use root as context", contextDir)
+	if cmd.eventsOut != nil {
+		defer cmd.eventsOut.Close()
 	}
-	imageStore, err := storage.NewImageStore(cmd.storageDir)
-	if err != nil {
-		return fmt.Errorf("failed to init image store: %s", err)
-	}
-	buildContext, err := context.NewBuildContext("/", contextDirAbs, imageStore)
-	if err != nil {
-		return fmt.Errorf("failed to create initial build context: %s", err)
-	}
-	defer buildContext.Cleanup()
-
-	// Make sure sandbox is cleaned after build.
-	// Optionally remove everything before and after build.
-	defer storage.CleanupSandbox(cmd.storageDir)
-	if cmd.allowModifyFS {
-		if cmd.preserveRoot {
-			rootPreserver, err := storage.NewRootPreserver("/", cmd.storageDir, pathutils.DefaultBlacklist)
-			if err != nil {
-				return fmt.Errorf("failed to preserve root: %s", err)
-			}
-			defer rootPreserver.RestoreRoot()
-		}
-		buildContext.MemFS.Remove()
-		defer buildContext.MemFS.Remove()
+	result, err := api.Build(context.Background(), opts)
+	if result != nil && cmd.reportPath != "" {
+		cmd.writeReport(result.Report)
 	}
+	return err
+}
 
-	// Create and execute build plan.
-	imageName, err := cmd.getTargetImageName()
-	if err != nil {
-		return fmt.Errorf("failed to get target image name: %s", err)
-	}
-	var parsedReplicas []image.Name
-	for _, replica := range cmd.replicas {
-		parsedReplicas = append(parsedReplicas, image.MustParseName(replica))
-	}
-	buildPlan, err := cmd.newBuildPlan(buildContext, imageName, parsedReplicas)
-	if err != nil {
-		return fmt.Errorf("failed to create build plan: %s", err)
+// writeReport writes the json report of the build to the report path.
+// Failing to write the report doesn't fail the build.
+func (cmd *buildCmd) writeReport(report *builder.BuildReport) {
+	if err := builder.WriteReport(report, cmd.reportPath); err != nil {
+		log.Errorf("Failed to write build report: %s", err)
+		return
 	}
-	if _, err = buildPlan.Execute(); err != nil {
-		return fmt.Errorf("failed to execute build plan: %s", err)
-	}
-	log.Infof("Successfully built image %s", imageName.ShortName())
+	log.Infof("Wrote build report to %s", cmd.reportPath)
+}
 
-	// Push image to registries that were specified in the --push flag.
-	for _, registry := range cmd.pushRegistries {
-		target := imageName.WithRegistry(registry)
-		if err := pushImage(buildContext, target); err != nil {
-			return fmt.Errorf("failed to push image: %s", err)
-		}
-	}
-	for _, replica := range cmd.replicas {
-		target := image.MustParseName(replica)
-		if err := pushImage(buildContext, target); err != nil {
-			return fmt.Errorf("failed to push image: %s", err)
-		}
+// newEventSink returns the sink build events are streamed to, if any. The
+// file it writes to is kept in eventsOut, to be closed when the build ends.
+func (cmd *buildCmd) newEventSink() (events.Sink, error) {
+	if cmd.eventsFile != "" && cmd.eventsFD >= 0 {
+		return nil, errors.New("events-file and events-fd cannot be both set")
 	}
-
-	// Optionally save image as a tar file.
-	if cmd.destination != "" {
-		if err := cmd.saveImage(buildContext, imageName); err != nil {
-			return fmt.Errorf("failed to save image: %s", err)
+	if cmd.eventsFile != "" {
+		f, err := os.OpenFile(cmd.eventsFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("open events file %s: %s", cmd.eventsFile, err)
 		}
-	}
-
-	// Optionally load image to local docker daemon.
-	if cmd.doLoad {
-		if err := cmd.loadImage(buildContext, imageName); err != nil {
-			return fmt.Errorf("failed to load image: %s", err)
+		cmd.eventsOut = f
+		return events.NewJSONLinesSink(f), nil
+	} else if cmd.eventsFD >= 0 {
+		f := os.NewFile(uintptr(cmd.eventsFD), fmt.Sprintf("events-fd-%d", cmd.eventsFD))
+		if _, err := f.Stat(); err != nil {
+			return nil, fmt.Errorf("invalid events fd %d: %s", cmd.eventsFD, err)
 		}
+		cmd.eventsOut = f
+		return events.NewJSONLinesSink(f), nil
 	}
-
-	log.Infof("Finished building %s", imageName.ShortName())
-	return nil
+	return nil, nil
 }
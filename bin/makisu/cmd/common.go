@@ -20,13 +20,14 @@ import (
 	"runtime/pprof"
 
 	"github.com/uber/makisu/lib/log"
+	"github.com/spf13/cobra"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
-func (cmd *rootCmd) processGlobalFlags() error {
+func (cmd *rootCmd) processGlobalFlags(ccmd *cobra.Command) error {
 	// Initializes logger.
-	logger, err := cmd.getLogger()
+	logger, err := cmd.getLogger(ccmd)
 	if err != nil {
 		return fmt.Errorf("configure logger: %s", err)
 	}
@@ -43,10 +44,17 @@ func (cmd *rootCmd) processGlobalFlags() error {
 	return nil
 }
 
-func (cmd *rootCmd) getLogger() (*zap.Logger, error) {
+func (cmd *rootCmd) getLogger(ccmd *cobra.Command) (*zap.Logger, error) {
 	config := zap.NewProductionConfig()
-	if cmd.logOutput != "stdout" {
-		config.OutputPaths = []string{cmd.logOutput}
+	logOutput := cmd.logOutput
+	// Commands printing json to stdout log to stderr by default, so their
+	// output can be parsed.
+	if f := ccmd.Flag("output"); f != nil && f.Value.String() == "json" &&
+		!ccmd.Flag("log-output").Changed {
+		logOutput = "stderr"
+	}
+	if logOutput != "stdout" {
+		config.OutputPaths = []string{logOutput}
 	}
 
 	if err := config.Level.UnmarshalText([]byte(cmd.logLevel)); err != nil {
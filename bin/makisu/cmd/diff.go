@@ -2,11 +2,15 @@ package cmd
 
 import (
 	"archive/tar"
+	"bufio"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/andres-erbsen/clock"
 	"github.com/google/go-cmp/cmp"
@@ -22,26 +26,58 @@ import (
 
 type diffCmd struct {
 	*cobra.Command
-	ignoreModTime bool
+	ignoreModTime  bool
+	output         string
+	local          bool
+	storageDir     string
+	registryConfig string
+}
+
+// diffImage is one of the images being compared.
+type diffImage struct {
+	Name string `json:"name"`
+	// Layers are the digests of the layers of a pulled image, or the paths of
+	// the layers in an image tar. Layer indexes in the file differences refer
+	// to this list.
+	Layers []string `json:"layers"`
+
+	config *image.Config
+	memfs  *snapshot.MemFS
+}
+
+// diffOutput is the result printed with '--output json'.
+type diffOutput struct {
+	Images []*diffImage `json:"images"`
+	// Config is a human readable diff of the image configs, empty if they
+	// match.
+	Config string           `json:"config"`
+	Files  *snapshot.FSDiff `json:"files"`
 }
 
 func getDiffCmd() *diffCmd {
 	diffCmd := &diffCmd{
 		Command: &cobra.Command{
-			Use:                   "diff <image name> <image name>",
+			Use:                   "diff [flags] <image> <image>",
 			DisableFlagsInUseLine: true,
-			Short:                 "Compare docker images from registry",
+			Short:                 "Compare docker images from registry, the local storage or image tars",
+			Long: "Compare the image configs and the files of two docker images. Images are " +
+				"either image names, which are pulled unless --local is set, or paths to " +
+				"image tars such as the ones saved by 'makisu build --dest'.",
 		},
 	}
 
 	diffCmd.Args = func(cmd *cobra.Command, args []string) error {
 		if len(args) != 2 {
-			return errors.New("Requires two image names as arguments")
+			return errors.New("Requires two images as arguments")
 		}
 		return nil
 	}
 
 	diffCmd.Run = func(cmd *cobra.Command, args []string) {
+		if err := diffCmd.processFlags(); err != nil {
+			log.Errorf("failed to process flags: %s", err)
+			os.Exit(1)
+		}
 		if err := diffCmd.Diff(args); err != nil {
 			log.Error(err)
 			os.Exit(1)
@@ -49,80 +85,248 @@ func getDiffCmd() *diffCmd {
 	}
 
 	diffCmd.PersistentFlags().BoolVar(&diffCmd.ignoreModTime, "ignoreModTime", true, "Ignore mod time of image files when comparing images")
+	diffCmd.PersistentFlags().StringVar(&diffCmd.output, "output", "text", "Format of the differences, could be 'text' to log them or 'json' to print them to stdout, in which case logs go to stderr unless --log-output is set")
+	diffCmd.PersistentFlags().BoolVar(&diffCmd.local, "local", false, "Read images from the storage directory instead of pulling them")
+	diffCmd.PersistentFlags().StringVar(&diffCmd.storageDir, "storage", "/tmp/makisu-storage", "Directory that makisu uses for pulled images and temp files")
+	diffCmd.PersistentFlags().StringVar(&diffCmd.registryConfig, "registry-config", "", "Registry configuration used to pull images, either as a file path or as a raw json blob")
 	return diffCmd
 }
 
-func (cmd *diffCmd) Diff(imagesFullName []string) error {
-	var pullImages []image.Name
-	for _, imageFullName := range imagesFullName {
-		pullImage, err := image.ParseNameForPull(imageFullName)
-		if err != nil {
-			return fmt.Errorf("parse image %s: %s", pullImage, err)
+func (cmd *diffCmd) processFlags() error {
+	if cmd.output != "text" && cmd.output != "json" {
+		return fmt.Errorf("invalid output format: %s", cmd.output)
+	}
+	if err := initRegistryConfig(cmd.registryConfig); err != nil {
+		return fmt.Errorf("failed to initialize registry configuration: %s", err)
+	}
+	return nil
+}
+
+// Diff compares the two given images.
+func (cmd *diffCmd) Diff(images []string) error {
+	store, err := storage.NewImageStore(cmd.storageDir)
+	if err != nil {
+		return fmt.Errorf("unable to create internal store: %s", err)
+	}
+	defer storage.CleanupSandbox(cmd.storageDir)
+
+	var diffImages []*diffImage
+	for _, input := range images {
+		var img *diffImage
+		if fi, err := os.Stat(input); err == nil && fi.Mode().IsRegular() {
+			img, err = loadImageTar(store, input)
+			if err != nil {
+				return fmt.Errorf("load image tar %s: %s", input, err)
+			}
+		} else {
+			img, err = cmd.loadImage(store, input)
+			if err != nil {
+				return fmt.Errorf("load image %s: %s", input, err)
+			}
 		}
-		pullImages = append(pullImages, pullImage)
+		diffImages = append(diffImages, img)
 	}
 
-	if err := initRegistryConfig(""); err != nil {
-		return fmt.Errorf("failed to initialize registry configuration: %s", err)
+	out := &diffOutput{
+		Images: diffImages,
+		Config: cmp.Diff(
+			diffImages[0].config, diffImages[1].config, cmpopts.IgnoreUnexported(image.Config{})),
+		Files: snapshot.CompareFS(diffImages[0].memfs, diffImages[1].memfs, cmd.ignoreModTime),
+	}
+	if cmd.output == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(out); err != nil {
+			return fmt.Errorf("encode differences: %s", err)
+		}
+		return nil
 	}
+	logDiff(out)
+	return nil
+}
 
-	store, err := storage.NewImageStore("/tmp/makisu-storage/")
+// loadImage reads the manifest, config and layers of the given image from
+// the store, after pulling it unless local is set.
+func (cmd *diffCmd) loadImage(store *storage.ImageStore, input string) (*diffImage, error) {
+	imageName, err := image.ParseNameForPull(input)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("parse image name: %s", err)
 	}
 
-	var memFSArr []*snapshot.MemFS
-	var imageConfigs []*image.Config
-	for i, pullImage := range pullImages {
-		client := registry.New(store, pullImage.GetRegistry(), pullImage.GetRepository())
-		manifest, err := client.Pull(pullImage.GetTag())
+	var manifest *image.DistributionManifest
+	if cmd.local {
+		reader, err := store.Manifests.GetStoreFileReader(
+			imageName.GetRepository(), imageName.GetTag())
 		if err != nil {
-			panic(err)
+			return nil, fmt.Errorf("get manifest reader: %s", err)
 		}
-
-		memfs, err := snapshot.NewMemFS(clock.New(), "/tmp/makisu-storage/", nil)
+		defer reader.Close()
+		manifestBytes, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return nil, fmt.Errorf("read manifest: %s", err)
+		}
+		m, _, err := image.UnmarshalDistributionManifest("", manifestBytes)
 		if err != nil {
-			panic(err)
+			return nil, fmt.Errorf("unmarshal manifest: %s", err)
 		}
+		manifest = &m
+	} else {
+		client := registry.New(store, imageName.GetRegistry(), imageName.GetRepository())
+		if manifest, err = client.Pull(imageName.GetTag()); err != nil {
+			return nil, fmt.Errorf("pull image: %s", err)
+		}
+	}
 
-		for _, descriptor := range manifest.Layers {
-			reader, err := store.Layers.GetStoreFileReader(descriptor.Digest.Hex())
-			if err != nil {
-				panic(fmt.Errorf("get reader from image %d layer: %s", i+1, err))
-			}
-			gzipReader, err := tario.NewGzipReader(reader)
-			if err != nil {
-				panic(fmt.Errorf("create gzip reader for layer: %s", err))
-			}
-			if err = memfs.UpdateFromTarReader(tar.NewReader(gzipReader), false); err != nil {
-				panic(fmt.Errorf("untar image %d layer reader: %s", i+1, err))
-			}
+	img := &diffImage{Name: imageName.String()}
+	configDigest := manifest.GetConfigDigest()
+	reader, err := store.Layers.GetStoreFileReader(configDigest.Hex())
+	if err != nil {
+		return nil, fmt.Errorf("get config reader %s: %s", configDigest.Hex(), err)
+	}
+	defer reader.Close()
+	if img.config, err = readImageConfig(reader); err != nil {
+		return nil, err
+	}
+
+	if img.memfs, err = snapshot.NewMemFS(clock.New(), store.SandboxDir, nil); err != nil {
+		return nil, fmt.Errorf("create memfs: %s", err)
+	}
+	img.memfs.SetIndexDir(store.MemFSIndexDir)
+	for _, descriptor := range manifest.Layers {
+		if err := mergeStoreLayer(store, img.memfs, descriptor.Digest); err != nil {
+			return nil, fmt.Errorf("merge layer %s: %s", descriptor.Digest.Hex(), err)
 		}
+		img.Layers = append(img.Layers, string(descriptor.Digest))
+	}
+	return img, nil
+}
 
-		memFSArr = append(memFSArr, memfs)
-		reader, err := store.Layers.GetStoreFileReader(manifest.GetConfigDigest().Hex())
-		if err != nil {
-			panic(fmt.Errorf("get image%d config file reader %s: %s", i+1, manifest.GetConfigDigest().Hex(), err))
+// mergeStoreLayer merges the layer with the given digest from the store.
+func mergeStoreLayer(store *storage.ImageStore, memfs *snapshot.MemFS, digest image.Digest) error {
+	reader, err := store.Layers.GetStoreFileReader(digest.Hex())
+	if err != nil {
+		return fmt.Errorf("get layer reader: %s", err)
+	}
+	defer reader.Close()
+	return memfs.UpdateFromLayer(digest, reader, false)
+}
+
+// loadImageTar reads the config and the layers of an image tar, in the
+// format of 'docker save'.
+func loadImageTar(store *storage.ImageStore, path string) (*diffImage, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open image tar: %s", err)
+	}
+	defer f.Close()
+	dir, err := ioutil.TempDir(store.SandboxDir, "diff")
+	if err != nil {
+		return nil, fmt.Errorf("create tmp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := tario.Untar(f, dir); err != nil {
+		return nil, fmt.Errorf("untar image tar: %s", err)
+	}
+
+	manifestBytes, err := ioutil.ReadFile(filepath.Join(dir, image.ExportManifestFileName))
+	if err != nil {
+		return nil, fmt.Errorf("read export manifest: %s", err)
+	}
+	var manifests []image.ExportManifest
+	if err := json.Unmarshal(manifestBytes, &manifests); err != nil {
+		return nil, fmt.Errorf("unmarshal export manifest: %s", err)
+	} else if len(manifests) != 1 {
+		return nil, fmt.Errorf("expected 1 image in export manifest, found %d", len(manifests))
+	}
+	manifest := manifests[0]
+
+	img := &diffImage{Name: path}
+	if len(manifest.RepoTags) > 0 {
+		img.Name = fmt.Sprintf("%s (%s)", path, strings.Join(manifest.RepoTags, ", "))
+	}
+	configFile, err := os.Open(filepath.Join(dir, manifest.Config.String()))
+	if err != nil {
+		return nil, fmt.Errorf("open config: %s", err)
+	}
+	defer configFile.Close()
+	if img.config, err = readImageConfig(configFile); err != nil {
+		return nil, err
+	}
+
+	if img.memfs, err = snapshot.NewMemFS(clock.New(), store.SandboxDir, nil); err != nil {
+		return nil, fmt.Errorf("create memfs: %s", err)
+	}
+	for _, layer := range manifest.Layers {
+		if err := mergeLayerFile(img.memfs, filepath.Join(dir, layer.String())); err != nil {
+			return nil, fmt.Errorf("merge layer %s: %s", layer, err)
 		}
+		img.Layers = append(img.Layers, layer.String())
+	}
+	return img, nil
+}
 
-		configBytes, err := ioutil.ReadAll(reader)
+// mergeLayerFile merges the layer tar at the given path, which may be
+// gzipped or not.
+func mergeLayerFile(memfs *snapshot.MemFS, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open layer: %s", err)
+	}
+	defer f.Close()
+
+	var r io.Reader = bufio.NewReader(f)
+	if magic, err := r.(*bufio.Reader).Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gzipReader, err := tario.NewGzipReader(r)
 		if err != nil {
-			panic(fmt.Errorf("read image%d config file %s: %s", i+1, manifest.GetConfigDigest().Hex(), err))
+			return fmt.Errorf("create gzip reader: %s", err)
 		}
+		defer gzipReader.Close()
+		r = gzipReader
+	}
+	return memfs.UpdateFromTarReader(tar.NewReader(r), false)
+}
 
-		config := new(image.Config)
-		if err := json.Unmarshal(configBytes, config); err != nil {
-			panic(fmt.Errorf("unmarshal image%d config file %s: %s", i+1, manifest.GetConfigDigest().Hex(), err))
-		}
-		imageConfigs = append(imageConfigs, config)
+// readImageConfig reads an image config from r.
+func readImageConfig(r io.Reader) (*image.Config, error) {
+	configBytes, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("read image config: %s", err)
 	}
+	config, err := image.NewImageConfigFromJSON(configBytes)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal image config: %s", err)
+	}
+	return config, nil
+}
 
-	log.Infof("* Diff image configs ")
-	if configDiff := cmp.Diff(imageConfigs[0], imageConfigs[1], cmpopts.IgnoreUnexported(image.Config{})); configDiff != "" {
-		log.Infof("-image %s +image %s):\n%s", pullImages[0].GetRepository()+":"+pullImages[0].GetTag(), pullImages[1].GetRepository()+":"+pullImages[1].GetTag(), configDiff)
+// logDiff logs the differences in a human readable format.
+func logDiff(out *diffOutput) {
+	image1, image2 := out.Images[0], out.Images[1]
+	log.Infof("* Diff image configs")
+	if out.Config != "" {
+		log.Infof("-image %s +image %s:\n%s", image1.Name, image2.Name, out.Config)
 	}
 
 	log.Infof("* Diff image layers")
-	snapshot.CompareFS(memFSArr[0], memFSArr[1], pullImages[0], pullImages[1], cmd.ignoreModTime)
-	return nil
+	log.Infof("===== files missing in first image %s =====", image1.Name)
+	for _, d := range out.Files.Added {
+		log.Infof("%s (added by layer %s)", d.Path, layerName(image2, d.Layer2))
+	}
+	log.Infof("===== files missing in second image %s =====", image2.Name)
+	for _, d := range out.Files.Removed {
+		log.Infof("%s (added by layer %s)", d.Path, layerName(image1, d.Layer1))
+	}
+	log.Infof("===== difference between two images %s and %s =====", image1.Name, image2.Name)
+	for _, d := range out.Files.Changed {
+		log.Infof("%s: %s (layers %s and %s)", d.Path, strings.Join(d.Fields, ", "),
+			layerName(image1, d.Layer1), layerName(image2, d.Layer2))
+	}
+}
+
+// layerName returns the name of the layer of img at index i.
+func layerName(img *diffImage, i int) string {
+	if i < 0 || i >= len(img.Layers) {
+		return "none"
+	}
+	return fmt.Sprintf("%d %s", i, img.Layers[i])
 }
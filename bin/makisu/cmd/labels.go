@@ -0,0 +1,112 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package cmd
+
+import (
+	"fmt"
+	"net/url"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/uber/makisu/lib/log"
+)
+
+// Standard OCI labels, see
+// https://github.com/opencontainers/image-spec/blob/master/annotations.md.
+const (
+	ociLabelCreated  = "org.opencontainers.image.created"
+	ociLabelRevision = "org.opencontainers.image.revision"
+	ociLabelSource   = "org.opencontainers.image.source"
+	ociLabelVersion  = "org.opencontainers.image.version"
+)
+
+// parseLabel splits a label with format <key>=<value>.
+func parseLabel(label string) (string, string, error) {
+	parts := strings.SplitN(label, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", "", fmt.Errorf("invalid label %s, format is <key>=<value>", label)
+	}
+	return parts[0], parts[1], nil
+}
+
+// getLabels returns the labels to set on the image. Labels set with --label
+// override the standard OCI labels.
+func (cmd *buildCmd) getLabels(contextDir string) (map[string]string, error) {
+	labels := make(map[string]string)
+	if cmd.ociLabels {
+		for k, v := range ociLabels(contextDir, cmd.tarConfig.Now()) {
+			labels[k] = v
+		}
+	}
+	for _, label := range cmd.labels {
+		k, v, err := parseLabel(label)
+		if err != nil {
+			return nil, err
+		}
+		labels[k] = v
+	}
+	return labels, nil
+}
+
+// ociLabels returns the standard OCI labels of the image created at the given
+// time. Revision, source and version are read from the git checkout of the
+// context dir, if any.
+func ociLabels(contextDir string, created time.Time) map[string]string {
+	labels := map[string]string{
+		ociLabelCreated: created.UTC().Format(time.RFC3339),
+	}
+	if _, err := git(contextDir, "rev-parse", "--is-inside-work-tree"); err != nil {
+		log.Infof("Context dir is not a git checkout, skipping git based OCI labels: %s", err)
+		return labels
+	}
+	if revision, err := git(contextDir, "rev-parse", "HEAD"); err != nil {
+		log.Warnf("Failed to get git revision of context dir: %s", err)
+	} else {
+		labels[ociLabelRevision] = revision
+	}
+	if source, err := git(contextDir, "config", "--get", "remote.origin.url"); err != nil {
+		log.Infof("Failed to get git remote of context dir: %s", err)
+	} else {
+		labels[ociLabelSource] = stripCredentials(source)
+	}
+	if version, err := git(contextDir, "describe", "--tags", "--exact-match"); err != nil {
+		log.Infof("No git tag at the revision of context dir: %s", err)
+	} else {
+		labels[ociLabelVersion] = version
+	}
+	return labels
+}
+
+// git runs a git command in dir, and returns its trimmed output.
+func git(dir string, args ...string) (string, error) {
+	c := exec.Command("git", args...)
+	c.Dir = dir
+	output, err := c.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %s", strings.Join(args, " "), err)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// stripCredentials removes the user info from URLs of git remotes, so tokens
+// don't end up in images.
+func stripCredentials(remote string) string {
+	u, err := url.Parse(remote)
+	if err != nil || u.User == nil || u.Scheme == "" {
+		return remote
+	}
+	u.User = nil
+	return u.String()
+}
@@ -0,0 +1,219 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/log"
+	"github.com/uber/makisu/lib/registry"
+	"github.com/uber/makisu/lib/storage"
+
+	"github.com/spf13/cobra"
+)
+
+type manifestCmd struct {
+	*cobra.Command
+
+	format         string
+	storageDir     string
+	registryConfig string
+}
+
+func getManifestCmd() *manifestCmd {
+	manifestCmd := &manifestCmd{
+		Command: &cobra.Command{
+			Use:   "manifest",
+			Short: "Create and push manifest lists of images built for multiple platforms",
+		},
+	}
+	manifestCmd.Run = func(cmd *cobra.Command, args []string) {
+		cmd.HelpFunc()(cmd, args)
+	}
+
+	createCmd := &cobra.Command{
+		Use:                   "create [flags] <target> <image>...",
+		DisableFlagsInUseLine: true,
+		Short:                 "Create a manifest list from the manifests of images in the repository of the target",
+	}
+	createCmd.Args = func(cmd *cobra.Command, args []string) error {
+		if len(args) < 2 {
+			return errors.New("Requires a target name and at least one image as arguments")
+		}
+		return nil
+	}
+	createCmd.Run = func(cmd *cobra.Command, args []string) {
+		if err := manifestCmd.processFlags(); err != nil {
+			log.Errorf("failed to process flags: %s", err)
+			os.Exit(1)
+		}
+		if err := manifestCmd.Create(args[0], args[1:]); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+	}
+	createCmd.Flags().StringVar(&manifestCmd.format, "format", "docker", "Format of the manifest list, could be 'docker' for a docker manifest list or 'oci' for an OCI image index")
+
+	pushCmd := &cobra.Command{
+		Use:                   "push [flags] <target>",
+		DisableFlagsInUseLine: true,
+		Short:                 "Push a manifest list created by 'makisu manifest create'",
+	}
+	pushCmd.Args = func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return errors.New("Requires a target name as argument")
+		}
+		return nil
+	}
+	pushCmd.Run = func(cmd *cobra.Command, args []string) {
+		if err := manifestCmd.processFlags(); err != nil {
+			log.Errorf("failed to process flags: %s", err)
+			os.Exit(1)
+		}
+		if err := manifestCmd.Push(args[0]); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+	}
+
+	manifestCmd.PersistentFlags().StringVar(&manifestCmd.storageDir, "storage", "/tmp/makisu-storage", "Directory that makisu uses to save manifest lists between create and push")
+	manifestCmd.PersistentFlags().StringVar(&manifestCmd.registryConfig, "registry-config", "", "Set build-time variables")
+	manifestCmd.PersistentFlags().SortFlags = false
+
+	manifestCmd.AddCommand(createCmd)
+	manifestCmd.AddCommand(pushCmd)
+	return manifestCmd
+}
+
+func (cmd *manifestCmd) processFlags() error {
+	if cmd.format != "docker" && cmd.format != "oci" {
+		return fmt.Errorf("invalid manifest list format: %s", cmd.format)
+	}
+	if err := initRegistryConfig(cmd.registryConfig); err != nil {
+		return fmt.Errorf("failed to initialize registry configuration: %s", err)
+	}
+	return nil
+}
+
+// Create creates a manifest list of the images and saves it in the storage dir.
+// Platforms of the images are read from their image configs. The images must
+// be in the same repository as the target, since registries only accept
+// manifest lists that reference manifests of their own repository.
+func (cmd *manifestCmd) Create(target string, images []string) error {
+	targetName, err := image.ParseNameForPull(target)
+	if err != nil {
+		return fmt.Errorf("parse target name %s: %s", target, err)
+	}
+
+	mediaType := image.MediaTypeManifestList
+	if cmd.format == "oci" {
+		mediaType = image.MediaTypeOCIIndex
+	}
+	list, err := image.NewManifestList(mediaType)
+	if err != nil {
+		return err
+	}
+
+	store, err := storage.NewImageStore(cmd.storageDir)
+	if err != nil {
+		return fmt.Errorf("unable to create internal store: %s", err)
+	}
+	defer storage.CleanupSandbox(cmd.storageDir)
+
+	for _, input := range images {
+		imageName, err := image.ParseNameForPull(input)
+		if err != nil {
+			return fmt.Errorf("parse image name %s: %s", input, err)
+		}
+		if imageName.GetRegistry() != targetName.GetRegistry() ||
+			imageName.GetRepository() != targetName.GetRepository() {
+			return fmt.Errorf("image %s is not in the repository of %s", imageName, targetName)
+		}
+
+		descriptor, platform, err := cmd.describeImage(store, imageName)
+		if err != nil {
+			return fmt.Errorf("describe image %s: %s", imageName, err)
+		}
+		if err := list.Add(descriptor, platform); err != nil {
+			return fmt.Errorf("add image %s: %s", imageName, err)
+		}
+		log.Infof("* Added manifest %s of %s for platform %s", descriptor.Digest, imageName, platform)
+	}
+
+	if err := store.SaveManifestList(*list, targetName); err != nil {
+		return fmt.Errorf("save manifest list: %s", err)
+	}
+	log.Infof("Created manifest list %s", targetName)
+	return nil
+}
+
+// describeImage pulls the manifest and the image config of the image, and
+// returns the descriptor of the manifest and the platform of the image.
+func (cmd *manifestCmd) describeImage(
+	store *storage.ImageStore, imageName image.Name) (image.Descriptor, image.Platform, error) {
+
+	client := registry.New(store, imageName.GetRegistry(), imageName.GetRepository())
+	manifest, descriptor, err := client.PullManifestDescriptor(imageName.GetTag())
+	if err != nil {
+		return image.Descriptor{}, image.Platform{}, fmt.Errorf("pull manifest: %s", err)
+	}
+	configDigest := manifest.GetConfigDigest()
+	if _, err := client.PullImageConfig(configDigest); err != nil {
+		return image.Descriptor{}, image.Platform{}, fmt.Errorf("pull image config: %s", err)
+	}
+	reader, err := store.Layers.GetStoreFileReader(configDigest.Hex())
+	if err != nil {
+		return image.Descriptor{}, image.Platform{}, fmt.Errorf("get image config reader: %s", err)
+	}
+	defer reader.Close()
+	configBytes, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return image.Descriptor{}, image.Platform{}, fmt.Errorf("read image config: %s", err)
+	}
+	config, err := image.NewImageConfigFromJSON(configBytes)
+	if err != nil {
+		return image.Descriptor{}, image.Platform{}, fmt.Errorf("unmarshal image config: %s", err)
+	}
+	return descriptor, config.Platform(), nil
+}
+
+// Push pushes the manifest list created for the target.
+func (cmd *manifestCmd) Push(target string) error {
+	targetName, err := image.ParseNameForPull(target)
+	if err != nil {
+		return fmt.Errorf("parse target name %s: %s", target, err)
+	}
+
+	store, err := storage.NewImageStore(cmd.storageDir)
+	if err != nil {
+		return fmt.Errorf("unable to create internal store: %s", err)
+	}
+	defer storage.CleanupSandbox(cmd.storageDir)
+
+	list, err := store.LoadManifestList(targetName)
+	if err != nil {
+		return fmt.Errorf("load manifest list of %s, it must be created with 'makisu manifest create' first: %s", targetName, err)
+	}
+
+	client := registry.New(store, targetName.GetRegistry(), targetName.GetRepository())
+	if err := client.PushManifestList(targetName.GetTag(), list); err != nil {
+		return fmt.Errorf("failed to push manifest list: %s", err)
+	}
+	log.Infof("Successfully pushed manifest list %s with %d manifests", targetName, len(list.Manifests))
+	return nil
+}
@@ -36,7 +36,8 @@ import (
 type pushCmd struct {
 	*cobra.Command
 
-	tag string
+	tag    string
+	format string
 
 	pushRegistries []string
 	replicas       []string
@@ -74,6 +75,7 @@ func getPushCmd() *pushCmd {
 	pushCmd.PersistentFlags().StringArrayVar(&pushCmd.pushRegistries, "push", nil, "Registry to push image to")
 	pushCmd.PersistentFlags().StringArrayVar(&pushCmd.replicas, "replica", nil, "Push targets with alternative full image names \"<registry>/<repo>:<tag>\"")
 	pushCmd.PersistentFlags().StringVar(&pushCmd.registryConfig, "registry-config", "", "Set build-time variables")
+	pushCmd.PersistentFlags().StringVar(&pushCmd.format, "format", "docker", "Format of the image manifest, could be 'docker' or 'oci'")
 
 	pushCmd.MarkFlagRequired("tag")
 	pushCmd.Flags().SortFlags = false
@@ -83,6 +85,9 @@ func getPushCmd() *pushCmd {
 }
 
 func (cmd *pushCmd) processFlags() error {
+	if _, err := image.ManifestMediaType(cmd.format); err != nil {
+		return err
+	}
 	if err := initRegistryConfig(cmd.registryConfig); err != nil {
 		return fmt.Errorf("failed to initialize registry configuration: %s", err)
 	}
@@ -190,6 +195,10 @@ func (cmd *pushCmd) importTar(
 		return fmt.Errorf("unmarshal export manifest: %s", err)
 	}
 
+	mediaType, err := image.ManifestMediaType(cmd.format)
+	if err != nil {
+		return err
+	}
 	for _, exportManifest := range exportManifests {
 		// Import extracted dir content into image store -- {sha}.json.
 		configPath := filepath.Join(dir, exportManifest.Config.String())
@@ -236,28 +245,24 @@ func (cmd *pushCmd) importTar(
 			}
 
 			layers = append(layers, image.Descriptor{
-				MediaType: image.MediaTypeLayer,
-				Size:      layerInfo.Size(),
-				Digest:    layerDigest,
+				Size:   layerInfo.Size(),
+				Digest: layerDigest,
 			})
 		}
 
 		// Import extracted dir content into image store -- manifest.json.
-		distManifest := image.DistributionManifest{
-			SchemaVersion: 2,
-			MediaType:     image.MediaTypeManifest,
-			Config: image.Descriptor{
-				MediaType: image.MediaTypeConfig,
-				Size:      configInfo.Size(),
-				Digest:    configDigest,
-			},
-			Layers: layers,
+		distManifest, err := image.NewDistributionManifest(mediaType, image.Descriptor{
+			Size:   configInfo.Size(),
+			Digest: configDigest,
+		}, layers)
+		if err != nil {
+			return fmt.Errorf("create distribution manifest: %s", err)
 		}
-		store.SaveManifest(distManifest, imageName)
+		store.SaveManifest(*distManifest, imageName)
 
 		for _, replica := range replicas {
 			parsed := image.MustParseName(replica)
-			store.SaveManifest(distManifest, parsed)
+			store.SaveManifest(*distManifest, parsed)
 		}
 	}
 
@@ -54,7 +54,7 @@ func getRootCmd() *rootCmd {
 	rootCmd.PersistentFlags().SortFlags = false
 
 	rootCmd.PersistentPreRun = func(ccmd *cobra.Command, args []string) {
-		if err := rootCmd.processGlobalFlags(); err != nil {
+		if err := rootCmd.processGlobalFlags(ccmd); err != nil {
 			fmt.Println(err)
 			os.Exit(1)
 		}
@@ -77,6 +77,7 @@ func Execute() {
 	rootCmd.AddCommand(getPullCmd().Command)
 	rootCmd.AddCommand(getPushCmd().Command)
 	rootCmd.AddCommand(getDiffCmd().Command)
+	rootCmd.AddCommand(getManifestCmd().Command)
 	if err := rootCmd.Execute(); err != nil {
 		log.Error(err)
 		os.Exit(1)
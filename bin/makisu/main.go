@@ -16,8 +16,11 @@ package main
 
 import (
 	"github.com/uber/makisu/bin/makisu/cmd"
+	"github.com/uber/makisu/lib/shell"
 )
 
 func main() {
+	// RUN commands with resource limits are executed through makisu itself.
+	shell.InitRlimitHelper()
 	cmd.Execute()
 }
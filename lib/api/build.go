@@ -0,0 +1,427 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package api runs makisu builds from Go programs, without the makisu command.
+package api
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/uber/makisu/lib/builder"
+	"github.com/uber/makisu/lib/cache"
+	"github.com/uber/makisu/lib/cache/keyvalue"
+	buildcontext "github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/docker/cli"
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/events"
+	"github.com/uber/makisu/lib/fileio"
+	"github.com/uber/makisu/lib/log"
+	"github.com/uber/makisu/lib/parser/dockerfile"
+	"github.com/uber/makisu/lib/pathutils"
+	"github.com/uber/makisu/lib/registry"
+	"github.com/uber/makisu/lib/shell"
+	"github.com/uber/makisu/lib/storage"
+	"github.com/uber/makisu/lib/utils"
+)
+
+// Result describes the outcome of a build.
+type Result struct {
+	// Image is the name of the built image.
+	Image image.Name
+
+	// Manifest is the distribution manifest of the image. It's nil if the
+	// build failed.
+	Manifest *image.DistributionManifest
+
+	// Report summarizes the build, whether it succeeded or not.
+	Report *builder.BuildReport
+}
+
+// Build builds the image described by opts. Depending on the options, the
+// image is then pushed to registries, saved as a tar and/or loaded into the
+// docker daemon.
+// The result is returned even if the build fails, unless the options are
+// invalid. ctx is checked between the phases of the build, a running step is
+// not interrupted.
+func Build(ctx context.Context, opts BuildOptions) (result *Result, err error) {
+	if err := opts.process(); err != nil {
+		return nil, fmt.Errorf("invalid build options: %s", err)
+	}
+	log.Infof("Starting Makisu build (version=%s)", utils.BuildHash)
+
+	var buildPlan *builder.BuildPlan
+	result = &Result{}
+	start := time.Now()
+	defer func() {
+		result.Report = &builder.BuildReport{Target: opts.Tag}
+		if buildPlan != nil {
+			result.Report = buildPlan.Report()
+		}
+		result.Report.Duration = time.Since(start)
+		result.Report.Succeeded = err == nil
+		e := &events.Event{Type: events.BuildFinished, Duration: result.Report.Duration}
+		if err != nil {
+			result.Report.Error = err.Error()
+			e.BuildCode = 1
+			e.Error = err.Error()
+		}
+		events.EmitTo(opts.Events, e)
+	}()
+
+	// Create BuildContext.
+	contextDirAbs, err := filepath.Abs(opts.ContextDir)
+	if err != nil {
+		return result, fmt.Errorf("failed to resolve context dir: %s", err)
+	}
+	if contextDirAbs == "/" {
+		return result, fmt.Errorf("the absolute path for context directory %s is /. Cannot use root as context", opts.ContextDir)
+	}
+	blacklist, err := opts.blacklist()
+	if err != nil {
+		return result, fmt.Errorf("failed to extend blacklist: %s", err)
+	}
+	imageStore, err := storage.NewImageStore(opts.StorageDir)
+	if err != nil {
+		return result, fmt.Errorf("failed to init image store: %s", err)
+	}
+	rootDir := "/"
+	if opts.RootfsDir != "" {
+		if err := os.MkdirAll(opts.RootfsDir, 0755); err != nil {
+			return result, fmt.Errorf("failed to create rootfs dir: %s", err)
+		}
+		rootDir = opts.RootfsDir
+	}
+	buildContext, err := buildcontext.NewBuildContextWithBlacklist(
+		rootDir, contextDirAbs, imageStore, blacklist)
+	if err != nil {
+		return result, fmt.Errorf("failed to create initial build context: %s", err)
+	}
+	defer buildContext.Cleanup()
+	buildContext.RunOptions = shell.ExecOptions{
+		Network: opts.Network,
+		Timeout: opts.RunTimeout,
+		Rlimits: opts.RunRlimits,
+		Env:     opts.RunEnv,
+		Chroot:  opts.RootfsDir,
+	}
+	buildContext.MemFS.SetChroot(opts.RootfsDir != "")
+	buildContext.SetTarConfig(opts.TarConfig)
+	buildContext.SetFullScan(opts.FullScan)
+	buildContext.RegistryConfig = opts.RegistryConfig
+	buildContext.Events = opts.Events
+	buildContext.TransferStats = registry.NewTransferStats()
+	if buildContext.ManifestMediaType, err = image.ManifestMediaType(opts.Format); err != nil {
+		return result, err
+	}
+	if opts.Platform != "" {
+		if buildContext.Platform, err = image.ParsePlatform(opts.Platform); err != nil {
+			return result, fmt.Errorf("failed to parse platform: %s", err)
+		}
+	}
+	if opts.LockFile != "" {
+		if buildContext.ImageLock, err = image.LoadLock(opts.LockFile, opts.Frozen); err != nil {
+			return result, fmt.Errorf("failed to load lock file: %s", err)
+		}
+	}
+
+	// Make sure sandbox is cleaned after build.
+	// Optionally remove everything before and after build.
+	defer storage.CleanupSandbox(opts.StorageDir)
+	if opts.AllowModifyFS {
+		if opts.PreserveRoot {
+			rootPreserver, err := storage.NewRootPreserver("/", opts.StorageDir, blacklist)
+			if err != nil {
+				return result, fmt.Errorf("failed to preserve root: %s", err)
+			}
+			defer rootPreserver.RestoreRoot()
+		}
+	}
+	if opts.AllowModifyFS || opts.RootfsDir != "" {
+		buildContext.MemFS.Remove()
+		defer buildContext.MemFS.Remove()
+	}
+
+	// Create and execute build plan.
+	imageName, err := opts.targetImageName()
+	if err != nil {
+		return result, fmt.Errorf("failed to get target image name: %s", err)
+	}
+	result.Image = imageName
+	var parsedReplicas []image.Name
+	for _, replica := range opts.Replicas {
+		parsed, err := image.ParseName(replica)
+		if err != nil {
+			return result, fmt.Errorf("failed to parse replica %s: %s", replica, err)
+		}
+		parsedReplicas = append(parsedReplicas, parsed)
+	}
+	buildPlan, err = opts.newBuildPlan(buildContext, imageName, parsedReplicas)
+	if err != nil {
+		return result, fmt.Errorf("failed to create build plan: %s", err)
+	}
+	if err := ctx.Err(); err != nil {
+		return result, err
+	}
+	if result.Manifest, err = buildPlan.Execute(); err != nil {
+		if opts.DebugOnFailure != "" {
+			opts.saveDebugImage(buildContext, buildPlan, imageName)
+		}
+		return result, fmt.Errorf("failed to execute build plan: %s", err)
+	}
+	log.Infof("Successfully built image %s", imageName.ShortName())
+
+	// Add the images resolved during the build to the lock file.
+	if opts.LockFile != "" && !opts.Frozen {
+		if err := buildContext.ImageLock.Save(opts.LockFile); err != nil {
+			return result, fmt.Errorf("failed to save lock file: %s", err)
+		}
+	}
+
+	// Push image to the registries and replicas.
+	targets := make([]image.Name, 0, len(opts.PushRegistries)+len(parsedReplicas))
+	for _, registry := range opts.PushRegistries {
+		targets = append(targets, imageName.WithRegistry(registry))
+	}
+	targets = append(targets, parsedReplicas...)
+	for _, target := range targets {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		if err := pushImage(buildContext, target); err != nil {
+			return result, fmt.Errorf("failed to push image: %s", err)
+		}
+	}
+
+	// Optionally save image as a tar file.
+	if opts.Destination != "" {
+		if err := saveImage(buildContext, imageName, opts.Destination); err != nil {
+			return result, fmt.Errorf("failed to save image: %s", err)
+		}
+	}
+
+	// Optionally load image to local docker daemon.
+	if opts.Load {
+		if err := opts.loadImage(ctx, buildContext, imageName); err != nil {
+			return result, fmt.Errorf("failed to load image: %s", err)
+		}
+	}
+
+	log.Infof("Finished building %s", imageName.ShortName())
+	return result, nil
+}
+
+func (opts *BuildOptions) newBuildPlan(
+	buildContext *buildcontext.BuildContext, imageName image.Name,
+	replicas []image.Name) (*builder.BuildPlan, error) {
+
+	// Read in and parse dockerfile.
+	dockerfile, err := opts.getDockerfile(buildContext.ContextDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get dockerfile: %s", err)
+	}
+
+	// Remove image manifest if an image with the same name already exists.
+	if err := cleanManifest(buildContext, imageName); err != nil {
+		return nil, fmt.Errorf("failed to clean manifest: %s", err)
+	}
+	for _, replica := range replicas {
+		if err := cleanManifest(buildContext, replica); err != nil {
+			return nil, fmt.Errorf("failed to clean manifest: %s", err)
+		}
+	}
+
+	// Init cache manager.
+	cacheMgr := opts.newCacheManager(buildContext, imageName)
+
+	// forceCommit will make every step attempt to commit a layer.
+	// Commit is noop for steps other than ADD/COPY/RUN if they are not after an
+	// uncommitted RUN, so this won't generate extra empty layers.
+	forceCommit := !opts.ExplicitCommit
+
+	// Create BuildPlan and validate it.
+	plan, err := builder.NewBuildPlan(
+		buildContext, imageName, replicas, cacheMgr, dockerfile, opts.AllowModifyFS || opts.RootfsDir != "", forceCommit, opts.Target,
+		opts.Squash)
+	if err != nil {
+		return nil, err
+	}
+
+	// Labels are added to the final image config, after cache IDs are set.
+	plan.SetLabels(opts.Labels)
+	return plan, nil
+}
+
+// getDockerfile reads and parses the dockerfile.
+func (opts *BuildOptions) getDockerfile(contextDir string) ([]*dockerfile.Stage, error) {
+	fi, err := os.Lstat(contextDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lstat build context %s: %s", contextDir, err)
+	} else if !fi.Mode().IsDir() {
+		return nil, fmt.Errorf("build context provided is not a directory: %s", contextDir)
+	}
+
+	dockerfilePath := opts.DockerfilePath
+	if !path.IsAbs(dockerfilePath) {
+		dockerfilePath = path.Join(contextDir, dockerfilePath)
+	}
+
+	log.Infof("Using build context: %s", contextDir)
+	contents, err := ioutil.ReadFile(dockerfilePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate/find dockerfile in context: %s", err)
+	}
+
+	buildArgs := opts.BuildArgs
+	if buildArgs == nil {
+		buildArgs = make(map[string]string)
+	}
+	dockerfile, err := dockerfile.ParseFile(string(contents), buildArgs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse dockerfile: %s", err)
+	}
+	return dockerfile, nil
+}
+
+// newCacheManager inits and returns a cache manager object.
+func (opts *BuildOptions) newCacheManager(
+	buildContext *buildcontext.BuildContext, imageName image.Name) cache.Manager {
+
+	var kvStore keyvalue.Store
+	var err error
+	if opts.RedisCacheAddress != "" {
+		log.Infof("Using redis at %s for cacheID storage", opts.RedisCacheAddress)
+
+		kvStore, err = keyvalue.NewRedisStore(opts.RedisCacheAddress, opts.RedisCachePassword, opts.RedisCacheTTL)
+		if err != nil {
+			log.Errorf("Failed to connect to redis store: %s", err)
+		}
+	} else if opts.HTTPCacheAddress != "" {
+		log.Infof("Using http server at %s for cacheID storage", opts.HTTPCacheAddress)
+
+		kvStore, err = keyvalue.NewHTTPStore(opts.HTTPCacheAddress, opts.HTTPCacheHeaders...)
+		if err != nil {
+			log.Errorf("Failed to instantiate cache id store: %s", err)
+		}
+	} else if opts.LocalCacheTTL != 0 {
+		fullpath := path.Join(buildContext.ImageStore.RootDir, pathutils.CacheKeyValueFileName)
+		log.Infof("Using local file at %s for cacheID storage", fullpath)
+
+		kvStore, err = keyvalue.NewFSStore(
+			fullpath, buildContext.ImageStore.SandboxDir, opts.LocalCacheTTL)
+		if err != nil {
+			log.Errorf("Failed to init local cache ID store: %s", err)
+		}
+	} else {
+		log.Infof("No cache option provided, not using cache")
+		return cache.NewNoopCacheManager()
+	}
+
+	var registryClient registry.Client
+	if len(opts.PushRegistries) == 0 {
+		log.Infof("No registry information provided, using cached layers")
+		registryClient = nil
+	} else {
+		registryClient = buildContext.NewRegistryClient(imageName)
+	}
+	return cache.New(buildContext.ImageStore, kvStore, registryClient)
+}
+
+// saveDebugImage saves the file system of the stage that failed to build as an
+// image, and either saves it as a tar or pushes it, depending on
+// DebugOnFailure. Errors are logged and don't change the build result.
+func (opts *BuildOptions) saveDebugImage(
+	buildContext *buildcontext.BuildContext, buildPlan *builder.BuildPlan, imageName image.Name) {
+
+	debugName := image.MustParseName(opts.DebugOnFailure)
+	tarPath := strings.HasSuffix(opts.DebugOnFailure, ".tar")
+	if tarPath {
+		debugName = image.NewImageName("", imageName.GetRepository(), "debug")
+	}
+	if _, err := buildPlan.SaveDebugImage(debugName); err != nil {
+		log.Errorf("Failed to save debug image: %s", err)
+		return
+	}
+	var err error
+	if tarPath {
+		err = saveImage(buildContext, debugName, opts.DebugOnFailure)
+	} else {
+		err = pushImage(buildContext, debugName)
+	}
+	if err != nil {
+		log.Errorf("Failed to save debug image: %s", err)
+		return
+	}
+	log.Infof("Saved debug image of the failed build to %s", opts.DebugOnFailure)
+}
+
+// loadImage loads the image into the docker daemon.
+func (opts *BuildOptions) loadImage(
+	ctx context.Context, buildContext *buildcontext.BuildContext, imageName image.Name) error {
+
+	log.Infof("Loading image %s", imageName.ShortName())
+	tarer := cli.NewDefaultImageTarer(buildContext.ImageStore)
+	if tar, err := tarer.CreateTarReader(imageName); err != nil {
+		return fmt.Errorf("failed to create tar of image: %s", err)
+	} else if cli, err := cli.NewDockerClient(
+		buildContext.ImageStore.SandboxDir, opts.DockerHost,
+		opts.DockerScheme, opts.DockerVersion, http.Header{}); err != nil {
+
+		return fmt.Errorf("failed to create new docker client: %s", err)
+	} else if err := cli.ImageTarLoad(ctx, tar); err != nil {
+		return fmt.Errorf("failed to load image to local docker daemon: %s", err)
+	}
+	log.Infof("Successfully loaded image %s", imageName)
+	return nil
+}
+
+// pushImage pushes the specified image to docker registry.
+func pushImage(buildContext *buildcontext.BuildContext, imageName image.Name) error {
+	registryClient := buildContext.NewRegistryClient(imageName)
+	if err := registryClient.Push(imageName.GetTag()); err != nil {
+		return fmt.Errorf("failed to push image: %s", err)
+	}
+	log.Infof("Successfully pushed %s to %s", imageName, imageName.GetRegistry())
+	return nil
+}
+
+// saveImage tars the image layers and manifests into a single tar, and saves that tar
+// into <destination>.
+func saveImage(buildContext *buildcontext.BuildContext, imageName image.Name, destination string) error {
+	log.Infof("Saving image %s at location %s", imageName.ShortName(), destination)
+	tarer := cli.NewDefaultImageTarer(buildContext.ImageStore)
+	if tar, err := tarer.CreateTarReadCloser(imageName); err != nil {
+		return fmt.Errorf("failed to create a tarball from image layers and manifests: %s", err)
+	} else if err := fileio.ReaderToFile(tar, destination); err != nil {
+		return fmt.Errorf("failed to write image tarball to destination %s: %s", destination, err)
+	}
+	return nil
+}
+
+// cleanManifest removes specified image manifest from local filesystem.
+func cleanManifest(buildContext *buildcontext.BuildContext, imageName image.Name) error {
+	repo, tag := imageName.GetRepository(), imageName.GetTag()
+	err := buildContext.ImageStore.Manifests.DeleteStoreFile(repo, tag)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete %s from manifest store: %s", imageName, err)
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/uber/makisu/lib/builder"
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/tario"
+	"github.com/uber/makisu/lib/utils/testutil"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuild(t *testing.T) {
+	require := require.New(t)
+
+	tmpDir, err := ioutil.TempDir("/tmp", "makisu-test-api")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	contextDir := filepath.Join(tmpDir, "context")
+	require.NoError(os.MkdirAll(contextDir, 0755))
+	require.NoError(ioutil.WriteFile(filepath.Join(contextDir, "Dockerfile"),
+		[]byte("FROM scratch\nCOPY a /a\nLABEL k=v\n"), 0644))
+	require.NoError(ioutil.WriteFile(filepath.Join(contextDir, "a"), []byte("a"), 0644))
+
+	build := func(storageDir, format string) *Result {
+		tarConfig := tario.NewConfig()
+		tarConfig.SetSourceDateEpoch(1000)
+		result, err := Build(context.Background(), BuildOptions{
+			ContextDir:  contextDir,
+			Tag:         "testrepo:testtag",
+			StorageDir:  filepath.Join(tmpDir, storageDir),
+			Labels:      map[string]string{"label": "value"},
+			TarConfig:   tarConfig,
+			Destination: filepath.Join(tmpDir, storageDir+".tar"),
+			Format:      format,
+		})
+		require.NoError(err)
+		return result
+	}
+
+	result := build("storage1", "")
+	require.Equal("testrepo:testtag", result.Image.ShortName())
+	require.NotNil(result.Manifest)
+	require.Len(result.Manifest.Layers, 1)
+	require.Equal(image.MediaTypeManifest, result.Manifest.MediaType)
+	require.True(result.Report.Succeeded)
+	require.Equal(result.Report.ManifestDigest, build("storage2", "docker").Report.ManifestDigest)
+
+	ociResult := build("storage3", "oci")
+	require.Equal(image.MediaTypeOCIManifest, ociResult.Manifest.MediaType)
+	require.Equal(image.MediaTypeOCIConfig, ociResult.Manifest.Config.MediaType)
+	require.Equal(image.MediaTypeOCILayer, ociResult.Manifest.Layers[0].MediaType)
+	require.Equal(result.Manifest.Layers[0].Digest, ociResult.Manifest.Layers[0].Digest)
+
+	_, err = os.Stat(filepath.Join(tmpDir, "storage1.tar"))
+	require.NoError(err)
+
+	// Options are not written to package level settings.
+	require.Nil(tario.SourceDateEpoch)
+}
+
+func TestBuildReportsTransfersPerBuild(t *testing.T) {
+	require := require.New(t)
+
+	tmpDir, err := ioutil.TempDir("/tmp", "makisu-test-api")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	// Serve the alpine test image.
+	testFileDir := "../../testdata/files/alpine"
+	blobs := map[string]string{
+		testutil.SampleImageConfigDigest: "test_image_config",
+		testutil.SampleLayerTarDigest:    "test_layer.tar",
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		repoPath := "/v2/" + testutil.SampleImageRepoName
+		if r.URL.Path == repoPath+"/manifests/"+testutil.SampleImageTag {
+			w.Header().Set("Content-Type", image.MediaTypeManifest)
+			http.ServeFile(w, r, filepath.Join(testFileDir, "test_distribution_manifest"))
+		} else if name, ok := blobs[strings.TrimPrefix(r.URL.Path, repoPath+"/blobs/sha256:")]; ok {
+			http.ServeFile(w, r, filepath.Join(testFileDir, name))
+		} else {
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	registry := strings.TrimPrefix(server.URL, "http://")
+
+	contextDir := filepath.Join(tmpDir, "context")
+	require.NoError(os.MkdirAll(contextDir, 0755))
+	require.NoError(ioutil.WriteFile(filepath.Join(contextDir, "Dockerfile"), []byte(
+		"FROM "+registry+"/"+testutil.SampleImageRepoName+":"+testutil.SampleImageTag+"\nLABEL k=v\n"), 0644))
+
+	build := func(storageDir string) *Result {
+		result, err := Build(context.Background(), BuildOptions{
+			ContextDir: contextDir,
+			Tag:        "testrepo:testtag",
+			StorageDir: filepath.Join(tmpDir, storageDir),
+		})
+		require.NoError(err)
+		return result
+	}
+
+	// Both builds pull the image into their own storage, and only report
+	// their own transfers.
+	first := build("storage1").Report.Registries
+	second := build("storage2").Report.Registries
+	require.Contains(first, registry)
+	require.True(first[registry].BytesPulled > 0)
+	require.Equal(first, second)
+}
+
+func TestBuildFailure(t *testing.T) {
+	require := require.New(t)
+
+	tmpDir, err := ioutil.TempDir("/tmp", "makisu-test-api")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	_, err = Build(context.Background(), BuildOptions{ContextDir: tmpDir})
+	require.Error(err)
+
+	_, err = Build(context.Background(), BuildOptions{
+		ContextDir: tmpDir, Tag: "testrepo:testtag", Squash: builder.SquashMode("invalid"),
+	})
+	require.Error(err)
+
+	_, err = Build(context.Background(), BuildOptions{
+		ContextDir: tmpDir, Tag: "testrepo:testtag", Format: "invalid",
+	})
+	require.Error(err)
+
+	result, err := Build(context.Background(), BuildOptions{
+		ContextDir: tmpDir,
+		Tag:        "testrepo:testtag",
+		StorageDir: filepath.Join(tmpDir, "storage"),
+	})
+	require.Error(err)
+	require.NotNil(result)
+	require.False(result.Report.Succeeded)
+	require.Contains(result.Report.Error, "dockerfile")
+}
@@ -0,0 +1,304 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/uber/makisu/lib/builder"
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/events"
+	"github.com/uber/makisu/lib/log"
+	"github.com/uber/makisu/lib/mountutils"
+	"github.com/uber/makisu/lib/pathutils"
+	"github.com/uber/makisu/lib/registry"
+	"github.com/uber/makisu/lib/shell"
+	"github.com/uber/makisu/lib/tario"
+	"github.com/uber/makisu/lib/utils/stringset"
+)
+
+// BuildOptions configures one build. All settings are read from it instead of
+// package level variables, so builds with different options can run in the
+// same process.
+type BuildOptions struct {
+	// ContextDir is the build context. Required.
+	ContextDir string
+
+	// DockerfilePath is the path of the dockerfile, relative to ContextDir
+	// unless absolute. Defaults to "Dockerfile".
+	DockerfilePath string
+
+	// Tag is the name of the image, "(<registry>/)<repo>:<tag>". Required.
+	Tag string
+
+	// BuildArgs are the arguments of the dockerfile, as per the spec of ARG.
+	BuildArgs map[string]string
+
+	// Target is the build stage to build. Defaults to the last one.
+	Target string
+
+	// Platform is the platform of the image, with format
+	// <os>/<arch>[/<variant>]. Defaults to the platform of the host.
+	Platform string
+
+	// Labels are set on the image, without changing cache IDs.
+	Labels map[string]string
+
+	// Format is the format of the image manifest, "docker" or "oci".
+	// Defaults to "docker".
+	Format string
+
+	// PushRegistries are the registries to push the image to. The first one
+	// replaces the registry of Tag, and is used for cached layers.
+	PushRegistries []string
+
+	// Replicas are alternative full image names to push the image to.
+	Replicas []string
+
+	// RegistryConfig configures the registry clients. The global registry
+	// configuration is not used.
+	RegistryConfig registry.Map
+
+	// Destination is the path to save the image tar to, if set.
+	Destination string
+
+	// Load loads the image into the docker daemon at DockerHost.
+	Load          bool
+	DockerHost    string // Defaults to "unix:///var/run/docker.sock".
+	DockerVersion string // Defaults to "1.21".
+	DockerScheme  string // Defaults to "http".
+
+	// StorageDir is the directory used for temp files and cached layers. If
+	// AllowModifyFS is set, defaults to /makisu-storage; Otherwise defaults
+	// to /tmp/makisu-storage.
+	StorageDir string
+
+	// AllowModifyFS allows the build to modify files outside of the storage
+	// dir.
+	AllowModifyFS bool
+
+	// RootfsDir is the directory to build in instead of /, and to chroot
+	// into to execute RUN steps. Relative paths are under StorageDir. Cannot
+	// be used with AllowModifyFS.
+	RootfsDir string
+
+	// FullScan makes scans of the file system list every directory after each
+	// step. By default, the listings of directories whose mtime and link
+	// count didn't change are reused, which is unsafe on file systems that
+	// don't update directory mtimes reliably but aren't detected as such.
+	FullScan bool
+
+	// PreserveRoot copies / in the storage dir and copies it back after the
+	// build. Only used with AllowModifyFS.
+	PreserveRoot bool
+
+	// ExplicitCommit only commits layers at steps with '#!COMMIT'
+	// annotations, instead of at every ADD/COPY/RUN step.
+	ExplicitCommit bool
+
+	// Blacklist contains paths ignored by the build, on top of
+	// pathutils.DefaultBlacklist.
+	Blacklist []string
+
+	// Squash squashes the layers of the image. Requires AllowModifyFS or
+	// RootfsDir.
+	Squash builder.SquashMode
+
+	// Network is the network mode of RUN steps. Defaults to shell.NetworkHost.
+	Network shell.NetworkMode
+
+	// RunTimeout is the maximum duration of RUN steps, 0 means no limit.
+	RunTimeout time.Duration
+
+	// RunRlimits are the resource limits of RUN commands. They require
+	// shell.InitRlimitHelper to be called at the start of main.
+	RunRlimits shell.Rlimits
+
+	// RunEnv is the environment passed to RUN commands on top of the env of
+	// the image and the stage, in "key=value" form.
+	RunEnv []string
+
+	// LockFile pins the images of FROM and 'COPY --from=<image>' to the
+	// digests in this file. Images missing from it are resolved and added to
+	// it after a successful build, unless Frozen is set, in which case the
+	// build fails.
+	LockFile string
+	Frozen   bool
+
+	// LocalCacheTTL is the Time-To-Live of the local cache of cache IDs. Only
+	// used if neither redis nor http cache is set. 0 disables it.
+	LocalCacheTTL time.Duration
+
+	// RedisCacheAddress is the address of a redis server for cache IDs.
+	RedisCacheAddress  string
+	RedisCachePassword string
+	RedisCacheTTL      time.Duration
+
+	// HTTPCacheAddress is the address of an http server for cache IDs.
+	HTTPCacheAddress string
+	HTTPCacheHeaders []string // With format "<header>:<value>".
+
+	// TarConfig controls the compression of layers, and whether they are
+	// reproducible. Defaults to tario.NewConfig().
+	TarConfig *tario.Config
+
+	// Events receives the events of the build. Defaults to dropping them.
+	Events events.Sink
+
+	// DebugOnFailure is where the file system of the stage is saved as an
+	// image if a step fails, either a path ending with '.tar', or an image
+	// name "<registry>/<repo>:<tag>" to push to.
+	DebugOnFailure string
+}
+
+// process validates the options and sets their defaults.
+func (opts *BuildOptions) process() error {
+	if opts.ContextDir == "" {
+		return fmt.Errorf("context dir is required")
+	}
+	if opts.Tag == "" {
+		return fmt.Errorf("tag is required")
+	}
+	if opts.DockerfilePath == "" {
+		opts.DockerfilePath = "Dockerfile"
+	}
+	if opts.DockerHost == "" {
+		opts.DockerHost = "unix:///var/run/docker.sock"
+	}
+	if opts.DockerVersion == "" {
+		opts.DockerVersion = "1.21"
+	}
+	if opts.DockerScheme == "" {
+		opts.DockerScheme = "http"
+	}
+	if opts.RegistryConfig == nil {
+		opts.RegistryConfig = make(registry.Map)
+	}
+	if opts.TarConfig == nil {
+		opts.TarConfig = tario.NewConfig()
+	}
+	if opts.Events == nil {
+		opts.Events = events.NewNoopSink()
+	}
+	if opts.Network == "" {
+		opts.Network = shell.NetworkHost
+	}
+	if opts.Format == "" {
+		opts.Format = "docker"
+	}
+
+	if opts.Platform != "" {
+		if _, err := image.ParsePlatform(opts.Platform); err != nil {
+			return fmt.Errorf("invalid platform: %s", err)
+		}
+	}
+	if opts.Frozen && opts.LockFile == "" {
+		return fmt.Errorf("frozen requires lock file")
+	}
+	if _, err := shell.ParseNetworkMode(string(opts.Network)); err != nil {
+		return fmt.Errorf("invalid network: %s", err)
+	}
+	if opts.RunTimeout < 0 {
+		return fmt.Errorf("invalid run timeout: %s", opts.RunTimeout)
+	}
+	if _, err := image.ManifestMediaType(opts.Format); err != nil {
+		return err
+	}
+	switch opts.Squash {
+	case builder.SquashNone, builder.SquashStage, builder.SquashAll:
+	default:
+		return fmt.Errorf("invalid squash mode: %s", opts.Squash)
+	}
+
+	// If modifyfs is true, verify it's not running on Mac.
+	if opts.AllowModifyFS && runtime.GOOS == "darwin" {
+		return fmt.Errorf("modifyfs option could erase fs and is not allowed on Mac")
+	}
+
+	// Configure default storage dir.
+	if opts.StorageDir == "" {
+		if opts.AllowModifyFS {
+			opts.StorageDir = pathutils.DefaultStorageDir
+		} else {
+			opts.StorageDir = "/tmp/makisu-storage"
+		}
+	}
+
+	// Verify storage dir is not child of internal dir.
+	if pathutils.IsDescendantOfAny(opts.StorageDir, []string{pathutils.DefaultInternalDir}) {
+		return fmt.Errorf("storage dir cannot be under internal dir %s",
+			pathutils.DefaultInternalDir)
+	}
+
+	// Verify the debug image can be saved or pushed.
+	if opts.DebugOnFailure != "" && !strings.HasSuffix(opts.DebugOnFailure, ".tar") {
+		if name, err := image.ParseName(opts.DebugOnFailure); err != nil || !name.IsValid() {
+			return fmt.Errorf("invalid debug image name: %s", opts.DebugOnFailure)
+		} else if name.GetRegistry() == "" {
+			return fmt.Errorf("debug image name must include a registry: %s", opts.DebugOnFailure)
+		}
+	}
+
+	// Configure rootfs dir, relative to the storage dir.
+	if opts.RootfsDir != "" {
+		if opts.AllowModifyFS {
+			return fmt.Errorf("rootfs dir and modifyfs cannot be used together")
+		}
+		if !filepath.IsAbs(opts.RootfsDir) {
+			opts.RootfsDir = filepath.Join(opts.StorageDir, opts.RootfsDir)
+		}
+		if filepath.Clean(opts.RootfsDir) == "/" {
+			return fmt.Errorf("rootfs dir cannot be /")
+		}
+	}
+	return nil
+}
+
+// blacklist returns the paths ignored by the build.
+func (opts *BuildOptions) blacklist() ([]string, error) {
+	blacklist := append(append([]string{}, pathutils.DefaultBlacklist...), opts.Blacklist...)
+	if found, err := mountutils.ContainsMountpoint("/var/run"); err != nil {
+		return nil, err
+	} else if found {
+		blacklist = append(blacklist, "/var/run")
+		log.Warnf("Blacklisted /var/run because it contains a mountpoint inside. " +
+			"No changes of that directory will be reflected in the final image.")
+	}
+	return stringset.FromSlice(blacklist).ToSlice(), nil
+}
+
+// targetImageName returns the name of the image to build.
+func (opts *BuildOptions) targetImageName() (image.Name, error) {
+	targetImageName, err := image.ParseName(opts.Tag)
+	if err != nil {
+		return image.Name{}, fmt.Errorf("parse tag %s: %s", opts.Tag, err)
+	}
+	if len(opts.PushRegistries) == 0 {
+		return targetImageName, nil
+	}
+
+	// If push registries are specified we ignore the registry in the image
+	// name and replace it with the first one. This will cause all of the
+	// cache layers to go to that registry.
+	return image.NewImageName(
+		opts.PushRegistries[0],
+		targetImageName.GetRepository(),
+		targetImageName.GetTag(),
+	), nil
+}
@@ -15,7 +15,6 @@
 package builder
 
 import (
-	"archive/tar"
 	"fmt"
 	"strings"
 	"time"
@@ -24,8 +23,9 @@ import (
 	"github.com/uber/makisu/lib/cache"
 	"github.com/uber/makisu/lib/context"
 	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/events"
 	"github.com/uber/makisu/lib/log"
-	"github.com/uber/makisu/lib/tario"
+	"github.com/uber/makisu/lib/shell"
 )
 
 // buildNodeOptions wraps options that are specified when a node is built.
@@ -43,15 +43,25 @@ type buildNode struct {
 	// shared with other nodes, requiring that the nodes be executed in order.
 	ctx *context.BuildContext
 
+	// stage is the alias of the stage the node belongs to.
+	stage string
+
 	// digestPair are the layer(s) committed or fetched by this node.
 	digestPairs []*image.DigestPair
+
+	// Build results, used for reporting.
+	cacheStatus CacheStatus
+	duration    time.Duration
+	err         error
+	timedOut    bool
 }
 
 // newBuildNode initializes a buildNode.
-func newBuildNode(ctx *context.BuildContext, step step.BuildStep) *buildNode {
+func newBuildNode(ctx *context.BuildContext, stage string, step step.BuildStep) *buildNode {
 	return &buildNode{
 		BuildStep: step,
 		ctx:       ctx,
+		stage:     stage,
 	}
 }
 
@@ -61,7 +71,30 @@ func newBuildNode(ctx *context.BuildContext, step step.BuildStep) *buildNode {
 // TODO: Build and push intermediate cache layers concurrently.
 func (n *buildNode) Build(
 	cacheMgr cache.Manager, prevConfig *image.Config,
-	opts *buildNodeOptions) (*image.Config, error) {
+	opts *buildNodeOptions) (config *image.Config, err error) {
+
+	start := time.Now()
+	events.EmitTo(n.ctx.Events, &events.Event{
+		Type:    events.StepStarted,
+		Stage:   n.stage,
+		Step:    n.String(),
+		CacheID: n.CacheID(),
+	})
+	defer func() {
+		n.duration = time.Since(start)
+		n.err = err
+		e := &events.Event{
+			Type:     events.StepFinished,
+			Stage:    n.stage,
+			Step:     n.String(),
+			CacheID:  n.CacheID(),
+			Duration: n.duration,
+		}
+		if err != nil {
+			e.Error = err.Error()
+		}
+		events.EmitTo(n.ctx.Events, e)
+	}()
 
 	// Always apply config.
 	if err := n.ApplyCtxAndConfig(n.ctx, prevConfig); err != nil {
@@ -79,9 +112,17 @@ func (n *buildNode) Build(
 		}
 	}
 
+	n.cacheStatus = CacheSkipped
 	if opts.skipBuild {
 		log.Infof("* Skipping execution; a later step was cached *")
 	} else if cached {
+		n.cacheStatus = CacheHit
+		events.EmitTo(n.ctx.Events, &events.Event{
+			Type:    events.CacheHit,
+			Stage:   n.stage,
+			Step:    n.String(),
+			CacheID: n.CacheID(),
+		})
 		log.Infof("* Skipping execution; cache was applied *")
 	} else if err := n.doExecute(cacheMgr, opts); err != nil {
 		return nil, fmt.Errorf("do execute: %s", err)
@@ -92,7 +133,7 @@ func (n *buildNode) Build(
 	}
 
 	// Always generate a new config.
-	config, err := n.UpdateCtxAndConfig(n.ctx, prevConfig)
+	config, err = n.UpdateCtxAndConfig(n.ctx, prevConfig)
 	if err != nil {
 		return nil, fmt.Errorf("generate config: %s", err)
 	}
@@ -105,6 +146,16 @@ func (n *buildNode) doCommit(cacheMgr cache.Manager, opts *buildNodeOptions) err
 	if err != nil {
 		return fmt.Errorf("commit: %s", err)
 	}
+	for _, pair := range n.digestPairs {
+		events.EmitTo(n.ctx.Events, &events.Event{
+			Type:    events.LayerCommitted,
+			Stage:   n.stage,
+			Step:    n.String(),
+			CacheID: n.CacheID(),
+			Digest:  string(pair.GzipDescriptor.Digest),
+			Size:    pair.GzipDescriptor.Size,
+		})
+	}
 
 	// If the number of digestPairs is greater than 1 then we cannot push
 	// the resulting layer mappings to the distributed cache.
@@ -115,6 +166,7 @@ func (n *buildNode) doCommit(cacheMgr cache.Manager, opts *buildNodeOptions) err
 	if err := n.pushCacheLayer(cacheMgr); err != nil {
 		return fmt.Errorf("push cache: %s", err)
 	}
+	n.cacheStatus = CacheMiss
 	return nil
 }
 
@@ -122,6 +174,7 @@ func (n *buildNode) doExecute(cacheMgr cache.Manager, opts *buildNodeOptions) er
 	start := time.Now()
 	err := n.Execute(n.ctx, opts.modifyFS)
 	if err != nil {
+		_, n.timedOut = err.(*shell.TimeoutError)
 		return fmt.Errorf("execute step: %s", err)
 	}
 	log.Infow(fmt.Sprintf("* Executed %s", n.String()), "duration", time.Since(start))
@@ -135,13 +188,10 @@ func (n *buildNode) applyLayer(digestPair *image.DigestPair, modifyfs bool) erro
 	if err != nil {
 		return fmt.Errorf("get reader from layer: %s", err)
 	}
-	gzipReader, err := tario.NewGzipReader(reader)
-	if err != nil {
-		return fmt.Errorf("create gzip reader for layer: %s", err)
-	}
+	defer reader.Close()
 	log.Infof("* Applying cache layer %s (unpack=%v)",
 		digestPair.GzipDescriptor.Digest.Hex(), modifyfs)
-	if err := n.ctx.MemFS.UpdateFromTarReader(tar.NewReader(gzipReader), modifyfs); err != nil {
+	if err := n.ctx.MemFS.UpdateFromLayer(digestPair.GzipDescriptor.Digest, reader, modifyfs); err != nil {
 		return fmt.Errorf("untar reader: %s", err)
 	}
 	return nil
@@ -15,20 +15,37 @@
 package builder
 
 import (
+	"encoding/json"
 	"fmt"
-	"hash/crc32"
-	"os"
 	"strconv"
 
 	"github.com/uber/makisu/lib/cache"
 	"github.com/uber/makisu/lib/context"
 	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/events"
 	"github.com/uber/makisu/lib/log"
 	"github.com/uber/makisu/lib/parser/dockerfile"
 	"github.com/uber/makisu/lib/utils"
 	"github.com/uber/makisu/lib/utils/stringset"
 )
 
+// SquashMode describes which layers of the built image are squashed.
+type SquashMode string
+
+const (
+	// SquashNone keeps all layers.
+	SquashNone = SquashMode("")
+	// SquashStage squashes the layers produced by the final stage on top of
+	// its base image.
+	SquashStage = SquashMode("stage")
+	// SquashAll squashes all layers, including the ones of the base image.
+	SquashAll = SquashMode("all")
+)
+
+// _defaultPlatform is the platform images were built for before the platform
+// could be chosen.
+var _defaultPlatform = image.Platform{OS: "linux", Architecture: "amd64"}
+
 type buildPlanOptions struct {
 	forceCommit   bool
 	allowModifyFS bool
@@ -59,13 +76,39 @@ type BuildPlan struct {
 	stageIndexAliases map[string]*buildStage
 
 	opts *buildPlanOptions
+
+	// squash is not part of opts, because it doesn't affect cache IDs.
+	squash SquashMode
+
+	// labels are set on the image config of the final stage. Like squash,
+	// they are not part of opts, so they don't affect cache IDs.
+	labels map[string]string
+
+	// manifest and manifestDigest describe the image produced by the plan
+	// once it has been executed successfully.
+	manifest       *image.DistributionManifest
+	manifestDigest image.Digest
+
+	// failedStage is the stage that failed to build, if any.
+	failedStage *buildStage
 }
 
 // NewBuildPlan takes in contextDir, a target image and an ImageStore, and
 // returns a new BuildPlan.
 func NewBuildPlan(
 	ctx *context.BuildContext, target image.Name, replicas []image.Name, cacheMgr cache.Manager,
-	parsedStages []*dockerfile.Stage, allowModifyFS, forceCommit bool, stageTarget string) (*BuildPlan, error) {
+	parsedStages []*dockerfile.Stage, allowModifyFS, forceCommit bool, stageTarget string,
+	squash SquashMode) (*BuildPlan, error) {
+
+	switch squash {
+	case SquashNone:
+	case SquashStage, SquashAll:
+		if !allowModifyFS {
+			return nil, fmt.Errorf("must allow modifyfs to squash layers")
+		}
+	default:
+		return nil, fmt.Errorf("invalid squash mode: %s", squash)
+	}
 
 	plan := &BuildPlan{
 		baseCtx:           ctx,
@@ -81,6 +124,7 @@ func NewBuildPlan(
 			forceCommit:   forceCommit,
 			allowModifyFS: allowModifyFS,
 		},
+		squash: squash,
 	}
 
 	if err := plan.processStagesAndAliases(ctx, parsedStages); err != nil {
@@ -90,11 +134,26 @@ func NewBuildPlan(
 	return plan, nil
 }
 
+// SetLabels sets labels to add to the image config of the final stage, on top
+// of the ones set by LABEL directives.
+func (plan *BuildPlan) SetLabels(labels map[string]string) {
+	plan.labels = labels
+}
+
 func (plan *BuildPlan) processStagesAndAliases(
 	ctx *context.BuildContext, parsedStages dockerfile.Stages) error {
 
-	checksum := crc32.ChecksumIEEE([]byte(utils.BuildHash + fmt.Sprintf("%v", plan.opts)))
-	seedCacheID := fmt.Sprintf("%x", checksum)
+	seed := utils.BuildHash + fmt.Sprintf("%v", plan.opts)
+	if tarConfig := ctx.TarConfig; tarConfig.SourceDateEpoch != nil {
+		// Layers built in reproducible mode differ from regular ones.
+		seed += fmt.Sprintf("reproducible:%d:%v", tarConfig.SourceDateEpoch.Unix(), tarConfig.NormalizeOwners)
+	}
+	if platform := ctx.Platform; platform != _defaultPlatform {
+		// Layers of other platforms differ from the ones of the default one,
+		// which cache IDs were computed for before platforms were supported.
+		seed += fmt.Sprintf("platform:%s", platform)
+	}
+	seedCacheID := cache.ComputeID(seed)
 
 	existingAliases := make(map[string]struct{})
 	for i, parsedStage := range parsedStages {
@@ -172,9 +231,6 @@ func (plan *BuildPlan) processStagesAndAliases(
 
 // Execute executes all build stages in order.
 func (plan *BuildPlan) Execute() (*image.DistributionManifest, error) {
-	// We need to backup the original env to restore it between stages
-	orignalEnv := utils.ConvertStringSliceToMap(os.Environ())
-
 	var currStage *buildStage
 	for k := 0; k < len(plan.stages); k++ {
 		currStage = plan.stages[k]
@@ -182,6 +238,7 @@ func (plan *BuildPlan) Execute() (*image.DistributionManifest, error) {
 		// TODO: Implicit stages from "COPY --from=<image>" might introduce
 		// confusion here. Print stageIndexAliases instead.
 		log.Infof("* Stage %d/%d : %s", k+1, len(plan.stages), currStage.String())
+		events.EmitTo(plan.baseCtx.Events, &events.Event{Type: events.StageStarted, Stage: currStage.alias})
 
 		// Try to pull reusable layers cached from previous builds.
 		currStage.pullCacheLayers(plan.cacheMgr)
@@ -189,14 +246,17 @@ func (plan *BuildPlan) Execute() (*image.DistributionManifest, error) {
 		lastStage := k == len(plan.stages)-1
 		_, copiedFrom := plan.copyFromDirs[currStage.alias]
 
-		if err := plan.executeStage(currStage, lastStage, copiedFrom); err != nil {
-			return nil, fmt.Errorf("execute stage: %s", err)
+		// Only the stage producing the final image is squashed. Its files
+		// need to be on disk to create the squashed layer.
+		squash := plan.squash != SquashNone &&
+			(lastStage || currStage.alias == plan.stageTarget)
+		if squash {
+			currStage.opts.requireOnDisk = true
 		}
 
-		// Restore env
-		os.Clearenv()
-		for k, v := range orignalEnv {
-			os.Setenv(k, v)
+		if err := plan.executeStage(currStage, lastStage, copiedFrom, squash); err != nil {
+			plan.failedStage = currStage
+			return nil, fmt.Errorf("execute stage: %s", err)
 		}
 
 		if plan.stageTarget != "" && currStage.alias == plan.stageTarget {
@@ -211,11 +271,22 @@ func (plan *BuildPlan) Execute() (*image.DistributionManifest, error) {
 		log.Errorf("Failed to push cache: %s", err)
 	}
 
+	currStage.addLabels(plan.labels)
+
 	// Save image manifest.
 	manifest, err := currStage.saveManifest(plan.baseCtx.ImageStore, plan.target)
 	if err != nil {
 		return nil, fmt.Errorf("save image manifest %s: %s", plan.target, err)
 	}
+	manifestJSON, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, fmt.Errorf("marshal image manifest %s: %s", plan.target, err)
+	}
+	plan.manifestDigest, err = image.NewDigester().FromBytes(manifestJSON)
+	if err != nil {
+		return nil, fmt.Errorf("compute image manifest digest %s: %s", plan.target, err)
+	}
+	plan.manifest = manifest
 	for _, replica := range plan.replicas {
 		_, err := currStage.saveManifest(plan.baseCtx.ImageStore, replica)
 		if err != nil {
@@ -233,11 +304,17 @@ func (plan *BuildPlan) Execute() (*image.DistributionManifest, error) {
 	return manifest, nil
 }
 
-func (plan *BuildPlan) executeStage(stage *buildStage, lastStage, copiedFrom bool) error {
+func (plan *BuildPlan) executeStage(stage *buildStage, lastStage, copiedFrom, squash bool) error {
 	if err := stage.build(plan.cacheMgr, lastStage, copiedFrom); err != nil {
 		return fmt.Errorf("build stage %s: %s", stage.alias, err)
 	}
 
+	if squash {
+		if err := stage.squash(plan.squash == SquashAll); err != nil {
+			return fmt.Errorf("squash stage %s: %s", stage.alias, err)
+		}
+	}
+
 	if plan.opts.allowModifyFS {
 		// Note: The rest of this function mostly deal with `COPY --from`
 		// related logic, and currently `COPY --from` cannot be supported with
@@ -253,3 +330,20 @@ func (plan *BuildPlan) executeStage(stage *buildStage, lastStage, copiedFrom boo
 
 	return nil
 }
+
+// SaveDebugImage saves an image of the file system of the stage that failed to
+// build, as it was when its failing step stopped, under the given name. It
+// must be called after Execute failed, before the file system is cleaned up.
+func (plan *BuildPlan) SaveDebugImage(name image.Name) (*image.DistributionManifest, error) {
+	stage := plan.failedStage
+	if stage == nil {
+		return nil, fmt.Errorf("no stage failed to build")
+	}
+	_, copiedFrom := plan.copyFromDirs[stage.alias]
+	onDisk := stage.opts.requireOnDisk || copiedFrom
+	manifest, err := stage.saveDebugImage(plan.baseCtx.ImageStore, name, onDisk)
+	if err != nil {
+		return nil, fmt.Errorf("save debug image of stage %s: %s", stage.alias, err)
+	}
+	return manifest, nil
+}
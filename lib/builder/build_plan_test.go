@@ -15,15 +15,22 @@
 package builder
 
 import (
+	"archive/tar"
 	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"path/filepath"
+	"sync"
 	"testing"
 
 	"github.com/uber/makisu/lib/cache"
 	"github.com/uber/makisu/lib/context"
 	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/events"
 	"github.com/uber/makisu/lib/parser/dockerfile"
 	"github.com/uber/makisu/lib/registry"
+	"github.com/uber/makisu/lib/tario"
 
 	"github.com/stretchr/testify/require"
 )
@@ -49,7 +56,7 @@ func TestBuildPlanExecution(t *testing.T) {
 	}
 	stages := []*dockerfile.Stage{{from, directives}}
 
-	plan, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, false, "")
+	plan, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, false, "", SquashNone)
 	require.NoError(err)
 
 	manifest, err := plan.Execute()
@@ -62,8 +69,16 @@ func TestBuildPlanExecution(t *testing.T) {
 	require.NoError(err)
 	var config image.Config
 	require.NoError(json.Unmarshal(b, &config))
-	require.Equal(2, len(config.History))
+	require.Equal(4, len(config.History))
 	require.Equal(2, len(config.RootFS.DiffIDs))
+
+	// Steps that didn't produce a layer have empty layer history entries.
+	require.True(config.History[0].EmptyLayer)
+	require.Equal("/bin/sh -c #(nop)  ENV TESTENV=test", config.History[0].CreatedBy)
+	require.False(config.History[1].EmptyLayer)
+	require.Equal("/bin/sh -c ls .", config.History[1].CreatedBy)
+	require.True(config.History[2].EmptyLayer)
+	require.False(config.History[3].EmptyLayer)
 }
 
 func TestBuildPlanContextDirs(t *testing.T) {
@@ -93,7 +108,7 @@ func TestBuildPlanContextDirs(t *testing.T) {
 	// Here we need to set the allowModifyFS to true because we copy
 	// files across stages.
 	// TODO(pourchet): support copy --from without relying on FS.
-	plan, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, false, "")
+	plan, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, false, "", SquashNone)
 	require.NoError(err)
 	require.Contains(plan.copyFromDirs, "stage1")
 	require.Len(plan.copyFromDirs, 1)
@@ -108,7 +123,7 @@ func TestBuildPlanContextDirs(t *testing.T) {
 	}
 	stages = []*dockerfile.Stage{{from, directives}}
 
-	_, err = NewBuildPlan(ctx, target, nil, cacheMgr, stages, false, false, "")
+	_, err = NewBuildPlan(ctx, target, nil, cacheMgr, stages, false, false, "", SquashNone)
 	require.Error(err)
 
 	// Copy from subsequent stage.
@@ -119,7 +134,7 @@ func TestBuildPlanContextDirs(t *testing.T) {
 	from2 = dockerfile.FromDirectiveFixture("", envImage.String(), "stage2")
 	stages = []*dockerfile.Stage{{from1, directives1}, {from2, nil}}
 
-	_, err = NewBuildPlan(ctx, target, nil, cacheMgr, stages, false, false, "")
+	_, err = NewBuildPlan(ctx, target, nil, cacheMgr, stages, false, false, "", SquashNone)
 	require.Error(err)
 }
 
@@ -142,7 +157,7 @@ func TestBuildPlanBadRun(t *testing.T) {
 	}
 	stages := []*dockerfile.Stage{{from, directives}}
 
-	plan, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, false, "")
+	plan, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, false, "", SquashNone)
 	require.NoError(err)
 
 	_, err = plan.Execute()
@@ -166,7 +181,7 @@ func TestDuplicateStageAlias(t *testing.T) {
 	from2 := dockerfile.FromDirectiveFixture("", envImage.String(), "alias")
 	stages := []*dockerfile.Stage{{from1, nil}, {from2, nil}}
 
-	_, err = NewBuildPlan(ctx, target, nil, cacheMgr, stages, false, false, "")
+	_, err = NewBuildPlan(ctx, target, nil, cacheMgr, stages, false, false, "", SquashNone)
 	require.Error(err)
 
 	// Same image different alias.
@@ -174,7 +189,7 @@ func TestDuplicateStageAlias(t *testing.T) {
 	from2 = dockerfile.FromDirectiveFixture("", envImage.String(), "alias2")
 	stages = []*dockerfile.Stage{{from1, nil}, {from2, nil}}
 
-	_, err = NewBuildPlan(ctx, target, nil, cacheMgr, stages, false, false, "")
+	_, err = NewBuildPlan(ctx, target, nil, cacheMgr, stages, false, false, "", SquashNone)
 	require.NoError(err)
 }
 
@@ -195,7 +210,7 @@ func TestTargetStageMissing(t *testing.T) {
 	from2 := dockerfile.FromDirectiveFixture("", envImage.String(), "alias2")
 	stages := []*dockerfile.Stage{{from1, nil}, {from2, nil}}
 
-	_, err = NewBuildPlan(ctx, target, nil, cacheMgr, stages, false, false, "alias3")
+	_, err = NewBuildPlan(ctx, target, nil, cacheMgr, stages, false, false, "alias3", SquashNone)
 	require.Error(err)
 }
 
@@ -217,6 +232,256 @@ func TestTargetStageOk(t *testing.T) {
 	from3 := dockerfile.FromDirectiveFixture("", envImage.String(), "alias3")
 	stages := []*dockerfile.Stage{{from1, nil}, {from2, nil}, {from3, nil}}
 
-	_, err = NewBuildPlan(ctx, target, nil, cacheMgr, stages, false, false, "alias2")
+	_, err = NewBuildPlan(ctx, target, nil, cacheMgr, stages, false, false, "alias2", SquashNone)
 	require.NoError(err)
 }
+
+type recordingSink struct {
+	sync.Mutex
+	events []*events.Event
+}
+
+func (s *recordingSink) Emit(e *events.Event) {
+	s.Lock()
+	defer s.Unlock()
+	s.events = append(s.events, e)
+}
+
+func (s *recordingSink) types() []events.Type {
+	s.Lock()
+	defer s.Unlock()
+	var types []events.Type
+	for _, e := range s.events {
+		types = append(types, e.Type)
+	}
+	return types
+}
+
+func TestBuildPlanEmitsEvents(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	sink := &recordingSink{}
+	events.SetSink(sink)
+	defer events.SetSink(nil)
+
+	target := image.NewImageName("", "testrepo", "testtag")
+	cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture())
+
+	from := dockerfile.FromDirectiveFixture("", "scratch", "")
+	directives := []dockerfile.Directive{
+		dockerfile.RunCommitDirectiveFixture("echo hello", "echo hello"),
+	}
+	stages := []*dockerfile.Stage{{From: from, Directives: directives}}
+
+	plan, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, false, "", SquashNone)
+	require.NoError(err)
+	_, err = plan.Execute()
+	require.NoError(err)
+
+	types := sink.types()
+	require.Equal(events.StageStarted, types[0])
+	require.Contains(types, events.StepStarted)
+	require.Contains(types, events.StepFinished)
+	require.Contains(types, events.LayerCommitted)
+
+	var stage string
+	var lines []string
+	for _, e := range sink.events {
+		if e.Type == events.StepStarted {
+			stage = e.Stage
+		} else if e.Type == events.RunOutput {
+			require.Equal(stage, e.Stage)
+			lines = append(lines, e.Line)
+		}
+	}
+	require.NotEmpty(stage)
+	require.Equal([]string{"hello"}, lines)
+}
+
+func TestBuildPlanSquash(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	target := image.NewImageName("", "testrepo", "testtag")
+	cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture())
+
+	dir := filepath.Join(ctx.RootDir, "dir")
+	from := dockerfile.FromDirectiveFixture("", "scratch", "")
+	directives := []dockerfile.Directive{
+		dockerfile.RunCommitDirectiveFixture("mkdir", fmt.Sprintf("mkdir %s && echo a > %s/a", dir, dir)),
+		dockerfile.RunCommitDirectiveFixture("rm", fmt.Sprintf("rm %s/a && echo b > %s/b", dir, dir)),
+	}
+	stages := []*dockerfile.Stage{{From: from, Directives: directives}}
+
+	_, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, false, false, "", SquashStage)
+	require.Error(err)
+	_, err = NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, false, "", SquashMode("bad"))
+	require.Error(err)
+
+	plan, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, false, "", SquashStage)
+	require.NoError(err)
+	manifest, err := plan.Execute()
+	require.NoError(err)
+	require.Len(manifest.Layers, 1)
+
+	r, err := ctx.ImageStore.Layers.GetStoreFileReader(manifest.Config.Digest.Hex())
+	require.NoError(err)
+	b, err := ioutil.ReadAll(r)
+	require.NoError(err)
+	var config image.Config
+	require.NoError(json.Unmarshal(b, &config))
+	require.Len(config.RootFS.DiffIDs, 1)
+	require.Len(config.History, 3)
+	require.True(config.History[0].EmptyLayer)
+	require.True(config.History[1].EmptyLayer)
+	require.False(config.History[2].EmptyLayer)
+
+	// The squashed layer only contains the final state of the files.
+	r, err = ctx.ImageStore.Layers.GetStoreFileReader(manifest.Layers[0].Digest.Hex())
+	require.NoError(err)
+	gzipReader, err := tario.NewGzipReader(r)
+	require.NoError(err)
+	tarReader := tar.NewReader(gzipReader)
+	var names []string
+	for {
+		hdr, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(err)
+		names = append(names, hdr.Name)
+	}
+	require.Contains(names, "dir/b")
+	require.NotContains(names, "dir/a")
+	require.NotContains(names, "dir/.wh.a")
+}
+
+func TestBuildPlanReproducible(t *testing.T) {
+	require := require.New(t)
+
+	tario.SetSourceDateEpoch(1000)
+	defer func() { tario.SourceDateEpoch = nil }()
+
+	build := func() image.Digest {
+		ctx, cleanup := context.BuildContextFixture()
+		defer cleanup()
+
+		target := image.NewImageName("", "testrepo", "testtag")
+		cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture())
+
+		// The command is part of the image history, so it must not depend on
+		// the root dir of the build context. RUN steps are executed in it.
+		from := dockerfile.FromDirectiveFixture("", "scratch", "")
+		directives := []dockerfile.Directive{
+			dockerfile.RunCommitDirectiveFixture("mkdir", "mkdir dir && echo a > dir/a"),
+		}
+		stages := []*dockerfile.Stage{{From: from, Directives: directives}}
+
+		plan, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, false, "", SquashNone)
+		require.NoError(err)
+		_, err = plan.Execute()
+		require.NoError(err)
+		return plan.manifestDigest
+	}
+
+	require.Equal(build(), build())
+}
+
+func TestBuildPlanSaveDebugImage(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	target := image.NewImageName("", "testrepo", "testtag")
+	debug := image.NewImageName("", "testrepo", "debug")
+	cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture())
+
+	dir := filepath.Join(ctx.RootDir, "dir")
+	from := dockerfile.FromDirectiveFixture("", "scratch", "")
+	directives := []dockerfile.Directive{
+		dockerfile.RunCommitDirectiveFixture("mkdir", fmt.Sprintf("mkdir %s && echo a > %s/a", dir, dir)),
+		dockerfile.RunCommitDirectiveFixture("fail", fmt.Sprintf("echo b > %s/b && false", dir)),
+	}
+	stages := []*dockerfile.Stage{{From: from, Directives: directives}}
+
+	plan, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, false, "", SquashNone)
+	require.NoError(err)
+	_, err = plan.SaveDebugImage(debug)
+	require.Error(err)
+	_, err = plan.Execute()
+	require.Error(err)
+	manifest, err := plan.SaveDebugImage(debug)
+	require.NoError(err)
+	require.Len(manifest.Layers, 2)
+
+	_, err = ctx.ImageStore.Manifests.GetStoreFileStat(debug.GetRepository(), debug.GetTag())
+	require.NoError(err)
+
+	// The last layer contains the changes of the failed step.
+	r, err := ctx.ImageStore.Layers.GetStoreFileReader(manifest.Layers[1].Digest.Hex())
+	require.NoError(err)
+	gzipReader, err := tario.NewGzipReader(r)
+	require.NoError(err)
+	tarReader := tar.NewReader(gzipReader)
+	var names []string
+	for {
+		hdr, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(err)
+		names = append(names, hdr.Name)
+	}
+	require.Contains(names, "dir/b")
+	require.NotContains(names, "dir/a")
+}
+
+func TestBuildPlanLabels(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	target := image.NewImageName("", "testrepo", "testtag")
+	cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture())
+
+	stages := func() []*dockerfile.Stage {
+		from := dockerfile.FromDirectiveFixture("", "scratch", "")
+		directives := []dockerfile.Directive{
+			dockerfile.LabelDirectiveFixture("", map[string]string{"a": "1", "b": "2"}),
+		}
+		return []*dockerfile.Stage{{From: from, Directives: directives}}
+	}
+
+	plain, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages(), true, false, "", SquashNone)
+	require.NoError(err)
+
+	plan, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages(), true, false, "", SquashNone)
+	require.NoError(err)
+	plan.SetLabels(map[string]string{"b": "3", "c": "4"})
+
+	// Labels don't change cache IDs.
+	for i, node := range plan.stages[0].nodes {
+		require.Equal(plain.stages[0].nodes[i].CacheID(), node.CacheID())
+	}
+
+	manifest, err := plan.Execute()
+	require.NoError(err)
+
+	r, err := ctx.ImageStore.Layers.GetStoreFileReader(manifest.Config.Digest.Hex())
+	require.NoError(err)
+	b, err := ioutil.ReadAll(r)
+	require.NoError(err)
+	var config image.Config
+	require.NoError(json.Unmarshal(b, &config))
+	require.Equal(map[string]string{"a": "1", "b": "3", "c": "4"}, config.Config.Labels)
+	last := config.History[len(config.History)-1]
+	require.Equal("/bin/sh -c #(nop)  LABEL b=3 c=4", last.CreatedBy)
+	require.True(last.EmptyLayer)
+}
@@ -22,6 +22,8 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/uber/makisu/lib/builder/step"
@@ -31,6 +33,7 @@ import (
 	"github.com/uber/makisu/lib/log"
 	"github.com/uber/makisu/lib/parser/dockerfile"
 	"github.com/uber/makisu/lib/storage"
+	"github.com/uber/makisu/lib/utils"
 )
 
 type buildStageOptions struct {
@@ -50,6 +53,14 @@ type buildStage struct {
 	nodes           []*buildNode
 	lastImageConfig *image.Config
 
+	// duration is the time spent building the stage.
+	duration time.Duration
+
+	// squashedLayer replaces the layers of the stage after the first
+	// squashBase ones, if the stage was squashed.
+	squashedLayer *image.DigestPair
+	squashBase    int
+
 	opts *buildStageOptions
 }
 
@@ -59,11 +70,11 @@ func newBuildStage(
 	planOpts *buildPlanOptions) (*buildStage, error) {
 
 	// Create a new build context for the stage.
-	ctx, err := context.NewBuildContext(
-		baseCtx.RootDir, baseCtx.ContextDir, baseCtx.ImageStore)
+	ctx, err := newStageContext(baseCtx, alias)
 	if err != nil {
-		return nil, fmt.Errorf("create stage build context: %s", err)
+		return nil, err
 	}
+	ctx.RunOptions = baseCtx.RunOptions
 
 	// Create steps from parsed stage.
 	steps, err := createDockerfileSteps(ctx, seed, parsedStage, planOpts)
@@ -74,16 +85,36 @@ func newBuildStage(
 	return newBuildStageHelper(ctx, alias, steps, planOpts)
 }
 
+// newStageContext creates the build context of the stage with the given alias,
+// with the settings of the base context shared by all stages.
+func newStageContext(baseCtx *context.BuildContext, alias string) (*context.BuildContext, error) {
+	ctx, err := context.NewBuildContextWithBlacklist(
+		baseCtx.RootDir, baseCtx.ContextDir, baseCtx.ImageStore, baseCtx.Blacklist)
+	if err != nil {
+		return nil, fmt.Errorf("create stage build context: %s", err)
+	}
+	ctx.Stage = alias
+	ctx.Platform = baseCtx.Platform
+	ctx.ImageLock = baseCtx.ImageLock
+	ctx.RegistryConfig = baseCtx.RegistryConfig
+	ctx.Events = baseCtx.Events
+	ctx.TransferStats = baseCtx.TransferStats
+	ctx.ManifestMediaType = baseCtx.ManifestMediaType
+	ctx.SetTarConfig(baseCtx.TarConfig)
+	ctx.SetFullScan(baseCtx.FullScan)
+	ctx.MemFS.SetChroot(baseCtx.RunOptions.Chroot != "")
+	return ctx, nil
+}
+
 // newRemoteImageStage initializes a buildStage used for `COPY --from=<image>`.
 func newRemoteImageStage(
 	baseCtx *context.BuildContext, alias, seed string,
 	planOpts *buildPlanOptions) (*buildStage, error) {
 
 	// Create a new build context for the stage.
-	ctx, err := context.NewBuildContext(
-		baseCtx.RootDir, baseCtx.ContextDir, baseCtx.ImageStore)
+	ctx, err := newStageContext(baseCtx, alias)
 	if err != nil {
-		return nil, fmt.Errorf("create stage build context: %s", err)
+		return nil, err
 	}
 
 	// Create from step.
@@ -117,7 +148,7 @@ func newBuildStageHelper(
 	nodes := make([]*buildNode, 0)
 	copyFromDirs := make(map[string][]string)
 	for _, step := range steps {
-		newNode := newBuildNode(ctx, step)
+		newNode := newBuildNode(ctx, alias, step)
 		nodes = append(nodes, newNode)
 
 		// Add context dirs for cross-stage copy, if any.
@@ -169,7 +200,9 @@ func createDockerfileSteps(
 // build performs the build for that stage. There are side effects that should
 // be expected on each node within the stage.
 func (stage *buildStage) build(cacheMgr cache.Manager, lastStage, copiedFrom bool) error {
-	var err error
+	start := time.Now()
+	defer func() { stage.duration = time.Since(start) }()
+
 	diffIDs := make([]image.Digest, 0)
 	histories := make([]image.History, 0)
 	for i, node := range stage.nodes {
@@ -189,33 +222,156 @@ func (stage *buildStage) build(cacheMgr cache.Manager, lastStage, copiedFrom boo
 		}
 
 		log.Infof("* Step %d/%d (%s) : %s", i+1, len(stage.nodes), nodeOpts.String(), node.String())
-		stage.lastImageConfig, err = node.Build(cacheMgr, stage.lastImageConfig, nodeOpts)
+		// Keep the config of the last successful step, for debugging.
+		config, err := node.Build(cacheMgr, stage.lastImageConfig, nodeOpts)
 		if err != nil {
 			return fmt.Errorf("build node: %s", err)
 		}
+		stage.lastImageConfig = config
 
 		// Update diff IDs and history information.
 		for _, digestPair := range node.digestPairs {
 			diffIDs = append(diffIDs, digestPair.TarDigest)
-			histories = append(histories, image.History{
-				Created:   time.Now(),
-				CreatedBy: fmt.Sprintf("makisu: %s", node.String()),
-				Author:    "makisu",
-			})
 		}
+		histories = appendHistory(histories, node, config, i == 0)
 	}
-	stage.lastImageConfig.Created = time.Now()
+	stage.lastImageConfig.Created = stage.ctx.TarConfig.Now()
 	stage.lastImageConfig.History = histories
 	stage.lastImageConfig.RootFS.DiffIDs = diffIDs
 	stage.lastImageConfig.ContainerConfiguration = nil
 	return nil
 }
 
+// appendHistory appends the history entries of the node: one for each layer it
+// produced, or an empty layer one if it produced none. The entries of the FROM
+// node are inherited from the config of the base image, if they match its
+// layers.
+func appendHistory(
+	histories []image.History, node *buildNode, config *image.Config, from bool) []image.History {
+
+	if from {
+		var layers int
+		for _, h := range config.History {
+			if !h.EmptyLayer {
+				layers++
+			}
+		}
+		if layers == len(node.digestPairs) {
+			return append(histories, config.History...)
+		}
+	}
+	if len(node.digestPairs) == 0 {
+		return append(histories, image.History{
+			Created:    node.ctx.TarConfig.Now(),
+			CreatedBy:  node.CreatedBy(),
+			Author:     "makisu",
+			EmptyLayer: true,
+		})
+	}
+	for range node.digestPairs {
+		histories = append(histories, image.History{
+			Created:   node.ctx.TarConfig.Now(),
+			CreatedBy: node.CreatedBy(),
+			Author:    "makisu",
+		})
+	}
+	return histories
+}
+
+// squash replaces the layers produced by the stage with a single layer, and
+// marks the history entries of the replaced layers as empty. Layers of the base
+// image are kept, unless all is true.
+// Files of the stage must have been written to disk.
+func (stage *buildStage) squash(all bool) error {
+	var base int
+	if !all {
+		base = len(stage.nodes[0].digestPairs)
+	}
+	config := stage.lastImageConfig
+	count := len(config.RootFS.DiffIDs) - base
+	if count < 2 {
+		log.Infof("* Skipping squash of stage %s; %d layer(s) to squash", stage.alias, count)
+		return nil
+	}
+
+	log.Infof("* Squashing %d layers of stage %s", count, stage.alias)
+	digestPairs, err := step.CommitSquashedLayer(stage.ctx, base)
+	if err != nil {
+		return fmt.Errorf("commit squashed layer: %s", err)
+	}
+	stage.squashedLayer = digestPairs[0]
+	stage.squashBase = base
+
+	// Histories of non empty layers are in the same order as the diff IDs.
+	var layers int
+	for i := range config.History {
+		if config.History[i].EmptyLayer {
+			continue
+		}
+		if layers >= base {
+			config.History[i].EmptyLayer = true
+		}
+		layers++
+	}
+	config.History = append(config.History, image.History{
+		Created:   stage.ctx.TarConfig.Now(),
+		CreatedBy: fmt.Sprintf("makisu: squash %d layers", count),
+		Author:    "makisu",
+	})
+	config.RootFS.DiffIDs = append(
+		config.RootFS.DiffIDs[:base], stage.squashedLayer.TarDigest)
+	log.Infof("* Committed squashed layer %s (%d bytes)",
+		stage.squashedLayer.GzipDescriptor.Digest, stage.squashedLayer.GzipDescriptor.Size)
+	return nil
+}
+
+// addLabels sets labels on the image config produced by the stage, overriding
+// the ones set by LABEL directives. Layers and cache IDs of steps are unchanged.
+func (stage *buildStage) addLabels(labels map[string]string) {
+	if len(labels) == 0 {
+		return
+	}
+	config := stage.lastImageConfig
+	config.Config.Labels = utils.MergeStringMaps(config.Config.Labels, labels)
+
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", k, v))
+	}
+	sort.Strings(pairs)
+	config.History = append(config.History, image.History{
+		Created:    stage.ctx.TarConfig.Now(),
+		CreatedBy:  fmt.Sprintf("/bin/sh -c #(nop)  LABEL %s", strings.Join(pairs, " ")),
+		Author:     "makisu",
+		EmptyLayer: true,
+	})
+}
+
 // GetDistributionManifest returns the distribution manifest produced at the end of the stage.
 func (stage *buildStage) GetDistributionManifest(
 	store *storage.ImageStore) (*image.DistributionManifest, error) {
 
-	imageConfigJSON, err := json.Marshal(stage.lastImageConfig)
+	descriptors := []image.Descriptor{}
+	for _, node := range stage.nodes {
+		for _, digestPair := range node.digestPairs {
+			descriptors = append(descriptors, digestPair.GzipDescriptor)
+		}
+	}
+
+	if stage.squashedLayer != nil {
+		descriptors = append(
+			descriptors[:stage.squashBase], stage.squashedLayer.GzipDescriptor)
+	}
+	return stage.newManifest(store, stage.lastImageConfig, descriptors)
+}
+
+// newManifest commits the image config to the store, and returns the
+// distribution manifest of the image made of the config and layers.
+func (stage *buildStage) newManifest(
+	store *storage.ImageStore, config *image.Config,
+	layers []image.Descriptor) (*image.DistributionManifest, error) {
+
+	imageConfigJSON, err := json.Marshal(config)
 	if err != nil {
 		return nil, fmt.Errorf("marshal image config: %s", err)
 	}
@@ -238,27 +394,16 @@ func (stage *buildStage) GetDistributionManifest(
 		return nil, fmt.Errorf("get image config file stat: %s", err)
 	}
 
-	// Save the manifest at the last node to a temp file, then move into store.
-	distributionManifest := image.DistributionManifest{
-		SchemaVersion: 2,
-		MediaType:     image.MediaTypeManifest,
+	configDescriptor := image.Descriptor{
+		Size:   imageConfigStat.Size(),
+		Digest: image.Digest("sha256:" + imageConfigSHA256),
 	}
-
-	distributionManifest.Config = image.Descriptor{
-		MediaType: image.MediaTypeConfig,
-		Size:      imageConfigStat.Size(),
-		Digest:    image.Digest("sha256:" + imageConfigSHA256),
-	}
-
-	descriptors := []image.Descriptor{}
-	for _, node := range stage.nodes {
-		for _, digestPair := range node.digestPairs {
-			descriptors = append(descriptors, digestPair.GzipDescriptor)
-		}
+	distributionManifest, err := image.NewDistributionManifest(
+		stage.ctx.ManifestMediaType, configDescriptor, layers)
+	if err != nil {
+		return nil, fmt.Errorf("create distribution manifest: %s", err)
 	}
-
-	distributionManifest.Layers = descriptors
-	return &distributionManifest, nil
+	return distributionManifest, nil
 }
 
 // saveManifest saves the image produced at the end of this stage.
@@ -269,13 +414,24 @@ func (stage *buildStage) saveManifest(
 	if err != nil {
 		return nil, fmt.Errorf("get distribution manifest: %s", err)
 	}
+	if err := stage.storeManifest(store, imageName, manifest); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// storeManifest saves the manifest in the store under the given image name.
+func (stage *buildStage) storeManifest(
+	store *storage.ImageStore, imageName image.Name,
+	manifest *image.DistributionManifest) error {
+
 	manifestJSON, err := json.Marshal(manifest)
 	if err != nil {
-		return nil, fmt.Errorf("marshal manifest: %s", err)
+		return fmt.Errorf("marshal manifest: %s", err)
 	}
 	manifestFile, err := ioutil.TempFile(stage.ctx.ImageStore.SandboxDir, "")
 	if err != nil {
-		return nil, fmt.Errorf("tmp manifest file: %s", err)
+		return fmt.Errorf("tmp manifest file: %s", err)
 	}
 
 	manifestPath := manifestFile.Name()
@@ -283,13 +439,77 @@ func (stage *buildStage) saveManifest(
 	defer os.Remove(manifestPath)
 
 	if err := ioutil.WriteFile(manifestPath, manifestJSON, 0755); err != nil {
-		return nil, fmt.Errorf("write manifest file: %s", err)
+		return fmt.Errorf("write manifest file: %s", err)
 	}
 
 	if err := store.Manifests.LinkStoreFileFrom(
 		imageName.GetRepository(), imageName.GetTag(), manifestPath); err != nil {
 
-		return nil, fmt.Errorf("commit manifest to store: %s", err)
+		return fmt.Errorf("commit manifest to store: %s", err)
+	}
+	return nil
+}
+
+// saveDebugImage saves an image of the state of the stage when one of its
+// steps failed: the layers committed before the failed step, plus a layer
+// with the changes made since then, including the ones of the failed step.
+// If onDisk is true, these changes are found by scanning the file system.
+func (stage *buildStage) saveDebugImage(
+	store *storage.ImageStore, imageName image.Name,
+	onDisk bool) (*image.DistributionManifest, error) {
+
+	failed := -1
+	for i, node := range stage.nodes {
+		if node.err != nil {
+			failed = i
+			break
+		}
+	}
+	if failed == -1 {
+		return nil, fmt.Errorf("no failed step in stage %s", stage.alias)
+	} else if stage.lastImageConfig == nil {
+		return nil, fmt.Errorf("no image config before failed step %s", stage.nodes[failed])
+	}
+
+	config, err := image.NewImageConfigFromCopy(stage.lastImageConfig)
+	if err != nil {
+		return nil, fmt.Errorf("copy image config: %s", err)
+	}
+	// The config of the last successful step still has the history of the
+	// base image, since it is only replaced at the end of the stage.
+	config.History = nil
+	config.RootFS.DiffIDs = nil
+	var layers []image.Descriptor
+	for i, node := range stage.nodes[:failed] {
+		for _, digestPair := range node.digestPairs {
+			layers = append(layers, digestPair.GzipDescriptor)
+			config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, digestPair.TarDigest)
+		}
+		config.History = appendHistory(config.History, node, stage.lastImageConfig, i == 0)
+	}
+
+	digestPairs, err := step.CommitDebugLayer(stage.ctx, onDisk)
+	if err != nil {
+		return nil, fmt.Errorf("commit debug layer: %s", err)
+	}
+	for _, digestPair := range digestPairs {
+		layers = append(layers, digestPair.GzipDescriptor)
+		config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, digestPair.TarDigest)
+		config.History = append(config.History, image.History{
+			Created:   stage.ctx.TarConfig.Now(),
+			CreatedBy: fmt.Sprintf("makisu: failed %s", stage.nodes[failed].CreatedBy()),
+			Author:    "makisu",
+		})
+	}
+	config.Created = stage.ctx.TarConfig.Now()
+	config.ContainerConfiguration = nil
+
+	manifest, err := stage.newManifest(store, config, layers)
+	if err != nil {
+		return nil, fmt.Errorf("get distribution manifest: %s", err)
+	}
+	if err := stage.storeManifest(store, imageName, manifest); err != nil {
+		return nil, err
 	}
 	return manifest, nil
 }
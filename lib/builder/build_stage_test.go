@@ -17,6 +17,7 @@ package builder
 import (
 	"testing"
 
+	"github.com/uber/makisu/lib/builder/step"
 	"github.com/uber/makisu/lib/cache"
 	"github.com/uber/makisu/lib/cache/keyvalue"
 	"github.com/uber/makisu/lib/context"
@@ -148,3 +149,61 @@ func TestPullCacheLayers(t *testing.T) {
 		})
 	}
 }
+
+func TestAppendHistory(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	from, err := step.NewFromStep("", "alpine", "")
+	require.NoError(err)
+	fromNode := newBuildNode(ctx, "", from)
+	fromNode.digestPairs = []*image.DigestPair{_testDigestPair}
+	base := &image.Config{History: []image.History{
+		{CreatedBy: "/bin/sh -c #(nop) ADD file:5dde1d6e in / "},
+		{CreatedBy: "/bin/sh -c #(nop)  CMD [\"sh\"]", EmptyLayer: true},
+	}}
+
+	// Entries of the base image are inherited.
+	histories := appendHistory(nil, fromNode, base, true)
+	require.Equal(base.History, histories)
+
+	// Unless they don't match its layers.
+	fromNode.digestPairs = append(fromNode.digestPairs, _testDigestPair)
+	require.Len(appendHistory(nil, fromNode, base, true), 2)
+	require.Equal("/bin/sh -c #(nop)  FROM index.docker.io/library/alpine:latest", appendHistory(nil, fromNode, base, true)[0].CreatedBy)
+
+	env := newBuildNode(ctx, "", step.NewEnvStep("A=b", map[string]string{"A": "b"}, false))
+	histories = appendHistory(histories, env, base, false)
+	require.Len(histories, 3)
+	require.Equal("/bin/sh -c #(nop)  ENV A=b", histories[2].CreatedBy)
+	require.True(histories[2].EmptyLayer)
+
+	run := newBuildNode(ctx, "", step.NewRunStep("", "echo hi", "", 0, true))
+	run.digestPairs = []*image.DigestPair{_testDigestPair}
+	histories = appendHistory(histories, run, base, false)
+	require.Len(histories, 4)
+	require.Equal("/bin/sh -c echo hi", histories[3].CreatedBy)
+	require.False(histories[3].EmptyLayer)
+
+	copy, err := step.NewCopyStep("a /b", "", "", []string{"a"}, "/b", false, false)
+	require.NoError(err)
+	require.Equal("/bin/sh -c #(nop) COPY a /b", copy.CreatedBy())
+}
+
+func TestNewStageContext(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+	ctx.SetFullScan(true)
+	ctx.TransferStats = registry.NewTransferStats()
+
+	stageCtx, err := newStageContext(ctx, "stage1")
+	require.NoError(err)
+	require.Equal("stage1", stageCtx.Stage)
+	require.True(stageCtx.FullScan)
+	require.Equal(ctx.TransferStats, stageCtx.TransferStats)
+	require.Equal(ctx.ManifestMediaType, stageCtx.ManifestMediaType)
+}
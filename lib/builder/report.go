@@ -0,0 +1,154 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/registry"
+)
+
+// CacheStatus describes how the distributed cache was used by a step.
+type CacheStatus string
+
+const (
+	// CacheHit means the layer of the step was fetched from cache.
+	CacheHit = CacheStatus("hit")
+	// CacheMiss means the step was executed and its result pushed to cache.
+	CacheMiss = CacheStatus("miss")
+	// CacheSkipped means cache wasn't used for the step, either because it
+	// doesn't commit or because a later step was cached.
+	CacheSkipped = CacheStatus("skipped")
+)
+
+// BuildReport is a machine-readable summary of a build.
+type BuildReport struct {
+	Target    string        `json:"target"`
+	Succeeded bool          `json:"succeeded"`
+	Error     string        `json:"error,omitempty"`
+	Duration  time.Duration `json:"duration"`
+
+	// FailedStep is the string representation of the step that failed, if any.
+	FailedStep string `json:"failed_step,omitempty"`
+
+	Stages []*StageReport `json:"stages"`
+
+	// Registries contains the number of bytes transferred with each registry.
+	Registries map[string]registry.Transfer `json:"registries"`
+
+	ManifestDigest image.Digest `json:"manifest_digest,omitempty"`
+	TotalImageSize int64        `json:"total_image_size"`
+}
+
+// StageReport summarizes the build of one stage.
+type StageReport struct {
+	Alias    string        `json:"alias"`
+	Duration time.Duration `json:"duration"`
+	Steps    []*StepReport `json:"steps"`
+}
+
+// StepReport summarizes the build of one step.
+type StepReport struct {
+	Step     string         `json:"step"`
+	CacheID  string         `json:"cache_id"`
+	Cache    CacheStatus    `json:"cache"`
+	Duration time.Duration  `json:"duration"`
+	Layers   []*LayerReport `json:"layers,omitempty"`
+	Error    string         `json:"error,omitempty"`
+
+	// TimedOut is true if the step failed because its command timed out.
+	TimedOut bool `json:"timed_out,omitempty"`
+}
+
+// LayerReport describes a layer committed or fetched by a step.
+type LayerReport struct {
+	Digest    image.Digest `json:"digest"`
+	TarDigest image.Digest `json:"tar_digest"`
+	Size      int64        `json:"size"`
+}
+
+// Report returns a summary of the build plan execution so far. It can be
+// called whether the execution succeeded or not.
+func (plan *BuildPlan) Report() *BuildReport {
+	report := &BuildReport{
+		Target:         plan.target.String(),
+		Stages:         make([]*StageReport, 0, len(plan.stages)),
+		Registries:     plan.transferStats().Snapshot(),
+		ManifestDigest: plan.manifestDigest,
+	}
+	for _, stage := range plan.stages {
+		stageReport := &StageReport{
+			Alias:    stage.alias,
+			Duration: stage.duration,
+			Steps:    make([]*StepReport, 0, len(stage.nodes)),
+		}
+		for _, node := range stage.nodes {
+			stepReport := &StepReport{
+				Step:     node.String(),
+				CacheID:  node.CacheID(),
+				Cache:    node.cacheStatus,
+				Duration: node.duration,
+			}
+			if stepReport.Cache == "" {
+				stepReport.Cache = CacheSkipped
+			}
+			for _, pair := range node.digestPairs {
+				stepReport.Layers = append(stepReport.Layers, &LayerReport{
+					Digest:    pair.GzipDescriptor.Digest,
+					TarDigest: pair.TarDigest,
+					Size:      pair.GzipDescriptor.Size,
+				})
+			}
+			if node.err != nil {
+				stepReport.Error = node.err.Error()
+				stepReport.TimedOut = node.timedOut
+				report.FailedStep = node.String()
+			}
+			stageReport.Steps = append(stageReport.Steps, stepReport)
+		}
+		report.Stages = append(report.Stages, stageReport)
+	}
+	if plan.manifest != nil {
+		for _, layer := range plan.manifest.Layers {
+			report.TotalImageSize += layer.Size
+		}
+	}
+	return report
+}
+
+// transferStats returns the stats recording the bytes transferred with
+// registries by the build.
+func (plan *BuildPlan) transferStats() *registry.TransferStats {
+	if plan.baseCtx.TransferStats == nil {
+		return registry.DefaultTransferStats
+	}
+	return plan.baseCtx.TransferStats
+}
+
+// WriteReport writes the report to the given path in json format.
+func WriteReport(report *BuildReport, path string) error {
+	content, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal report: %s", err)
+	}
+	if err := ioutil.WriteFile(path, content, 0644); err != nil {
+		return fmt.Errorf("write report to %s: %s", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/uber/makisu/lib/cache"
+	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/parser/dockerfile"
+	"github.com/uber/makisu/lib/registry"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildPlanReport(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	target := image.NewImageName("", "testrepo", "testtag")
+	cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture())
+
+	from := dockerfile.FromDirectiveFixture("", "scratch", "")
+	directives := []dockerfile.Directive{
+		dockerfile.EnvDirectiveFixture("TESTENV=test", map[string]string{"TESTENV": "test"}),
+		dockerfile.RunCommitDirectiveFixture("ls .", "ls ."),
+	}
+	stages := []*dockerfile.Stage{{From: from, Directives: directives}}
+
+	plan, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, false, "", SquashNone)
+	require.NoError(err)
+	manifest, err := plan.Execute()
+	require.NoError(err)
+
+	report := plan.Report()
+	require.Equal(target.String(), report.Target)
+	require.Len(report.Stages, 1)
+	require.Len(report.Stages[0].Steps, 3)
+	require.Empty(report.FailedStep)
+
+	run := report.Stages[0].Steps[2]
+	require.Equal(CacheMiss, run.Cache)
+	require.Equal(plan.stages[0].nodes[2].CacheID(), run.CacheID)
+	require.Len(run.Layers, 1)
+	require.Equal(manifest.Layers[0].Digest, run.Layers[0].Digest)
+	require.Equal(CacheSkipped, report.Stages[0].Steps[1].Cache)
+
+	var size int64
+	for _, layer := range manifest.Layers {
+		size += layer.Size
+	}
+	require.Equal(size, report.TotalImageSize)
+	require.NotEmpty(report.ManifestDigest)
+
+	path := filepath.Join(ctx.ImageStore.SandboxDir, "report.json")
+	require.NoError(WriteReport(report, path))
+	content, err := ioutil.ReadFile(path)
+	require.NoError(err)
+	var decoded BuildReport
+	require.NoError(json.Unmarshal(content, &decoded))
+	require.Equal(report.ManifestDigest, decoded.ManifestDigest)
+}
+
+func TestBuildPlanReportOnFailure(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	target := image.NewImageName("", "testrepo", "testtag")
+	cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture())
+
+	from := dockerfile.FromDirectiveFixture("", "scratch", "")
+	directives := []dockerfile.Directive{
+		dockerfile.RunCommitDirectiveFixture("false", "false"),
+	}
+	stages := []*dockerfile.Stage{{From: from, Directives: directives}}
+
+	plan, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, false, "", SquashNone)
+	require.NoError(err)
+	_, err = plan.Execute()
+	require.Error(err)
+
+	report := plan.Report()
+	require.Equal(plan.stages[0].nodes[1].String(), report.FailedStep)
+	require.NotEmpty(report.Stages[0].Steps[1].Error)
+	require.False(report.Stages[0].Steps[1].TimedOut)
+	require.Empty(report.ManifestDigest)
+}
+
+func TestBuildPlanReportOnTimeout(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+	ctx.RunOptions.Timeout = 100 * time.Millisecond
+
+	target := image.NewImageName("", "testrepo", "testtag")
+	cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture())
+
+	from := dockerfile.FromDirectiveFixture("", "scratch", "")
+	directives := []dockerfile.Directive{
+		dockerfile.RunCommitDirectiveFixture("sleep 10", "sleep 10"),
+	}
+	stages := []*dockerfile.Stage{{From: from, Directives: directives}}
+
+	plan, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, false, "", SquashNone)
+	require.NoError(err)
+	_, err = plan.Execute()
+	require.Error(err)
+
+	report := plan.Report()
+	require.Equal(plan.stages[0].nodes[1].String(), report.FailedStep)
+	require.True(report.Stages[0].Steps[1].TimedOut)
+}
@@ -16,12 +16,12 @@ package step
 
 import (
 	"fmt"
-	"hash/crc32"
 	"io"
 	"os"
 	"path/filepath"
 	"strings"
 
+	"github.com/uber/makisu/lib/cache"
 	"github.com/uber/makisu/lib/context"
 	"github.com/uber/makisu/lib/pathutils"
 	"github.com/uber/makisu/lib/snapshot"
@@ -83,10 +83,6 @@ func newAddCopyStep(
 	}, nil
 }
 
-// RequireOnDisk returns true if the add/copy has a chown argument, as we need
-// to read the users file to translate user/group name to uid/gid.
-func (s *addCopyStep) RequireOnDisk() bool { return s.chown != "" }
-
 // ContextDirs returns the stage and directories that a 'COPY --from=<stage>' depends on.
 func (s *addCopyStep) ContextDirs() (string, []string) {
 	if s.fromStage == "" {
@@ -95,13 +91,19 @@ func (s *addCopyStep) ContextDirs() (string, []string) {
 	return s.fromStage, s.fromPaths
 }
 
+// CreatedBy returns the description of the step in the history of the image.
+// Docker formats ADD and COPY with a single space after "#(nop)".
+func (s *addCopyStep) CreatedBy() string {
+	return fmt.Sprintf("/bin/sh -c #(nop) %s %s", s.directive, s.args)
+}
+
 // SetCacheID sets the cache ID of the step given a seed SHA256 value.
 // Calculates the ID based on content of files. If the previous steps, current
 // step args and the contents of sources are identical, cache ID should also be
 // identical.
 func (s *addCopyStep) SetCacheID(ctx *context.BuildContext, seed string) error {
 	// Initialize the checksum with the seed, directive and args.
-	checksum := crc32.NewIEEE()
+	checksum := cache.NewIDHasher()
 	_, err := checksum.Write([]byte(seed + string(s.directive) + s.args))
 	if err != nil {
 		return fmt.Errorf("hash copy directive: %s", err)
@@ -116,7 +118,7 @@ func (s *addCopyStep) SetCacheID(ctx *context.BuildContext, seed string) error {
 			return fmt.Errorf("hash context sources: %s", err)
 		}
 	}
-	s.cacheID = fmt.Sprintf("%x", checksum.Sum32())
+	s.cacheID = cache.IDFromHasher(checksum)
 
 	return nil
 }
@@ -134,21 +136,43 @@ func (s *addCopyStep) Execute(ctx *context.BuildContext, modifyFS bool) (err err
 		}
 	}
 
+	chown, err := s.resolveChown(ctx)
+	if err != nil {
+		return fmt.Errorf("resolve chown: %s", err)
+	}
+
 	internal := s.fromStage != ""
-	blacklist := append(pathutils.DefaultBlacklist, ctx.ImageStore.RootDir)
+	blacklist := append(append([]string{}, ctx.Blacklist...), ctx.ImageStore.RootDir)
 	copyOp, err := snapshot.NewCopyOperation(
-		relPaths, sourceRoot, s.workingDir, s.toPath, s.chown, blacklist, internal, s.preserveOwner)
+		relPaths, sourceRoot, s.workingDir, s.toPath, chown, blacklist, internal, s.preserveOwner)
 	if err != nil {
 		return fmt.Errorf("invalid copy operation: %s", err)
 	}
 
 	ctx.CopyOps = append(ctx.CopyOps, copyOp)
 	if modifyFS {
-		return copyOp.Execute()
+		return copyOp.ExecuteInRoot(ctx.RootDir)
 	}
 	return nil
 }
 
+// resolveChown translates user and group names of the chown argument to
+// numeric ids, using the accounts of the image rather than the host's.
+func (s *addCopyStep) resolveChown(ctx *context.BuildContext) (string, error) {
+	if s.chown == "" {
+		return "", nil
+	}
+	accounts, err := ctx.Accounts()
+	if err != nil {
+		return "", fmt.Errorf("read accounts: %s", err)
+	}
+	uid, gid, err := accounts.ResolveChown(s.chown)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d:%d", uid, gid), nil
+}
+
 // Updates the checksum passed in based on the content of files to be copied in.
 func (s *addCopyStep) calculateContextChecksum(ctx *context.BuildContext, checksum io.Writer) error {
 	if s.fromStage != "" {
@@ -15,8 +15,12 @@
 package step
 
 import (
+	"archive/tar"
+	"bytes"
 	"testing"
 
+	"github.com/uber/makisu/lib/context"
+
 	"github.com/stretchr/testify/require"
 )
 
@@ -54,3 +58,37 @@ func TestTrimmingPaths(t *testing.T) {
 	require.Equal("/from/path", ac.fromPaths[0])
 	require.Equal("/to/path", ac.toPath)
 }
+
+func TestResolveChownFromImage(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	// Merge accounts of the image without writing them to disk.
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	for name, content := range map[string]string{
+		"etc/passwd": "app:x:1000:1000::/home/app:/bin/sh\n",
+		"etc/group":  "app:x:1000:\nstaff:x:50:app\n",
+	} {
+		require.NoError(w.WriteHeader(&tar.Header{
+			Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))}))
+		_, err := w.Write([]byte(content))
+		require.NoError(err)
+	}
+	require.NoError(w.Close())
+	require.NoError(ctx.MemFS.UpdateFromTarReader(tar.NewReader(&buf), false))
+
+	ac, err := newAddCopyStep(Copy, "", "app:staff", "", []string{"src"}, "/dst", false, false)
+	require.NoError(err)
+	require.False(ac.RequireOnDisk())
+	chown, err := ac.resolveChown(ctx)
+	require.NoError(err)
+	require.Equal("1000:50", chown)
+
+	ac, err = newAddCopyStep(Copy, "", "nobody", "", []string{"src"}, "/dst", false, false)
+	require.NoError(err)
+	_, err = ac.resolveChown(ctx)
+	require.Error(err)
+}
@@ -16,10 +16,11 @@ package step
 
 import (
 	"fmt"
-	"hash/crc32"
 	"os"
+	"path/filepath"
 	"strconv"
 
+	"github.com/uber/makisu/lib/cache"
 	"github.com/uber/makisu/lib/context"
 	"github.com/uber/makisu/lib/docker/image"
 )
@@ -31,6 +32,9 @@ type baseStep struct {
 	workingDir string
 	cacheID    string
 	commit     bool
+
+	// env contains the resolved ARG and ENV values of the stage.
+	env map[string]string
 }
 
 // newBaseStep returns a new baseStep. baseStep is not sufficient to implement
@@ -57,12 +61,17 @@ func (s *baseStep) String() string {
 	return fmt.Sprintf("%s %s %s (%s)", s.directive, s.args, commitStr, s.cacheID)
 }
 
+// CreatedBy returns the description of the step in the history of the image.
+// Like docker, steps that don't run commands are marked with "#(nop)".
+func (s *baseStep) CreatedBy() string {
+	return fmt.Sprintf("/bin/sh -c #(nop)  %s %s", s.directive, s.args)
+}
+
 // SetCacheID sets the cache ID of the step given a seed SHA256 value.
 // Special steps like FROM, ADD, COPY have their own implementations.
 func (s *baseStep) SetCacheID(ctx *context.BuildContext, seed string) error {
 	commitStr := fmt.Sprintf("%v", s.commit)
-	checksum := crc32.ChecksumIEEE([]byte(seed + string(s.directive) + s.args + commitStr))
-	s.cacheID = fmt.Sprintf("%x", checksum)
+	s.cacheID = cache.ComputeID(seed + string(s.directive) + s.args + commitStr)
 	return nil
 }
 
@@ -70,50 +79,61 @@ func (s *baseStep) SetCacheID(ctx *context.BuildContext, seed string) error {
 // Exporting the logic to this method allows overwriting `ApplyCtxAndConfig`.
 func (s *baseStep) SetWorkingDir(
 	ctx *context.BuildContext, imageConfig *image.Config) error {
-	s.workingDir = ctx.RootDir // Default workingDir to root.
+	s.workingDir = "/" // Default workingDir to root.
 
 	// Set working dir from imageConfig.
 	if imageConfig != nil && imageConfig.Config.WorkingDir != "" {
-		s.workingDir = os.ExpandEnv(imageConfig.Config.WorkingDir)
+		s.workingDir = s.expandEnv(imageConfig.Config.WorkingDir)
 	}
 
-	// Create working dir if it does not exist.
-	if _, err := os.Lstat(s.workingDir); err != nil {
+	// Create working dir under the root dir if it does not exist.
+	dir := filepath.Join(ctx.RootDir, s.workingDir)
+	if _, err := os.Lstat(dir); err != nil {
 		if os.IsNotExist(err) {
-			if err := os.MkdirAll(s.workingDir, 0755); err != nil {
-				return fmt.Errorf("mkdir all working dir %s: %s", s.workingDir, err)
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return fmt.Errorf("mkdir all working dir %s: %s", dir, err)
 			}
 		} else {
-			return fmt.Errorf("lstat working dir %s: %s", s.workingDir, err)
+			return fmt.Errorf("lstat working dir %s: %s", dir, err)
 		}
 	}
 	return nil
 }
 
-// SetEnvFromContext set environment variables from previous stages
+// SetEnvFromContext resolves the environment of the step from the ARG and ENV
+// values of the stage. The environment of the makisu process is not used nor
+// modified.
 // Exporting the logic to this method allows for an easier `ApplyCtxAndConfig` overwriting
 func (s *baseStep) SetEnvFromContext(
 	ctx *context.BuildContext) error {
+	vars := make(map[string]string, len(ctx.StageVars))
 	for key, value := range ctx.StageVars {
 		unquoted, err := strconv.Unquote(value)
 		if err == nil {
 			value = unquoted
 		}
-		value = os.ExpandEnv(value)
-		if err := os.Setenv(key, value); err != nil {
-			return fmt.Errorf("failed to set env %s=%s: %s", key, value, err)
-		}
+		vars[key] = value
+	}
+	s.env = make(map[string]string, len(vars))
+	for key, value := range vars {
+		s.env[key] = os.Expand(value, func(k string) string { return vars[k] })
 	}
 	return nil
 }
 
+// expandEnv replaces ${var} or $var in the string according to the
+// environment of the step.
+func (s *baseStep) expandEnv(value string) string {
+	return os.Expand(value, func(k string) string { return s.env[k] })
+}
+
 // ApplyCtxAndConfig sets up the execution environment from build context and
 // image config.
 // This function will not be skipped.
 func (s *baseStep) ApplyCtxAndConfig(
 	ctx *context.BuildContext, imageConfig *image.Config) error {
-	s.SetWorkingDir(ctx, imageConfig)
 	s.SetEnvFromContext(ctx)
+	s.SetWorkingDir(ctx, imageConfig)
 	return nil
 }
 
@@ -27,7 +27,6 @@ import (
 	"github.com/uber/makisu/lib/docker/image"
 	"github.com/uber/makisu/lib/snapshot"
 	"github.com/uber/makisu/lib/stream"
-	"github.com/uber/makisu/lib/tario"
 )
 
 // tarAndGzipDiffs tars and gzips files to a temporary location.
@@ -45,7 +44,7 @@ func tarAndGzipDiffs(ctx *context.BuildContext, writeDiffs func(*tar.Writer) err
 	tarDigester = sha256.New()
 
 	gzipMulti := stream.NewConcurrentMultiWriter(tempGzipTar, gzipDigester)
-	gzipper, err := tario.NewGzipWriter(gzipMulti)
+	gzipper, err := ctx.TarConfig.NewGzipWriter(gzipMulti)
 	if err != nil {
 		return nil, nil, "", fmt.Errorf("new gzip writer: %s", err)
 	}
@@ -77,6 +76,38 @@ func commitLayer(ctx *context.BuildContext) ([]*image.DigestPair, error) {
 		return nil, nil
 	}
 
+	digestPairs, err := storeLayer(ctx, writeDiffs)
+	if err != nil {
+		return nil, err
+	}
+	ctx.MustScan = false
+	ctx.CopyOps = make([]*snapshot.CopyOperation, 0)
+	return digestPairs, nil
+}
+
+// CommitDebugLayer commits a layer with the changes of the build context that
+// haven't been committed yet, including the ones of a step that failed. If
+// onDisk is true, changes are found by scanning the file system.
+func CommitDebugLayer(ctx *context.BuildContext, onDisk bool) ([]*image.DigestPair, error) {
+	if onDisk {
+		ctx.MustScan = true
+	}
+	return commitLayer(ctx)
+}
+
+// CommitSquashedLayer commits a single layer that replaces all the layers of
+// the build context's MemFS after the first base ones.
+func CommitSquashedLayer(ctx *context.BuildContext, base int) ([]*image.DigestPair, error) {
+	return storeLayer(ctx, func(w *tar.Writer) error {
+		return ctx.MemFS.AddSquashedLayer(base, w)
+	})
+}
+
+// storeLayer writes diffs to a gzipped layer tar, and moves it into the layer
+// store.
+func storeLayer(ctx *context.BuildContext, writeDiffs func(w *tar.Writer) error) (
+	[]*image.DigestPair, error) {
+
 	gzipTarDigester, tarDigester, tempFileName, err := tarAndGzipDiffs(ctx, writeDiffs)
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate diff layer: %s", err)
@@ -100,8 +131,6 @@ func commitLayer(ctx *context.BuildContext) ([]*image.DigestPair, error) {
 		Size:      info.Size(),
 		Digest:    image.Digest("sha256:" + gzipTarSHA256),
 	}
-	ctx.MustScan = false
-	ctx.CopyOps = make([]*snapshot.CopyOperation, 0)
 	return []*image.DigestPair{
 		{
 			TarDigest:      layerTarDigest,
@@ -102,7 +102,7 @@ func TestCommitDiffs(t *testing.T) {
 		verifyGzippedTar func(io.Reader)
 	}{
 		{
-			NewRunStep("", "touch file1 && touch file2", true),
+			NewRunStep("", "touch file1 && touch file2", "", 0, true),
 			func(f io.Reader) {
 				files := readGzippedTar(t, f)
 				require.Equal(2, len(files))
@@ -111,7 +111,7 @@ func TestCommitDiffs(t *testing.T) {
 			},
 		},
 		{
-			NewRunStep("", "mkdir dir1 && rm file1", true),
+			NewRunStep("", "mkdir dir1 && rm file1", "", 0, true),
 			func(f io.Reader) {
 				files := readGzippedTar(t, f)
 				require.Equal(2, len(files))
@@ -120,7 +120,7 @@ func TestCommitDiffs(t *testing.T) {
 			},
 		},
 		{
-			NewRunStep("", "rm -rf dir1", true),
+			NewRunStep("", "rm -rf dir1", "", 0, true),
 			func(f io.Reader) {
 				files := readGzippedTar(t, f)
 				require.Equal(1, len(files))
@@ -128,7 +128,7 @@ func TestCommitDiffs(t *testing.T) {
 			},
 		},
 		{
-			NewRunStep("", "ls ./", true),
+			NewRunStep("", "ls ./", "", 0, true),
 			func(f io.Reader) {
 				// Verify no files were tarred, since the command doesn't write to or create any files.
 				files := readGzippedTar(t, f)
@@ -0,0 +1,81 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package step
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/uber/makisu/lib/parser/dockerfile"
+)
+
+// CustomStepConstructor creates the build step of a custom directive.
+type CustomStepConstructor func(d *dockerfile.CustomDirective) (BuildStep, error)
+
+var (
+	customStepsMu sync.RWMutex
+	customSteps   = make(map[string]CustomStepConstructor)
+)
+
+// RegisterDirective adds a custom directive to the ones dockerfiles can use,
+// with the parser of its args and the constructor of its build step.
+// The step takes part in cache IDs, commits and image config updates like
+// built-in steps. It can embed BaseStep to get the default behavior.
+func RegisterDirective(
+	name string, parse dockerfile.CustomDirectiveParser, newStep CustomStepConstructor) error {
+
+	if err := dockerfile.RegisterDirective(name, parse); err != nil {
+		return err
+	}
+
+	customStepsMu.Lock()
+	defer customStepsMu.Unlock()
+
+	customSteps[strings.ToUpper(name)] = newStep
+	return nil
+}
+
+// newCustomStep creates the build step of the given custom directive.
+func newCustomStep(d *dockerfile.CustomDirective) (BuildStep, error) {
+	customStepsMu.RLock()
+	newStep, ok := customSteps[d.Name]
+	customStepsMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("no step registered for directive %s", d.Name)
+	}
+	return newStep(d)
+}
+
+// BaseStep implements the parts of BuildStep shared by most steps. Steps of
+// custom directives can embed it and only implement what they need, usually
+// Execute and UpdateCtxAndConfig.
+type BaseStep struct {
+	*baseStep
+}
+
+// NewBaseStep returns a new BaseStep for the given directive.
+func NewBaseStep(directive Directive, args string, commit bool) *BaseStep {
+	return &BaseStep{newBaseStep(directive, args, commit)}
+}
+
+// WorkingDir returns the working dir of the step, once set by
+// ApplyCtxAndConfig.
+func (s *BaseStep) WorkingDir() string { return s.workingDir }
+
+// ExpandEnv replaces ${var} or $var in the string according to the
+// environment of the step, once set by ApplyCtxAndConfig.
+func (s *BaseStep) ExpandEnv(value string) string { return s.expandEnv(value) }
@@ -0,0 +1,108 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package step
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/parser/dockerfile"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testTouchStep struct {
+	*BaseStep
+
+	path string
+}
+
+func (s *testTouchStep) Execute(ctx *context.BuildContext, modifyFS bool) error {
+	if !modifyFS {
+		return nil
+	}
+	path := filepath.Join(ctx.RootDir, s.ExpandEnv(s.path))
+	if err := ioutil.WriteFile(path, []byte("touched"), 0644); err != nil {
+		return err
+	}
+	ctx.MustScan = true
+	return nil
+}
+
+func (s *testTouchStep) UpdateCtxAndConfig(
+	ctx *context.BuildContext, imageConfig *image.Config) (*image.Config, error) {
+
+	config, err := image.NewImageConfigFromCopy(imageConfig)
+	if err != nil {
+		return nil, err
+	}
+	if config.Config.Labels == nil {
+		config.Config.Labels = make(map[string]string)
+	}
+	config.Config.Labels["touched"] = s.path
+	return config, nil
+}
+
+func TestCustomStep(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	parse := func(args string) (interface{}, error) { return args, nil }
+	newStep := func(d *dockerfile.CustomDirective) (BuildStep, error) {
+		return &testTouchStep{
+			BaseStep: NewBaseStep(Directive(d.Name), d.Args, d.Commit),
+			path:     d.Value.(string),
+		}, nil
+	}
+	require.NoError(RegisterDirective("TEST_TOUCH", parse, newStep))
+	require.Error(RegisterDirective("TEST_TOUCH", parse, newStep))
+
+	stages, err := dockerfile.ParseFile("FROM scratch\nTEST_TOUCH /touched\n", nil)
+	require.NoError(err)
+	step, err := NewDockerfileStep(ctx, stages[0].Directives[0], "")
+	require.NoError(err)
+	require.NoError(step.SetCacheID(ctx, "seed"))
+	require.NotEmpty(step.CacheID())
+
+	config := image.NewDefaultImageConfig()
+	require.NoError(step.ApplyCtxAndConfig(ctx, &config))
+	require.NoError(step.Execute(ctx, true))
+	digestPairs, err := step.Commit(ctx)
+	require.NoError(err)
+	require.Len(digestPairs, 1)
+
+	newConfig, err := step.UpdateCtxAndConfig(ctx, &config)
+	require.NoError(err)
+	require.Equal("/touched", newConfig.Config.Labels["touched"])
+}
+
+func TestCustomStepNotRegistered(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	require.NoError(dockerfile.RegisterDirective(
+		"TEST_UNREGISTERED", func(args string) (interface{}, error) { return args, nil }))
+	stages, err := dockerfile.ParseFile("FROM scratch\nTEST_UNREGISTERED foo\n", nil)
+	require.NoError(err)
+	_, err = NewDockerfileStep(ctx, stages[0].Directives[0], "")
+	require.Error(err)
+}
@@ -16,7 +16,6 @@ package step
 
 import (
 	"fmt"
-	"os"
 
 	"github.com/uber/makisu/lib/context"
 	"github.com/uber/makisu/lib/docker/image"
@@ -43,8 +42,15 @@ func NewEnvStep(args string, envs map[string]string, commit bool) BuildStep {
 func (s *EnvStep) UpdateCtxAndConfig(
 	ctx *context.BuildContext, imageConfig *image.Config) (*image.Config, error) {
 
-	// Update in-memory map of merged stage vars from ARG and ENV.
+	// Values are expanded against the previous environment, so that values
+	// referencing themselves, like PATH=/opt/bin:$PATH, are resolved once.
+	expandedEnvs := make(map[string]string, len(s.envs))
 	for k, v := range s.envs {
+		expandedEnvs[k] = s.expandEnv(v)
+	}
+
+	// Update in-memory map of merged stage vars from ARG and ENV.
+	for k, v := range expandedEnvs {
 		ctx.StageVars[k] = v
 	}
 
@@ -53,11 +59,6 @@ func (s *EnvStep) UpdateCtxAndConfig(
 	if err != nil {
 		return nil, fmt.Errorf("copy image config: %s", err)
 	}
-
-	expandedEnvs := make(map[string]string, len(s.envs))
-	for k, v := range s.envs {
-		expandedEnvs[k] = os.ExpandEnv(v)
-	}
 	config.Config.Env = utils.MergeEnv(config.Config.Env, expandedEnvs)
 	return config, nil
 }
@@ -20,6 +20,7 @@ import (
 
 	"github.com/uber/makisu/lib/context"
 	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/utils"
 
 	"github.com/stretchr/testify/require"
 )
@@ -51,6 +52,31 @@ func TestEnvStepUpdateCtxAndConfig(t *testing.T) {
 	}
 }
 
+func TestEnvStepSelfReference(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	ctx.StageVars["PATH"] = "/usr/bin:/bin"
+	c := image.NewDefaultImageConfig()
+	config := &c
+	for _, dir := range []string{"/x", "/y"} {
+		step := NewEnvStep("", map[string]string{"PATH": dir + ":$PATH"}, false)
+		require.NoError(step.ApplyCtxAndConfig(ctx, config))
+		var err error
+		config, err = step.UpdateCtxAndConfig(ctx, config)
+		require.NoError(err)
+	}
+	require.Contains(config.Config.Env, "PATH=/y:/x:/usr/bin:/bin")
+
+	run := NewRunStep("", `test "$PATH" = /y:/x:/usr/bin:/bin`, "", 0, false)
+	require.NoError(run.ApplyCtxAndConfig(ctx, config))
+	env := utils.ConvertStringSliceToMap(run.execOptions(ctx).Env)
+	require.Equal("/y:/x:/usr/bin:/bin", env["PATH"])
+	require.NoError(run.Execute(ctx, true))
+}
+
 func TestEnvStepNilConfig(t *testing.T) {
 	require := require.New(t)
 
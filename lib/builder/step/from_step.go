@@ -15,26 +15,22 @@
 package step
 
 import (
-	"archive/tar"
 	"encoding/json"
 	"fmt"
-	"hash/crc32"
 	"io/ioutil"
 	"strings"
 
+	"github.com/uber/makisu/lib/cache"
 	"github.com/uber/makisu/lib/context"
 	"github.com/uber/makisu/lib/docker/image"
 	"github.com/uber/makisu/lib/log"
 	"github.com/uber/makisu/lib/registry"
 	"github.com/uber/makisu/lib/storage"
-	"github.com/uber/makisu/lib/tario"
 	"github.com/uber/makisu/lib/utils"
 )
 
 const (
-	defaultAuthor       = "ubuild"
-	defaultArchitecture = "amd64"
-	defaultOS           = "linux"
+	defaultAuthor = "ubuild"
 )
 
 // FromStep implements BuildStep and execute FROM directive
@@ -44,6 +40,9 @@ type FromStep struct {
 	image string
 	alias string
 
+	// digest is the digest the image is pinned to by the lock file, if any.
+	digest image.Digest
+
 	manifest *image.DistributionManifest
 	client   registry.Client
 }
@@ -74,11 +73,43 @@ func (s *FromStep) GetAlias() string {
 	return s.alias
 }
 
-// SetCacheID sets the cacheID of the step using the name of the base image.
-// TODO: Use the sha of that image instead of the image name itself.
+// CreatedBy describes the layers of the base image in the history of the
+// image, when the base image doesn't have history entries for them.
+func (s *FromStep) CreatedBy() string {
+	return fmt.Sprintf("/bin/sh -c #(nop)  FROM %s", s.image)
+}
+
+// SetCacheID sets the cacheID of the step using the name of the base image,
+// and its digest if it's pinned by the lock file.
 func (s *FromStep) SetCacheID(ctx *context.BuildContext, seed string) error {
-	checksum := crc32.ChecksumIEEE([]byte(seed + string(s.directive) + s.image))
-	s.cacheID = fmt.Sprintf("%x", checksum)
+	if err := s.resolveDigest(ctx); err != nil {
+		return fmt.Errorf("resolve digest of %s: %s", s.image, err)
+	}
+	s.cacheID = cache.ComputeID(seed + string(s.directive) + s.image + string(s.digest))
+	return nil
+}
+
+// resolveDigest pins the image to the digest recorded in the lock file of the
+// build context, or adds its current digest to the lock file.
+func (s *FromStep) resolveDigest(ctx *context.BuildContext) error {
+	if ctx.ImageLock == nil || isScratch(s.image) || s.digest != "" {
+		return nil
+	}
+	name, err := image.ParseNameForPull(s.image)
+	if err != nil {
+		return fmt.Errorf("parse image name: %s", err)
+	}
+	if strings.HasPrefix(name.GetTag(), "sha256:") {
+		// Already pinned by the dockerfile.
+		return nil
+	}
+	s.digest, err = ctx.ImageLock.Resolve(name, func() (image.Digest, error) {
+		return ctx.NewRegistryClient(name).ResolveDigest(name.GetTag())
+	})
+	if err != nil {
+		return err
+	}
+	log.Infof("* Pinned image %s to %s", s.image, s.digest)
 	return nil
 }
 
@@ -99,7 +130,7 @@ func (s *FromStep) Execute(ctx *context.BuildContext, modifyFS bool) error {
 	}
 
 	// Otherwise, pull image.
-	manifest, err := s.getManifest(ctx.ImageStore)
+	manifest, err := s.getManifest(ctx)
 	if err != nil {
 		return fmt.Errorf("get manifest: %s", err)
 	}
@@ -122,12 +153,9 @@ func (s *FromStep) Execute(ctx *context.BuildContext, modifyFS bool) error {
 		if err != nil {
 			return fmt.Errorf("get reader from layer: %s", err)
 		}
-		gzipReader, err := tario.NewGzipReader(reader)
-		if err != nil {
-			return fmt.Errorf("create gzip reader for layer: %s", err)
-		}
 		log.Infof("* Processing FROM layer %s", descriptor.Digest.Hex())
-		err = ctx.MemFS.UpdateFromTarReader(tar.NewReader(gzipReader), modifyFS)
+		err = ctx.MemFS.UpdateFromLayer(descriptor.Digest, reader, modifyFS)
+		reader.Close()
 		if err != nil {
 			return fmt.Errorf("untar reader: %s", err)
 		}
@@ -141,7 +169,7 @@ func (s *FromStep) Commit(ctx *context.BuildContext) ([]*image.DigestPair, error
 		return nil, nil
 	}
 
-	manifest, err := s.getManifest(ctx.ImageStore)
+	manifest, err := s.getManifest(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("get manifest: %s", err)
 	}
@@ -175,10 +203,11 @@ func (s *FromStep) UpdateCtxAndConfig(
 
 	if isScratch(s.image) {
 		config := image.NewDefaultImageConfig()
+		config.SetPlatform(ctx.Platform)
 		return &config, nil
 	}
 
-	manifest, err := s.getManifest(ctx.ImageStore)
+	manifest, err := s.getManifest(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("get manifest: %s", err)
 	}
@@ -188,6 +217,17 @@ func (s *FromStep) UpdateCtxAndConfig(
 		return nil, fmt.Errorf("get config: %s", err)
 	}
 
+	// Verify the base image is for the platform being built, and fill in its
+	// platform if it's missing.
+	if config.Architecture == "" || config.OS == "" {
+		config.SetPlatform(ctx.Platform)
+	} else if !ctx.Platform.Matches(config.Platform()) {
+		return nil, fmt.Errorf("base image %s is for platform %s, not %s",
+			s.image, config.Platform(), ctx.Platform)
+	} else if config.Variant == "" {
+		config.Variant = ctx.Platform.Variant
+	}
+
 	// Update in-memory map of merged stage vars from ARG and ENV.
 	envMap := utils.ConvertStringSliceToMap(config.Config.Env)
 	for k, v := range envMap {
@@ -197,7 +237,7 @@ func (s *FromStep) UpdateCtxAndConfig(
 	return config, nil
 }
 
-func (s *FromStep) getManifest(store *storage.ImageStore) (*image.DistributionManifest, error) {
+func (s *FromStep) getManifest(ctx *context.BuildContext) (*image.DistributionManifest, error) {
 	if s.manifest != nil {
 		return s.manifest, nil
 	}
@@ -207,8 +247,12 @@ func (s *FromStep) getManifest(store *storage.ImageStore) (*image.DistributionMa
 	if err != nil {
 		return nil, fmt.Errorf("parse pull image %s: %s", pullImage, err)
 	}
-	s.setRegistryClient(registry.New(store, pullImage.GetRegistry(), pullImage.GetRepository()))
-	manifest, err := s.client.Pull(pullImage.GetTag())
+	s.setRegistryClient(ctx.NewRegistryClient(pullImage))
+	reference := pullImage.GetTag()
+	if s.digest != "" {
+		reference = string(s.digest)
+	}
+	manifest, err := s.client.Pull(reference)
 	if err != nil {
 		return nil, fmt.Errorf("pull image %s: %s", s.image, err)
 	}
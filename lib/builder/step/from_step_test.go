@@ -23,6 +23,7 @@ import (
 	"github.com/uber/makisu/lib/context"
 	"github.com/uber/makisu/lib/docker/image"
 	"github.com/uber/makisu/lib/registry"
+	"github.com/uber/makisu/lib/utils/testutil"
 
 	"github.com/stretchr/testify/require"
 )
@@ -124,6 +125,24 @@ func TestFromStepScratch(t *testing.T) {
 	require.Equal(image.NewDefaultImageConfig(), *conf)
 }
 
+func TestFromStepScratchPlatform(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	ctx.Platform = image.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}
+	step, err := NewFromStep("", image.Scratch, "")
+	require.NoError(err)
+	require.NoError(step.Execute(ctx, false))
+
+	conf, err := step.UpdateCtxAndConfig(ctx, nil)
+	require.NoError(err)
+	require.Equal("arm", conf.Architecture)
+	require.Equal("v7", conf.Variant)
+	require.Equal(ctx.Platform, conf.Platform())
+}
+
 func TestFromStepRegularFlow(t *testing.T) {
 	require := require.New(t)
 
@@ -131,7 +150,7 @@ func TestFromStepRegularFlow(t *testing.T) {
 	defer cleanup()
 
 	testFileDirAlpine := "../../../testdata/files/alpine"
-	p, err := registry.PullClientFixture(ctx,
+	p, err := registry.PullClientFixture(ctx.ImageStore,
 		filepath.Join(testFileDirAlpine, "test_distribution_manifest"),
 		filepath.Join(testFileDirAlpine, "test_image_config"),
 		filepath.Join(testFileDirAlpine, "test_layer.tar"))
@@ -161,3 +180,73 @@ func TestFromStepRegularFlow(t *testing.T) {
 	require.NoError(json.Unmarshal(expectedConfBytes, &expectedConf))
 	require.Equal(expectedConf, *conf)
 }
+
+func TestFromStepLock(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	testFileDirAlpine := "../../../testdata/files/alpine"
+	p, err := registry.PullClientFixture(ctx.ImageStore,
+		filepath.Join(testFileDirAlpine, "test_distribution_manifest"),
+		filepath.Join(testFileDirAlpine, "test_image_config"),
+		filepath.Join(testFileDirAlpine, "test_layer.tar"))
+	require.NoError(err)
+	name := "localhost:5055/" + testutil.SampleImageRepoName + ":" + testutil.SampleImageTag
+	digest, err := p.ResolveDigest(testutil.SampleImageTag)
+	require.NoError(err)
+
+	unpinned, err := NewFromStep("", name, "")
+	require.NoError(err)
+	require.NoError(unpinned.SetCacheID(ctx, ""))
+
+	// Images missing from frozen lock files are rejected.
+	ctx.ImageLock = image.NewLock()
+	ctx.ImageLock.Frozen = true
+	step, err := NewFromStep("", name, "")
+	require.NoError(err)
+	require.Error(step.SetCacheID(ctx, ""))
+
+	// Pinned images are pulled by digest.
+	ctx.ImageLock.Images[image.MustParseName(name).String()] = image.LockEntry{Digest: digest}
+	require.NoError(step.SetCacheID(ctx, ""))
+	require.NotEqual(unpinned.CacheID(), step.CacheID())
+	step.setRegistryClient(p)
+	require.NoError(step.Execute(ctx, false))
+	_, err = ctx.ImageStore.Manifests.GetStoreFileStat(testutil.SampleImageRepoName, string(digest))
+	require.NoError(err)
+}
+
+func TestFromStepLockSchema1(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	p, err := registry.PullSchema1ClientFixture(ctx.ImageStore,
+		"../../../testdata/files/alpine_schema1/test_distribution_manifest",
+		"../../../testdata/files/alpine/test_layer.tar")
+	require.NoError(err)
+	name := "localhost:5055/" + testutil.SampleImageRepoName + ":" + testutil.SampleImageTag
+
+	// The image is pinned to a digest the registry serves, and pulled by it.
+	ctx.ImageLock = image.NewLock()
+	step, err := NewFromStep("", name, "")
+	require.NoError(err)
+	digest, err := ctx.ImageLock.Resolve(image.MustParseName(name), func() (image.Digest, error) {
+		return p.ResolveDigest(testutil.SampleImageTag)
+	})
+	require.NoError(err)
+	require.NoError(step.SetCacheID(ctx, ""))
+	step.setRegistryClient(p)
+	require.NoError(step.Execute(ctx, false))
+	_, err = ctx.ImageStore.Manifests.GetStoreFileStat(testutil.SampleImageRepoName, string(digest))
+	require.NoError(err)
+
+	conf, err := step.UpdateCtxAndConfig(ctx, nil)
+	require.NoError(err)
+	require.Equal([]image.Digest{
+		"sha256:4ac76077f2c741c856a2419dfdb0804b18e48d2e1a9ce9c6a3f0605a2078caba",
+	}, conf.RootFS.DiffIDs)
+}
@@ -16,31 +16,109 @@ package step
 
 import (
 	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
+	"github.com/uber/makisu/lib/cache"
 	"github.com/uber/makisu/lib/context"
 	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/events"
 	"github.com/uber/makisu/lib/log"
 	"github.com/uber/makisu/lib/shell"
+	"github.com/uber/makisu/lib/utils"
 )
 
+// _defaultRunEnv is the environment of RUN commands that don't get these
+// variables from the image or the stage.
+var _defaultRunEnv = map[string]string{
+	"PATH": "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+}
+
+// _defaultHome is the home dir of RUN commands without USER.
+const _defaultHome = "/root"
+
+// _chrootHostFiles are copied from the host into the root dir before running
+// chrooted commands, so that they can resolve names. They are blacklisted, so
+// they are not committed.
+var _chrootHostFiles = []string{"/etc/resolv.conf", "/etc/hosts"}
+
 // RunStep implements BuildStep and execute RUN directive
 type RunStep struct {
 	*baseStep
 
 	cmd string
 
+	// opts overrides the options of the build context the command is
+	// executed with. Only network and timeout can be overridden.
+	opts shell.ExecOptions
+
 	// Used by the user step and the run step to determine which user should run a command (format should be <user>[:<group>] or <UID>[:<GID>], default is "" which is 0:0)
 	user string
 }
 
-// NewRunStep returns a BuildStep from given arguments.
-func NewRunStep(args, cmd string, commit bool) *RunStep {
+// NewRunStep returns a BuildStep from given arguments. Non-zero network and
+// timeout override the ones of the build context.
+func NewRunStep(
+	args, cmd string, network shell.NetworkMode, timeout time.Duration, commit bool) *RunStep {
+
 	return &RunStep{
 		baseStep: newBaseStep(Run, args, commit),
 		cmd:      cmd,
+		opts: shell.ExecOptions{
+			Network: network,
+			Timeout: timeout,
+		},
 	}
 }
 
+// SetCacheID sets the cache ID of the step given a seed SHA256 value.
+// Layers built without network are not interchangeable with other layers, so
+// the network mode is part of the cache ID.
+func (s *RunStep) SetCacheID(ctx *context.BuildContext, seed string) error {
+	if err := s.baseStep.SetCacheID(ctx, seed); err != nil {
+		return err
+	}
+	if network := s.execOptions(ctx).Network; network != shell.NetworkHost {
+		s.cacheID = cache.ComputeID(s.cacheID + string(network))
+	}
+	return nil
+}
+
+// execOptions returns the options the command should be executed with.
+func (s *RunStep) execOptions(ctx *context.BuildContext) *shell.ExecOptions {
+	opts := ctx.RunOptions
+	if s.opts.Network != "" {
+		opts.Network = s.opts.Network
+	}
+	if opts.Network == "" {
+		opts.Network = shell.NetworkHost
+	}
+	if s.opts.Timeout != 0 {
+		opts.Timeout = s.opts.Timeout
+	}
+	opts.Env = s.runEnv(ctx, _defaultHome)
+	return &opts
+}
+
+// runEnv returns the environment of the command. Values of the stage override
+// the ones allowed from the makisu process, which override the defaults.
+func (s *RunStep) runEnv(ctx *context.BuildContext, home string) []string {
+	env := utils.MergeEnv(nil, _defaultRunEnv)
+	env = utils.MergeEnv(env, map[string]string{"HOME": home})
+	env = utils.MergeEnv(env, utils.ConvertStringSliceToMap(ctx.RunOptions.Env))
+	return utils.MergeEnv(env, s.env)
+}
+
+// CreatedBy returns the command run by the step, as it appears in the history
+// of images built by docker.
+func (s *RunStep) CreatedBy() string {
+	return fmt.Sprintf("/bin/sh -c %s", s.cmd)
+}
+
 // RequireOnDisk always returns true, as run steps always require the stage's
 // layers to be present on disk.
 func (s *RunStep) RequireOnDisk() bool { return true }
@@ -49,8 +127,8 @@ func (s *RunStep) RequireOnDisk() bool { return true }
 // See ./user_step.go to see how it's set in image.Config
 func (s *RunStep) ApplyCtxAndConfig(ctx *context.BuildContext, imageConfig *image.Config) error {
 	// This is from ./base_step.go
-	s.SetWorkingDir(ctx, imageConfig)
 	s.SetEnvFromContext(ctx)
+	s.SetWorkingDir(ctx, imageConfig)
 
 	if imageConfig == nil {
 		return nil
@@ -65,7 +143,78 @@ func (s *RunStep) ApplyCtxAndConfig(ctx *context.BuildContext, imageConfig *imag
 func (s *RunStep) Execute(ctx *context.BuildContext, modifyFS bool) error {
 	if !modifyFS {
 		return errors.New("attempted to execute RUN step without modifying file system")
+	} else if host := image.HostPlatform(); !host.Matches(ctx.Platform) {
+		return fmt.Errorf("cannot execute RUN step for platform %s on %s", ctx.Platform, host)
 	}
 	ctx.MustScan = true
-	return shell.ExecCommand(log.Infof, log.Errorf, s.workingDir, s.user, "sh", "-c", s.cmd)
+	opts := s.execOptions(ctx)
+	if s.user != "" {
+		accounts, err := ctx.Accounts()
+		if err != nil {
+			return fmt.Errorf("read accounts: %s", err)
+		}
+		if opts.User, err = accounts.ResolveUser(s.user); err != nil {
+			return fmt.Errorf("resolve user: %s", err)
+		}
+		opts.Env = s.runEnv(ctx, opts.User.Home)
+	}
+
+	workingDir, shellName := filepath.Join(ctx.RootDir, s.workingDir), "sh"
+	if opts.Chroot != "" {
+		// Paths are relative to the chroot, and the shell must come from the
+		// image.
+		workingDir, shellName = s.workingDir, "/bin/sh"
+		if err := copyHostFiles(opts.Chroot, _chrootHostFiles); err != nil {
+			return fmt.Errorf("copy host files to chroot: %s", err)
+		}
+	}
+	return shell.ExecCommandWithOptions(
+		s.outputStream(ctx, log.Infof, "stdout"), s.outputStream(ctx, log.Errorf, "stderr"),
+		opts, workingDir, "", shellName, "-c", s.cmd)
+}
+
+// copyHostFiles copies the given files of the host to the same paths under
+// root. Files missing on the host are ignored.
+func copyHostFiles(root string, paths []string) error {
+	for _, p := range paths {
+		content, err := ioutil.ReadFile(p)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("read %s: %s", p, err)
+		}
+		dst := filepath.Join(root, p)
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return fmt.Errorf("mkdir %s: %s", filepath.Dir(dst), err)
+		}
+		// Remove first, in case the image has a symlink there.
+		if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("remove %s: %s", dst, err)
+		}
+		if err := ioutil.WriteFile(dst, content, 0644); err != nil {
+			return fmt.Errorf("write %s: %s", dst, err)
+		}
+	}
+	return nil
+}
+
+// outputStream returns a function that logs the output of the command with
+// logf, and emits one build event per line of output.
+func (s *RunStep) outputStream(
+	ctx *context.BuildContext, logf func(string, ...interface{}),
+	stream string) func(string, ...interface{}) {
+
+	return func(format string, args ...interface{}) {
+		logf(format, args...)
+		output := strings.TrimRight(fmt.Sprintf(format, args...), "\n")
+		for _, line := range strings.Split(output, "\n") {
+			events.EmitTo(ctx.Events, &events.Event{
+				Type:   events.RunOutput,
+				Stage:  ctx.Stage,
+				Step:   s.String(),
+				Stream: stream,
+				Line:   line,
+			})
+		}
+	}
 }
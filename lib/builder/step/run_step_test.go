@@ -15,9 +15,16 @@
 package step
 
 import (
+	"archive/tar"
+	"bytes"
+	"os"
 	"testing"
+	"time"
 
 	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/shell"
+	"github.com/uber/makisu/lib/utils"
 
 	"github.com/stretchr/testify/require"
 )
@@ -27,7 +34,143 @@ func TestRunStepExecutionFail(t *testing.T) {
 	context, cleanup := context.BuildContextFixture()
 	defer cleanup()
 
-	step := NewRunStep("", "echo hello", false)
+	step := NewRunStep("", "echo hello", "", 0, false)
 	err := step.Execute(context, false)
 	require.Error(err)
 }
+
+func TestRunStepPlatformMismatch(t *testing.T) {
+	require := require.New(t)
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	ctx.Platform = image.Platform{OS: "linux", Architecture: "riscv64"}
+	step := NewRunStep("", "true", "", 0, false)
+	err := step.Execute(ctx, true)
+	require.Error(err)
+	require.Contains(err.Error(), "linux/riscv64")
+}
+
+func TestRunStepNetwork(t *testing.T) {
+	require := require.New(t)
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	host := NewRunStep("", "echo hello", "", 0, false)
+	require.NoError(host.SetCacheID(ctx, ""))
+	require.Equal(shell.NetworkHost, host.execOptions(ctx).Network)
+
+	none := NewRunStep("", "echo hello", shell.NetworkNone, 0, false)
+	require.NoError(none.SetCacheID(ctx, ""))
+	require.Equal(shell.NetworkNone, none.execOptions(ctx).Network)
+	require.NotEqual(host.CacheID(), none.CacheID())
+
+	// The step's network mode overrides the build context's.
+	ctx.RunOptions.Network = shell.NetworkNone
+	require.Equal(shell.NetworkNone, host.execOptions(ctx).Network)
+	override := NewRunStep("", "echo hello", shell.NetworkHost, 0, false)
+	require.Equal(shell.NetworkHost, override.execOptions(ctx).Network)
+}
+
+func TestRunStepExecOptions(t *testing.T) {
+	require := require.New(t)
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	ctx.RunOptions = shell.ExecOptions{
+		Network: shell.NetworkNone,
+		Timeout: time.Minute,
+		Rlimits: shell.Rlimits{NoFile: 1024},
+	}
+
+	// Zero values inherit the options of the build context.
+	step := NewRunStep("", "echo hello", "", 0, false)
+	opts := step.execOptions(ctx)
+	require.Equal(shell.NetworkNone, opts.Network)
+	require.Equal(time.Minute, opts.Timeout)
+	require.Equal(ctx.RunOptions.Rlimits, opts.Rlimits)
+
+	step = NewRunStep("", "echo hello", shell.NetworkHost, time.Second, false)
+	opts = step.execOptions(ctx)
+	require.Equal(shell.NetworkHost, opts.Network)
+	require.Equal(time.Second, opts.Timeout)
+	require.Equal(uint64(1024), opts.Rlimits.NoFile)
+}
+
+func TestRunStepTimeout(t *testing.T) {
+	require := require.New(t)
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	step := NewRunStep("", "sleep 10", "", 100*time.Millisecond, false)
+	err := step.Execute(ctx, true)
+	require.Error(err)
+	_, ok := err.(*shell.TimeoutError)
+	require.True(ok)
+}
+
+func TestRunStepEnv(t *testing.T) {
+	require := require.New(t)
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	require.NoError(os.Setenv("MAKISU_TEST_SECRET", "secret"))
+	defer os.Unsetenv("MAKISU_TEST_SECRET")
+
+	ctx.StageVars["PATH"] = "/opt/bin:/usr/bin:/bin"
+	ctx.StageVars["FOO"] = "foo"
+	ctx.StageVars["BAR"] = `"${FOO}bar"`
+	ctx.RunOptions.Env = []string{"HTTP_PROXY=proxy", "FOO=ignored"}
+
+	c := image.NewDefaultImageConfig()
+	step := NewRunStep("", "echo hello", "", 0, false)
+	require.NoError(step.ApplyCtxAndConfig(ctx, &c))
+	env := utils.ConvertStringSliceToMap(step.execOptions(ctx).Env)
+	require.Equal(map[string]string{
+		"BAR":        "foobar",
+		"FOO":        "foo",
+		"HOME":       "/root",
+		"HTTP_PROXY": "proxy",
+		"PATH":       "/opt/bin:/usr/bin:/bin",
+	}, env)
+
+	// The environment of the makisu process is not modified.
+	_, ok := os.LookupEnv("FOO")
+	require.False(ok)
+
+	step = NewRunStep("", `test "$BAR" = foobar && test -z "$MAKISU_TEST_SECRET"`, "", 0, false)
+	require.NoError(step.ApplyCtxAndConfig(ctx, &c))
+	require.NoError(step.Execute(ctx, true))
+}
+
+func TestRunStepUserFromImage(t *testing.T) {
+	require := require.New(t)
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+	// The working dir of the command is the root dir.
+	require.NoError(os.Chmod(ctx.RootDir, 0755))
+
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	for name, content := range map[string]string{
+		"etc/passwd": "app:x:1234:1234::/srv/app:/bin/sh\n",
+		"etc/group":  "app:x:1234:\nstaff:x:4321:app\n",
+	} {
+		require.NoError(w.WriteHeader(&tar.Header{
+			Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))}))
+		_, err := w.Write([]byte(content))
+		require.NoError(err)
+	}
+	require.NoError(w.Close())
+	require.NoError(ctx.MemFS.UpdateFromTarReader(tar.NewReader(&buf), false))
+
+	c := image.NewDefaultImageConfig()
+	c.Config.User = "app"
+	step := NewRunStep("", `test "$(id -u):$(id -g)" = 1234:1234 && test "$HOME" = /srv/app && id -G | grep -qw 4321`, "", 0, false)
+	require.NoError(step.ApplyCtxAndConfig(ctx, &c))
+	require.NoError(step.Execute(ctx, true))
+
+	c.Config.User = "nobody"
+	require.NoError(step.ApplyCtxAndConfig(ctx, &c))
+	require.Error(step.Execute(ctx, true))
+}
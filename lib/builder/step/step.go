@@ -20,6 +20,7 @@ import (
 	"github.com/uber/makisu/lib/context"
 	"github.com/uber/makisu/lib/docker/image"
 	"github.com/uber/makisu/lib/parser/dockerfile"
+	"github.com/uber/makisu/lib/shell"
 )
 
 // Directive represents a valid directive type.
@@ -49,6 +50,10 @@ const (
 type BuildStep interface {
 	String() string
 
+	// CreatedBy returns the description of the step in the history of the
+	// image, in the format used by docker.
+	CreatedBy() string
+
 	// RequireOnDisk returns whether executing this step requires on-disk state.
 	RequireOnDisk() bool
 
@@ -126,7 +131,7 @@ func NewDockerfileStep(
 		step = NewMaintainerStep(s.Args, s.Author, s.Commit)
 	case *dockerfile.RunDirective:
 		s, _ := d.(*dockerfile.RunDirective)
-		step = NewRunStep(s.Args, s.Cmd, s.Commit)
+		step = NewRunStep(s.Args, s.Cmd, shell.NetworkMode(s.Network), s.Timeout, s.Commit)
 	case *dockerfile.StopsignalDirective:
 		s, _ := d.(*dockerfile.StopsignalDirective)
 		step = NewStopsignalStep(s.Args, s.Signal, s.Commit)
@@ -139,6 +144,9 @@ func NewDockerfileStep(
 	case *dockerfile.WorkdirDirective:
 		s, _ := d.(*dockerfile.WorkdirDirective)
 		step = NewWorkdirStep(s.Args, s.WorkingDir, s.Commit)
+	case *dockerfile.CustomDirective:
+		s, _ := d.(*dockerfile.CustomDirective)
+		step, err = newCustomStep(s)
 	default:
 		err = fmt.Errorf("unsupported directive type: %#v", t)
 	}
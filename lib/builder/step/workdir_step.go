@@ -48,20 +48,23 @@ func (s *WorkdirStep) UpdateCtxAndConfig(
 		return nil, fmt.Errorf("copy image config: %s", err)
 	}
 
-	workdir := os.ExpandEnv(s.workingDir)
-	if filepath.IsAbs(workdir) {
-		config.Config.WorkingDir = ctx.RootDir
+	// The working dir of the config is a path of the image, it is created
+	// under the root dir of the build.
+	workdir := s.expandEnv(s.workingDir)
+	if filepath.IsAbs(workdir) || config.Config.WorkingDir == "" {
+		config.Config.WorkingDir = "/"
 	}
 	config.Config.WorkingDir = filepath.Join(config.Config.WorkingDir, workdir)
 
 	// Create this workdir if it does not exist already.
-	if _, err := os.Lstat(config.Config.WorkingDir); err != nil {
+	dir := filepath.Join(ctx.RootDir, config.Config.WorkingDir)
+	if _, err := os.Lstat(dir); err != nil {
 		if os.IsNotExist(err) {
-			if err := os.MkdirAll(config.Config.WorkingDir, 0755); err != nil {
-				return nil, fmt.Errorf("mkdir all working dir %s: %s", config.Config.WorkingDir, err)
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return nil, fmt.Errorf("mkdir all working dir %s: %s", dir, err)
 			}
 		} else {
-			return nil, fmt.Errorf("lstat working dir %s: %s", config.Config.WorkingDir, err)
+			return nil, fmt.Errorf("lstat working dir %s: %s", dir, err)
 		}
 	}
 	return config, nil
@@ -36,7 +36,8 @@ func TestWorkdirStepUpdateCtxAndConfig(t *testing.T) {
 	c := image.NewDefaultImageConfig()
 	result, err := step.UpdateCtxAndConfig(ctx, &c)
 	require.NoError(err)
-	require.Equal(result.Config.WorkingDir, filepath.Join(ctx.RootDir, workdir))
+	require.Equal(workdir, result.Config.WorkingDir)
+	require.DirExists(filepath.Join(ctx.RootDir, workdir))
 }
 
 func TestWorkdirStepNilConfig(t *testing.T) {
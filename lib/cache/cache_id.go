@@ -0,0 +1,39 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+)
+
+// NewIDHasher returns the hash used to compute cache IDs.
+func NewIDHasher() hash.Hash {
+	return sha256.New()
+}
+
+// IDFromHasher returns the cache ID corresponding to the content written to
+// the given hasher.
+func IDFromHasher(h hash.Hash) string {
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// ComputeID returns the cache ID of the given string.
+func ComputeID(s string) string {
+	h := NewIDHasher()
+	h.Write([]byte(s))
+	return IDFromHasher(h)
+}
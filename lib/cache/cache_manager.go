@@ -34,6 +34,12 @@ import (
 const _cachePrefix = "makisu_builder_cache_"
 const _cacheEmptyEntry = "MAKISU_CACHE_EMPTY"
 
+// _cacheKeyVersion is the version of the cache ID scheme. It is part of every
+// key and entry written to the key-value store, so that entries written by
+// builds using another scheme can coexist with new ones and are never served.
+// It must be bumped whenever the way cache IDs are computed changes.
+const _cacheKeyVersion = "v2"
+
 // Manager is the interface through which we interact with the cacheID -> image layer mapping.
 type Manager interface {
 	PullCache(cacheID string) (*image.DigestPair, error)
@@ -119,7 +125,7 @@ func (manager *registryCacheManager) PullCache(cacheID string) (*image.DigestPai
 
 	var entry string
 	var err error
-	key := _cachePrefix + cacheID
+	key := cacheKey(cacheID)
 	entry, ok := manager.memKVStore[key]
 	if ok {
 		log.Infof("Found mapping in cacheID mem kv store: %s => %s", cacheID, entry)
@@ -141,6 +147,11 @@ func (manager *registryCacheManager) PullCache(cacheID string) (*image.DigestPai
 		log.Infof("Found mapping in cacheID kv store: %s => %s", cacheID, entry)
 	}
 
+	entry, err = trimEntryVersion(entry)
+	if err != nil {
+		return nil, errors.Wrapf(ErrorLayerNotFound, "check entry of %s: %s", cacheID, err)
+	}
+
 	if entry == _cacheEmptyEntry {
 		return nil, nil
 	}
@@ -186,7 +197,7 @@ func (manager *registryCacheManager) PushCache(cacheID string, digestPair *image
 	manager.Lock()
 	defer manager.Unlock()
 
-	key := _cachePrefix + cacheID
+	key := cacheKey(cacheID)
 	entry := createEntry(digestPair)
 	manager.memKVStore[key] = entry
 
@@ -210,7 +221,7 @@ func (manager *registryCacheManager) PushCache(cacheID string, digestPair *image
 		manager.Lock()
 		defer manager.Unlock()
 
-		if err := manager.kvStore.Put(_cachePrefix+cacheID, entry); err != nil {
+		if err := manager.kvStore.Put(key, entry); err != nil {
 			manager.pushErrors.Add(fmt.Errorf("store tag mapping (%s,%s): %s", cacheID, entry, err))
 			return
 		}
@@ -236,6 +247,21 @@ func (manager *registryCacheManager) WaitForPush() error {
 	}
 }
 
+// cacheKey returns the key under which the entry of given cache ID is stored.
+func cacheKey(cacheID string) string {
+	return _cachePrefix + _cacheKeyVersion + "_" + cacheID
+}
+
+// trimEntryVersion verifies that the entry was written with the current cache
+// key version, and returns the entry without its version prefix.
+func trimEntryVersion(entry string) (string, error) {
+	prefix := _cacheKeyVersion + ":"
+	if !strings.HasPrefix(entry, prefix) {
+		return "", errors.Errorf("entry %s doesn't match key version %s", entry, _cacheKeyVersion)
+	}
+	return strings.TrimPrefix(entry, prefix), nil
+}
+
 func parseEntry(entry string) (image.Digest, image.Digest, error) {
 	if strings.Index(entry, ",") == -1 {
 		return image.NewEmptyDigest(), image.NewEmptyDigest(), errors.Errorf("parse redis entry: %s", entry)
@@ -246,7 +272,8 @@ func parseEntry(entry string) (image.Digest, image.Digest, error) {
 
 func createEntry(pair *image.DigestPair) string {
 	if pair == nil {
-		return _cacheEmptyEntry
+		return _cacheKeyVersion + ":" + _cacheEmptyEntry
 	}
-	return fmt.Sprintf("%s,%s", pair.TarDigest.Hex(), pair.GzipDescriptor.Digest.Hex())
+	return fmt.Sprintf("%s:%s,%s",
+		_cacheKeyVersion, pair.TarDigest.Hex(), pair.GzipDescriptor.Digest.Hex())
 }
@@ -122,3 +122,41 @@ func TestCachePullWithOngoingPushing(t *testing.T) {
 	_, err = cacheMgr.PullCache("cacheid2")
 	require.NoError(err)
 }
+
+func TestCachePullIgnoresMismatchedKeyVersion(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	kvStore := keyvalue.MockStore{
+		// Entry written without a key version.
+		"makisu_builder_cache_v2_cacheid1": "test,testgzip",
+		// Entry written with a different key version.
+		"makisu_builder_cache_v2_cacheid2": "v1:test,testgzip",
+		// Empty entry written with a different key version.
+		"makisu_builder_cache_v2_cacheid3": "v1:MAKISU_CACHE_EMPTY",
+		// Legacy key that shouldn't be looked up anymore.
+		"makisu_builder_cache_cacheid4": "test,testgzip",
+	}
+	cacheMgr := cache.New(ctx.ImageStore, kvStore, registry.NoopClientFixture())
+
+	for _, cacheID := range []string{"cacheid1", "cacheid2", "cacheid3", "cacheid4"} {
+		pair, err := cacheMgr.PullCache(cacheID)
+		require.Equal(cache.ErrorLayerNotFound, errors.Cause(err))
+		require.Nil(pair)
+	}
+}
+
+func TestComputeID(t *testing.T) {
+	require := require.New(t)
+
+	id1 := cache.ComputeID("seed")
+	require.Len(id1, 64)
+	require.Equal(id1, cache.ComputeID("seed"))
+	require.NotEqual(id1, cache.ComputeID("seed2"))
+
+	h := cache.NewIDHasher()
+	h.Write([]byte("seed"))
+	require.Equal(id1, cache.IDFromHasher(h))
+}
@@ -28,6 +28,7 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/uber/makisu/lib/events"
 	"github.com/uber/makisu/lib/fileio"
 	"github.com/uber/makisu/lib/log"
 )
@@ -39,6 +40,9 @@ type MakisuClient struct {
 
 	WorkerLog func(line string)
 	HTTPDo    func(req *http.Request) (*http.Response, error)
+
+	// EventSink receives the build events streamed by the worker.
+	EventSink events.Sink
 }
 
 // New creates a new Makisu client that will talk to the worker available on the socket
@@ -57,6 +61,7 @@ func New(socket, localPath, workerPath string) *MakisuClient {
 
 		WorkerLog: func(line string) { fmt.Fprintf(os.Stderr, line+"\n") },
 		HTTPDo:    cli.Do,
+		EventSink: events.NewNoopSink(),
 	}
 }
 
@@ -65,6 +70,13 @@ func (cli *MakisuClient) SetWorkerLog(fn func(line string)) {
 	cli.WorkerLog = fn
 }
 
+// SetEventSink sets the sink that receives build events streamed by the
+// worker. Events are only streamed if the worker was started with
+// "--events-fd" pointing to its output.
+func (cli *MakisuClient) SetEventSink(sink events.Sink) {
+	cli.EventSink = sink
+}
+
 // Ready returns true if the worker is ready for work, and false if it is already performing
 // a build.
 func (cli *MakisuClient) Ready() (bool, error) {
@@ -168,6 +180,15 @@ func (cli *MakisuClient) readLines(body io.ReadCloser) error {
 		} else if err != nil {
 			return fmt.Errorf("failed to read build body: %s", err)
 		}
+		if e, ok := events.ParseJSONLine(line); ok {
+			if cli.EventSink != nil {
+				cli.EventSink.Emit(e)
+			}
+			if e.Type == events.BuildFinished {
+				buildCode = e.BuildCode
+			}
+			continue
+		}
 		cli.WorkerLog(string(line))
 		cli.maybeGetBuildCode(line, &buildCode)
 	}
@@ -177,6 +198,8 @@ func (cli *MakisuClient) readLines(body io.ReadCloser) error {
 	return nil
 }
 
+// maybeGetBuildCode looks for the build code in log lines of workers that
+// don't stream build events.
 func (cli *MakisuClient) maybeGetBuildCode(line []byte, code *int) {
 	into := map[string]interface{}{}
 	if err := json.Unmarshal(line, &into); err == nil {
@@ -20,9 +20,15 @@ import (
 	"os"
 	"path/filepath"
 
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/events"
 	"github.com/uber/makisu/lib/pathutils"
+	"github.com/uber/makisu/lib/registry"
+	"github.com/uber/makisu/lib/shell"
 	"github.com/uber/makisu/lib/snapshot"
 	"github.com/uber/makisu/lib/storage"
+	"github.com/uber/makisu/lib/tario"
+	"github.com/uber/makisu/lib/utils"
 
 	"github.com/andres-erbsen/clock"
 )
@@ -47,6 +53,47 @@ type BuildContext struct {
 	MemFS      *snapshot.MemFS     // Merged view of base layers. Layers should be merged in order.
 	ImageStore *storage.ImageStore // Stores image layers and manifests.
 
+	// Stage is the alias of the stage the context belongs to, if any.
+	Stage string
+
+	// RunOptions are the options of commands executed by RUN steps. Steps
+	// can override some of them.
+	RunOptions shell.ExecOptions
+
+	// Platform is the platform of the image being built. Defaults to the
+	// platform of the host.
+	Platform image.Platform
+
+	// ImageLock pins the base images to digests, if set. It's shared by all
+	// stages.
+	ImageLock *image.Lock
+
+	// Blacklist contains the paths of the image ignored by the build.
+	Blacklist []string
+
+	// TarConfig controls how layers are written. It must be set with
+	// SetTarConfig, since MemFS also uses it.
+	TarConfig *tario.Config
+
+	// FullScan makes scans of the file system list every directory. It must
+	// be set with SetFullScan, since MemFS also uses it.
+	FullScan bool
+
+	// RegistryConfig configures the registry clients of the build. Nil means
+	// the global registry.ConfigurationMap.
+	RegistryConfig registry.Map
+
+	// Events receives the build events. Nil means the global sink.
+	Events events.Sink
+
+	// TransferStats records the bytes transferred with registries by the
+	// build. Nil means the global registry.DefaultTransferStats.
+	TransferStats *registry.TransferStats
+
+	// ManifestMediaType is the media type of the manifests of built images,
+	// either image.MediaTypeManifest or image.MediaTypeOCIManifest.
+	ManifestMediaType string
+
 	CopyOps   []*snapshot.CopyOperation
 	MustScan  bool
 	stagesDir string // Contains dirs with files needed for 'copy --from' operations.
@@ -56,16 +103,30 @@ type BuildContext struct {
 func NewBuildContext(
 	rootDir, contextDir string, imageStore *storage.ImageStore) (*BuildContext, error) {
 
+	return NewBuildContextWithBlacklist(
+		rootDir, contextDir, imageStore, pathutils.DefaultBlacklist)
+}
+
+// NewBuildContextWithBlacklist inits a new BuildContext object, which ignores
+// the given paths instead of pathutils.DefaultBlacklist.
+func NewBuildContextWithBlacklist(
+	rootDir, contextDir string, imageStore *storage.ImageStore,
+	imageBlacklist []string) (*BuildContext, error) {
+
 	stagesDir := filepath.Join(imageStore.SandboxDir, _stagesDir)
 	if err := os.MkdirAll(stagesDir, os.ModePerm); err != nil {
 		return nil, fmt.Errorf("create stages dir: %s", err)
 	}
 
-	blacklist := append(pathutils.DefaultBlacklist, contextDir, imageStore.RootDir)
+	blacklist := rootBlacklist(
+		rootDir, imageBlacklist, []string{contextDir, imageStore.RootDir})
 	memFS, err := snapshot.NewMemFS(clock.New(), rootDir, blacklist)
 	if err != nil {
 		return nil, fmt.Errorf("init memfs: %s", err)
 	}
+	memFS.SetIndexDir(imageStore.MemFSIndexDir)
+	tarConfig := tario.DefaultConfig()
+	memFS.SetTarConfig(tarConfig)
 
 	return &BuildContext{
 		RootDir:    rootDir,
@@ -73,12 +134,65 @@ func NewBuildContext(
 		StageVars:  make(map[string]string, 0),
 		MemFS:      memFS,
 		ImageStore: imageStore,
+		RunOptions: shell.ExecOptions{Network: shell.NetworkHost},
+		Platform:   image.HostPlatform(),
+		Blacklist:  imageBlacklist,
+		TarConfig:  tarConfig,
 		CopyOps:    make([]*snapshot.CopyOperation, 0),
 		MustScan:   false,
 		stagesDir:  stagesDir,
+
+		ManifestMediaType: image.MediaTypeManifest,
 	}, nil
 }
 
+// rootBlacklist returns the blacklist of the file system rooted at rootDir.
+// Paths of the image are moved under rootDir, while host paths are kept,
+// unless they contain rootDir, e.g. the storage dir containing a rootfs dir.
+func rootBlacklist(rootDir string, imagePaths, hostPaths []string) []string {
+	if rootDir == "/" {
+		return append(append([]string{}, imagePaths...), hostPaths...)
+	}
+	var blacklist []string
+	for _, p := range imagePaths {
+		blacklist = append(blacklist, filepath.Join(rootDir, p))
+	}
+	for _, p := range hostPaths {
+		if !pathutils.IsDescendantOfAny(rootDir, []string{p}) {
+			blacklist = append(blacklist, p)
+		}
+	}
+	return blacklist
+}
+
+// SetTarConfig sets how layers are written.
+func (ctx *BuildContext) SetTarConfig(c *tario.Config) {
+	ctx.TarConfig = c
+	ctx.MemFS.SetTarConfig(c)
+}
+
+// SetFullScan sets whether scans of the file system list every directory,
+// instead of reusing the listings of directories whose mtime didn't change.
+func (ctx *BuildContext) SetFullScan(fullScan bool) {
+	ctx.FullScan = fullScan
+	ctx.MemFS.SetFullScan(fullScan)
+}
+
+// NewRegistryClient returns a client of the registry and repository of the
+// given image, configured by the context.
+func (ctx *BuildContext) NewRegistryClient(name image.Name) *registry.DockerRegistryClient {
+	configs := ctx.RegistryConfig
+	if configs == nil {
+		configs = registry.ConfigurationMap
+	}
+	client := registry.NewWithConfig(
+		ctx.ImageStore, name.GetRegistry(), name.GetRepository(), configs)
+	client.SetPlatform(ctx.Platform)
+	client.SetEventSink(ctx.Events)
+	client.SetTransferStats(ctx.TransferStats)
+	return client
+}
+
 // CopyFromRoot returns the directory that context from a stage should be written to and read from.
 func (ctx *BuildContext) CopyFromRoot(alias string) string {
 	// Here we sha the alias to get a string that can be directly appended to the context's
@@ -91,3 +205,17 @@ func (ctx *BuildContext) CopyFromRoot(alias string) string {
 func (ctx *BuildContext) Cleanup() error {
 	return os.RemoveAll(ctx.stagesDir)
 }
+
+// Accounts returns the users and groups of the image being built, read from
+// its /etc/passwd and /etc/group files in the merged view of the layers.
+func (ctx *BuildContext) Accounts() (*utils.Accounts, error) {
+	var contents [2][]byte
+	for i, p := range []string{"/etc/passwd", "/etc/group"} {
+		content, err := ctx.MemFS.ReadFile(p)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("read %s: %s", p, err)
+		}
+		contents[i] = content
+	}
+	return utils.ParseAccounts(contents[0], contents[1]), nil
+}
@@ -148,7 +148,7 @@ func (tarer DefaultImageTarer) getExportManifest(imageName image.Name) (image.Ex
 	}
 	defer manifestReader.Close()
 
-	distribution, _, err := image.UnmarshalDistributionManifest(image.MediaTypeManifest, manifestData)
+	distribution, _, err := image.UnmarshalDistributionManifest("", manifestData)
 	if err != nil {
 		return image.ExportManifest{}, err
 	}
@@ -29,9 +29,21 @@ const (
 
 	// MediaTypeLayer is the mediaType used for layers referenced by the manifest.
 	MediaTypeLayer = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+
+	// MediaTypeOCIManifest specifies the mediaType of OCI image manifests.
+	MediaTypeOCIManifest = "application/vnd.oci.image.manifest.v1+json"
+
+	// MediaTypeOCIConfig specifies the mediaType of the image configuration
+	// referenced by OCI image manifests.
+	MediaTypeOCIConfig = "application/vnd.oci.image.config.v1+json"
+
+	// MediaTypeOCILayer is the mediaType used for gzipped layers referenced by
+	// OCI image manifests.
+	MediaTypeOCILayer = "application/vnd.oci.image.layer.v1.tar+gzip"
 )
 
-// DistributionManifest defines a schema2 manifest. It's used for docker pull and docker push.
+// DistributionManifest defines a schema2 manifest or an OCI image manifest.
+// It's used for docker pull and docker push.
 type DistributionManifest struct {
 	// SchemaVersion is the image manifest schema that this image uses.
 	SchemaVersion int `json:"schemaVersion"`
@@ -68,8 +80,64 @@ type DigestPair struct {
 	GzipDescriptor Descriptor
 }
 
+// NewDistributionManifest returns a manifest of the given media type, which is
+// either MediaTypeManifest or MediaTypeOCIManifest. The media types of the
+// config and of gzipped layers are converted to the ones of that format.
+func NewDistributionManifest(
+	mediaType string, config Descriptor, layers []Descriptor) (*DistributionManifest, error) {
+
+	var configMediaType, layerMediaType string
+	switch mediaType {
+	case MediaTypeManifest:
+		configMediaType, layerMediaType = MediaTypeConfig, MediaTypeLayer
+	case MediaTypeOCIManifest:
+		configMediaType, layerMediaType = MediaTypeOCIConfig, MediaTypeOCILayer
+	default:
+		return nil, fmt.Errorf("unsupported manifest mediatype: %s", mediaType)
+	}
+
+	config.MediaType = configMediaType
+	convertedLayers := make([]Descriptor, len(layers))
+	for i, layer := range layers {
+		if layer.MediaType == "" || layer.MediaType == MediaTypeLayer ||
+			layer.MediaType == MediaTypeOCILayer {
+			layer.MediaType = layerMediaType
+		}
+		convertedLayers[i] = layer
+	}
+	return &DistributionManifest{
+		SchemaVersion: 2,
+		MediaType:     mediaType,
+		Config:        config,
+		Layers:        convertedLayers,
+	}, nil
+}
+
+// ManifestMediaType returns the media type of the image manifests of the given
+// format, which is either "docker" or "oci".
+func ManifestMediaType(format string) (string, error) {
+	switch format {
+	case "docker":
+		return MediaTypeManifest, nil
+	case "oci":
+		return MediaTypeOCIManifest, nil
+	default:
+		return "", fmt.Errorf("invalid image format: %s", format)
+	}
+}
+
 // UnmarshalDistributionManifest verifies MediaType and unmarshals manifest.
+// If ctHeader is empty, the media type is read from the manifest itself, like
+// for manifests of the local store.
 func UnmarshalDistributionManifest(ctHeader string, p []byte) (DistributionManifest, Descriptor, error) {
+	manifest := DistributionManifest{}
+	if err := json.Unmarshal(p, &manifest); err != nil {
+		return DistributionManifest{}, Descriptor{}, err
+	}
+	if ctHeader == "" {
+		ctHeader = manifest.MediaType
+	}
+
 	// Need to look up by the actual media type, not the raw contents of the header.
 	// Strip semicolons and anything following them.
 	var mediatype string
@@ -81,22 +149,21 @@ func UnmarshalDistributionManifest(ctHeader string, p []byte) (DistributionManif
 		}
 	}
 
-	if mediatype != MediaTypeManifest {
+	if mediatype != MediaTypeManifest && mediatype != MediaTypeOCIManifest {
 		return DistributionManifest{},
 			Descriptor{},
 			fmt.Errorf("unsupported manifest mediatype: %s", mediatype)
 	}
-
-	manifest := DistributionManifest{}
-	if err := json.Unmarshal(p, &manifest); err != nil {
-		return DistributionManifest{}, Descriptor{}, err
+	// The mediaType field is optional in OCI manifests.
+	if manifest.MediaType == "" {
+		manifest.MediaType = mediatype
 	}
 
 	digest, err := NewDigester().FromBytes(p)
 	if err != nil {
 		return DistributionManifest{}, Descriptor{}, err
 	}
-	return manifest, Descriptor{Digest: digest, Size: int64(len(p)), MediaType: MediaTypeManifest}, nil
+	return manifest, Descriptor{Digest: digest, Size: int64(len(p)), MediaType: mediatype}, nil
 }
 
 // GetLayerDigests returns the list of layer digests of the image.
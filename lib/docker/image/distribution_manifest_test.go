@@ -45,3 +45,70 @@ func TestUnmarshalDistributionManifest(t *testing.T) {
 	require.NoError(err)
 	require.Equal(1, len(manifest.GetLayerDigests()))
 }
+
+const ociManifest = `{
+   "schemaVersion": 2,
+   "config": {
+      "mediaType": "application/vnd.oci.image.config.v1+json",
+      "size": 1472,
+      "digest": "sha256:c50cd2f2d4ed1d6e5ea41b2f0f2e23bd8bba5b6bb3ad3e27b1bbfa8bd5a55ba0"
+   },
+   "layers": [
+      {
+         "mediaType": "application/vnd.oci.image.layer.v1.tar+gzip",
+         "size": 760770,
+         "digest": "sha256:7b2699543f22d5b8dc8d66a5873eb246767bca37232dee1e7a3b8c9956bceb0c"
+      }
+   ]
+}`
+
+func TestUnmarshalOCIManifest(t *testing.T) {
+	require := require.New(t)
+
+	manifest, descriptor, err := UnmarshalDistributionManifest(
+		MediaTypeOCIManifest+"; charset=utf-8", []byte(ociManifest))
+	require.NoError(err)
+	require.Equal(MediaTypeOCIManifest, manifest.MediaType)
+	require.Equal(MediaTypeOCIManifest, descriptor.MediaType)
+	require.Equal(MediaTypeOCILayer, manifest.Layers[0].MediaType)
+
+	// Without a content type, the media type of the manifest is used.
+	manifest, _, err = UnmarshalDistributionManifest("", []byte(busyboxDistManifest))
+	require.NoError(err)
+	require.Equal(MediaTypeManifest, manifest.MediaType)
+
+	_, _, err = UnmarshalDistributionManifest("", []byte(ociManifest))
+	require.Error(err)
+	_, _, err = UnmarshalDistributionManifest(MediaTypeManifestList, []byte(ociManifest))
+	require.Error(err)
+}
+
+func TestNewDistributionManifest(t *testing.T) {
+	require := require.New(t)
+
+	config := Descriptor{MediaType: MediaTypeConfig, Size: 10, Digest: "sha256:config"}
+	layers := []Descriptor{
+		{MediaType: MediaTypeLayer, Size: 1, Digest: "sha256:docker"},
+		{MediaType: MediaTypeOCILayer, Size: 2, Digest: "sha256:oci"},
+		{MediaType: "application/vnd.oci.image.layer.v1.tar+zstd", Size: 3, Digest: "sha256:zstd"},
+	}
+
+	manifest, err := NewDistributionManifest(MediaTypeOCIManifest, config, layers)
+	require.NoError(err)
+	require.Equal(2, manifest.SchemaVersion)
+	require.Equal(MediaTypeOCIManifest, manifest.MediaType)
+	require.Equal(MediaTypeOCIConfig, manifest.Config.MediaType)
+	require.Equal(MediaTypeOCILayer, manifest.Layers[0].MediaType)
+	require.Equal(MediaTypeOCILayer, manifest.Layers[1].MediaType)
+	require.Equal(layers[2], manifest.Layers[2])
+	// The given descriptors are not modified.
+	require.Equal(MediaTypeLayer, layers[0].MediaType)
+
+	manifest, err = NewDistributionManifest(MediaTypeManifest, config, layers)
+	require.NoError(err)
+	require.Equal(MediaTypeConfig, manifest.Config.MediaType)
+	require.Equal(MediaTypeLayer, manifest.Layers[1].MediaType)
+
+	_, err = NewDistributionManifest(MediaTypeOCIIndex, config, layers)
+	require.Error(err)
+}
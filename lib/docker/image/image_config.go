@@ -55,6 +55,8 @@ type V1Image struct {
 	Architecture string `json:"architecture,omitempty"`
 	// OS is the operating system used to build and run the image
 	OS string `json:"os,omitempty"`
+	// Variant is the variant of the architecture, e.g. v7 for arm
+	Variant string `json:"variant,omitempty"`
 	// Size is the total size of the image including all layers it is composed of
 	Size int64 `json:",omitempty"`
 }
@@ -141,6 +143,18 @@ func NewDefaultImageConfig() Config {
 	}
 }
 
+// Platform returns the platform of the image.
+func (img *Config) Platform() Platform {
+	return Platform{Architecture: img.Architecture, OS: img.OS, Variant: img.Variant}
+}
+
+// SetPlatform sets the architecture, OS and variant of the image.
+func (img *Config) SetPlatform(platform Platform) {
+	img.Architecture = platform.Architecture
+	img.OS = platform.OS
+	img.Variant = platform.Variant
+}
+
 // NewImageConfigFromJSON creates an Image configuration from json.
 func NewImageConfigFromJSON(src []byte) (*Config, error) {
 	img := &Config{}
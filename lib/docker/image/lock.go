@@ -0,0 +1,100 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// LockEntry pins an image reference to the digest of its manifest, or of its
+// manifest list.
+type LockEntry struct {
+	Registry   string `json:"registry"`
+	Repository string `json:"repository"`
+	Tag        string `json:"tag"`
+	Digest     Digest `json:"digest"`
+}
+
+// Lock maps the base images referenced by a dockerfile to digests, so that
+// later builds use the exact same images.
+type Lock struct {
+	// Images maps the full names of images to their entries.
+	Images map[string]LockEntry `json:"images"`
+
+	// Frozen lock files can't be changed, images missing from them are
+	// rejected.
+	Frozen bool `json:"-"`
+}
+
+// NewLock returns an empty Lock.
+func NewLock() *Lock {
+	return &Lock{Images: make(map[string]LockEntry)}
+}
+
+// LoadLock reads a lock file. If the file doesn't exist, an empty lock is
+// returned, unless frozen is set.
+func LoadLock(path string, frozen bool) (*Lock, error) {
+	lock := NewLock()
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && !frozen {
+		return lock, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("read lock file: %s", err)
+	}
+	if err := json.Unmarshal(content, lock); err != nil {
+		return nil, fmt.Errorf("unmarshal lock file: %s", err)
+	}
+	if lock.Images == nil {
+		lock.Images = make(map[string]LockEntry)
+	}
+	lock.Frozen = frozen
+	return lock, nil
+}
+
+// Save writes the lock file.
+func (l *Lock) Save(path string) error {
+	content, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal lock file: %s", err)
+	}
+	if err := ioutil.WriteFile(path, append(content, '\n'), 0644); err != nil {
+		return fmt.Errorf("write lock file: %s", err)
+	}
+	return nil
+}
+
+// Resolve returns the digest the image is pinned to. If the image is missing
+// and the lock is not frozen, resolve is called to get its digest, which is
+// then added to the lock.
+func (l *Lock) Resolve(name Name, resolve func() (Digest, error)) (Digest, error) {
+	if entry, ok := l.Images[name.String()]; ok {
+		return entry.Digest, nil
+	} else if l.Frozen {
+		return "", fmt.Errorf("image %s is missing from frozen lock file", name)
+	}
+	digest, err := resolve()
+	if err != nil {
+		return "", err
+	}
+	l.Images[name.String()] = LockEntry{
+		Registry:   name.GetRegistry(),
+		Repository: name.GetRepository(),
+		Tag:        name.GetTag(),
+		Digest:     digest,
+	}
+	return digest, nil
+}
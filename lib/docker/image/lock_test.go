@@ -0,0 +1,67 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package image
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLock(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "lock")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "makisu.lock")
+
+	// Frozen locks require an existing lock file.
+	_, err = LoadLock(path, true)
+	require.Error(err)
+
+	lock, err := LoadLock(path, false)
+	require.NoError(err)
+	require.Empty(lock.Images)
+
+	alpine := MustParseName("index.docker.io/library/alpine:3.9")
+	resolved := Digest("sha256:ab")
+	digest, err := lock.Resolve(alpine, func() (Digest, error) { return resolved, nil })
+	require.NoError(err)
+	require.Equal(resolved, digest)
+	require.NoError(lock.Save(path))
+
+	lock, err = LoadLock(path, true)
+	require.NoError(err)
+	require.Equal(LockEntry{
+		Registry:   "index.docker.io",
+		Repository: "library/alpine",
+		Tag:        "3.9",
+		Digest:     resolved,
+	}, lock.Images[alpine.String()])
+
+	// Pinned images are not resolved again.
+	fail := func() (Digest, error) { return "", errors.New("unexpected resolve") }
+	digest, err = lock.Resolve(alpine, fail)
+	require.NoError(err)
+	require.Equal(resolved, digest)
+
+	// Frozen locks reject missing images.
+	_, err = lock.Resolve(MustParseName("index.docker.io/library/busybox:latest"), fail)
+	require.Error(err)
+}
@@ -0,0 +1,134 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+)
+
+const (
+	// MediaTypeManifestList specifies the mediaType of manifest lists, which
+	// reference the manifests of an image for different platforms.
+	MediaTypeManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+
+	// MediaTypeOCIIndex specifies the mediaType of OCI image indexes, the OCI
+	// equivalent of manifest lists.
+	MediaTypeOCIIndex = "application/vnd.oci.image.index.v1+json"
+)
+
+// ManifestList defines a manifest list or an OCI image index.
+type ManifestList struct {
+	// SchemaVersion is the manifest list schema that this list uses.
+	SchemaVersion int `json:"schemaVersion"`
+
+	// MediaType is the media type of this schema.
+	MediaType string `json:"mediaType,omitempty"`
+
+	// Manifests references the manifests of the image for each platform.
+	Manifests []ManifestListEntry `json:"manifests"`
+}
+
+// ManifestListEntry references the manifest of one platform.
+type ManifestListEntry struct {
+	Descriptor
+
+	// Platform is the platform of the referenced image. It's omitted by OCI
+	// indexes for entries that are not images.
+	Platform *Platform `json:"platform,omitempty"`
+}
+
+// NewManifestList returns an empty manifest list of the given media type,
+// which is either MediaTypeManifestList or MediaTypeOCIIndex.
+func NewManifestList(mediaType string) (*ManifestList, error) {
+	if mediaType != MediaTypeManifestList && mediaType != MediaTypeOCIIndex {
+		return nil, fmt.Errorf("unsupported manifest list mediatype: %s", mediaType)
+	}
+	return &ManifestList{
+		SchemaVersion: 2,
+		MediaType:     mediaType,
+		Manifests:     []ManifestListEntry{},
+	}, nil
+}
+
+// IsManifestListMediaType returns true if the media type, possibly including
+// parameters, is the one of a manifest list or OCI index.
+func IsManifestListMediaType(ctHeader string) bool {
+	mediatype, _, err := mime.ParseMediaType(ctHeader)
+	if err != nil {
+		return false
+	}
+	return mediatype == MediaTypeManifestList || mediatype == MediaTypeOCIIndex
+}
+
+// UnmarshalManifestList verifies MediaType and unmarshals a manifest list.
+func UnmarshalManifestList(ctHeader string, p []byte) (ManifestList, error) {
+	if !IsManifestListMediaType(ctHeader) {
+		return ManifestList{}, fmt.Errorf("unsupported manifest list mediatype: %s", ctHeader)
+	}
+	list := ManifestList{}
+	if err := json.Unmarshal(p, &list); err != nil {
+		return ManifestList{}, err
+	}
+	return list, nil
+}
+
+// Select returns the descriptor of the manifest of the given platform. Entries
+// with the exact same variant are preferred.
+func (list ManifestList) Select(platform Platform) (Descriptor, error) {
+	var match *ManifestListEntry
+	for i, entry := range list.Manifests {
+		if entry.Platform == nil || !platform.Matches(*entry.Platform) {
+			continue
+		}
+		if entry.Platform.normalize().Variant == platform.normalize().Variant {
+			return entry.Descriptor, nil
+		} else if match == nil {
+			match = &list.Manifests[i]
+		}
+	}
+	if match == nil {
+		var platforms []string
+		for _, entry := range list.Manifests {
+			if entry.Platform != nil {
+				platforms = append(platforms, entry.Platform.String())
+			}
+		}
+		return Descriptor{}, fmt.Errorf(
+			"no manifest for platform %s, available platforms: %v", platform, platforms)
+	}
+	return match.Descriptor, nil
+}
+
+// Add appends the manifest of the given platform to the list. It returns an
+// error if the list already references a manifest of the same platform.
+func (list *ManifestList) Add(descriptor Descriptor, platform Platform) error {
+	if platform.OS == "" || platform.Architecture == "" {
+		return fmt.Errorf("platform of manifest %s is missing os or architecture", descriptor.Digest)
+	}
+	platform = platform.normalize()
+	for _, entry := range list.Manifests {
+		if entry.Platform != nil && entry.Platform.normalize() == platform {
+			return fmt.Errorf("manifests %s and %s are both for platform %s",
+				entry.Digest, descriptor.Digest, platform)
+		}
+	}
+	list.Manifests = append(list.Manifests, ManifestListEntry{
+		Descriptor: descriptor,
+		Platform:   &platform,
+	})
+	return nil
+}
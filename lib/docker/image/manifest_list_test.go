@@ -0,0 +1,110 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const busyboxManifestList = `{
+   "schemaVersion": 2,
+   "mediaType": "application/vnd.docker.distribution.manifest.list.v2+json",
+   "manifests": [
+      {
+         "mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+         "size": 527,
+         "digest": "sha256:e95d7f9d1d4e2b4d4c2f7d3e2c0d8b5f1a3e8c9b7d6a5f4e3d2c1b0a9f8e7d6c",
+         "platform": {"architecture": "amd64", "os": "linux"}
+      },
+      {
+         "mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+         "size": 527,
+         "digest": "sha256:a1b2c3d4e5f60718293a4b5c6d7e8f90a1b2c3d4e5f60718293a4b5c6d7e8f90",
+         "platform": {"architecture": "arm", "os": "linux", "variant": "v6"}
+      },
+      {
+         "mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+         "size": 527,
+         "digest": "sha256:0f1e2d3c4b5a69788796a5b4c3d2e1f00f1e2d3c4b5a69788796a5b4c3d2e1f0",
+         "platform": {"architecture": "arm", "os": "linux", "variant": "v7"}
+      }
+   ]
+}`
+
+func TestUnmarshalManifestList(t *testing.T) {
+	require := require.New(t)
+
+	list, err := UnmarshalManifestList(MediaTypeManifestList, []byte(busyboxManifestList))
+	require.NoError(err)
+	require.Len(list.Manifests, 3)
+	require.Equal(int64(527), list.Manifests[0].Size)
+	require.Equal("linux/arm/v6", list.Manifests[1].Platform.String())
+
+	_, err = UnmarshalManifestList(MediaTypeManifest, []byte(busyboxManifestList))
+	require.Error(err)
+}
+
+func TestManifestListSelect(t *testing.T) {
+	require := require.New(t)
+
+	list, err := UnmarshalManifestList(
+		MediaTypeOCIIndex+"; charset=utf-8", []byte(busyboxManifestList))
+	require.NoError(err)
+
+	d, err := list.Select(Platform{OS: "linux", Architecture: "amd64"})
+	require.NoError(err)
+	require.Equal(list.Manifests[0].Digest, d.Digest)
+
+	d, err = list.Select(Platform{OS: "linux", Architecture: "arm", Variant: "v7"})
+	require.NoError(err)
+	require.Equal(list.Manifests[2].Digest, d.Digest)
+
+	// Without variant, the first matching entry is picked.
+	d, err = list.Select(Platform{OS: "linux", Architecture: "arm"})
+	require.NoError(err)
+	require.Equal(list.Manifests[1].Digest, d.Digest)
+
+	_, err = list.Select(Platform{OS: "linux", Architecture: "arm64"})
+	require.Error(err)
+}
+
+func TestManifestListAdd(t *testing.T) {
+	require := require.New(t)
+
+	_, err := NewManifestList(MediaTypeManifest)
+	require.Error(err)
+
+	list, err := NewManifestList(MediaTypeOCIIndex)
+	require.NoError(err)
+
+	amd64 := Descriptor{MediaType: MediaTypeManifest, Size: 527, Digest: "sha256:amd64"}
+	require.NoError(list.Add(amd64, Platform{OS: "linux", Architecture: "x86_64"}))
+	armv7 := Descriptor{MediaType: MediaTypeManifest, Size: 527, Digest: "sha256:armv7"}
+	require.NoError(list.Add(armv7, Platform{OS: "linux", Architecture: "arm", Variant: "v7"}))
+	armv6 := Descriptor{MediaType: MediaTypeManifest, Size: 527, Digest: "sha256:armv6"}
+	require.NoError(list.Add(armv6, Platform{OS: "linux", Architecture: "armel"}))
+	require.Len(list.Manifests, 3)
+	require.Equal("linux/amd64", list.Manifests[0].Platform.String())
+
+	// Platforms must be unique and complete.
+	require.Error(list.Add(armv6, Platform{OS: "linux", Architecture: "arm", Variant: "v6"}))
+	require.Error(list.Add(armv6, Platform{Architecture: "riscv64"}))
+
+	d, err := list.Select(Platform{OS: "linux", Architecture: "arm", Variant: "v6"})
+	require.NoError(err)
+	require.Equal(armv6, d)
+}
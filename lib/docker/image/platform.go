@@ -0,0 +1,86 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+)
+
+// Platform describes the operating system and architecture an image runs on.
+type Platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// HostPlatform returns the platform of the images that can run on the host.
+func HostPlatform() Platform {
+	return Platform{Architecture: runtime.GOARCH, OS: "linux"}.normalize()
+}
+
+// ParsePlatform parses a platform string with format <os>/<arch>[/<variant>].
+func ParsePlatform(s string) (Platform, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return Platform{}, fmt.Errorf("invalid platform %s, must be <os>/<arch>[/<variant>]", s)
+	}
+	p := Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p.normalize(), nil
+}
+
+// String returns the platform with format <os>/<arch>[/<variant>].
+func (p Platform) String() string {
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+// Matches returns true if images of the other platform run on this platform.
+// Variants are only compared if both are set.
+func (p Platform) Matches(other Platform) bool {
+	p, other = p.normalize(), other.normalize()
+	if p.OS != other.OS || p.Architecture != other.Architecture {
+		return false
+	}
+	return p.Variant == "" || other.Variant == "" || p.Variant == other.Variant
+}
+
+// normalize converts the common aliases of architectures and variants to the
+// names used by registries.
+func (p Platform) normalize() Platform {
+	p.OS = strings.ToLower(p.OS)
+	switch p.Architecture = strings.ToLower(p.Architecture); p.Architecture {
+	case "x86_64", "x86-64":
+		p.Architecture = "amd64"
+	case "aarch64":
+		p.Architecture = "arm64"
+	case "armhf":
+		p.Architecture, p.Variant = "arm", "v7"
+	case "armel":
+		p.Architecture, p.Variant = "arm", "v6"
+	}
+	if p.Architecture == "arm64" && p.Variant == "v8" {
+		// v8 is the only variant of arm64.
+		p.Variant = ""
+	}
+	return p
+}
@@ -0,0 +1,58 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePlatform(t *testing.T) {
+	require := require.New(t)
+
+	p, err := ParsePlatform("linux/arm64")
+	require.NoError(err)
+	require.Equal(Platform{OS: "linux", Architecture: "arm64"}, p)
+	require.Equal("linux/arm64", p.String())
+
+	p, err = ParsePlatform("linux/arm/v7")
+	require.NoError(err)
+	require.Equal(Platform{OS: "linux", Architecture: "arm", Variant: "v7"}, p)
+	require.Equal("linux/arm/v7", p.String())
+
+	p, err = ParsePlatform("linux/x86_64")
+	require.NoError(err)
+	require.Equal("linux/amd64", p.String())
+
+	for _, s := range []string{"", "linux", "linux/", "/amd64", "linux/arm/v7/x"} {
+		_, err := ParsePlatform(s)
+		require.Error(err, s)
+	}
+}
+
+func TestPlatformMatches(t *testing.T) {
+	require := require.New(t)
+
+	arm64 := Platform{OS: "linux", Architecture: "arm64"}
+	require.True(arm64.Matches(Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}))
+	require.True(arm64.Matches(Platform{OS: "linux", Architecture: "aarch64"}))
+	require.False(arm64.Matches(Platform{OS: "linux", Architecture: "amd64"}))
+	require.False(arm64.Matches(Platform{OS: "windows", Architecture: "arm64"}))
+
+	armv7 := Platform{OS: "linux", Architecture: "arm", Variant: "v7"}
+	require.True(armv7.Matches(Platform{OS: "linux", Architecture: "arm"}))
+	require.False(armv7.Matches(Platform{OS: "linux", Architecture: "arm", Variant: "v6"}))
+}
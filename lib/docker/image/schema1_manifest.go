@@ -0,0 +1,246 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package image
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"strings"
+	"time"
+)
+
+const (
+	// MediaTypeSchema1Manifest specifies the mediaType of legacy schema1
+	// manifests.
+	MediaTypeSchema1Manifest = "application/vnd.docker.distribution.manifest.v1+json"
+
+	// MediaTypeSchema1SignedManifest specifies the mediaType of signed legacy
+	// schema1 manifests.
+	MediaTypeSchema1SignedManifest = "application/vnd.docker.distribution.manifest.v1+prettyjws"
+)
+
+// Schema1Manifest defines a legacy schema1 manifest. Makisu only pulls them,
+// converting them into a DistributionManifest and a synthesized image config.
+// Signatures are ignored.
+type Schema1Manifest struct {
+	// SchemaVersion is the image manifest schema that this image uses.
+	SchemaVersion int `json:"schemaVersion"`
+
+	// Name is the name of the image's repository.
+	Name string `json:"name"`
+
+	// Tag is the tag of the image.
+	Tag string `json:"tag"`
+
+	// Architecture is the host architecture on which this image is intended to run.
+	Architecture string `json:"architecture"`
+
+	// FSLayers lists the layers of the image, starting from the top layer.
+	FSLayers []Schema1FSLayer `json:"fsLayers"`
+
+	// History lists the v1 configurations of the layers, in the same order as
+	// FSLayers.
+	History []Schema1History `json:"history"`
+}
+
+// Schema1FSLayer references a gzipped layer of a schema1 manifest.
+type Schema1FSLayer struct {
+	BlobSum Digest `json:"blobSum"`
+}
+
+// Schema1History holds the v1 configuration of a layer of a schema1 manifest.
+type Schema1History struct {
+	V1Compatibility string `json:"v1Compatibility"`
+}
+
+// schema1Compatibility holds the fields of a v1Compatibility configuration
+// that are needed to build the history of an image.
+type schema1Compatibility struct {
+	Created         time.Time `json:"created"`
+	Author          string    `json:"author,omitempty"`
+	Comment         string    `json:"comment,omitempty"`
+	ThrowAway       bool      `json:"throwaway,omitempty"`
+	ContainerConfig struct {
+		Cmd []string `json:"Cmd"`
+	} `json:"container_config,omitempty"`
+}
+
+// IsSchema1Manifest returns true if the manifest p, served with the given
+// content type, is a schema1 manifest. Legacy registries may serve them as
+// plain json, so the schema version of the manifest is checked too.
+func IsSchema1Manifest(ctHeader string, p []byte) bool {
+	mediatype, _, err := mime.ParseMediaType(ctHeader)
+	if err != nil {
+		return false
+	}
+	if mediatype != MediaTypeSchema1Manifest &&
+		mediatype != MediaTypeSchema1SignedManifest &&
+		mediatype != "application/json" {
+		return false
+	}
+	var versioned struct {
+		SchemaVersion int `json:"schemaVersion"`
+	}
+	if err := json.Unmarshal(p, &versioned); err != nil {
+		return false
+	}
+	return versioned.SchemaVersion == 1
+}
+
+// Schema1ManifestDigest returns the digest of the schema1 manifest p, the way
+// registries compute it. Signed manifests are hashed without their signatures,
+// using the format length and tail of the protected header of the first
+// signature to rebuild the signed payload.
+func Schema1ManifestDigest(p []byte) (Digest, error) {
+	var signed struct {
+		Signatures []struct {
+			Protected string `json:"protected"`
+		} `json:"signatures"`
+	}
+	if err := json.Unmarshal(p, &signed); err != nil {
+		return "", err
+	}
+	if len(signed.Signatures) == 0 {
+		return NewDigester().FromBytes(p)
+	}
+
+	protectedJSON, err := base64.RawURLEncoding.DecodeString(
+		strings.TrimRight(signed.Signatures[0].Protected, "="))
+	if err != nil {
+		return "", fmt.Errorf("decode protected header: %s", err)
+	}
+	var protected struct {
+		FormatLength int    `json:"formatLength"`
+		FormatTail   string `json:"formatTail"`
+	}
+	if err := json.Unmarshal(protectedJSON, &protected); err != nil {
+		return "", fmt.Errorf("unmarshal protected header: %s", err)
+	}
+	tail, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(protected.FormatTail, "="))
+	if err != nil {
+		return "", fmt.Errorf("decode format tail: %s", err)
+	}
+	if protected.FormatLength < 0 || protected.FormatLength > len(p) {
+		return "", fmt.Errorf("invalid format length %d", protected.FormatLength)
+	}
+	payload := append(append([]byte{}, p[:protected.FormatLength]...), tail...)
+	return NewDigester().FromBytes(payload)
+}
+
+// UnmarshalSchema1Manifest unmarshals and verifies a schema1 manifest.
+func UnmarshalSchema1Manifest(p []byte) (Schema1Manifest, error) {
+	manifest := Schema1Manifest{}
+	if err := json.Unmarshal(p, &manifest); err != nil {
+		return Schema1Manifest{}, err
+	}
+	if manifest.SchemaVersion != 1 {
+		return Schema1Manifest{}, fmt.Errorf(
+			"unsupported manifest schema version: %d", manifest.SchemaVersion)
+	}
+	if len(manifest.FSLayers) == 0 {
+		return Schema1Manifest{}, fmt.Errorf("no layers in schema1 manifest")
+	}
+	if len(manifest.FSLayers) != len(manifest.History) {
+		return Schema1Manifest{}, fmt.Errorf(
+			"length of history %d does not match number of layers %d",
+			len(manifest.History), len(manifest.FSLayers))
+	}
+	return manifest, nil
+}
+
+// compatibilities parses the v1 configurations of the manifest, starting from
+// the base layer.
+func (manifest Schema1Manifest) compatibilities() ([]schema1Compatibility, error) {
+	n := len(manifest.History)
+	compatibilities := make([]schema1Compatibility, n)
+	for i, h := range manifest.History {
+		if err := json.Unmarshal([]byte(h.V1Compatibility), &compatibilities[n-1-i]); err != nil {
+			return nil, fmt.Errorf("unmarshal v1 compatibility %d: %s", i, err)
+		}
+	}
+	return compatibilities, nil
+}
+
+// GetLayerDigests returns the digests of the gzipped layers of the image,
+// starting from the base layer. Throwaway layers, which are empty, are
+// skipped.
+func (manifest Schema1Manifest) GetLayerDigests() ([]Digest, error) {
+	compatibilities, err := manifest.compatibilities()
+	if err != nil {
+		return nil, err
+	}
+	n := len(manifest.FSLayers)
+	digests := []Digest{}
+	for i, compatibility := range compatibilities {
+		if !compatibility.ThrowAway {
+			digests = append(digests, manifest.FSLayers[n-1-i].BlobSum)
+		}
+	}
+	return digests, nil
+}
+
+// NewImageConfig synthesizes the image config of the manifest from the v1
+// configuration of its top layer. The diffIDs are the digests of the
+// uncompressed layers returned by GetLayerDigests, in the same order.
+func (manifest Schema1Manifest) NewImageConfig(diffIDs []Digest) ([]byte, error) {
+	compatibilities, err := manifest.compatibilities()
+	if err != nil {
+		return nil, err
+	}
+	history := make([]History, len(compatibilities))
+	var numLayers int
+	for i, compatibility := range compatibilities {
+		history[i] = History{
+			Created:    compatibility.Created,
+			Author:     compatibility.Author,
+			CreatedBy:  strings.Join(compatibility.ContainerConfig.Cmd, " "),
+			Comment:    compatibility.Comment,
+			EmptyLayer: compatibility.ThrowAway,
+		}
+		if !compatibility.ThrowAway {
+			numLayers++
+		}
+	}
+	if numLayers != len(diffIDs) {
+		return nil, fmt.Errorf(
+			"number of diff ids %d does not match number of layers %d", len(diffIDs), numLayers)
+	}
+
+	// Keep all the fields of the top v1 configuration, except the ones that
+	// only make sense for v1 images.
+	var config map[string]*json.RawMessage
+	if err := json.Unmarshal([]byte(manifest.History[0].V1Compatibility), &config); err != nil {
+		return nil, fmt.Errorf("unmarshal v1 compatibility: %s", err)
+	} else if config == nil {
+		return nil, fmt.Errorf("missing v1 compatibility of top layer")
+	}
+	for _, key := range []string{"id", "parent", "parent_id", "layer_id", "throwaway", "Size"} {
+		delete(config, key)
+	}
+	rootfs, err := json.Marshal(RootFS{Type: "layers", DiffIDs: diffIDs})
+	if err != nil {
+		return nil, fmt.Errorf("marshal rootfs: %s", err)
+	}
+	rawRootFS := json.RawMessage(rootfs)
+	config["rootfs"] = &rawRootFS
+	historyJSON, err := json.Marshal(history)
+	if err != nil {
+		return nil, fmt.Errorf("marshal history: %s", err)
+	}
+	rawHistory := json.RawMessage(historyJSON)
+	config["history"] = &rawHistory
+	return json.Marshal(config)
+}
@@ -0,0 +1,128 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package image
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const schema1Manifest = `{
+   "schemaVersion": 1,
+   "name": "library/busybox",
+   "tag": "latest",
+   "architecture": "amd64",
+   "fsLayers": [
+      {"blobSum": "sha256:a3ed95caeb02ffe68cdd9fd84406680ae93d633cb16422d00e8a7c22955b46d4"},
+      {"blobSum": "sha256:layer2"},
+      {"blobSum": "sha256:layer1"}
+   ],
+   "history": [
+      {"v1Compatibility": "{\"id\":\"c\",\"parent\":\"b\",\"architecture\":\"amd64\",\"os\":\"linux\",\"config\":{\"Cmd\":[\"sh\"]},\"container_config\":{\"Cmd\":[\"/bin/sh\",\"-c\",\"#(nop) CMD [\\\"sh\\\"]\"]},\"created\":\"2018-01-03T00:00:00Z\",\"throwaway\":true}"},
+      {"v1Compatibility": "{\"id\":\"b\",\"parent\":\"a\",\"author\":\"makisu\",\"container_config\":{\"Cmd\":[\"/bin/sh\",\"-c\",\"touch /a\"]},\"created\":\"2018-01-02T00:00:00Z\"}"},
+      {"v1Compatibility": "{\"id\":\"a\",\"comment\":\"base\",\"created\":\"2018-01-01T00:00:00Z\",\"Size\":10}"}
+   ],
+   "signatures": []
+}`
+
+func TestUnmarshalSchema1Manifest(t *testing.T) {
+	require := require.New(t)
+
+	require.True(IsSchema1Manifest(MediaTypeSchema1SignedManifest, []byte(schema1Manifest)))
+	require.True(IsSchema1Manifest(MediaTypeSchema1Manifest+"; charset=utf-8", []byte(schema1Manifest)))
+	require.True(IsSchema1Manifest("application/json", []byte(schema1Manifest)))
+	require.False(IsSchema1Manifest("application/json", []byte(busyboxDistManifest)))
+	require.False(IsSchema1Manifest(MediaTypeManifest, []byte(schema1Manifest)))
+
+	manifest, err := UnmarshalSchema1Manifest([]byte(schema1Manifest))
+	require.NoError(err)
+	digests, err := manifest.GetLayerDigests()
+	require.NoError(err)
+	require.Equal([]Digest{"sha256:layer1", "sha256:layer2"}, digests)
+
+	_, err = UnmarshalSchema1Manifest([]byte(busyboxDistManifest))
+	require.Error(err)
+
+	manifest.History = manifest.History[1:]
+	b, err := json.Marshal(manifest)
+	require.NoError(err)
+	_, err = UnmarshalSchema1Manifest(b)
+	require.Error(err)
+}
+
+func TestSchema1ManifestNewImageConfig(t *testing.T) {
+	require := require.New(t)
+
+	manifest, err := UnmarshalSchema1Manifest([]byte(schema1Manifest))
+	require.NoError(err)
+
+	_, err = manifest.NewImageConfig([]Digest{"sha256:diff1"})
+	require.Error(err)
+
+	b, err := manifest.NewImageConfig([]Digest{"sha256:diff1", "sha256:diff2"})
+	require.NoError(err)
+	config, err := NewImageConfigFromJSON(b)
+	require.NoError(err)
+	require.Equal("", config.V1Image.ID)
+	require.Equal("", config.V1Image.Parent)
+	require.Equal(int64(0), config.Size)
+	require.Equal("amd64", config.Architecture)
+	require.Equal("linux", config.OS)
+	require.Equal([]string{"sh"}, config.Config.Cmd)
+	require.Equal([]Digest{"sha256:diff1", "sha256:diff2"}, config.RootFS.DiffIDs)
+
+	require.Len(config.History, 3)
+	require.Equal("base", config.History[0].Comment)
+	require.False(config.History[0].EmptyLayer)
+	require.Equal("makisu", config.History[1].Author)
+	require.Equal("/bin/sh -c touch /a", config.History[1].CreatedBy)
+	require.True(config.History[2].EmptyLayer)
+	require.Equal(2018, config.History[2].Created.Year())
+	require.Equal(3, config.History[2].Created.Day())
+
+	// The top layer isn't a throwaway one anymore.
+	manifest.History[0].V1Compatibility = "null"
+	_, err = manifest.NewImageConfig([]Digest{"sha256:diff1", "sha256:diff2", "sha256:diff3"})
+	require.Error(err)
+	require.Contains(err.Error(), "missing v1 compatibility")
+}
+
+func TestSchema1ManifestDigest(t *testing.T) {
+	require := require.New(t)
+
+	// Unsigned manifests are hashed as is.
+	digest, err := Schema1ManifestDigest([]byte(schema1Manifest))
+	require.NoError(err)
+	expected, err := NewDigester().FromBytes([]byte(schema1Manifest))
+	require.NoError(err)
+	require.Equal(expected, digest)
+
+	// Signed manifests are hashed without their signatures.
+	payload := "{\n   \"schemaVersion\": 1\n}"
+	protected := base64.RawURLEncoding.EncodeToString([]byte(
+		`{"formatLength":23,"formatTail":"Cn0"}`))
+	signed := "{\n   \"schemaVersion\": 1,\n   \"signatures\": [{\"protected\": \"" + protected + "\"}]\n}"
+	digest, err = Schema1ManifestDigest([]byte(signed))
+	require.NoError(err)
+	expected, err = NewDigester().FromBytes([]byte(payload))
+	require.NoError(err)
+	require.Equal(expected, digest)
+
+	protected = base64.RawURLEncoding.EncodeToString([]byte(`{"formatLength":1000}`))
+	_, err = Schema1ManifestDigest([]byte(`{"signatures": [{"protected": "` + protected + `"}]}`))
+	require.Error(err)
+}
@@ -0,0 +1,123 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// Type is the type of a build event.
+type Type string
+
+// Set of all build event types.
+const (
+	StageStarted   = Type("stage_started")
+	StepStarted    = Type("step_started")
+	StepFinished   = Type("step_finished")
+	CacheHit       = Type("cache_hit")
+	LayerCommitted = Type("layer_committed")
+	PushProgress   = Type("push_progress")
+	RunOutput      = Type("run_output")
+	BuildFinished  = Type("build_finished")
+)
+
+// Event describes progress of a build. Only the fields relevant to the event
+// type are set.
+type Event struct {
+	Type Type      `json:"type"`
+	Time time.Time `json:"time"`
+
+	// Stage and Step identify the stage and step the event relates to.
+	Stage string `json:"stage,omitempty"`
+	Step  string `json:"step,omitempty"`
+
+	CacheID string `json:"cache_id,omitempty"`
+
+	// Registry, Repository and Digest identify the blob being pushed, or the
+	// layer being committed.
+	Registry   string `json:"registry,omitempty"`
+	Repository string `json:"repository,omitempty"`
+	Digest     string `json:"digest,omitempty"`
+
+	// Bytes is the number of bytes processed so far, and Size the total
+	// number of bytes.
+	Bytes int64 `json:"bytes,omitempty"`
+	Size  int64 `json:"size,omitempty"`
+
+	// Stream is either "stdout" or "stderr" for RUN output lines.
+	Stream string `json:"stream,omitempty"`
+	Line   string `json:"line,omitempty"`
+
+	Duration time.Duration `json:"duration,omitempty"`
+	Error    string        `json:"error,omitempty"`
+
+	// BuildCode is the exit code of the build, set on build_finished.
+	BuildCode int `json:"build_code,omitempty"`
+}
+
+// Sink receives build events. Implementations must be safe for concurrent
+// use.
+type Sink interface {
+	Emit(e *Event)
+}
+
+type noopSink struct{}
+
+func (noopSink) Emit(e *Event) {}
+
+var (
+	sinkMu sync.RWMutex
+	sink   Sink = noopSink{}
+)
+
+// NewNoopSink returns a Sink that drops all events.
+func NewNoopSink() Sink { return noopSink{} }
+
+// SetSink sets the sink that receives all build events.
+func SetSink(s Sink) {
+	sinkMu.Lock()
+	defer sinkMu.Unlock()
+
+	if s == nil {
+		s = noopSink{}
+	}
+	sink = s
+}
+
+// GetSink returns the current sink.
+func GetSink() Sink {
+	sinkMu.RLock()
+	defer sinkMu.RUnlock()
+
+	return sink
+}
+
+// Emit sends the event to the current sink, setting its time if needed.
+func Emit(e *Event) {
+	EmitTo(GetSink(), e)
+}
+
+// EmitTo sends the event to the given sink instead of the current one,
+// setting its time if needed. A nil sink means the current one.
+func EmitTo(s Sink, e *Event) {
+	if s == nil {
+		s = GetSink()
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	s.Emit(e)
+}
@@ -0,0 +1,60 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestJSONLinesSink(t *testing.T) {
+	require := require.New(t)
+
+	var buf bytes.Buffer
+	SetSink(NewJSONLinesSink(&buf))
+	defer SetSink(nil)
+
+	Emit(&Event{Type: StepStarted, Stage: "stage1", Step: "RUN ls"})
+	Emit(&Event{Type: RunOutput, Step: "RUN ls", Stream: "stdout", Line: "a b"})
+	Emit(&Event{Type: BuildFinished, BuildCode: 1, Error: "failed"})
+
+	var parsed []*Event
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		e, ok := ParseJSONLine(scanner.Bytes())
+		require.True(ok)
+		parsed = append(parsed, e)
+	}
+	require.Len(parsed, 3)
+	require.Equal(StepStarted, parsed[0].Type)
+	require.Equal("stage1", parsed[0].Stage)
+	require.False(parsed[0].Time.IsZero())
+	require.Equal("a b", parsed[1].Line)
+	require.Equal(BuildFinished, parsed[2].Type)
+	require.Equal(1, parsed[2].BuildCode)
+	require.Equal("failed", parsed[2].Error)
+}
+
+func TestParseJSONLineIgnoresLogs(t *testing.T) {
+	require := require.New(t)
+
+	_, ok := ParseJSONLine([]byte(`{"level":"info","msg":"hello","build_code":"0"}`))
+	require.False(ok)
+	_, ok = ParseJSONLine([]byte(`not json`))
+	require.False(ok)
+}
@@ -0,0 +1,58 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+
+	"github.com/uber/makisu/lib/log"
+)
+
+// JSONLinesSink writes events to a writer, one json object per line.
+type JSONLinesSink struct {
+	sync.Mutex
+
+	encoder *json.Encoder
+	failed  bool
+}
+
+// NewJSONLinesSink returns a new JSONLinesSink writing to w.
+func NewJSONLinesSink(w io.Writer) *JSONLinesSink {
+	return &JSONLinesSink{encoder: json.NewEncoder(w)}
+}
+
+// Emit writes the event as a single line of json. Write errors are logged
+// once and otherwise ignored, so they never fail the build.
+func (s *JSONLinesSink) Emit(e *Event) {
+	s.Lock()
+	defer s.Unlock()
+
+	if err := s.encoder.Encode(e); err != nil && !s.failed {
+		s.failed = true
+		log.Errorf("Failed to write build event: %s", err)
+	}
+}
+
+// ParseJSONLine parses one line written by JSONLinesSink. It returns false if
+// the line isn't a build event.
+func ParseJSONLine(line []byte) (*Event, bool) {
+	e := new(Event)
+	if err := json.Unmarshal(line, e); err != nil || e.Type == "" {
+		return nil, false
+	}
+	return e, true
+}
@@ -226,7 +226,7 @@ func (c *Copier) copyRegularFile(fi os.FileInfo, src, dst string) error {
 	if err := os.Chmod(dst, fi.Mode()); err != nil {
 		return fmt.Errorf("chmod %s: %s", dst, err)
 	}
-	return nil
+	return copyXattrs(src, dst)
 }
 
 func (c *Copier) copySymlink(src, dst string) error {
@@ -322,8 +322,7 @@ func (c *Copier) copyDir(src, dst string) error {
 	if err := os.Chown(dst, uid, gid); err != nil {
 		return fmt.Errorf("chown %s: %s", dst, err)
 	}
-
-	return nil
+	return copyXattrs(src, dst)
 }
 
 // mkdirAll performs the same operation as os.MkdirAll, except it also changes
@@ -115,6 +115,33 @@ func TestCopyFileSetSpecialBit(t *testing.T) {
 	require.Equal(targetFi.Mode(), os.ModePerm|os.ModeSetuid)
 }
 
+func TestCopyPreservesXattrs(t *testing.T) {
+	require := require.New(t)
+
+	tmpRoot, err := ioutil.TempDir("/tmp", "testCopy")
+	require.NoError(err)
+	defer os.RemoveAll(tmpRoot)
+
+	srcDir := filepath.Join(tmpRoot, "src")
+	require.NoError(os.Mkdir(srcDir, 0755))
+	srcFile := filepath.Join(srcDir, "file")
+	require.NoError(ioutil.WriteFile(srcFile, []byte("Testing COPY"), 0755))
+	xattrs := map[string]string{"user.test": "value"}
+	require.NoError(utils.SetXattrs(srcDir, xattrs))
+	require.NoError(utils.SetXattrs(srcFile, xattrs))
+	if result, err := utils.GetXattrs(srcFile); err != nil || len(result) == 0 {
+		t.Skip("xattrs are not supported")
+	}
+
+	c := NewCopier(nil, WithDstFileAndChildrenOwner(1, 1, true))
+	require.NoError(c.CopyDir(tmpRoot, filepath.Join(tmpRoot, "dst")))
+	for _, p := range []string{"dst/src", "dst/src/file"} {
+		result, err := utils.GetXattrs(filepath.Join(tmpRoot, p))
+		require.NoError(err)
+		require.Equal(xattrs, result)
+	}
+}
+
 func TestCopyFileTargetEmpty(t *testing.T) {
 	require := require.New(t)
 
@@ -31,6 +31,19 @@ func getFileOwners(fi os.FileInfo) (uid int, gid int) {
 	return int(stat.Uid), int(stat.Gid)
 }
 
+// copyXattrs copies the extended attributes of src to dst. It needs to be
+// called after chown, otherwise file capabilities would be cleared.
+func copyXattrs(src, dst string) error {
+	xattrs, err := utils.GetXattrs(src)
+	if err != nil {
+		return fmt.Errorf("get xattrs: %s", err)
+	}
+	if err := utils.SetXattrs(dst, xattrs); err != nil {
+		return fmt.Errorf("set xattrs: %s", err)
+	}
+	return nil
+}
+
 // ReaderToFile copies the data from a reader to a destination file.
 func ReaderToFile(r io.Reader, dst string) error {
 	dst = filepath.Clean(dst)
@@ -0,0 +1,99 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dockerfile
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+var customNameRegexp = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*$`)
+
+// CustomDirectiveParser parses the args of a custom directive, after the
+// variables of the stage are replaced. The result is kept in the Value of the
+// directive.
+type CustomDirectiveParser func(args string) (interface{}, error)
+
+var (
+	customDirectivesMu sync.RWMutex
+	customDirectives   = make(map[string]CustomDirectiveParser)
+)
+
+// RegisterDirective adds a custom directive to the ones dockerfiles can use
+// within build stages. Directive names are case insensitive, and cannot be the
+// ones of built-in directives.
+func RegisterDirective(name string, parse CustomDirectiveParser) error {
+	if !customNameRegexp.MatchString(name) {
+		return fmt.Errorf("invalid directive name: %s", name)
+	}
+	t := strings.ToLower(name)
+	if _, ok := directiveConstructors[t]; ok {
+		return fmt.Errorf("cannot override built-in directive %s", name)
+	}
+
+	customDirectivesMu.Lock()
+	defer customDirectivesMu.Unlock()
+
+	if _, ok := customDirectives[t]; ok {
+		return fmt.Errorf("directive %s is already registered", name)
+	}
+	customDirectives[t] = parse
+	return nil
+}
+
+// getCustomDirectiveParser returns the parser of the custom directive of the
+// given lower case name, if registered.
+func getCustomDirectiveParser(t string) (CustomDirectiveParser, bool) {
+	customDirectivesMu.RLock()
+	defer customDirectivesMu.RUnlock()
+
+	parse, ok := customDirectives[t]
+	return parse, ok
+}
+
+// CustomDirective represents a directive registered with RegisterDirective.
+type CustomDirective struct {
+	*baseDirective
+
+	// Name is the upper case name of the directive.
+	Name string
+
+	// Value is the result of the parser of the directive.
+	Value interface{}
+}
+
+// Variables:
+//   Replaced from ARGs and ENVs from within our stage.
+// Formats:
+//   Defined by the parser of the directive.
+func newCustomDirective(
+	base *baseDirective, state *parsingState, parse CustomDirectiveParser) (Directive, error) {
+
+	if err := base.replaceVarsCurrStage(state); err != nil {
+		return nil, err
+	}
+	value, err := parse(base.Args)
+	if err != nil {
+		return nil, base.err(err)
+	}
+	return &CustomDirective{base, strings.ToUpper(base.t), value}, nil
+}
+
+// Add this command to the build stage.
+func (d *CustomDirective) update(state *parsingState) error {
+	return state.addToCurrStage(d)
+}
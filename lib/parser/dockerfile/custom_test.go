@@ -0,0 +1,56 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dockerfile
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegisterDirective(t *testing.T) {
+	require := require.New(t)
+
+	parse := func(args string) (interface{}, error) {
+		parts := strings.Fields(args)
+		if len(parts) != 2 {
+			return nil, errors.New("expected <id> <dst>")
+		}
+		return parts, nil
+	}
+	require.NoError(RegisterDirective("TEST_FETCH", parse))
+	require.Error(RegisterDirective("test_fetch", parse))
+	require.Error(RegisterDirective("RUN", parse))
+	require.Error(RegisterDirective("test fetch", parse))
+
+	stages, err := ParseFile("FROM scratch\nARG id=1234\nTEST_FETCH $id /dst #!COMMIT\n", nil)
+	require.NoError(err)
+	require.Len(stages, 1)
+	require.Len(stages[0].Directives, 2)
+	d, ok := stages[0].Directives[1].(*CustomDirective)
+	require.True(ok)
+	require.Equal("TEST_FETCH", d.Name)
+	require.Equal([]string{"1234", "/dst"}, d.Value)
+	require.True(d.Commit)
+
+	_, err = ParseFile("FROM scratch\ntest_fetch 1234\n", nil)
+	require.Error(err)
+	_, err = ParseFile("TEST_FETCH 1234 /dst\nFROM scratch\n", nil)
+	require.Error(err)
+	_, err = ParseFile("FROM scratch\nTEST_OTHER 1234 /dst\n", nil)
+	require.Error(err)
+}
@@ -52,9 +52,11 @@ func newDirective(line string, state *parsingState) (Directive, error) {
 		return nil, nil
 	}
 
-	cons, found := directiveConstructors[base.t]
-	if !found {
-		return nil, base.err(errUnsupportedDirective)
+	if cons, found := directiveConstructors[base.t]; found {
+		return cons(base, state)
 	}
-	return cons(base, state)
+	if parse, found := getCustomDirectiveParser(base.t); found {
+		return newCustomDirective(base, state, parse)
+	}
+	return nil, base.err(errUnsupportedDirective)
 }
@@ -21,13 +21,13 @@ func FromDirectiveFixture(args, image, alias string) *FromDirective {
 
 // RunDirectiveFixture returns a RunDirective for testing purposes.
 func RunDirectiveFixture(args string, cmd string) *RunDirective {
-	return &RunDirective{&baseDirective{"run", args, false}, cmd}
+	return &RunDirective{&baseDirective{"run", args, false}, cmd, "", 0}
 }
 
 // RunCommitDirectiveFixture returns a RunDirective with a commit annotation
 // for testing purposes.
 func RunCommitDirectiveFixture(args string, cmd string) *RunDirective {
-	return &RunDirective{&baseDirective{"run", args, true}, cmd}
+	return &RunDirective{&baseDirective{"run", args, true}, cmd, "", 0}
 }
 
 // CmdDirectiveFixture returns a CmdDirective for testing purposes.
@@ -569,6 +569,8 @@ func integration() []*test {
 	stage1.addDirective(&RunDirective{
 		&baseDirective{"run", "echo echo ubuntu", false},
 		"echo echo ubuntu",
+		"",
+		0,
 	})
 	stage1.addDirective(&CmdDirective{
 		&baseDirective{"cmd", "echo echo ubuntu", false},
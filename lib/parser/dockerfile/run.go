@@ -15,30 +15,73 @@
 package dockerfile
 
 import (
+	"fmt"
 	"strings"
+	"time"
 )
 
 // RunDirective represents the "RUN" dockerfile command.
 type RunDirective struct {
 	*baseDirective
 	Cmd string
+
+	// Network is the network mode of the command. Empty if not specified.
+	Network string
+
+	// Timeout is the maximum duration of the command. Zero if not specified.
+	Timeout time.Duration
 }
 
 // Variables:
 //   Replaced from ARGs and ENVs from within our stage.
 // Formats:
-//   RUN ["<executable>", "<param>"...]
-//   RUN ["<param>"...]
-//   RUN <command>
+//   RUN [--network=<none|host|default>] [--timeout=<duration>] ["<executable>", "<param>"...]
+//   RUN [--network=<none|host|default>] [--timeout=<duration>] ["<param>"...]
+//   RUN [--network=<none|host|default>] [--timeout=<duration>] <command>
 func newRunDirective(base *baseDirective, state *parsingState) (Directive, error) {
 	if err := base.replaceVarsCurrStage(state); err != nil {
 		return nil, err
 	}
-	if cmd, ok := parseJSONArray(base.Args); ok {
-		return &RunDirective{base, strings.Join(cmd, " ")}, nil
+
+	args := strings.TrimSpace(base.Args)
+	var network string
+	var timeout time.Duration
+	for {
+		fields := strings.Fields(args)
+		if len(fields) == 0 {
+			break
+		}
+		if val, ok, err := parseStringFlag(fields[0], "network"); err != nil {
+			return nil, base.err(err)
+		} else if ok {
+			switch val {
+			case "none", "host":
+				network = val
+			case "default":
+			default:
+				return nil, base.err(fmt.Errorf("Invalid network mode: %s", val))
+			}
+		} else if val, ok, err := parseStringFlag(fields[0], "timeout"); err != nil {
+			return nil, base.err(err)
+		} else if ok {
+			timeout, err = time.ParseDuration(val)
+			if err != nil || timeout <= 0 {
+				return nil, base.err(fmt.Errorf("Invalid timeout: %s", val))
+			}
+		} else {
+			break
+		}
+		args = strings.TrimSpace(strings.TrimPrefix(args, fields[0]))
+		if args == "" {
+			return nil, base.err(errMissingArgs)
+		}
+	}
+
+	if cmd, ok := parseJSONArray(args); ok {
+		return &RunDirective{base, strings.Join(cmd, " "), network, timeout}, nil
 	}
 
-	return &RunDirective{base, base.Args}, nil
+	return &RunDirective{base, args, network, timeout}, nil
 }
 
 // Add this command to the build stage.
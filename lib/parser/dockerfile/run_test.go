@@ -16,6 +16,7 @@ package dockerfile
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -29,11 +30,24 @@ func TestNewRunDirective(t *testing.T) {
 		succeed bool
 		input   string
 		cmd     string
+		network string
+		timeout time.Duration
 	}{
-		{"good json", true, `run ["this", "cmd"]`, "this cmd"},
-		{"substitution", true, `run ["${prefix}this", "cmd${suffix}"]`, "test_this cmd_test"},
-		{"substitution2", true, `run ["this"$comma "cmd"]`, "this cmd"},
-		{"bad substitution", false, `run ["${prefixthis", "cmd${suffix}"]`, ""},
+		{"good json", true, `run ["this", "cmd"]`, "this cmd", "", 0},
+		{"substitution", true, `run ["${prefix}this", "cmd${suffix}"]`, "test_this cmd_test", "", 0},
+		{"substitution2", true, `run ["this"$comma "cmd"]`, "this cmd", "", 0},
+		{"bad substitution", false, `run ["${prefixthis", "cmd${suffix}"]`, "", "", 0},
+		{"network none", true, `run --network=none  ls  -l`, "ls  -l", "none", 0},
+		{"network host json", true, `run --network=host ["this", "cmd"]`, "this cmd", "host", 0},
+		{"network default", true, `run --network=default ls`, "ls", "", 0},
+		{"bad network", false, `run --network=bridge ls`, "", "", 0},
+		{"network without cmd", false, `run --network=none`, "", "", 0},
+		{"timeout", true, `run --timeout=10m ls`, "ls", "", 10 * time.Minute},
+		{"timeout and network", true, `run --timeout=1h30m --network=none ls`, "ls", "none", 90 * time.Minute},
+		{"network and timeout", true, `run --network=none --timeout=5s ["ls"]`, "ls", "none", 5 * time.Second},
+		{"bad timeout", false, `run --timeout=forever ls`, "", "", 0},
+		{"negative timeout", false, `run --timeout=-1s ls`, "", "", 0},
+		{"timeout without cmd", false, `run --timeout=1s`, "", "", 0},
 	}
 
 	for _, test := range tests {
@@ -45,6 +59,8 @@ func TestNewRunDirective(t *testing.T) {
 				run, ok := directive.(*RunDirective)
 				require.True(ok)
 				require.Equal(test.cmd, run.Cmd)
+				require.Equal(test.network, run.Network)
+				require.Equal(test.timeout, run.Timeout)
 			} else {
 				require.Error(err)
 			}
@@ -24,6 +24,7 @@ import (
 	"net/url"
 	"os"
 	"regexp"
+	"strings"
 	"time"
 
 	"github.com/cenkalti/backoff"
@@ -31,8 +32,10 @@ import (
 
 	"github.com/uber/makisu/lib/concurrency"
 	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/events"
 	"github.com/uber/makisu/lib/log"
 	"github.com/uber/makisu/lib/storage"
+	"github.com/uber/makisu/lib/tario"
 	"github.com/uber/makisu/lib/utils"
 	"github.com/uber/makisu/lib/utils/httputil"
 )
@@ -50,6 +53,8 @@ type Client interface {
 	Push(tag string) error
 	PullManifest(tag string) (*image.DistributionManifest, error)
 	PushManifest(tag string, manifest *image.DistributionManifest) error
+	PullManifestList(tag string) (*image.ManifestList, error)
+	PushManifestList(tag string, list *image.ManifestList) error
 	PullLayer(layerDigest image.Digest) (os.FileInfo, error)
 	PushLayer(layerDigest image.Digest) error
 	PullImageConfig(layerDigest image.Digest) (os.FileInfo, error)
@@ -67,26 +72,44 @@ type DockerRegistryClient struct {
 	registry   string
 	repository string
 
+	// platform is the platform of the manifests picked from manifest lists.
+	platform image.Platform
+
+	// sink receives push progress events. Nil means the global sink.
+	sink events.Sink
+
+	// stats records the bytes transferred by the client.
+	stats *TransferStats
+
 	// TODO: there must be a better way to test this.
 	client *http.Client
 }
 
 // New returns a new default Client.
 func New(store *storage.ImageStore, registry, repository string) *DockerRegistryClient {
-	return newClient(store, registry, repository, nil)
+	return newClient(store, registry, repository, ConfigurationMap, nil)
 }
 
 // NewWithClient returns a new Client with a customized http.Client.
 func NewWithClient(store *storage.ImageStore, registry, repository string, client *http.Client) *DockerRegistryClient {
-	return newClient(store, registry, repository, client)
+	return newClient(store, registry, repository, ConfigurationMap, client)
 }
 
-func newClient(store *storage.ImageStore, registry, repository string, client *http.Client) *DockerRegistryClient {
+// NewWithConfig returns a new Client configured by the given map instead of
+// the global ConfigurationMap.
+func NewWithConfig(store *storage.ImageStore, registry, repository string, configs Map) *DockerRegistryClient {
+	return newClient(store, registry, repository, configs, nil)
+}
+
+func newClient(
+	store *storage.ImageStore, registry, repository string, configs Map,
+	client *http.Client) *DockerRegistryClient {
+
 	config := Config{}
 	if registry == image.DockerHubRegistry {
 		config = DefaultDockerHubConfiguration
 	}
-	repoConfig, ok := ConfigurationMap[registry]
+	repoConfig, ok := configs[registry]
 	if ok {
 		for repo, c := range repoConfig {
 			r := regexp.MustCompile(repo)
@@ -101,10 +124,32 @@ func newClient(store *storage.ImageStore, registry, repository string, client *h
 		registry:   registry,
 		repository: repository,
 		store:      store,
+		platform:   image.HostPlatform(),
+		stats:      DefaultTransferStats,
 		client:     client,
 	}
 }
 
+// SetPlatform sets the platform of the manifests picked from manifest lists
+// and OCI indexes. Defaults to the platform of the host.
+func (c *DockerRegistryClient) SetPlatform(platform image.Platform) {
+	c.platform = platform
+}
+
+// SetEventSink sets the sink receiving push progress events.
+func (c *DockerRegistryClient) SetEventSink(sink events.Sink) {
+	c.sink = sink
+}
+
+// SetTransferStats sets the stats recording the bytes transferred by the
+// client. Nil means DefaultTransferStats.
+func (c *DockerRegistryClient) SetTransferStats(stats *TransferStats) {
+	if stats == nil {
+		stats = DefaultTransferStats
+	}
+	c.stats = stats
+}
+
 // Pull tries to pull an image from its docker registry.
 // If the pull succeeded, it would store the image in the ImageStore of the client, and returns the
 // distribution manifest.
@@ -211,15 +256,118 @@ func (c DockerRegistryClient) Push(tag string) error {
 	return nil
 }
 
-// PullManifest pulls docker image manifest from the docker registry.
+// PullManifest pulls docker or OCI image manifest from the docker registry.
+// If the tag references a manifest list or an OCI index, the manifest of the
+// platform of the client is pulled.
+// If the registry only serves a legacy schema1 manifest, its layers are pulled
+// and it is converted into a docker image manifest, with a synthesized image
+// config saved into the layer store.
 // It does not save the manifest to the store.
 func (c DockerRegistryClient) PullManifest(tag string) (*image.DistributionManifest, error) {
+	ctHeader, body, err := c.pullManifest(tag, image.MediaTypeManifest, image.MediaTypeOCIManifest,
+		image.MediaTypeManifestList, image.MediaTypeOCIIndex,
+		image.MediaTypeSchema1SignedManifest, image.MediaTypeSchema1Manifest)
+	if err != nil {
+		return nil, err
+	}
+	if image.IsSchema1Manifest(ctHeader, body) {
+		manifest, err := c.convertSchema1Manifest(body)
+		if err != nil {
+			return nil, fmt.Errorf("convert schema1 manifest: %s", err)
+		}
+		return manifest, nil
+	} else if image.IsManifestListMediaType(ctHeader) {
+		list, err := image.UnmarshalManifestList(ctHeader, body)
+		if err != nil {
+			return nil, fmt.Errorf("unmarshal manifest list: %s", err)
+		}
+		descriptor, err := list.Select(c.platform)
+		if err != nil {
+			return nil, fmt.Errorf("select manifest: %s", err)
+		}
+		log.Infof("* Selected manifest %s for platform %s", descriptor.Digest, c.platform)
+		ctHeader, body, err = c.pullManifest(
+			string(descriptor.Digest), image.MediaTypeManifest, image.MediaTypeOCIManifest)
+		if err != nil {
+			return nil, err
+		}
+		// Make sure the registry served the manifest referenced by the list.
+		digest, err := image.NewDigester().FromBytes(body)
+		if err != nil {
+			return nil, fmt.Errorf("compute manifest digest: %s", err)
+		} else if digest != descriptor.Digest {
+			return nil, fmt.Errorf("digest %s of manifest doesn't match %s", digest, descriptor.Digest)
+		}
+	}
+	// Parse the manifest according to the content type.
+	manifest, _, err := image.UnmarshalDistributionManifest(ctHeader, body)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal distribution manifest: %s", err)
+	}
+	return &manifest, nil
+}
+
+// convertSchema1Manifest converts a legacy schema1 manifest into a schema2
+// manifest. Its layers are pulled to compute their uncompressed digests, and
+// the synthesized image config is saved into the layer store.
+func (c DockerRegistryClient) convertSchema1Manifest(body []byte) (*image.DistributionManifest, error) {
+	schema1, err := image.UnmarshalSchema1Manifest(body)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal schema1 manifest: %s", err)
+	}
+	layerDigests, err := schema1.GetLayerDigests()
+	if err != nil {
+		return nil, fmt.Errorf("get layer digests: %s", err)
+	}
+	log.Infof("* Converting schema1 manifest of %s/%s", c.registry, c.repository)
+
+	layers := make([]image.Descriptor, len(layerDigests))
+	diffIDs := make([]image.Digest, len(layerDigests))
+	for i, layerDigest := range layerDigests {
+		info, err := c.PullLayer(layerDigest)
+		if err != nil {
+			return nil, fmt.Errorf("pull layer %s: %s", layerDigest, err)
+		}
+		diffID, err := c.computeDiffID(layerDigest)
+		if err != nil {
+			return nil, fmt.Errorf("compute diff id of layer %s: %s", layerDigest, err)
+		}
+		layers[i] = image.Descriptor{
+			MediaType: image.MediaTypeLayer,
+			Size:      info.Size(),
+			Digest:    layerDigest,
+		}
+		diffIDs[i] = diffID
+	}
+
+	config, err := schema1.NewImageConfig(diffIDs)
+	if err != nil {
+		return nil, fmt.Errorf("create image config: %s", err)
+	}
+	configDigest, err := image.NewDigester().FromBytes(config)
+	if err != nil {
+		return nil, fmt.Errorf("compute image config digest: %s", err)
+	}
+	if err := c.saveImageConfig(configDigest, config); err != nil {
+		return nil, fmt.Errorf("save image config: %s", err)
+	}
+	return image.NewDistributionManifest(image.MediaTypeManifest, image.Descriptor{
+		Size:   int64(len(config)),
+		Digest: configDigest,
+	}, layers)
+}
+
+// pullManifest pulls the manifest with the given tag or digest, accepting the
+// given media types. It returns the content type and the body of the response.
+func (c DockerRegistryClient) pullManifest(
+	reference string, mediaTypes ...string) (string, []byte, error) {
+
 	opt, err := c.config.Security.GetHTTPOption(c.registry, c.repository)
 	if err != nil {
-		return nil, fmt.Errorf("get security opt: %s", err)
+		return "", nil, fmt.Errorf("get security opt: %s", err)
 	}
 
-	URL := fmt.Sprintf(baseManifestQuery, c.registry, c.repository, tag)
+	URL := fmt.Sprintf(baseManifestQuery, c.registry, c.repository, reference)
 	resp, err := httputil.Send(
 		"GET",
 		URL,
@@ -228,38 +376,98 @@ func (c DockerRegistryClient) PullManifest(tag string) (*image.DistributionManif
 		httputil.SendTimeout(c.config.Timeout),
 		c.config.sendRetry(),
 		httputil.SendAcceptedCodes(http.StatusOK, http.StatusNotFound, http.StatusBadRequest),
-		httputil.SendHeaders(map[string]string{"Accept": image.MediaTypeManifest}))
+		httputil.SendHeaders(map[string]string{"Accept": strings.Join(mediaTypes, ", ")}))
 	if err != nil {
-		return nil, fmt.Errorf("http send error: %s", err)
+		return "", nil, fmt.Errorf("http send error: %s", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusBadRequest {
-		return nil, fmt.Errorf("manifest not found")
+		return "", nil, fmt.Errorf("manifest not found")
 	} else if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("bad pull manifest request resp code: %d", resp.StatusCode)
+		return "", nil, fmt.Errorf("bad pull manifest request resp code: %d", resp.StatusCode)
 	}
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("read resp body: %s", err)
+		return "", nil, fmt.Errorf("read resp body: %s", err)
 	}
-	// Parse the manifest according to the content type.
-	ctHeader := resp.Header.Get("Content-Type")
-	manifest, _, err := image.UnmarshalDistributionManifest(ctHeader, body)
+	c.stats.AddPulled(c.registry, int64(len(body)))
+	return resp.Header.Get("Content-Type"), body, nil
+}
+
+// PullManifestDescriptor pulls the docker or OCI image manifest with the given
+// tag from the docker registry, and returns it along with its descriptor.
+// Unlike PullManifest, it does not resolve manifest lists.
+// It does not save the manifest to the store.
+func (c DockerRegistryClient) PullManifestDescriptor(
+	tag string) (*image.DistributionManifest, image.Descriptor, error) {
+
+	ctHeader, body, err := c.pullManifest(tag, image.MediaTypeManifest, image.MediaTypeOCIManifest)
 	if err != nil {
-		return nil, fmt.Errorf("unmarshal distribution manifest: %s", err)
+		return nil, image.Descriptor{}, err
 	}
-	return &manifest, nil
+	manifest, descriptor, err := image.UnmarshalDistributionManifest(ctHeader, body)
+	if err != nil {
+		return nil, image.Descriptor{}, fmt.Errorf("unmarshal distribution manifest: %s", err)
+	}
+	return &manifest, descriptor, nil
+}
+
+// PullManifestList pulls the manifest list or OCI index with the given tag
+// from the docker registry.
+func (c DockerRegistryClient) PullManifestList(tag string) (*image.ManifestList, error) {
+	ctHeader, body, err := c.pullManifest(tag, image.MediaTypeManifestList, image.MediaTypeOCIIndex)
+	if err != nil {
+		return nil, err
+	}
+	list, err := image.UnmarshalManifestList(ctHeader, body)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal manifest list: %s", err)
+	}
+	return &list, nil
+}
+
+// ResolveDigest returns the digest of the manifest, manifest list or OCI index
+// referenced by the tag. Signed schema1 manifests are hashed without their
+// signatures, like registries do.
+func (c DockerRegistryClient) ResolveDigest(tag string) (image.Digest, error) {
+	ctHeader, body, err := c.pullManifest(tag, image.MediaTypeManifest, image.MediaTypeOCIManifest,
+		image.MediaTypeManifestList, image.MediaTypeOCIIndex,
+		image.MediaTypeSchema1SignedManifest, image.MediaTypeSchema1Manifest)
+	if err != nil {
+		return "", err
+	}
+	if image.IsSchema1Manifest(ctHeader, body) {
+		return image.Schema1ManifestDigest(body)
+	}
+	return image.NewDigester().FromBytes(body)
 }
 
 // PushManifest pushes the manifest to the registry.
 func (c DockerRegistryClient) PushManifest(tag string, manifest *image.DistributionManifest) error {
-	payload, err := json.MarshalIndent(manifest, "", "   ")
+	// Marshal the manifest the same way it's saved in the local store, so the
+	// digest computed by the registry matches the local one.
+	payload, err := json.Marshal(manifest)
 	if err != nil {
 		return fmt.Errorf("marshal manifest: %s", err)
 	}
+	return c.pushManifest(tag, manifest.MediaType, payload)
+}
+
+// PushManifestList pushes the manifest list or OCI index to the registry.
+// The manifests it references must already exist in the repository.
+func (c DockerRegistryClient) PushManifestList(tag string, list *image.ManifestList) error {
+	payload, err := json.Marshal(list)
+	if err != nil {
+		return fmt.Errorf("marshal manifest list: %s", err)
+	}
+	return c.pushManifest(tag, list.MediaType, payload)
+}
+
+// pushManifest pushes the payload of a manifest of the given media type.
+func (c DockerRegistryClient) pushManifest(tag, mediaType string, payload []byte) error {
 	headers := map[string]string{
-		"Content-Type": manifest.MediaType,
+		"Content-Type": mediaType,
 		"Host":         c.registry,
 	}
 	opt, err := c.config.Security.GetHTTPOption(c.registry, c.repository)
@@ -282,6 +490,7 @@ func (c DockerRegistryClient) PushManifest(tag string, manifest *image.Distribut
 		return err
 	}
 	defer resp.Body.Close()
+	c.stats.AddPushed(c.registry, int64(len(payload)))
 	return nil
 }
 
@@ -342,9 +551,11 @@ func (c DockerRegistryClient) pullLayerHelper(
 	}
 	defer w.Close()
 
-	if _, err := io.Copy(w, resp.Body); err != nil {
+	n, err := io.Copy(w, resp.Body)
+	if err != nil {
 		return nil, fmt.Errorf("copy layer file: %s", err)
 	}
+	c.stats.AddPulled(c.registry, n)
 	if err := c.saveLayer(layerDigest); err != nil {
 		return nil, fmt.Errorf("save layer file: %s", err)
 	}
@@ -540,6 +751,15 @@ func (c DockerRegistryClient) pushLayerContent(digest image.Digest, location str
 		if err != nil {
 			return location, fmt.Errorf("push layer chunk: %w", err)
 		}
+		c.stats.AddPushed(c.registry, endInclusive+1-start)
+		events.EmitTo(c.sink, &events.Event{
+			Type:       events.PushProgress,
+			Registry:   c.registry,
+			Repository: c.repository,
+			Digest:     string(digest),
+			Bytes:      endInclusive + 1,
+			Size:       size,
+		})
 		start, endInclusive = endInclusive+1, utils.Min(start+pushChunk-1, size-1)
 	}
 	return location, nil
@@ -632,6 +852,44 @@ func (c DockerRegistryClient) saveLayer(layerDigest image.Digest) error {
 	return nil
 }
 
+// computeDiffID returns the digest of the uncompressed content of the given
+// gzipped layer in the local store.
+func (c DockerRegistryClient) computeDiffID(layerDigest image.Digest) (image.Digest, error) {
+	r, err := c.store.Layers.GetStoreFileReader(layerDigest.Hex())
+	if err != nil {
+		return "", fmt.Errorf("get layer file reader: %s", err)
+	}
+	defer r.Close()
+	gzipReader, err := tario.NewGzipReader(r)
+	if err != nil {
+		return "", fmt.Errorf("create gzip reader: %s", err)
+	}
+	defer gzipReader.Close()
+	return image.NewDigester().FromReader(gzipReader)
+}
+
+// saveImageConfig saves given image config into the layer store.
+func (c DockerRegistryClient) saveImageConfig(configDigest image.Digest, config []byte) error {
+	if _, err := c.store.Layers.GetDownloadOrCacheFileStat(configDigest.Hex()); err == nil {
+		return nil
+	}
+	if err := c.store.Layers.CreateDownloadFile(configDigest.Hex(), 0); err != nil {
+		return fmt.Errorf("create image config file: %s", err)
+	}
+	w, err := c.store.Layers.GetDownloadFileReadWriter(configDigest.Hex())
+	if err != nil {
+		return fmt.Errorf("get image config file readwriter: %s", err)
+	}
+	defer w.Close()
+	if _, err := w.Write(config); err != nil {
+		return fmt.Errorf("write image config: %s", err)
+	}
+	if err := c.store.Layers.MoveDownloadFileToStore(configDigest.Hex()); err != nil && !os.IsExist(err) {
+		return fmt.Errorf("commit image config to store: %s", err)
+	}
+	return nil
+}
+
 // saveManifest saves given distribution manifest into local store.
 func (c DockerRegistryClient) saveManifest(tag string, manifest *image.DistributionManifest) error {
 	if _, err := c.store.Manifests.GetDownloadOrCacheFileStat(c.repository, tag); err == nil {
@@ -22,8 +22,8 @@ import (
 	"path"
 	"testing"
 
-	"github.com/uber/makisu/lib/context"
 	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/storage"
 	"github.com/uber/makisu/lib/utils/testutil"
 
 	"github.com/stretchr/testify/require"
@@ -31,10 +31,10 @@ import (
 
 func TestPullManifest(t *testing.T) {
 	require := require.New(t)
-	ctx, cleanup := context.BuildContextFixture()
+	store, cleanup := storage.StoreFixture()
 	defer cleanup()
 
-	p, err := PullClientFixtureWithAlpine(ctx)
+	p, err := PullClientFixtureWithAlpine(store)
 	require.NoError(err)
 
 	// Pull manifest.
@@ -42,12 +42,82 @@ func TestPullManifest(t *testing.T) {
 	require.NoError(err)
 }
 
+func TestPullManifestFromList(t *testing.T) {
+	require := require.New(t)
+	store, cleanup := storage.StoreFixture()
+	defer cleanup()
+
+	riscv64 := image.Platform{OS: "linux", Architecture: "riscv64"}
+	p, err := PullClientFixtureWithAlpineList(store, riscv64)
+	require.NoError(err)
+
+	// No manifest for the default platform.
+	_, err = p.PullManifest(testutil.SampleImageTag)
+	require.Error(err)
+
+	p.SetPlatform(riscv64)
+	manifest, err := p.PullManifest(testutil.SampleImageTag)
+	require.NoError(err)
+	require.Len(manifest.Layers, 1)
+
+	// The selected manifest must match its digest in the list.
+	transport := p.client.Transport.(pullTransportFixture)
+	transport.manifestPath = path.Join(_testFileDirAlpineOCI, "test_distribution_manifest")
+	p.client.Transport = transport
+	_, err = p.PullManifest(testutil.SampleImageTag)
+	require.Error(err)
+	require.Contains(err.Error(), "doesn't match")
+}
+
+func TestPullManifestList(t *testing.T) {
+	require := require.New(t)
+	store, cleanup := storage.StoreFixture()
+	defer cleanup()
+
+	riscv64 := image.Platform{OS: "linux", Architecture: "riscv64"}
+	p, err := PullClientFixtureWithAlpineList(store, riscv64)
+	require.NoError(err)
+
+	list, err := p.PullManifestList(testutil.SampleImageTag)
+	require.NoError(err)
+	require.Equal(image.MediaTypeManifestList, list.MediaType)
+	require.Len(list.Manifests, 2)
+	require.Equal(riscv64, *list.Manifests[1].Platform)
+
+	// The tag of a regular image does not reference a manifest list.
+	p, err = PullClientFixtureWithAlpine(store)
+	require.NoError(err)
+	_, err = p.PullManifestList(testutil.SampleImageTag)
+	require.Error(err)
+}
+
+func TestPullManifestDescriptor(t *testing.T) {
+	require := require.New(t)
+	store, cleanup := storage.StoreFixture()
+	defer cleanup()
+
+	p, err := PullClientFixtureWithAlpine(store)
+	require.NoError(err)
+
+	manifest, descriptor, err := p.PullManifestDescriptor(testutil.SampleImageTag)
+	require.NoError(err)
+	require.Len(manifest.Layers, 1)
+
+	content, err := ioutil.ReadFile(path.Join(_testFileDirAlpine, "test_distribution_manifest"))
+	require.NoError(err)
+	digest, err := image.NewDigester().FromBytes(content)
+	require.NoError(err)
+	require.Equal(image.MediaTypeManifest, descriptor.MediaType)
+	require.Equal(int64(len(content)), descriptor.Size)
+	require.Equal(digest, descriptor.Digest)
+}
+
 func TestPullImage(t *testing.T) {
 	require := require.New(t)
-	ctx, cleanup := context.BuildContextFixture()
+	store, cleanup := storage.StoreFixture()
 	defer cleanup()
 
-	p, err := PullClientFixtureWithAlpine(ctx)
+	p, err := PullClientFixtureWithAlpine(store)
 	require.NoError(err)
 
 	// Pull image.
@@ -61,12 +131,104 @@ func TestPullImage(t *testing.T) {
 	require.NoError(err)
 }
 
+func TestPullOCIImage(t *testing.T) {
+	require := require.New(t)
+	store, cleanup := storage.StoreFixture()
+	defer cleanup()
+
+	p, err := PullClientFixtureWithAlpineOCI(store)
+	require.NoError(err)
+
+	manifest, err := p.Pull(testutil.SampleImageTag)
+	require.NoError(err)
+	require.Equal(image.MediaTypeOCIManifest, manifest.MediaType)
+	require.Equal(image.MediaTypeOCIConfig, manifest.Config.MediaType)
+	require.Equal(image.MediaTypeOCILayer, manifest.Layers[0].MediaType)
+
+	_, err = p.store.Layers.GetStoreFileStat("393ccd5c4dd90344c9d725125e13f636ce0087c62f5ca89050faaacbb9e3ed5b")
+	require.NoError(err)
+
+	// The media type is kept in the store.
+	r, err := p.store.Manifests.GetStoreFileReader(testutil.SampleImageRepoName, testutil.SampleImageTag)
+	require.NoError(err)
+	defer r.Close()
+	content, err := ioutil.ReadAll(r)
+	require.NoError(err)
+	stored, _, err := image.UnmarshalDistributionManifest("", content)
+	require.NoError(err)
+	require.Equal(*manifest, stored)
+
+	_, descriptor, err := p.PullManifestDescriptor(testutil.SampleImageTag)
+	require.NoError(err)
+	require.Equal(image.MediaTypeOCIManifest, descriptor.MediaType)
+}
+
+func TestPullSchema1Image(t *testing.T) {
+	require := require.New(t)
+	store, cleanup := storage.StoreFixture()
+	defer cleanup()
+
+	p, err := PullClientFixtureWithAlpineSchema1(store)
+	require.NoError(err)
+
+	manifest, err := p.Pull(testutil.SampleImageTag)
+	require.NoError(err)
+	require.Equal(image.MediaTypeManifest, manifest.MediaType)
+	require.Equal(image.MediaTypeConfig, manifest.Config.MediaType)
+
+	// The throwaway layer is skipped.
+	require.Equal([]image.Digest{
+		"sha256:393ccd5c4dd90344c9d725125e13f636ce0087c62f5ca89050faaacbb9e3ed5b",
+	}, manifest.GetLayerDigests())
+	info, err := p.store.Layers.GetStoreFileStat("393ccd5c4dd90344c9d725125e13f636ce0087c62f5ca89050faaacbb9e3ed5b")
+	require.NoError(err)
+	require.Equal(info.Size(), manifest.Layers[0].Size)
+
+	// The synthesized image config is saved in the store.
+	r, err := p.store.Layers.GetStoreFileReader(manifest.GetConfigDigest().Hex())
+	require.NoError(err)
+	defer r.Close()
+	content, err := ioutil.ReadAll(r)
+	require.NoError(err)
+	require.Equal(manifest.Config.Size, int64(len(content)))
+	config, err := image.NewImageConfigFromJSON(content)
+	require.NoError(err)
+	require.Equal([]image.Digest{
+		"sha256:4ac76077f2c741c856a2419dfdb0804b18e48d2e1a9ce9c6a3f0605a2078caba",
+	}, config.RootFS.DiffIDs)
+	require.Equal([]string{"sh"}, config.Config.Cmd)
+	require.Len(config.History, 2)
+	require.True(config.History[1].EmptyLayer)
+
+	_, err = p.store.Manifests.GetStoreFileStat(testutil.SampleImageRepoName, testutil.SampleImageTag)
+	require.NoError(err)
+}
+
+func TestPullSchema1ImageByDigest(t *testing.T) {
+	require := require.New(t)
+	store, cleanup := storage.StoreFixture()
+	defer cleanup()
+
+	p, err := PullClientFixtureWithAlpineSchema1(store)
+	require.NoError(err)
+
+	// The digest excludes the signatures of the manifest, so it can be pulled
+	// by that digest.
+	digest, err := p.ResolveDigest(testutil.SampleImageTag)
+	require.NoError(err)
+	require.Equal(image.Digest(
+		"sha256:ebfb4e2172603ba9518297bbcd1666b44ece960b85988e585184e687fc4ea103"), digest)
+	manifest, err := p.Pull(string(digest))
+	require.NoError(err)
+	require.Equal(image.MediaTypeManifest, manifest.MediaType)
+}
+
 func TestPullImageWithDuplicateLayers(t *testing.T) {
 	require := require.New(t)
-	ctx, cleanup := context.BuildContextFixture()
+	store, cleanup := storage.StoreFixture()
 	defer cleanup()
 
-	p, err := PullClientFixtureWithAlpineDup(ctx)
+	p, err := PullClientFixtureWithAlpineDup(store)
 	require.NoError(err)
 
 	// Pull image.
@@ -82,22 +244,22 @@ func TestPullImageWithDuplicateLayers(t *testing.T) {
 
 func TestPullWithExistingLayerInCache(t *testing.T) {
 	require := require.New(t)
-	ctx, cleanup := context.BuildContextFixture()
+	store, cleanup := storage.StoreFixture()
 	defer cleanup()
 
-	p, err := PullClientFixtureWithAlpine(ctx)
+	p, err := PullClientFixtureWithAlpine(store)
 	require.NoError(err)
 
 	// Put layer in store first.
 	layerTarData, err := ioutil.ReadFile(path.Join(_testFileDirAlpine, "test_layer.tar"))
 	require.NoError(err)
-	err = ctx.ImageStore.Layers.CreateDownloadFile("393ccd5c4dd90344c9d725125e13f636ce0087c62f5ca89050faaacbb9e3ed5b", 0)
+	err = store.Layers.CreateDownloadFile("393ccd5c4dd90344c9d725125e13f636ce0087c62f5ca89050faaacbb9e3ed5b", 0)
 	require.NoError(err)
-	w, err := ctx.ImageStore.Layers.GetDownloadFileReadWriter("393ccd5c4dd90344c9d725125e13f636ce0087c62f5ca89050faaacbb9e3ed5b")
+	w, err := store.Layers.GetDownloadFileReadWriter("393ccd5c4dd90344c9d725125e13f636ce0087c62f5ca89050faaacbb9e3ed5b")
 	require.NoError(err)
 	_, err = w.Write(layerTarData)
 	require.NoError(err)
-	require.NoError(ctx.ImageStore.Layers.MoveDownloadFileToStore("393ccd5c4dd90344c9d725125e13f636ce0087c62f5ca89050faaacbb9e3ed5b"))
+	require.NoError(store.Layers.MoveDownloadFileToStore("393ccd5c4dd90344c9d725125e13f636ce0087c62f5ca89050faaacbb9e3ed5b"))
 
 	// Pull image.
 	_, err = p.Pull(testutil.SampleImageTag)
@@ -111,10 +273,10 @@ func TestPullWithExistingLayerInCache(t *testing.T) {
 
 func TestManifestExists(t *testing.T) {
 	require := require.New(t)
-	ctx, cleanup := context.BuildContextFixture()
+	store, cleanup := storage.StoreFixture()
 	defer cleanup()
 
-	p, err := PullClientFixtureWithAlpine(ctx)
+	p, err := PullClientFixtureWithAlpine(store)
 	require.NoError(err)
 
 	exists, err := p.manifestExists(testutil.SampleImageTag)
@@ -124,10 +286,10 @@ func TestManifestExists(t *testing.T) {
 
 func TestLayerExists(t *testing.T) {
 	require := require.New(t)
-	ctx, cleanup := context.BuildContextFixture()
+	store, cleanup := storage.StoreFixture()
 	defer cleanup()
 
-	p, err := PullClientFixtureWithAlpine(ctx)
+	p, err := PullClientFixtureWithAlpine(store)
 	require.NoError(err)
 
 	exists, err := p.layerExists("sha256:" + testutil.SampleLayerTarDigest)
@@ -137,28 +299,41 @@ func TestLayerExists(t *testing.T) {
 
 func TestPushManifest(t *testing.T) {
 	require := require.New(t)
-	ctx, cleanup := context.BuildContextFixture()
+	store, cleanup := storage.StoreFixture()
 	defer cleanup()
 
-	p, err := PushClientFixture(ctx)
+	p, err := PushClientFixture(store)
 	require.NoError(err)
 
 	require.NoError(p.PushManifest(testutil.SampleImageTag, &image.DistributionManifest{}))
 }
 
+func TestPushManifestList(t *testing.T) {
+	require := require.New(t)
+	store, cleanup := storage.StoreFixture()
+	defer cleanup()
+
+	p, err := PushClientFixture(store)
+	require.NoError(err)
+
+	list, err := image.NewManifestList(image.MediaTypeManifestList)
+	require.NoError(err)
+	require.NoError(p.PushManifestList(testutil.SampleImageTag, list))
+}
+
 func TestPushImage(t *testing.T) {
 	require := require.New(t)
-	ctx, cleanup := context.BuildContextFixtureWithSampleImage()
+	store, cleanup := storage.StoreFixtureWithSampleImage()
 	defer cleanup()
 
-	p, err := PushClientFixture(ctx)
+	p, err := PushClientFixture(store)
 	require.NoError(err)
 	require.NoError(p.Push(testutil.SampleImageTag))
 }
 
 func TestPushLayerRetry(t *testing.T) {
 	require := require.New(t)
-	ctx, cleanup := context.BuildContextFixtureWithSampleImage()
+	store, cleanup := storage.StoreFixtureWithSampleImage()
 	defer cleanup()
 
 	digest := image.Digest("sha256:" + testutil.SampleLayerTarDigest)
@@ -174,7 +349,7 @@ func TestPushLayerRetry(t *testing.T) {
 			Header:     make(http.Header),
 		},
 	}
-	p, err := PushClientFixture(ctx, responseOverride)
+	p, err := PushClientFixture(store, responseOverride)
 	require.NoError(err)
 	p.config.Retries = 1
 	commitError := fmt.Sprintf("commit layer push %s: commit: PUT "+url+" 503", digest)
@@ -183,10 +358,10 @@ func TestPushLayerRetry(t *testing.T) {
 
 func TestPushLayerNoRetry(t *testing.T) {
 	require := require.New(t)
-	ctx, cleanup := context.BuildContextFixtureWithSampleImage()
+	store, cleanup := storage.StoreFixtureWithSampleImage()
 	defer cleanup()
 
-	p, err := PushClientFixture(ctx)
+	p, err := PushClientFixture(store)
 	require.NoError(err)
 	p.config.Retries = 1
 	require.EqualError(p.PushLayer(image.NewEmptyDigest()), "push layer content : get layer file stat: file does not exist")
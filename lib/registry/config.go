@@ -111,28 +111,44 @@ func (c *Config) sendRetry() httputil.SendOption {
 // - a JSON string of the configuration
 // - a path to a YAML file
 func UpdateGlobalConfig(registryConfig string) error {
+	config, err := ParseConfig(registryConfig)
+	if err != nil {
+		return err
+	}
+	ConfigurationMap.Merge(config)
+	return nil
+}
+
+// ParseConfig parses the registry config given either:
+// - a JSON string of the configuration
+// - a path to a YAML file
+func ParseConfig(registryConfig string) (Map, error) {
 	config := make(Map)
 	if utils.IsValidJSON([]byte(registryConfig)) {
 		if err := json.Unmarshal([]byte(registryConfig), &config); err != nil {
-			return fmt.Errorf("unmarshal registry config: %s", err)
+			return nil, fmt.Errorf("unmarshal registry config: %s", err)
 		}
 	} else {
 		data, err := ioutil.ReadFile(registryConfig)
 		if err != nil {
-			return fmt.Errorf("read registry config: %s", err)
+			return nil, fmt.Errorf("read registry config: %s", err)
 		}
 		if err := yaml.Unmarshal(data, &config); err != nil {
-			return fmt.Errorf("unmarshal registry config: %s", err)
+			return nil, fmt.Errorf("unmarshal registry config: %s", err)
 		}
 	}
+	return config, nil
+}
 
-	for reg, repoConfig := range config {
-		if _, ok := ConfigurationMap[reg]; !ok {
-			ConfigurationMap[reg] = make(RepositoryMap)
+// Merge adds the repo configs of the given map to m, overriding the existing
+// ones.
+func (m Map) Merge(other Map) {
+	for reg, repoConfig := range other {
+		if _, ok := m[reg]; !ok {
+			m[reg] = make(RepositoryMap)
 		}
 		for repo, config := range repoConfig {
-			ConfigurationMap[reg][repo] = config
+			m[reg][repo] = config
 		}
 	}
-	return nil
 }
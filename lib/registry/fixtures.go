@@ -49,6 +49,16 @@ func (noopClientFixture) PushManifest(tag string, manifest *image.DistributionMa
 	return nil
 }
 
+// PullManifestList implements registry.Client.PullManifestList.
+func (noopClientFixture) PullManifestList(tag string) (*image.ManifestList, error) {
+	return nil, nil
+}
+
+// PushManifestList implements registry.Client.PushManifestList.
+func (noopClientFixture) PushManifestList(tag string, list *image.ManifestList) error {
+	return nil
+}
+
 // PullLayer implements registry.Client.PullLayer.
 func (noopClientFixture) PullLayer(layerDigest image.Digest) (os.FileInfo, error) {
 	return nil, nil
@@ -2,26 +2,31 @@ package registry
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 
-	"github.com/uber/makisu/lib/context"
 	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/storage"
 	"github.com/uber/makisu/lib/utils/testutil"
 )
 
 const (
 	_testFileDirAlpine    = "../../testdata/files/alpine"
 	_testFileDirAlpineDup = "../../testdata/files/alpine_dup"
+	_testFileDirAlpineOCI = "../../testdata/files/alpine_oci"
+
+	_testFileDirAlpineSchema1 = "../../testdata/files/alpine_schema1"
 )
 
 // PullClientFixture returns a new registry client fixture that can handle image
 // pull requests using a local alpine test image.
-func PullClientFixtureWithAlpine(ctx *context.BuildContext) (*DockerRegistryClient, error) {
-	return PullClientFixture(ctx,
+func PullClientFixtureWithAlpine(store *storage.ImageStore) (*DockerRegistryClient, error) {
+	return PullClientFixture(store,
 		filepath.Join(_testFileDirAlpine, "test_distribution_manifest"),
 		filepath.Join(_testFileDirAlpine, "test_image_config"),
 		filepath.Join(_testFileDirAlpine, "test_layer.tar"))
@@ -29,39 +34,155 @@ func PullClientFixtureWithAlpine(ctx *context.BuildContext) (*DockerRegistryClie
 
 // PullClientFixture returns a new registry client fixture that can handle image
 // pull requests using a local alpine test image that contains duplicate layers.
-func PullClientFixtureWithAlpineDup(ctx *context.BuildContext) (*DockerRegistryClient, error) {
-	return PullClientFixture(ctx,
+func PullClientFixtureWithAlpineDup(store *storage.ImageStore) (*DockerRegistryClient, error) {
+	return PullClientFixture(store,
 		filepath.Join(_testFileDirAlpineDup, "test_distribution_manifest"),
 		filepath.Join(_testFileDirAlpine, "test_image_config"),
 		filepath.Join(_testFileDirAlpine, "test_layer.tar"))
 }
 
+// PullClientFixtureWithAlpineOCI returns a new registry client fixture that
+// can handle image pull requests using the local alpine test image, with an
+// OCI image manifest.
+func PullClientFixtureWithAlpineOCI(store *storage.ImageStore) (*DockerRegistryClient, error) {
+	c, err := PullClientFixture(store,
+		filepath.Join(_testFileDirAlpineOCI, "test_distribution_manifest"),
+		filepath.Join(_testFileDirAlpine, "test_image_config"),
+		filepath.Join(_testFileDirAlpine, "test_layer.tar"))
+	if err != nil {
+		return nil, err
+	}
+	transport := c.client.Transport.(pullTransportFixture)
+	transport.manifestMediaType = image.MediaTypeOCIManifest
+	c.client.Transport = transport
+	return c, nil
+}
+
+// PullClientFixtureWithAlpineSchema1 returns a new registry client fixture
+// that can handle image pull requests using the local alpine test image, with
+// a signed schema1 manifest.
+func PullClientFixtureWithAlpineSchema1(store *storage.ImageStore) (*DockerRegistryClient, error) {
+	return PullSchema1ClientFixture(store,
+		filepath.Join(_testFileDirAlpineSchema1, "test_distribution_manifest"),
+		filepath.Join(_testFileDirAlpine, "test_layer.tar"))
+}
+
+// PullSchema1ClientFixture returns a new registry client fixture that can
+// handle image pull requests of an image with a signed schema1 manifest. Like
+// registries, it serves the manifest by the digest of its unsigned payload.
+func PullSchema1ClientFixture(
+	store *storage.ImageStore, manifestPath, layerTarPath string) (*DockerRegistryClient, error) {
+
+	c, err := PullClientFixture(store, manifestPath, "", layerTarPath)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	transport := c.client.Transport.(pullTransportFixture)
+	transport.manifestMediaType = image.MediaTypeSchema1SignedManifest
+	if transport.manifestDigest, err = image.Schema1ManifestDigest(manifest); err != nil {
+		return nil, err
+	}
+	c.client.Transport = transport
+	return c, nil
+}
+
+// PullClientFixtureWithAlpineList returns a new registry client fixture that
+// can handle image pull requests using a manifest list, that references the
+// local alpine test image for the given platform and missing images for others.
+func PullClientFixtureWithAlpineList(
+	store *storage.ImageStore, platform image.Platform) (*DockerRegistryClient, error) {
+
+	c, err := PullClientFixtureWithAlpine(store)
+	if err != nil {
+		return nil, err
+	}
+	transport := c.client.Transport.(pullTransportFixture)
+	other := image.Platform{OS: "linux", Architecture: "s390x"}
+	list, err := json.Marshal(image.ManifestList{
+		SchemaVersion: 2,
+		MediaType:     image.MediaTypeManifestList,
+		Manifests: []image.ManifestListEntry{
+			{
+				Descriptor: image.Descriptor{
+					MediaType: image.MediaTypeManifest,
+					Digest:    image.Digest("sha256:" + strings.Repeat("0", 64)),
+				},
+				Platform: &other,
+			},
+			{
+				Descriptor: image.Descriptor{
+					MediaType: image.MediaTypeManifest,
+					Digest:    transport.manifestDigest,
+				},
+				Platform: &platform,
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	transport.manifestList = list
+	c.client.Transport = transport
+	return c, nil
+}
+
 // PullClientFixture returns a new registry client fixture that can handle image
 // pull requests.
 func PullClientFixture(
-	ctx *context.BuildContext, manifestPath, imageConfigPath, layerTarPath string,
+	store *storage.ImageStore, manifestPath, imageConfigPath, layerTarPath string,
 ) (*DockerRegistryClient, error) {
 
 	imageName := image.MustParseName(
 		fmt.Sprintf("localhost:5055/%s:%s", testutil.SampleImageRepoName, testutil.SampleImageTag))
+	manifest, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	manifestDigest, err := image.NewDigester().FromBytes(manifest)
+	if err != nil {
+		return nil, err
+	}
 	cli := &http.Client{
 		Transport: pullTransportFixture{
-			imageName:       imageName,
-			manifestPath:    manifestPath,
-			imageConfigPath: imageConfigPath,
-			layerTarPath:    layerTarPath,
+			imageName:         imageName,
+			manifestPath:      manifestPath,
+			manifestMediaType: image.MediaTypeManifest,
+			manifestDigest:    manifestDigest,
+			imageConfigPath:   imageConfigPath,
+			layerTarPath:      layerTarPath,
 		},
 	}
-	c := NewWithClient(ctx.ImageStore, imageName.GetRegistry(), imageName.GetRepository(), cli)
+	c := NewWithClient(store, imageName.GetRegistry(), imageName.GetRepository(), cli)
 	c.config.Security.TLS.Client.Disabled = true
 	return c, nil
 }
 
 type pullTransportFixture struct {
-	imageName       image.Name
-	manifestPath    string
-	imageConfigPath string
-	layerTarPath    string
+	imageName         image.Name
+	manifestPath      string
+	manifestMediaType string
+	imageConfigPath   string
+	layerTarPath      string
+
+	// The manifest is also returned for its digest.
+	manifestDigest image.Digest
+
+	// If set, manifestList is returned for the tag of the image.
+	manifestList []byte
+}
+
+func (t pullTransportFixture) manifestListResponse() (*http.Response, error) {
+	header := make(http.Header)
+	header.Add("Content-Type", image.MediaTypeManifestList)
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(bytes.NewReader(t.manifestList)),
+		Header:     header,
+	}, nil
 }
 
 func (t pullTransportFixture) manifestResponse() (*http.Response, error) {
@@ -70,7 +191,7 @@ func (t pullTransportFixture) manifestResponse() (*http.Response, error) {
 		return nil, err
 	}
 	header := make(http.Header)
-	header.Add("Content-Type", "application/vnd.docker.distribution.manifest.v2+json")
+	header.Add("Content-Type", t.manifestMediaType)
 	return &http.Response{
 		StatusCode: http.StatusOK,
 		Body:       manifest,
@@ -125,7 +246,11 @@ func (t pullTransportFixture) RoundTrip(r *http.Request) (*http.Response, error)
 		}, nil
 	}
 
-	if r.URL.String() == manifestURL {
+	if t.manifestList != nil && r.URL.String() == manifestURL {
+		return t.manifestListResponse()
+	} else if r.URL.String() == repoURL+"/manifests/"+string(t.manifestDigest) {
+		return t.manifestResponse()
+	} else if r.URL.String() == manifestURL {
 		return t.manifestResponse()
 	} else if r.URL.String() == imageConfigURL {
 		return t.imageConfigResponse()
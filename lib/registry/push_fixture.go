@@ -7,19 +7,19 @@ import (
 	"net/http"
 	"strings"
 
-	"github.com/uber/makisu/lib/context"
 	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/storage"
 	"github.com/uber/makisu/lib/utils/testutil"
 )
 
 // PushClientFixture returns a new registry client fixture that can handle
 // image push requests.
-func PushClientFixture(ctx *context.BuildContext, overrides ...responseOverride) (*DockerRegistryClient, error) {
+func PushClientFixture(store *storage.ImageStore, overrides ...responseOverride) (*DockerRegistryClient, error) {
 	image := image.MustParseName(fmt.Sprintf("localhost:5055/%s:%s", testutil.SampleImageRepoName, testutil.SampleImageTag))
 	cli := &http.Client{
 		Transport: newPushTransportFixture(image, overrides...),
 	}
-	c := NewWithClient(ctx.ImageStore, image.GetRegistry(), image.GetRepository(), cli)
+	c := NewWithClient(store, image.GetRegistry(), image.GetRepository(), cli)
 	c.config.Security.TLS.Client.Disabled = true
 	return c, nil
 }
@@ -0,0 +1,77 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import "sync"
+
+// DefaultTransferStats records the bytes transferred by registry clients that
+// are not given their own stats.
+var DefaultTransferStats = NewTransferStats()
+
+// Transfer contains the number of bytes transferred with one registry.
+type Transfer struct {
+	BytesPulled int64 `json:"bytes_pulled"`
+	BytesPushed int64 `json:"bytes_pushed"`
+}
+
+// TransferStats records the number of bytes pulled from and pushed to each
+// registry. It is safe for concurrent use.
+type TransferStats struct {
+	sync.Mutex
+
+	registries map[string]*Transfer
+}
+
+// NewTransferStats returns a new empty TransferStats.
+func NewTransferStats() *TransferStats {
+	return &TransferStats{registries: make(map[string]*Transfer)}
+}
+
+// AddPulled records n bytes pulled from the registry.
+func (s *TransferStats) AddPulled(registry string, n int64) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.get(registry).BytesPulled += n
+}
+
+// AddPushed records n bytes pushed to the registry.
+func (s *TransferStats) AddPushed(registry string, n int64) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.get(registry).BytesPushed += n
+}
+
+// Snapshot returns a copy of the current stats, indexed by registry.
+func (s *TransferStats) Snapshot() map[string]Transfer {
+	s.Lock()
+	defer s.Unlock()
+
+	result := make(map[string]Transfer, len(s.registries))
+	for registry, t := range s.registries {
+		result[registry] = *t
+	}
+	return result
+}
+
+func (s *TransferStats) get(registry string) *Transfer {
+	t, ok := s.registries[registry]
+	if !ok {
+		t = &Transfer{}
+		s.registries[registry] = t
+	}
+	return t
+}
@@ -0,0 +1,39 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransferStats(t *testing.T) {
+	require := require.New(t)
+
+	stats := NewTransferStats()
+	stats.AddPulled("registry1", 10)
+	stats.AddPulled("registry1", 5)
+	stats.AddPushed("registry1", 3)
+	stats.AddPushed("registry2", 7)
+
+	snapshot := stats.Snapshot()
+	require.Equal(Transfer{BytesPulled: 15, BytesPushed: 3}, snapshot["registry1"])
+	require.Equal(Transfer{BytesPushed: 7}, snapshot["registry2"])
+
+	// Snapshot is a copy.
+	stats.AddPushed("registry2", 1)
+	require.Equal(int64(7), snapshot["registry2"].BytesPushed)
+}
@@ -20,7 +20,9 @@ import (
 	"os"
 	"os/exec"
 	"strings"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/uber/makisu/lib/utils"
 )
@@ -30,29 +32,102 @@ const ShellStreamBufferSize = 1 << 20
 
 type formatStream func(string, ...interface{})
 
+// ExecOptions contains optional settings for executing commands.
+type ExecOptions struct {
+	// Network is the network available to the command. Defaults to the
+	// network of the host.
+	Network NetworkMode
+
+	// Timeout is the maximum duration of the command. Once it's reached, the
+	// process group of the command is killed. Zero means no timeout.
+	Timeout time.Duration
+
+	// Rlimits are resource limits applied to the command.
+	Rlimits Rlimits
+
+	// User is the user running the command. If set, the user given to
+	// ExecCommandWithOptions is ignored, and HOME is expected to be set in
+	// Env by the caller.
+	User *utils.ResolvedUser
+
+	// Env is the environment of the command, in "key=value" form. If nil, the
+	// command inherits the environment of the makisu process.
+	Env []string
+
+	// Chroot is the root dir of the command. If set, the working dir and the
+	// command name are paths inside of it. Without root privileges, the
+	// command runs as root in new user and mount namespaces.
+	Chroot string
+}
+
+// Rlimits contains resource limits of commands. Zero values mean unlimited.
+// Limits are set before the command is executed, and are inherited by its
+// children. They require InitRlimitHelper to be called at the start of main.
+type Rlimits struct {
+	// NoFile is the maximum number of open files.
+	NoFile uint64
+	// NProc is the maximum number of processes of the user running the
+	// command. It's ignored for root.
+	NProc uint64
+	// CPU is the maximum CPU time in seconds.
+	CPU uint64
+}
+
+// TimeoutError is returned when a command doesn't finish before its timeout.
+type TimeoutError struct {
+	Timeout time.Duration
+}
+
+// Error returns the error message.
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("command timed out after %s", e.Timeout)
+}
+
 // ExecCommand exec a cmd and args inside workingDir as user, returns error if cmd fails
 func ExecCommand(outStream, errStream formatStream, workingDir, user, cmdName string, cmdArgs ...string) error {
+	return ExecCommandWithOptions(
+		outStream, errStream, &ExecOptions{}, workingDir, user, cmdName, cmdArgs...)
+}
+
+// ExecCommandWithOptions exec a cmd and args inside workingDir as user with the
+// given options, returns error if cmd fails.
+func ExecCommandWithOptions(
+	outStream, errStream formatStream, opts *ExecOptions,
+	workingDir, user, cmdName string, cmdArgs ...string) error {
+
 	cmd := exec.Command(cmdName, cmdArgs...)
 	if workingDir != "" {
 		cmd.Dir = workingDir
 	}
 
-	if err := setProcAttributes(cmd, user); err != nil {
+	if err := setProcAttributes(cmd, user, opts.User); err != nil {
 		return fmt.Errorf("set command creds: %v", err)
 	}
+	if err := setNetworkMode(cmd, opts.Network); err != nil {
+		return fmt.Errorf("set network mode: %s", err)
+	}
+	if err := setRoot(cmd, opts.Chroot); err != nil {
+		return fmt.Errorf("set root: %s", err)
+	}
+	if err := setRlimits(cmd, opts.Rlimits); err != nil {
+		return fmt.Errorf("set rlimits: %s", err)
+	}
 
 	cmd.Env = os.Environ()
-	if user != "" {
+	if opts.Env != nil {
+		cmd.Env = append([]string{}, opts.Env...)
+	}
+	if user != "" && opts.User == nil {
 		// We also need to change the HOME env var if we change user
 		home := fmt.Sprintf("HOME=/home/%s", strings.Split(user, ":")[0])
 
 		// Append it so it has a priority on any other env var from before (and will override previous HOME definition)
 		cmd.Env = append(cmd.Env, home)
 	}
-	return streamCmd(outStream, errStream, cmd)
+	return streamCmd(outStream, errStream, cmd, opts)
 }
 
-func streamCmd(outStream, errStream formatStream, cmd *exec.Cmd) error {
+func streamCmd(outStream, errStream formatStream, cmd *exec.Cmd, opts *ExecOptions) error {
 	outReader, outWriter := io.Pipe()
 	errReader, errWriter := io.Pipe()
 	cmd.Stdout, cmd.Stderr = outWriter, errWriter
@@ -70,17 +145,53 @@ func streamCmd(outStream, errStream formatStream, cmd *exec.Cmd) error {
 	}()
 
 	if err := cmd.Start(); err != nil {
+		if opts.Network == NetworkNone {
+			return fmt.Errorf(
+				"cmd start in new network namespace (requires CAP_SYS_ADMIN): %s", err)
+		}
 		return fmt.Errorf("cmd start: %s", err)
-	} else if err := cmd.Wait(); err != nil {
+	}
+
+	var timedOut int32
+	if opts.Timeout > 0 {
+		timer := time.AfterFunc(opts.Timeout, func() {
+			atomic.StoreInt32(&timedOut, 1)
+			killProcessGroup(cmd)
+		})
+		defer timer.Stop()
+	}
+
+	if err := cmd.Wait(); err != nil {
+		if atomic.LoadInt32(&timedOut) == 1 {
+			errStream("Command timed out after %s\n", opts.Timeout)
+			return &TimeoutError{opts.Timeout}
+		}
 		errStream("Command exited with %d\n", cmd.ProcessState.ExitCode())
 		return fmt.Errorf("cmd wait: %s", err)
 	}
 	return nil
 }
 
-func setProcAttributes(cmd *exec.Cmd, user string) error {
+// killProcessGroup kills the command and all processes in its process group.
+func killProcessGroup(cmd *exec.Cmd) {
+	// The command is the leader of its process group, as Setpgid is set.
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
+
+func setProcAttributes(cmd *exec.Cmd, user string, resolved *utils.ResolvedUser) error {
 	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
-	if user == "" {
+	if resolved != nil {
+		groups := make([]uint32, len(resolved.Groups))
+		for i, gid := range resolved.Groups {
+			groups[i] = uint32(gid)
+		}
+		cmd.SysProcAttr.Credential = &syscall.Credential{
+			Uid:    uint32(resolved.UID),
+			Gid:    uint32(resolved.GID),
+			Groups: groups,
+		}
+		return nil
+	} else if user == "" {
 		return nil
 	}
 
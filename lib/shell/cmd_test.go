@@ -17,12 +17,21 @@ package shell
 import (
 	"bytes"
 	"fmt"
+	"os"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
+	"github.com/uber/makisu/lib/utils"
 )
 
+func TestMain(m *testing.M) {
+	InitRlimitHelper()
+	os.Exit(m.Run())
+}
+
 type bufferedSyncWriter struct {
 	b *bytes.Buffer
 
@@ -66,3 +75,82 @@ func TestExecCommandError(t *testing.T) {
 	require.Error(err)
 	require.NotEmpty(stderr.String())
 }
+
+func TestExecCommandNetworkNone(t *testing.T) {
+	require := require.New(t)
+	stdout, stderr := syncWriterFixture(), syncWriterFixture()
+	opts := &ExecOptions{Network: NetworkNone}
+	err := ExecCommandWithOptions(
+		stdout.Write, stderr.Write, opts, ".", "", "cat", "/proc/net/dev")
+	if err != nil {
+		// Creating network namespaces requires CAP_SYS_ADMIN.
+		require.Contains(err.Error(), "network namespace")
+		t.Skipf("cannot create network namespace: %s", err)
+	}
+
+	// Only the loopback interface exists.
+	var interfaces []string
+	for _, line := range strings.Split(stdout.String(), "\n")[2:] {
+		if fields := strings.Fields(line); len(fields) > 0 {
+			interfaces = append(interfaces, strings.TrimSuffix(fields[0], ":"))
+		}
+	}
+	require.Equal([]string{"lo"}, interfaces)
+}
+
+func TestParseNetworkMode(t *testing.T) {
+	require := require.New(t)
+
+	mode, err := ParseNetworkMode("none")
+	require.NoError(err)
+	require.Equal(NetworkNone, mode)
+
+	mode, err = ParseNetworkMode("host")
+	require.NoError(err)
+	require.Equal(NetworkHost, mode)
+
+	_, err = ParseNetworkMode("bridge")
+	require.Error(err)
+}
+
+func TestExecCommandTimeout(t *testing.T) {
+	require := require.New(t)
+	stdout, stderr := syncWriterFixture(), syncWriterFixture()
+	opts := &ExecOptions{Timeout: 200 * time.Millisecond}
+
+	// Children in the process group are killed too, otherwise the command
+	// would wait for them.
+	start := time.Now()
+	err := ExecCommandWithOptions(
+		stdout.Write, stderr.Write, opts, ".", "", "sh", "-c", "sleep 30 & sleep 30")
+	require.Error(err)
+	_, ok := err.(*TimeoutError)
+	require.True(ok)
+	require.True(time.Since(start) < 10*time.Second)
+	require.Contains(stderr.String(), "timed out")
+
+	// Commands finishing in time are not affected.
+	opts.Timeout = 10 * time.Second
+	require.NoError(ExecCommandWithOptions(
+		stdout.Write, stderr.Write, opts, ".", "", "true"))
+}
+
+func TestExecCommandRlimits(t *testing.T) {
+	require := require.New(t)
+	stdout, stderr := syncWriterFixture(), syncWriterFixture()
+	opts := &ExecOptions{Rlimits: Rlimits{NoFile: 64}}
+
+	// Limits are set before the command starts.
+	err := ExecCommandWithOptions(
+		stdout.Write, stderr.Write, opts, ".", "", "sh", "-c", "ulimit -n")
+	require.NoError(err)
+	require.Equal("64", strings.TrimSpace(stdout.String()))
+
+	// The working dir and the user of the command are kept.
+	stdout = syncWriterFixture()
+	opts.User = &utils.ResolvedUser{UID: 65534, GID: 65534, Groups: []int{65534}}
+	err = ExecCommandWithOptions(
+		stdout.Write, stderr.Write, opts, "/tmp", "", "sh", "-c", "ulimit -n; id -u; id -G; pwd")
+	require.NoError(err)
+	require.Equal("64\n65534\n65534\n/tmp", strings.TrimSpace(stdout.String()))
+}
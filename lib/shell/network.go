@@ -0,0 +1,37 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package shell
+
+import "fmt"
+
+// NetworkMode describes the network available to executed commands.
+type NetworkMode string
+
+const (
+	// NetworkHost shares the network of the host.
+	NetworkHost = NetworkMode("host")
+	// NetworkNone executes commands in a new network namespace, which only has
+	// a loopback interface.
+	NetworkNone = NetworkMode("none")
+)
+
+// ParseNetworkMode returns the network mode corresponding to the given string.
+func ParseNetworkMode(s string) (NetworkMode, error) {
+	switch mode := NetworkMode(s); mode {
+	case NetworkHost, NetworkNone:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid network mode %s, must be one of [%s, %s]", s, NetworkHost, NetworkNone)
+	}
+}
@@ -0,0 +1,154 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package shell
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// _rlimitNProc is RLIMIT_NPROC, which is missing from the syscall package.
+const _rlimitNProc = 6
+
+// _rlimitHelper is argv[0] of makisu when it's re-executed to set the
+// resource limits of a command before executing it.
+const _rlimitHelper = "makisu-rlimit-helper"
+
+// rlimitHelperConfig contains the settings of the command applied by the
+// helper, in that order.
+type rlimitHelperConfig struct {
+	Rlimits    Rlimits
+	Chroot     string
+	Dir        string
+	Credential *syscall.Credential
+}
+
+// rlimitHelperEnabled is true once InitRlimitHelper was called, in which case
+// the executable of the process can be started as the helper.
+var rlimitHelperEnabled bool
+
+// InitRlimitHelper must be called at the start of main by programs executing
+// commands with resource limits. Such commands are executed by re-executing
+// the program as a helper, which sets the limits before executing the
+// command, so that they apply from its start. In the helper,
+// InitRlimitHelper executes the command and never returns.
+func InitRlimitHelper() {
+	if len(os.Args) >= 3 && os.Args[0] == _rlimitHelper {
+		err := execRlimitHelper(os.Args[1], os.Args[2:])
+		fmt.Fprintf(os.Stderr, "%s: %s\n", _rlimitHelper, err)
+		os.Exit(127)
+	}
+	rlimitHelperEnabled = true
+}
+
+// setRlimits configures the command to be executed by the program itself,
+// started as the helper setting the resource limits before executing it. The
+// chroot, working dir and credentials of the command are applied by the
+// helper, since the program might not exist under the root of the command.
+func setRlimits(cmd *exec.Cmd, rlimits Rlimits) error {
+	if rlimits == (Rlimits{}) {
+		return nil
+	} else if !rlimitHelperEnabled {
+		return errors.New("resource limits require shell.InitRlimitHelper to be called at the start of main")
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("get makisu executable: %s", err)
+	}
+	config, err := json.Marshal(rlimitHelperConfig{
+		Rlimits:    rlimits,
+		Chroot:     cmd.SysProcAttr.Chroot,
+		Dir:        cmd.Dir,
+		Credential: cmd.SysProcAttr.Credential,
+	})
+	if err != nil {
+		return fmt.Errorf("marshal rlimit helper config: %s", err)
+	}
+	cmd.Args = append([]string{_rlimitHelper, string(config), cmd.Path}, cmd.Args...)
+	cmd.Path = self
+	cmd.Dir = ""
+	cmd.SysProcAttr.Chroot = ""
+	cmd.SysProcAttr.Credential = nil
+	return nil
+}
+
+// execRlimitHelper applies the config to the current process and executes
+// the command, whose path and arguments are given in args.
+func execRlimitHelper(configJSON string, args []string) error {
+	var config rlimitHelperConfig
+	if err := json.Unmarshal([]byte(configJSON), &config); err != nil {
+		return fmt.Errorf("unmarshal config: %s", err)
+	}
+
+	limits := []struct {
+		name     string
+		resource int
+		value    uint64
+	}{
+		{"nofile", syscall.RLIMIT_NOFILE, config.Rlimits.NoFile},
+		{"nproc", _rlimitNProc, config.Rlimits.NProc},
+		{"cpu", syscall.RLIMIT_CPU, config.Rlimits.CPU},
+	}
+	for _, limit := range limits {
+		if limit.value == 0 {
+			continue
+		}
+		// Use syscall.Setrlimit, so the Go runtime doesn't restore its
+		// original nofile limit on exec.
+		rlimit := syscall.Rlimit{Cur: limit.value, Max: limit.value}
+		if err := syscall.Setrlimit(limit.resource, &rlimit); err != nil {
+			return fmt.Errorf("setrlimit %s=%d: %s", limit.name, limit.value, err)
+		}
+	}
+
+	if config.Chroot != "" {
+		if err := syscall.Chroot(config.Chroot); err != nil {
+			return fmt.Errorf("chroot %s: %s", config.Chroot, err)
+		}
+	}
+	if config.Dir != "" {
+		if err := syscall.Chdir(config.Dir); err != nil {
+			return fmt.Errorf("chdir %s: %s", config.Dir, err)
+		}
+	}
+
+	// Credentials are changed with raw syscalls, which only apply to the
+	// current thread. That's the thread executing the command.
+	runtime.LockOSThread()
+	if cred := config.Credential; cred != nil {
+		if !cred.NoSetGroups {
+			var groups unsafe.Pointer
+			if len(cred.Groups) > 0 {
+				groups = unsafe.Pointer(&cred.Groups[0])
+			}
+			if _, _, errno := syscall.RawSyscall(
+				syscall.SYS_SETGROUPS, uintptr(len(cred.Groups)), uintptr(groups), 0); errno != 0 {
+				return fmt.Errorf("setgroups: %s", errno)
+			}
+		}
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_SETGID, uintptr(cred.Gid), 0, 0); errno != 0 {
+			return fmt.Errorf("setgid %d: %s", cred.Gid, errno)
+		}
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_SETUID, uintptr(cred.Uid), 0, 0); errno != 0 {
+			return fmt.Errorf("setuid %d: %s", cred.Uid, errno)
+		}
+	}
+	return syscall.Exec(args[0], args[1:], os.Environ())
+}
@@ -0,0 +1,35 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !linux
+
+package shell
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+)
+
+// InitRlimitHelper must be called at the start of main by programs executing
+// commands with resource limits. Resource limits are only supported on linux.
+func InitRlimitHelper() {}
+
+// setRlimits configures the command to be executed with the given resource
+// limits. It's only supported on linux.
+func setRlimits(cmd *exec.Cmd, rlimits Rlimits) error {
+	if rlimits != (Rlimits{}) {
+		return fmt.Errorf("rlimits are not supported on %s", runtime.GOOS)
+	}
+	return nil
+}
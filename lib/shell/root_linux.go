@@ -0,0 +1,47 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package shell
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// setRoot configures the command to be executed chrooted into root. If makisu
+// doesn't run as root, the command is executed in new user and mount
+// namespaces, where it runs as root.
+func setRoot(cmd *exec.Cmd, root string) error {
+	if root == "" {
+		return nil
+	}
+	cmd.SysProcAttr.Chroot = root
+	if os.Geteuid() == 0 {
+		return nil
+	}
+
+	if cred := cmd.SysProcAttr.Credential; cred != nil && (cred.Uid != 0 || cred.Gid != 0) {
+		return errors.New("running chrooted commands as another user requires root")
+	}
+	cmd.SysProcAttr.Credential = nil
+	cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS
+	cmd.SysProcAttr.UidMappings = []syscall.SysProcIDMap{
+		{ContainerID: 0, HostID: os.Geteuid(), Size: 1},
+	}
+	cmd.SysProcAttr.GidMappings = []syscall.SysProcIDMap{
+		{ContainerID: 0, HostID: os.Getegid(), Size: 1},
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !linux
+
+package shell
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+)
+
+// setRoot configures the command to be executed chrooted into root. Chroot is
+// only supported on linux.
+func setRoot(cmd *exec.Cmd, root string) error {
+	if root != "" {
+		return fmt.Errorf("chroot is not supported on %s", runtime.GOOS)
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshot
+
+import (
+	"path"
+	"path/filepath"
+	"sort"
+
+	"github.com/uber/makisu/lib/tario"
+)
+
+// FSDiff is the result of comparing the merged views of two file systems.
+type FSDiff struct {
+	Added   []*PathDiff `json:"added"`   // Paths only in the second file system
+	Removed []*PathDiff `json:"removed"` // Paths only in the first file system
+	Changed []*PathDiff `json:"changed"`
+}
+
+// PathDiff is one path that differs between two file systems.
+type PathDiff struct {
+	Path string `json:"path"`
+	// Fields are the names of the header fields that differ, for changed
+	// paths. See tario.DiffHeaders.
+	Fields []string `json:"fields,omitempty"`
+	// Layer1 and Layer2 are the indexes of the layers of each file system
+	// that last added or deleted the path, or -1 if none did.
+	Layer1 int `json:"layer1"`
+	Layer2 int `json:"layer2"`
+}
+
+// Empty returns true if no differences were found.
+func (d *FSDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// CompareFS compares the merged views of two file systems, and attributes
+// each difference to the layers of fs1 and fs2 that introduced it.
+// Added and removed directories are listed along with their contents.
+func CompareFS(fs1, fs2 *MemFS, ignoreModTime bool) *FSDiff {
+	missing1 := make(map[string]*memFSNode)
+	missing2 := make(map[string]*memFSNode)
+	diff1 := make(map[string]*memFSNode)
+	diff2 := make(map[string]*memFSNode)
+	compareNode(fs1.tree, fs2.tree, missing1, missing2, diff1, diff2, "/", ignoreModTime)
+
+	layers1 := newLayerAttribution(fs1.layers)
+	layers2 := newLayerAttribution(fs2.layers)
+	newPathDiff := func(p string) *PathDiff {
+		return &PathDiff{Path: p, Layer1: layers1.find(p), Layer2: layers2.find(p)}
+	}
+
+	d := &FSDiff{}
+	for _, p := range subtreePaths(missing1) {
+		d.Added = append(d.Added, newPathDiff(p))
+	}
+	for _, p := range subtreePaths(missing2) {
+		d.Removed = append(d.Removed, newPathDiff(p))
+	}
+	for _, p := range sortedPaths(diff1) {
+		pd := newPathDiff(p)
+		pd.Fields = tario.DiffHeaders(diff1[p].hdr, diff2[p].hdr, ignoreModTime)
+		d.Changed = append(d.Changed, pd)
+	}
+	return d
+}
+
+// compareNode compares two memFSNodes for differences.
+func compareNode(node1, node2 *memFSNode, missing1, missing2, diff1, diff2 map[string]*memFSNode, path string, ignoreModTime bool) {
+	if isSimilar, _ := tario.IsSimilarHeader(node1.hdr, node2.hdr, ignoreModTime); !isSimilar {
+		diff1[path] = node1
+		diff2[path] = node2
+	}
+
+	allChildren := make(map[string]bool)
+	for child := range node1.children {
+		allChildren[child] = true
+	}
+
+	for child := range node2.children {
+		allChildren[child] = true
+	}
+
+	for child := range allChildren {
+		nextNode1, ok1 := node1.children[child]
+		nextNode2, ok2 := node2.children[child]
+		updatedPath := filepath.Join(path, child)
+		if ok1 && ok2 {
+			compareNode(nextNode1, nextNode2, missing1, missing2, diff1, diff2, updatedPath, ignoreModTime)
+			continue
+		} else if ok1 {
+			missing2[updatedPath] = node1.children[child]
+		} else if ok2 {
+			missing1[updatedPath] = node2.children[child]
+		}
+	}
+}
+
+// subtreePaths returns the given paths and the paths of all their
+// descendants, sorted.
+func subtreePaths(nodes map[string]*memFSNode) []string {
+	var paths []string
+	var add func(p string, n *memFSNode)
+	add = func(p string, n *memFSNode) {
+		paths = append(paths, p)
+		for name, child := range n.children {
+			add(path.Join(p, name), child)
+		}
+	}
+	for p, n := range nodes {
+		add(p, n)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// sortedPaths returns the keys of the given map, sorted.
+func sortedPaths(nodes map[string]*memFSNode) []string {
+	paths := make([]string, 0, len(nodes))
+	for p := range nodes {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// layerAttribution finds the layer that last added or deleted a path.
+type layerAttribution struct {
+	// files maps paths to the last layer that added or whited them out.
+	files map[string]int
+	// cleared maps directories to the last layer that deleted their
+	// contents, with a whiteout or an opaque whiteout.
+	cleared map[string]int
+}
+
+// newLayerAttribution indexes the files of the given layers.
+func newLayerAttribution(layers []*memLayer) *layerAttribution {
+	a := &layerAttribution{
+		files:   make(map[string]int),
+		cleared: make(map[string]int),
+	}
+	for i, l := range layers {
+		for p, f := range l.files {
+			switch mf := f.(type) {
+			case *whiteoutMemFile:
+				a.files[p] = i
+				a.cleared[p] = i
+			case *opaqueMemFile:
+				a.cleared[mf.dir] = i
+			default:
+				a.files[p] = i
+			}
+		}
+	}
+	return a
+}
+
+// find returns the index of the last layer that added or deleted the given
+// path, or -1.
+func (a *layerAttribution) find(p string) int {
+	layer := -1
+	if i, ok := a.files[p]; ok {
+		layer = i
+	}
+	for dir := filepath.Dir(p); ; dir = filepath.Dir(dir) {
+		if i, ok := a.cleared[dir]; ok && i > layer {
+			layer = i
+		}
+		if dir == "/" {
+			break
+		}
+	}
+	return layer
+}
@@ -0,0 +1,67 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshot
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompareFSResult(t *testing.T) {
+	require := require.New(t)
+
+	tmpRoot, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(tmpRoot)
+
+	fs1, err := NewMemFS(clock.NewMock(), tmpRoot, nil)
+	require.NoError(err)
+	l := newMemLayer()
+	require.NoError(addDirectoryToLayer(l, tmpRoot, "/common", 0755))
+	require.NoError(addRegularFileToLayer(l, tmpRoot, "/common/world", "hello", 0644))
+	require.NoError(addDirectoryToLayer(l, tmpRoot, "/old", 0755))
+	require.NoError(addRegularFileToLayer(l, tmpRoot, "/old/file", "old", 0644))
+	require.NoError(fs1.merge(l))
+
+	fs2, err := NewMemFS(clock.NewMock(), tmpRoot, nil)
+	require.NoError(err)
+	require.NoError(fs2.merge(l))
+	l = newMemLayer()
+	require.NoError(addRegularFileToLayer(l, tmpRoot, "/common/world", "hello", 0755))
+	require.NoError(addDirectoryToLayer(l, tmpRoot, "/new", 0755))
+	require.NoError(addRegularFileToLayer(l, tmpRoot, "/new/file", "new", 0644))
+	require.NoError(addWhiteoutToLayer(l, "/old"))
+	require.NoError(fs2.merge(l))
+
+	d := CompareFS(fs1, fs2, true)
+	require.False(d.Empty())
+	require.Equal([]*PathDiff{
+		{Path: "/new", Layer1: -1, Layer2: 1},
+		{Path: "/new/file", Layer1: -1, Layer2: 1},
+	}, d.Added)
+	require.Equal([]*PathDiff{
+		{Path: "/old", Layer1: 0, Layer2: 1},
+		{Path: "/old/file", Layer1: 0, Layer2: 1},
+	}, d.Removed)
+	require.Equal([]*PathDiff{
+		{Path: "/common/world", Fields: []string{"mode"}, Layer1: 0, Layer2: 1},
+	}, d.Changed)
+
+	require.True(CompareFS(fs1, fs1, false).Empty())
+}
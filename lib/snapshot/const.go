@@ -20,3 +20,7 @@ const _whiteoutPrefix = ".wh."
 // Should be ignored during untar.
 // TODO: There could be hardlinks pointing to files under /.wh..wh.plnk.
 const _whiteoutMetaPrefix = _whiteoutPrefix + _whiteoutPrefix
+
+// _whiteoutOpaqueDir marks a directory as opaque: the contents of that
+// directory in lower layers are hidden.
+const _whiteoutOpaqueDir = _whiteoutMetaPrefix + ".opq"
@@ -81,7 +81,19 @@ func NewCopyOperation(
 
 // Execute performs the actual copying of files specified by the CopyOperation.
 func (c *CopyOperation) Execute() error {
+	return c.ExecuteInRoot("")
+}
+
+// ExecuteInRoot performs the actual copying of files specified by the
+// CopyOperation, into the file system rooted at root.
+func (c *CopyOperation) ExecuteInRoot(root string) error {
 	var err error
+	dst := c.dst
+	if root != "" {
+		if dst, err = resolveInRoot(root, c.dst); err != nil {
+			return fmt.Errorf("resolve %s in root: %s", c.dst, err)
+		}
+	}
 	for _, src := range c.srcs {
 		src, err = evalSymlinks(src, c.srcRoot)
 		if err != nil {
@@ -127,19 +139,19 @@ func (c *CopyOperation) Execute() error {
 
 		if fi.IsDir() {
 			// Dir to dir
-			if err := copier.CopyDir(src, c.dst); err != nil {
-				return fmt.Errorf("copy dir %s to dir %s: %s", src, c.dst, err)
+			if err := copier.CopyDir(src, dst); err != nil {
+				return fmt.Errorf("copy dir %s to dir %s: %s", src, dst, err)
 			}
 		} else if isDirFormat(c.dst) {
 			// File to dir
-			targetFilePath := filepath.Join(c.dst, filepath.Base(src))
+			targetFilePath := filepath.Join(dst, filepath.Base(src))
 			if err := copier.CopyFile(src, targetFilePath); err != nil {
 				return fmt.Errorf("copy file %s to dir %s: %s", src, targetFilePath, err)
 			}
 		} else {
 			// File to file
-			if err := copier.CopyFile(src, c.dst); err != nil {
-				return fmt.Errorf("copy file %s to file %s: %s", src, c.dst, err)
+			if err := copier.CopyFile(src, dst); err != nil {
+				return fmt.Errorf("copy file %s to file %s: %s", src, dst, err)
 			}
 		}
 	}
@@ -245,4 +245,28 @@ func TestExecuteCopyOperation(t *testing.T) {
 		require.NoError(err)
 		require.Equal(_hello2, b)
 	})
+	t.Run("file to dir under absolute symlink in root", func(t *testing.T) {
+		require := require.New(t)
+
+		srcRoot, err := ioutil.TempDir("/tmp", "makisu-test")
+		require.NoError(err)
+		defer os.RemoveAll(srcRoot)
+		root, err := ioutil.TempDir("/tmp", "makisu-test")
+		require.NoError(err)
+		defer os.RemoveAll(root)
+
+		require.NoError(ioutil.WriteFile(filepath.Join(srcRoot, "test.txt"), _hello, os.ModePerm))
+		require.NoError(os.MkdirAll(filepath.Join(root, "target"), os.ModePerm))
+		require.NoError(os.Symlink("/target", filepath.Join(root, "link")))
+
+		srcs := []string{"/test.txt"}
+		dst := "/link/"
+		c, err := NewCopyOperation(
+			srcs, srcRoot, "", dst, validChown, pathutils.DefaultBlacklist, false, false)
+		require.NoError(err)
+		require.NoError(c.ExecuteInRoot(root))
+		b, err := ioutil.ReadFile(filepath.Join(root, "target", "test.txt"))
+		require.NoError(err)
+		require.Equal(_hello, b)
+	})
 }
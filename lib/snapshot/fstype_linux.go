@@ -0,0 +1,52 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshot
+
+import (
+	"syscall"
+	"time"
+)
+
+// Magic numbers of the file systems known to update the mtime of directories
+// whenever entries are added or removed.
+const (
+	_btrfsSuperMagic   = 0x9123683e
+	_ext4SuperMagic    = 0xef53
+	_overlaySuperMagic = 0x794c7630
+	_tmpfsMagic        = 0x01021994
+	_xfsSuperMagic     = 0x58465342
+	_zfsSuperMagic     = 0x2fc12fc1
+)
+
+// hasReliableDirMtimes returns true if the file system of the given path
+// updates directory mtimes reliably. Network and FUSE file systems, among
+// others, might not.
+func hasReliableDirMtimes(p string) bool {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(p, &stat); err != nil {
+		return false
+	}
+	switch uint32(stat.Type) {
+	case _btrfsSuperMagic, _ext4SuperMagic, _overlaySuperMagic,
+		_tmpfsMagic, _xfsSuperMagic, _zfsSuperMagic:
+		return true
+	}
+	return false
+}
+
+// changeTime returns the ctime of the given file.
+func changeTime(stat *syscall.Stat_t) time.Time {
+	return time.Unix(stat.Ctim.Unix())
+}
@@ -0,0 +1,33 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !linux
+
+package snapshot
+
+import (
+	"syscall"
+	"time"
+)
+
+// hasReliableDirMtimes returns true if the file system of the given path
+// updates directory mtimes reliably. It is only known on linux.
+func hasReliableDirMtimes(p string) bool {
+	return false
+}
+
+// changeTime returns the ctime of the given file. It is only known on linux,
+// where listings of directories are reused by scans.
+func changeTime(stat *syscall.Stat_t) time.Time {
+	return time.Time{}
+}
@@ -16,8 +16,10 @@ package snapshot
 
 import (
 	"archive/tar"
+	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
@@ -34,6 +36,17 @@ import (
 	"github.com/uber/makisu/lib/utils"
 )
 
+// _capturedFiles are the files whose content is kept in memory when merging
+// tars, so MemFS can read them without the layers being on disk, including
+// from indexes saved after untarring.
+var _capturedFiles = map[string]bool{
+	"/etc/passwd": true,
+	"/etc/group":  true,
+}
+
+// _maxCapturedFileSize is the size above which files are not kept in memory.
+const _maxCapturedFileSize = 1 << 20
+
 // memFSNode represents one node of the directory tree in the merged fs view.
 type memFSNode struct {
 	*contentMemFile                       // No whiteouts
@@ -63,6 +76,24 @@ type MemFS struct {
 
 	blacklist []string
 	layers    []*memLayer
+
+	// chroot is true if root is meant to be chrooted into.
+	chroot bool
+
+	// tarConfig controls how layers are written.
+	tarConfig *tario.Config
+
+	// fullScan is true if scans must list every directory.
+	fullScan bool
+	// scanCache is the state of directories at the end of the previous scan.
+	// It is reset whenever the merged view is updated by other means.
+	scanCache map[string]scanDirStat
+
+	// indexDir is where indexes of merged layers are saved.
+	indexDir string
+	// indexChain are the digests of the layers merged with UpdateFromLayer.
+	// It is nil if the merged view was updated by other means.
+	indexChain []image.Digest
 }
 
 // NewMemFS inits a new MemFS instance.
@@ -76,15 +107,40 @@ func NewMemFS(clk clock.Clock, root string, blacklist []string) (*MemFS, error)
 		return nil, fmt.Errorf("unable to create root header")
 	}
 	return &MemFS{
-		clk:       clk,
-		tree:      newMemFSNode(newContentMemFile(root, "/", hdr)),
-		blacklist: blacklist,
+		clk:        clk,
+		tree:       newMemFSNode(newContentMemFile(root, "/", hdr)),
+		blacklist:  blacklist,
+		tarConfig:  tario.DefaultConfig(),
+		indexChain: []image.Digest{},
 	}, nil
 }
 
+// SetChroot sets whether root is meant to be chrooted into, in which case
+// absolute symlink targets are untarred as is instead of being prefixed with
+// root.
+func (fs *MemFS) SetChroot(chroot bool) {
+	fs.chroot = chroot
+}
+
+// SetTarConfig sets how layers are written. Defaults to the package level
+// settings of tario at the time the MemFS was created.
+func (fs *MemFS) SetTarConfig(c *tario.Config) {
+	fs.tarConfig = c
+}
+
+// SetFullScan sets whether scans list every directory. By default, the
+// listing of directories whose stat didn't change since the previous scan is
+// taken from memory, unless the file system doesn't update directory mtimes
+// reliably.
+func (fs *MemFS) SetFullScan(fullScan bool) {
+	fs.fullScan = fullScan
+}
+
 // Reset resets the in-memory file system view of the memFS.
 func (fs *MemFS) Reset() {
 	fs.tree.children = make(map[string]*memFSNode)
+	fs.scanCache = nil
+	fs.indexChain = []image.Digest{}
 }
 
 // Checkpoint relocates the given src files & directories to the given newRoot.
@@ -95,6 +151,10 @@ func (fs *MemFS) Checkpoint(newRoot string, sources []string) error {
 
 	resolvedSources := []string{}
 	for _, src := range sources {
+		// Sources are paths of the image, unless they already include root.
+		if !filepath.IsAbs(src) || !pathutils.IsDescendantOfAny(src, []string{fs.tree.src}) {
+			src = filepath.Join(fs.tree.src, src)
+		}
 		if matches, err := filepath.Glob(src); err != nil || len(matches) == 0 {
 			resolvedSources = append(resolvedSources, src)
 		} else {
@@ -104,14 +164,14 @@ func (fs *MemFS) Checkpoint(newRoot string, sources []string) error {
 
 	log.Infof("* Moving directories %v to %s", sources, newRoot)
 	for _, src := range resolvedSources {
-		if !filepath.IsAbs(src) {
-			src = filepath.Join(fs.tree.src, src)
-		}
 		trimmedSrc, err := pathutils.TrimRoot(src, fs.tree.src)
 		if err != nil {
 			return fmt.Errorf("trim src %s: %s", src, err)
 		}
 		dst := filepath.Join(newRoot, trimmedSrc)
+		if src, err = resolveInRoot(fs.tree.src, trimmedSrc); err != nil {
+			return fmt.Errorf("resolve %s in root: %s", trimmedSrc, err)
+		}
 		sourceInfo, err := os.Stat(src)
 		if err != nil {
 			return fmt.Errorf("stat %s: %s", src, err)
@@ -171,8 +231,14 @@ func (fs *MemFS) UpdateFromTarReader(r *tar.Reader, untar bool) error {
 	// reset them.
 	modtimes := make(map[string]time.Time)
 
+	// Keep a set of the paths read from this tar, which opaque whiteouts
+	// must not hide.
+	seen := make(map[string]bool)
+
 	var count int
 	l := newMemLayer()
+	fs.scanCache = nil
+	fs.indexChain = nil
 	for {
 		hdr, err := r.Next()
 		if err == io.EOF {
@@ -186,11 +252,23 @@ func (fs *MemFS) UpdateFromTarReader(r *tar.Reader, untar bool) error {
 		}
 
 		path := filepath.Join(fs.tree.src, hdr.Name)
-		if skip, err := shouldSkip(path, hdr.FileInfo(), fs.blacklist); err != nil {
+		if untar {
+			// Parent directories of the path might be symlinks.
+			if path, err = resolveInRoot(fs.tree.src, hdr.Name); err != nil {
+				return fmt.Errorf("resolve %s in root: %s", hdr.Name, err)
+			}
+		}
+		// Opaque whiteouts are checked against the directory they apply to.
+		opaque := filepath.Base(hdr.Name) == _whiteoutOpaqueDir
+		checkPath, checkFi := path, hdr.FileInfo()
+		if opaque {
+			checkPath, checkFi = filepath.Dir(path), nil
+		}
+		if skip, err := shouldSkip(checkPath, checkFi, fs.blacklist); err != nil {
 			return fmt.Errorf("check if should skip %s: %s", path, err)
 		} else if skip {
 			continue
-		} else if isMounted, err := mountutils.IsMounted(path); err != nil {
+		} else if isMounted, err := mountutils.IsMounted(checkPath); err != nil {
 			return fmt.Errorf("check if mounted %s: %s", path, err)
 		} else if isMounted {
 			continue
@@ -200,7 +278,7 @@ func (fs *MemFS) UpdateFromTarReader(r *tar.Reader, untar bool) error {
 		// the other files. If we are not untarring, this is not necessary and may fail
 		// because not all files are necessarily on disk.
 		if untar {
-			parentDir := filepath.Dir(path)
+			parentDir := filepath.Dir(filepath.Clean(path))
 			if _, found := modtimes[parentDir]; !found {
 				parentFi, err := os.Lstat(parentDir)
 				if err != nil {
@@ -212,6 +290,21 @@ func (fs *MemFS) UpdateFromTarReader(r *tar.Reader, untar bool) error {
 
 		hdr.Name = pathutils.RelPath(hdr.Name)
 
+		if opaque {
+			dir := pathutils.AbsPath(filepath.Dir(hdr.Name))
+			if untar {
+				if err := fs.untarOpaqueWhiteout(filepath.Dir(path), dir, seen); err != nil {
+					return fmt.Errorf("untar opaque whiteout %s: %s", path, err)
+				}
+			}
+			if err := fs.addOpaqueToLayer(l, dir, seen); err != nil {
+				return fmt.Errorf("add opaque whiteout from tar to layer: %s", err)
+			}
+			count++
+			continue
+		}
+		seen[pathutils.AbsPath(hdr.Name)] = true
+
 		// If the new file is a hard link, then append it to the list
 		// that will be created later.
 		if hdr.Typeflag == tar.TypeLink {
@@ -219,14 +312,27 @@ func (fs *MemFS) UpdateFromTarReader(r *tar.Reader, untar bool) error {
 			hdr.Linkname = pathutils.AbsPath(hdr.Linkname)
 			hardlinks[path] = hdr
 		} else {
+			var content []byte
+			var cr io.Reader = r
+			if isCapturedFile(hdr) {
+				if content, err = ioutil.ReadAll(r); err != nil {
+					return fmt.Errorf("read content of %s: %s", path, err)
+				}
+				cr = bytes.NewReader(content)
+			}
 			if untar {
-				if err := fs.untarOneItem(path, hdr, r); err != nil {
+				if err := fs.untarOneItem(path, hdr, cr); err != nil {
 					return fmt.Errorf("untar one item %s: %s", path, err)
 				}
 			}
-			if err := fs.maybeAddToLayer(l, pathutils.AbsPath(hdr.Name), pathutils.AbsPath(hdr.Name), hdr, false); err != nil {
+			if err := fs.maybeAddToLayer(l, pathutils.AbsPath(hdr.Name), pathutils.AbsPath(hdr.Name), hdr); err != nil {
 				return fmt.Errorf("add hdr from tar to layer: %s", err)
 			}
+			if content != nil {
+				if n, ok := fs.lookup(pathutils.AbsPath(hdr.Name)); ok {
+					n.content = content
+				}
+			}
 		}
 		count++
 	}
@@ -238,7 +344,7 @@ func (fs *MemFS) UpdateFromTarReader(r *tar.Reader, untar bool) error {
 				return fmt.Errorf("untar one item %s: %s", path, err)
 			}
 		}
-		if err := fs.maybeAddToLayer(l, pathutils.AbsPath(hdr.Name), pathutils.AbsPath(hdr.Name), hdr, false); err != nil {
+		if err := fs.maybeAddToLayer(l, pathutils.AbsPath(hdr.Name), pathutils.AbsPath(hdr.Name), hdr); err != nil {
 			return fmt.Errorf("add hdr from tar to layer: %s", err)
 		}
 	}
@@ -254,6 +360,47 @@ func (fs *MemFS) UpdateFromTarReader(r *tar.Reader, untar bool) error {
 	return nil
 }
 
+// ReadFile returns the content of the regular file at the given path of the
+// merged view. Files of tars merged without being untarred can only be read if
+// they are in _capturedFiles.
+func (fs *MemFS) ReadFile(p string) ([]byte, error) {
+	n, ok := fs.lookup(p)
+	if !ok {
+		return nil, &os.PathError{Op: "read", Path: p, Err: os.ErrNotExist}
+	} else if n.hdr.Typeflag != tar.TypeReg && n.hdr.Typeflag != tar.TypeRegA {
+		return nil, fmt.Errorf("read %s: not a regular file", p)
+	} else if n.content != nil {
+		return n.content, nil
+	}
+	src := n.src
+	if src == n.dst {
+		// Files merged from tars reference their path in the image.
+		src = filepath.Join(fs.tree.src, n.dst)
+	}
+	return ioutil.ReadFile(src)
+}
+
+// lookup returns the node at the given path. It doesn't follow symlinks.
+func (fs *MemFS) lookup(p string) (*memFSNode, bool) {
+	curr := fs.tree
+	for _, part := range pathutils.SplitPath(p) {
+		n, ok := curr.children[part]
+		if !ok {
+			return nil, false
+		}
+		curr = n
+	}
+	return curr, true
+}
+
+// isCapturedFile returns true if the content of the file should be kept in
+// memory.
+func isCapturedFile(hdr *tar.Header) bool {
+	return (hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA) &&
+		hdr.Size <= _maxCapturedFileSize &&
+		_capturedFiles[pathutils.AbsPath(hdr.Name)]
+}
+
 // AddLayerByScan creates an in-memory layer by scanning the differences
 // between the file system and existing in-memory merged layers. The
 // resulting layer is merged in memory and written to the tar writer.
@@ -275,6 +422,8 @@ func (fs *MemFS) AddLayerByScan(w *tar.Writer) error {
 // writer.
 func (fs *MemFS) AddLayerByCopyOps(cs []*CopyOperation, w *tar.Writer) error {
 	fs.sync()
+	fs.scanCache = nil
+	fs.indexChain = nil
 	l := newMemLayer()
 	for _, c := range cs {
 		if err := fs.addToLayer(l, c); err != nil {
@@ -288,6 +437,97 @@ func (fs *MemFS) AddLayerByCopyOps(cs []*CopyOperation, w *tar.Writer) error {
 	return nil
 }
 
+// AddSquashedLayer replaces all in-memory layers after the first base ones with
+// a single layer, computed from the differences between those base layers and
+// the current merged fs view. Content is read from the root of MemFS, so the
+// squashed layers must have been written to disk. The resulting layer is
+// written to the tar writer.
+func (fs *MemFS) AddSquashedLayer(base int, w *tar.Writer) error {
+	if base < 0 || base > len(fs.layers) {
+		return fmt.Errorf("invalid base layer count %d, memfs has %d layers", base, len(fs.layers))
+	}
+
+	// Rebuild the merged view of the base layers.
+	baseTree := newMemFSNode(fs.tree.contentMemFile)
+	for _, l := range fs.layers[:base] {
+		if err := l.rangeFiles(func(f memFile) error {
+			return f.updateMemFS(baseTree)
+		}); err != nil {
+			return fmt.Errorf("merge base layer: %s", err)
+		}
+	}
+
+	l := newMemLayer()
+	if _, err := fs.addSquashedDiffs(l, baseTree, fs.tree); err != nil {
+		return fmt.Errorf("create squashed layer: %s", err)
+	}
+	if err := l.rangeFiles(func(f memFile) error {
+		return f.commit(w, fs.tarConfig)
+	}); err != nil {
+		return fmt.Errorf("commit squashed layer: %s", err)
+	}
+	fs.layers = append(fs.layers[:base:base], l)
+	log.Infof("* Created squashed layer with %d files", l.count())
+	return nil
+}
+
+// addSquashedDiffs adds to the layer the children of node that are new or
+// changed compared to baseNode, as well as whiteouts for the children of
+// baseNode that no longer exist. Parent directories of changed files are also
+// added. It returns true if anything under node was added.
+func (fs *MemFS) addSquashedDiffs(l *memLayer, baseNode, node *memFSNode) (bool, error) {
+	var changed bool
+	for name, child := range node.children {
+		var baseChild *memFSNode
+		if baseNode != nil {
+			baseChild = baseNode.children[name]
+		}
+
+		added := true
+		if baseChild != nil {
+			similar, err := tario.IsSimilarHeader(baseChild.hdr, child.hdr, false)
+			if err != nil {
+				return false, fmt.Errorf("compare header %s: %s", child.dst, err)
+			}
+			added = !similar
+		}
+		if child.hdr.Typeflag == tar.TypeDir {
+			if baseChild != nil && baseChild.hdr.Typeflag != tar.TypeDir {
+				baseChild = nil
+			}
+			childChanged, err := fs.addSquashedDiffs(l, baseChild, child)
+			if err != nil {
+				return false, err
+			}
+			added = added || childChanged
+		}
+		if added {
+			hdr := *child.hdr
+			if hdr.Typeflag == tar.TypeLink {
+				// Hard link targets are absolute in memory, but tars produced
+				// by docker don't have leading "/".
+				hdr.Linkname = pathutils.RelPath(hdr.Linkname)
+			}
+			l.addHeader(filepath.Join(fs.tree.src, child.dst), child.dst, &hdr)
+			changed = true
+		}
+	}
+
+	if baseNode != nil {
+		// Only one whiteout file is needed for a deleted subtree.
+		for name, baseChild := range baseNode.children {
+			if _, ok := node.children[name]; ok {
+				continue
+			}
+			if _, err := l.addWhiteout(baseChild.dst); err != nil {
+				return false, fmt.Errorf("add whiteout to layer %s: %s", baseChild.dst, err)
+			}
+			changed = true
+		}
+	}
+	return changed, nil
+}
+
 // sync flushes filesystem cache, so mtime would be guaranteed to be updated.
 // It also waits at least one sec, in case mtime doesn't have sub-second
 // resolution.
@@ -317,23 +557,8 @@ func (fs *MemFS) createLayerByScan() (*memLayer, error) {
 	log.Info("* Collecting filesystem diff")
 
 	l := newMemLayer()
-	root := fs.tree.src
-	if err := walk(
-		root, fs.blacklist, func(src string, fi os.FileInfo) error {
-			dst, err := pathutils.TrimRoot(src, root)
-			if err != nil {
-				return err
-			}
-			hdr, err := l.createHeader(fs.tree.src, src, dst, fi)
-			if err != nil {
-				return fmt.Errorf("create header %s: %s", dst, err)
-			}
-			if err := fs.maybeAddToLayer(l, src, dst, hdr, true); err != nil {
-				return fmt.Errorf("add to layer: %s", err)
-			}
-			return nil
-		}); err != nil {
-		return nil, fmt.Errorf("walk %s: %s", root, err)
+	if err := fs.scanLayer(l); err != nil {
+		return nil, fmt.Errorf("scan %s: %s", fs.tree.src, err)
 	}
 
 	log.Infow(fmt.Sprintf("* Collected diff: %d files found", l.count()), "duration", time.Since(start).Round(time.Millisecond))
@@ -411,7 +636,7 @@ func (fs *MemFS) addToLayer(l *memLayer, c *CopyOperation) error {
 			}
 			hdr.Uid = c.uid
 			hdr.Gid = c.gid
-			return fs.maybeAddToLayer(l, currSrc, currDst, hdr, false)
+			return fs.maybeAddToLayer(l, currSrc, currDst, hdr)
 		}); err != nil {
 			return fmt.Errorf("copy src %s to dst %s: %s", src, c.dst, err)
 		}
@@ -424,7 +649,7 @@ func (fs *MemFS) addToLayer(l *memLayer, c *CopyOperation) error {
 func (fs *MemFS) commitLayer(l *memLayer, w *tar.Writer) error {
 	// Write to tar header in alphabetical order.
 	if err := l.rangeFiles(func(f memFile) error {
-		return f.commit(w)
+		return f.commit(w, fs.tarConfig)
 	}); err != nil {
 		return fmt.Errorf("commit layer: %s", err)
 	}
@@ -435,12 +660,11 @@ func (fs *MemFS) commitLayer(l *memLayer, w *tar.Writer) error {
 // maybeAddToLayer converts given file into to tar header, and adds to the layer
 // if it's different from what's already in the in-memory fs.
 // It ensures that all intermediate directories exist.
-// Set createWhiteout to false to avoid whiting out files, but that won't
-// prevent files/directories from being overwritten.
-func (fs *MemFS) maybeAddToLayer(
-	l *memLayer, src, dst string, hdr *tar.Header, createWhiteout bool) error {
+// It doesn't whiteout deleted files, which scans handle separately, but that
+// won't prevent files/directories from being overwritten.
+func (fs *MemFS) maybeAddToLayer(l *memLayer, src, dst string, hdr *tar.Header) error {
 	// Check if the header already exists and is up-to-date.
-	updated, n, err := fs.isUpdated(dst, hdr)
+	updated, _, err := fs.isUpdated(dst, hdr)
 	if err != nil {
 		return fmt.Errorf("check header %s: %s", dst, err)
 	} else if updated {
@@ -455,32 +679,58 @@ func (fs *MemFS) maybeAddToLayer(
 			}
 		}
 	}
+	return nil
+}
 
-	if createWhiteout {
-		// Handle deletions.
-		// Note: Only one whiteout file is needed for a deleted subtree.
-		if hdr.Typeflag == tar.TypeDir && n != nil {
-			for _, child := range n.children {
-				if ok, err := child.isOnDisk(); err != nil {
-					return fmt.Errorf("check on disk %s: %s", child.dst, err)
-				} else if !ok {
-					if mf, err := l.addWhiteout(child.dst); err != nil {
-						return fmt.Errorf(
-							"add whiteout to layer %s: %s", child.dst, err)
-					} else if err := mf.updateMemFS(fs.tree); err != nil {
-						return fmt.Errorf(
-							"update memfs with whiteout %s: %s", child.dst, err)
-						// Add intermediate directories for whited out file.
-					} else if _, err := fs.addAncestors(l, child.dst, false, 0, 0, 0); err != nil {
-						return fmt.Errorf("add ancestors of %s: %s", child.dst, err)
-					}
-				}
-			}
-		}
+// addWhiteoutToLayer adds a whiteout for the given path to the layer, and
+// removes it from the merged view.
+func (fs *MemFS) addWhiteoutToLayer(l *memLayer, p string) error {
+	if mf, err := l.addWhiteout(p); err != nil {
+		return fmt.Errorf("add whiteout to layer %s: %s", p, err)
+	} else if err := mf.updateMemFS(fs.tree); err != nil {
+		return fmt.Errorf("update memfs with whiteout %s: %s", p, err)
+		// Add intermediate directories for whited out file.
+	} else if _, err := fs.addAncestors(l, p, false, 0, 0, 0); err != nil {
+		return fmt.Errorf("add ancestors of %s: %s", p, err)
+	}
+	return nil
+}
+
+// addOpaqueToLayer adds an opaque whiteout for the given directory to the
+// layer, and removes the children of the directory from the merged view,
+// except the ones in keep, which were already merged from the same layer.
+func (fs *MemFS) addOpaqueToLayer(l *memLayer, dir string, keep map[string]bool) error {
+	if _, err := fs.addAncestors(l, dir, true, 0, 0, 0); err != nil {
+		return fmt.Errorf("add ancestors of %s: %s", dir, err)
+	}
+	n, ok := fs.lookup(dir)
+	if !ok || n.hdr.Typeflag != tar.TypeDir {
+		log.Warnf("Ignoring opaque whiteout of non-directory %s", dir)
+		return nil
 	}
+	l.addOpaque(dir)
+	fs.removeChildren(l, n, keep)
 	return nil
 }
 
+// removeChildren removes the descendants of node that are not in keep. Kept
+// descendants are added to the layer so that they are merged again after the
+// opaque whiteout of node.
+func (fs *MemFS) removeChildren(l *memLayer, node *memFSNode, keep map[string]bool) {
+	for name, child := range node.children {
+		if !keep[child.dst] {
+			delete(node.children, name)
+			continue
+		}
+		if _, ok := l.files[child.dst]; !ok {
+			l.files[child.dst] = child.contentMemFile
+		}
+		if child.hdr.Typeflag == tar.TypeDir {
+			fs.removeChildren(l, child, keep)
+		}
+	}
+}
+
 // isUpdated checks if the given path is new or updated compared to what's saved
 // in memory. it will also return node if the path exists in memory.
 // Note: it doesn't follow symlinks.
@@ -571,7 +821,7 @@ func (fs *MemFS) addAncestors(l *memLayer, dst string, inclusive bool, depth, ui
 // untarOneItem handles untarring a single header from a tar archive to local
 // disk. It handles existing files on disk, applying metainfo from the header,
 // and writing content.
-func (fs *MemFS) untarOneItem(path string, header *tar.Header, r *tar.Reader) error {
+func (fs *MemFS) untarOneItem(path string, header *tar.Header, r io.Reader) error {
 	// If it's a whiteout file, there's no need to check existing path on disk.
 	if strings.HasPrefix(filepath.Base(path), _whiteoutPrefix) {
 		if err := fs.untarWhiteout(path); err != nil {
@@ -603,6 +853,9 @@ func (fs *MemFS) untarOneItem(path string, header *tar.Header, r *tar.Reader) er
 		if err != nil {
 			return fmt.Errorf("create header %s: %s", path, err)
 		}
+		if err := tario.AddXattrs(localHeader, path); err != nil {
+			return fmt.Errorf("add xattrs %s: %s", path, err)
+		}
 
 		// If the file is already on disk, nothing needs to be done.
 		if similar, err := tario.IsSimilarHeader(localHeader, header, false); err != nil {
@@ -659,6 +912,30 @@ func (fs *MemFS) untarWhiteout(path string) error {
 	return nil
 }
 
+// untarOpaqueWhiteout removes the contents of the directory at path, except
+// the files in keep, which were already untarred from the same layer. dir is
+// the location of the directory in the image.
+func (fs *MemFS) untarOpaqueWhiteout(path, dir string, keep map[string]bool) error {
+	children, err := ioutil.ReadDir(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("read dir %s: %s", path, err)
+	}
+	for _, fi := range children {
+		childPath := filepath.Join(path, fi.Name())
+		childDst := filepath.Join(dir, fi.Name())
+		if !keep[childDst] {
+			removePathRecursive(childPath, fi, fs.blacklist)
+		} else if fi.IsDir() {
+			if err := fs.untarOpaqueWhiteout(childPath, childDst, keep); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 // untarDirectory creates the directory specified by path and applies the header metadata.
 func (fs *MemFS) untarDirectory(path string, header *tar.Header) error {
 	if err := os.Mkdir(path, header.FileInfo().Mode()); err != nil {
@@ -673,7 +950,7 @@ func (fs *MemFS) untarDirectory(path string, header *tar.Header) error {
 // untarSymlink creates the symlink specified by header at path.
 func (fs *MemFS) untarSymlink(path string, header *tar.Header) error {
 	target := header.Linkname
-	if filepath.IsAbs(header.Linkname) {
+	if filepath.IsAbs(header.Linkname) && !fs.chroot {
 		target = filepath.Join(fs.tree.src, target)
 	}
 	if err := os.Symlink(target, path); err != nil {
@@ -688,7 +965,10 @@ func (fs *MemFS) untarSymlink(path string, header *tar.Header) error {
 
 // untarHardlink creates the hard link specified by header at path.
 func (fs *MemFS) untarHardlink(path string, header *tar.Header) error {
-	target := filepath.Join(fs.tree.src, header.Linkname)
+	target, err := resolveInRoot(fs.tree.src, header.Linkname)
+	if err != nil {
+		return fmt.Errorf("resolve %s in root: %s", header.Linkname, err)
+	}
 	if err := os.Link(target, path); err != nil {
 		return fmt.Errorf(
 			"create link %s => %s: %s", path, target, err)
@@ -700,8 +980,8 @@ func (fs *MemFS) untarHardlink(path string, header *tar.Header) error {
 }
 
 // untarFile creates the file specified by header at path, copies its content from
-// the tar reader, and applies the metadata.
-func (fs *MemFS) untarFile(path string, header *tar.Header, r *tar.Reader) error {
+// the reader, and applies the metadata.
+func (fs *MemFS) untarFile(path string, header *tar.Header, r io.Reader) error {
 	fi := header.FileInfo()
 	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, fi.Mode())
 	if err != nil {
@@ -716,75 +996,3 @@ func (fs *MemFS) untarFile(path string, header *tar.Header, r *tar.Reader) error
 	}
 	return nil
 }
-
-// CompareFS is the public API for comparing merged layers of two images for differences.
-func CompareFS(fs1, fs2 *MemFS, image1Name, image2Name image.Name, ignoreModTime bool) {
-	missing1 := make(map[string]*memFSNode)
-	missing2 := make(map[string]*memFSNode)
-	diff1 := make(map[string]*memFSNode)
-	diff2 := make(map[string]*memFSNode)
-
-	compareNode(fs1.tree, fs2.tree, missing1, missing2, diff1, diff2, "/", ignoreModTime)
-	image1Format := image1Name.GetRepository() + ":" + image1Name.GetTag()
-	image2Format := image2Name.GetRepository() + ":" + image2Name.GetTag()
-	// Files missing in first image but appeared in second image.
-	log.Infof("===== file missing in first image %s =====", image1Format)
-	for _, node := range missing1 {
-		logMemFSNodeInfo(node)
-	}
-
-	// Files missing in second image but appeared in first image.
-	log.Infof("===== file missing in second image %s =====", image2Format)
-	for _, node := range missing2 {
-		logMemFSNodeInfo(node)
-	}
-
-	// File differences in two images.
-	log.Infof("===== difference between two images %s and %s =====", image1Format, image2Format)
-	for path := range diff1 {
-		hdr1, hdr2 := diff1[path].hdr, diff2[path].hdr
-		log.Infof("%s %s %d %d %d", path, hdr1.FileInfo().Mode(), hdr1.Uid, hdr1.Gid, hdr1.Size)
-		log.Infof("%s %s %d %d %d", path, hdr2.FileInfo().Mode(), hdr2.Uid, hdr2.Gid, hdr2.Size)
-		log.Infof("xxxxxxxxxxxxxxxxxxxxxxxxxxx")
-	}
-}
-
-// compareNode compares two memFSNodes for differences.
-func compareNode(node1, node2 *memFSNode, missing1, missing2, diff1, diff2 map[string]*memFSNode, path string, ignoreModTime bool) {
-	if isSimilar, _ := tario.IsSimilarHeader(node1.hdr, node2.hdr, ignoreModTime); !isSimilar {
-		diff1[path] = node1
-		diff2[path] = node2
-	}
-
-	allChildren := make(map[string]bool)
-	for child := range node1.children {
-		allChildren[child] = true
-	}
-
-	for child := range node2.children {
-		allChildren[child] = true
-	}
-
-	for child := range allChildren {
-		nextNode1, ok1 := node1.children[child]
-		nextNode2, ok2 := node2.children[child]
-		updatedPath := filepath.Join(path, child)
-		if ok1 && ok2 {
-			compareNode(nextNode1, nextNode2, missing1, missing2, diff1, diff2, updatedPath, ignoreModTime)
-			continue
-		} else if ok1 {
-			missing2[updatedPath] = node1.children[child]
-		} else if ok2 {
-			missing1[updatedPath] = node2.children[child]
-		}
-	}
-}
-
-//logMemFSNodeInfo logs the info of a memFSNode.
-func logMemFSNodeInfo(node *memFSNode) {
-	hdr := node.hdr
-	log.Infof("%s %s %d %d %d", hdr.Name, hdr.FileInfo().Mode(), hdr.Uid, hdr.Gid, hdr.Size)
-	for _, nxtNode := range node.children {
-		logMemFSNodeInfo(nxtNode)
-	}
-}
@@ -0,0 +1,234 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshot
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/log"
+	"github.com/uber/makisu/lib/tario"
+)
+
+// _indexVersion is part of index keys. It must be changed whenever the index
+// format or the way layers are merged changes, so stale indexes are ignored.
+const _indexVersion = "3"
+
+// indexEntry is one file of a layer in an index.
+type indexEntry struct {
+	Src      string
+	Dst      string // Path of the deleted file for whiteouts
+	Whiteout bool
+	Opaque   bool // Dst is the opaque directory
+	Header   *tar.Header
+	Content  []byte
+}
+
+// memFSIndex contains the files of one layer as it was merged into MemFS on
+// top of the previous layers of the chain.
+type memFSIndex struct {
+	Key     string
+	Entries []indexEntry
+}
+
+// SetIndexDir sets the dir where indexes of merged layers are saved. When a
+// layer is merged with UpdateFromLayer without being untarred, its index is
+// loaded instead if a previous MemFS with the same blacklist merged the same
+// chain of layers. Indexes are not used if it's not set.
+func (fs *MemFS) SetIndexDir(dir string) {
+	fs.indexDir = dir
+}
+
+// UpdateFromLayer updates MemFS with the gzipped layer tar from the given
+// reader, like UpdateFromTarReader. If untar is false and the index of the
+// layer on top of the previously merged layers exists, it is loaded instead,
+// and the reader is not read.
+// Missing or unreadable indexes are rebuilt from the reader.
+func (fs *MemFS) UpdateFromLayer(digest image.Digest, r io.Reader, untar bool) error {
+	key := fs.nextIndexKey(digest)
+	if key != "" && !untar {
+		if l, err := fs.loadIndex(key); err == nil {
+			if err := fs.mergeIndexLayer(l); err != nil {
+				return fmt.Errorf("merge memfs index: %s", err)
+			}
+			fs.indexChain = append(fs.indexChain, digest)
+			return nil
+		} else if !os.IsNotExist(err) {
+			log.Warnf("Failed to load memfs index of layer %s, rebuilding it: %s", digest.Hex(), err)
+		}
+	}
+
+	gzipReader, err := tario.NewGzipReader(r)
+	if err != nil {
+		return fmt.Errorf("new gzip reader: %s", err)
+	}
+	defer gzipReader.Close()
+	chain := fs.indexChain
+	if err := fs.UpdateFromTarReader(tar.NewReader(gzipReader), untar); err != nil {
+		return err
+	}
+	if chain == nil {
+		return nil
+	}
+	fs.indexChain = append(chain, digest)
+
+	if key != "" {
+		if err := fs.saveIndex(key, fs.layers[len(fs.layers)-1]); err != nil {
+			log.Warnf("Failed to save memfs index of layer %s: %s", digest.Hex(), err)
+		}
+	}
+	return nil
+}
+
+// nextIndexKey returns the key of the index of the given layer merged on top
+// of the current chain. It returns an empty string if indexes can't be used.
+// The root of MemFS is not part of the key: files merged from tars reference
+// their path in the image, and captured files are kept in the index, so
+// indexes don't depend on the root.
+func (fs *MemFS) nextIndexKey(digest image.Digest) string {
+	if fs.indexDir == "" || fs.indexChain == nil {
+		return ""
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "version:%s\n", _indexVersion)
+	fmt.Fprintf(h, "blacklist:%s\n", strings.Join(fs.blacklist, ":"))
+	for _, d := range fs.indexChain {
+		fmt.Fprintf(h, "layer:%s\n", d)
+	}
+	fmt.Fprintf(h, "layer:%s\n", digest)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// loadIndex returns the layer of the index with the given key.
+func (fs *MemFS) loadIndex(key string) (*memLayer, error) {
+	f, err := os.Open(filepath.Join(fs.indexDir, key))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	gzipReader, err := tario.NewGzipReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("new gzip reader: %s", err)
+	}
+	defer gzipReader.Close()
+
+	var index memFSIndex
+	if err := gob.NewDecoder(gzipReader).Decode(&index); err != nil {
+		return nil, fmt.Errorf("decode index: %s", err)
+	} else if index.Key != key {
+		return nil, fmt.Errorf("index key %s doesn't match %s", index.Key, key)
+	}
+
+	l := newMemLayer()
+	for _, e := range index.Entries {
+		if e.Opaque {
+			l.addOpaque(e.Dst)
+		} else if e.Whiteout {
+			if _, err := l.addWhiteout(e.Dst); err != nil {
+				return nil, fmt.Errorf("add whiteout %s: %s", e.Dst, err)
+			}
+		} else if e.Header == nil {
+			return nil, fmt.Errorf("missing header of %s", e.Dst)
+		} else {
+			mf := newContentMemFile(e.Src, e.Dst, e.Header)
+			mf.content = e.Content
+			l.files[e.Dst] = mf
+		}
+	}
+	return l, nil
+}
+
+// mergeIndexLayer merges the layer of an index into MemFS, the same way
+// AddSquashedLayer rebuilds base layers.
+func (fs *MemFS) mergeIndexLayer(l *memLayer) error {
+	fs.scanCache = nil
+	if err := l.rangeFiles(func(f memFile) error {
+		return f.updateMemFS(fs.tree)
+	}); err != nil {
+		fs.indexChain = nil
+		return err
+	}
+	fs.layers = append(fs.layers, l)
+	log.Infof("* Merged %d headers from memfs index", l.count())
+	return nil
+}
+
+// saveIndex saves the index of the given layer with the given key.
+func (fs *MemFS) saveIndex(key string, l *memLayer) error {
+	index := memFSIndex{Key: key}
+	if err := l.rangeFiles(func(f memFile) error {
+		switch mf := f.(type) {
+		case *contentMemFile:
+			index.Entries = append(index.Entries, indexEntry{
+				Src:     mf.src,
+				Dst:     mf.dst,
+				Header:  mf.hdr,
+				Content: mf.content,
+			})
+		case *whiteoutMemFile:
+			index.Entries = append(index.Entries, indexEntry{
+				Dst:      mf.del,
+				Whiteout: true,
+			})
+		case *opaqueMemFile:
+			index.Entries = append(index.Entries, indexEntry{
+				Dst:    mf.dir,
+				Opaque: true,
+			})
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(fs.indexDir, 0755); err != nil {
+		return fmt.Errorf("create index dir: %s", err)
+	}
+	f, err := ioutil.TempFile(fs.indexDir, ".tmp")
+	if err != nil {
+		return fmt.Errorf("create tmp index file: %s", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	w, err := tario.NewConfig().NewGzipWriter(f)
+	if err != nil {
+		return fmt.Errorf("new gzip writer: %s", err)
+	}
+	if err := gob.NewEncoder(w).Encode(&index); err != nil {
+		return fmt.Errorf("encode index: %s", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("close gzip writer: %s", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("close tmp index file: %s", err)
+	}
+	// Indexes are written atomically, so concurrent builds never see a
+	// partial one.
+	if err := os.Rename(f.Name(), filepath.Join(fs.indexDir, key)); err != nil {
+		return fmt.Errorf("commit index file: %s", err)
+	}
+	return nil
+}
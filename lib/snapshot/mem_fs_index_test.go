@@ -0,0 +1,179 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshot
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/tario"
+)
+
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, errors.New("layer should not be read")
+}
+
+func gzippedLayerFixture(require *require.Assertions, files map[string]string) []byte {
+	var buf bytes.Buffer
+	gw, err := tario.NewConfig().NewGzipWriter(&buf)
+	require.NoError(err)
+	w := tar.NewWriter(gw)
+	for _, name := range []string{"etc/", "etc/passwd", "etc/hosts", "etc/.wh.hosts"} {
+		content, ok := files[name]
+		if !ok {
+			continue
+		}
+		hdr := &tar.Header{Name: name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(content))}
+		if name == "etc/" {
+			hdr.Mode = 0755
+			hdr.Typeflag = tar.TypeDir
+		}
+		require.NoError(w.WriteHeader(hdr))
+		_, err := w.Write([]byte(content))
+		require.NoError(err)
+	}
+	require.NoError(w.Close())
+	require.NoError(gw.Close())
+	return buf.Bytes()
+}
+
+func TestUpdateFromLayerIndex(t *testing.T) {
+	require := require.New(t)
+
+	tmpRoot, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(tmpRoot)
+	indexDir := filepath.Join(tmpRoot, "index")
+	root := filepath.Join(tmpRoot, "root")
+	require.NoError(os.Mkdir(root, 0755))
+
+	layer1 := gzippedLayerFixture(require, map[string]string{
+		"etc/": "", "etc/passwd": "root:x:0:0::/root:/bin/sh\n", "etc/hosts": "hosts",
+	})
+	layer2 := gzippedLayerFixture(require, map[string]string{
+		"etc/": "", "etc/.wh.hosts": "",
+	})
+	digest1, err := image.NewDigester().FromBytes(layer1)
+	require.NoError(err)
+	digest2, err := image.NewDigester().FromBytes(layer2)
+	require.NoError(err)
+
+	fs1, err := NewMemFS(clock.NewMock(), root, nil)
+	require.NoError(err)
+	fs1.SetIndexDir(indexDir)
+	require.NoError(fs1.UpdateFromLayer(digest1, bytes.NewReader(layer1), false))
+	require.NoError(fs1.UpdateFromLayer(digest2, bytes.NewReader(layer2), false))
+	indexes, err := ioutil.ReadDir(indexDir)
+	require.NoError(err)
+	require.Len(indexes, 2)
+
+	// The second MemFS doesn't read layers.
+	fs2, err := NewMemFS(clock.NewMock(), root, nil)
+	require.NoError(err)
+	fs2.SetIndexDir(indexDir)
+	require.NoError(fs2.UpdateFromLayer(digest1, failingReader{}, false))
+	require.NoError(fs2.UpdateFromLayer(digest2, failingReader{}, false))
+	require.Len(fs2.layers, 2)
+	for i := range fs1.layers {
+		requireEqualLayers(require, fs1.layers[i], fs2.layers[i])
+	}
+	_, ok := fs2.lookup("/etc/hosts")
+	require.False(ok)
+	content, err := fs2.ReadFile("/etc/passwd")
+	require.NoError(err)
+	require.Equal("root:x:0:0::/root:/bin/sh\n", string(content))
+
+	// Indexes depend on the layers below.
+	fs3, err := NewMemFS(clock.NewMock(), root, nil)
+	require.NoError(err)
+	fs3.SetIndexDir(indexDir)
+	require.Error(fs3.UpdateFromLayer(digest2, failingReader{}, false))
+
+	// Layers are read when they are untarred, or when the chain is unknown.
+	fs4, err := NewMemFS(clock.NewMock(), root, nil)
+	require.NoError(err)
+	fs4.SetIndexDir(indexDir)
+	require.Error(fs4.UpdateFromLayer(digest1, failingReader{}, true))
+	fs4.Reset()
+	require.NoError(fs4.UpdateFromTarReader(tar.NewReader(bytes.NewReader(nil)), false))
+	require.Error(fs4.UpdateFromLayer(digest1, failingReader{}, false))
+
+	// Corrupt indexes are rebuilt.
+	for _, fi := range indexes {
+		require.NoError(ioutil.WriteFile(filepath.Join(indexDir, fi.Name()), []byte("corrupt"), 0644))
+	}
+	fs5, err := NewMemFS(clock.NewMock(), root, nil)
+	require.NoError(err)
+	fs5.SetIndexDir(indexDir)
+	require.NoError(fs5.UpdateFromLayer(digest1, bytes.NewReader(layer1), false))
+	require.NoError(fs5.UpdateFromLayer(digest2, bytes.NewReader(layer2), false))
+	fs6, err := NewMemFS(clock.NewMock(), root, nil)
+	require.NoError(err)
+	fs6.SetIndexDir(indexDir)
+	require.NoError(fs6.UpdateFromLayer(digest1, failingReader{}, false))
+	require.NoError(fs6.UpdateFromLayer(digest2, failingReader{}, false))
+	for i := range fs1.layers {
+		requireEqualLayers(require, fs1.layers[i], fs6.layers[i])
+	}
+}
+
+func TestUpdateFromLayerIndexAcrossRoots(t *testing.T) {
+	require := require.New(t)
+
+	tmpRoot, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(tmpRoot)
+	indexDir := filepath.Join(tmpRoot, "index")
+	root1 := filepath.Join(tmpRoot, "root1")
+	require.NoError(os.Mkdir(root1, 0755))
+	root2 := filepath.Join(tmpRoot, "root2")
+	require.NoError(os.MkdirAll(filepath.Join(root2, "etc"), 0755))
+	require.NoError(ioutil.WriteFile(filepath.Join(root2, "etc/passwd"), []byte("host"), 0644))
+
+	layer := gzippedLayerFixture(require, map[string]string{
+		"etc/": "", "etc/passwd": "root:x:0:0::/root:/bin/sh\n",
+	})
+	digest, err := image.NewDigester().FromBytes(layer)
+	require.NoError(err)
+
+	// The index is saved by a MemFS untarring the layer.
+	fs1, err := NewMemFS(clock.NewMock(), root1, nil)
+	require.NoError(err)
+	fs1.SetIndexDir(indexDir)
+	require.NoError(fs1.UpdateFromLayer(digest, bytes.NewReader(layer), true))
+	content, err := ioutil.ReadFile(filepath.Join(root1, "etc/passwd"))
+	require.NoError(err)
+	require.Equal("root:x:0:0::/root:/bin/sh\n", string(content))
+
+	// Captured files of the index are read from memory, not from the root of
+	// the MemFS loading it.
+	fs2, err := NewMemFS(clock.NewMock(), root2, nil)
+	require.NoError(err)
+	fs2.SetIndexDir(indexDir)
+	require.NoError(fs2.UpdateFromLayer(digest, failingReader{}, false))
+	content, err = fs2.ReadFile("/etc/passwd")
+	require.NoError(err)
+	require.Equal("root:x:0:0::/root:/bin/sh\n", string(content))
+}
@@ -16,12 +16,14 @@ package snapshot
 
 import (
 	"archive/tar"
+	"bytes"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sort"
 	"testing"
+	"time"
 
 	"github.com/andres-erbsen/clock"
 	"github.com/stretchr/testify/require"
@@ -116,6 +118,44 @@ func TestUntarFromPath(t *testing.T) {
 	require.Equal(2, fs.layers[len(fs.layers)-1].count())
 }
 
+func TestUntarDirWithTrailingSlashKeepsParentModTime(t *testing.T) {
+	require := require.New(t)
+
+	tmpRoot, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(tmpRoot)
+
+	modTime := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	require.NoError(os.Mkdir(filepath.Join(tmpRoot, "parent"), 0755))
+	require.NoError(os.Chtimes(filepath.Join(tmpRoot, "parent"), modTime, modTime))
+
+	tarFile, err := ioutil.TempFile("/tmp", "makisu-test-dir.tar")
+	require.NoError(err)
+	defer os.Remove(tarFile.Name())
+	w := tar.NewWriter(tarFile)
+	require.NoError(w.WriteHeader(&tar.Header{
+		Name:     "parent/dir/",
+		Typeflag: tar.TypeDir,
+		Mode:     0755,
+		ModTime:  modTime,
+	}))
+	require.NoError(w.Close())
+	_, err = tarFile.Seek(0, io.SeekStart)
+	require.NoError(err)
+
+	fs, err := NewMemFS(clock.NewMock(), tmpRoot, nil)
+	require.NoError(err)
+	require.NoError(fs.UpdateFromTarReader(tar.NewReader(tarFile), true))
+	require.NoError(tarFile.Close())
+
+	fi, err := os.Stat(filepath.Join(tmpRoot, "parent", "dir"))
+	require.NoError(err)
+	require.True(fi.IsDir())
+	fi, err = os.Stat(filepath.Join(tmpRoot, "parent"))
+	require.NoError(err)
+	require.True(modTime.Equal(fi.ModTime()))
+}
+
 func TestMemNodeIsOnDisk(t *testing.T) {
 	t.Run("Success", func(t *testing.T) {
 		require := require.New(t)
@@ -1277,3 +1317,186 @@ func TestCompareFS(t *testing.T) {
 	require.Equal(expectedDiff, actualDiff1)
 	require.Equal(expectedDiff, actualDiff2)
 }
+
+func TestAddSquashedLayer(t *testing.T) {
+	require := require.New(t)
+
+	tmpRoot, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(tmpRoot)
+
+	clk := clock.NewMock()
+	fs, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist)
+	require.NoError(err)
+	fs.blacklist = nil
+
+	scan := func() {
+		w := tar.NewWriter(ioutil.Discard)
+		require.NoError(fs.AddLayerByScan(w))
+		require.NoError(w.Close())
+	}
+
+	// Base layer.
+	require.NoError(os.MkdirAll(filepath.Join(tmpRoot, "base/sub"), 0755))
+	require.NoError(ioutil.WriteFile(filepath.Join(tmpRoot, "base/keep.txt"), []byte("keep"), 0644))
+	require.NoError(ioutil.WriteFile(filepath.Join(tmpRoot, "base/sub/rm.txt"), []byte("rm"), 0644))
+	scan()
+
+	// Add a file, then remove it along with a base file.
+	require.NoError(os.MkdirAll(filepath.Join(tmpRoot, "new"), 0755))
+	require.NoError(ioutil.WriteFile(filepath.Join(tmpRoot, "new/tmp.txt"), []byte("tmp"), 0644))
+	require.NoError(ioutil.WriteFile(filepath.Join(tmpRoot, "new/a.txt"), []byte("a"), 0644))
+	scan()
+	require.NoError(os.Remove(filepath.Join(tmpRoot, "new/tmp.txt")))
+	require.NoError(os.RemoveAll(filepath.Join(tmpRoot, "base/sub")))
+	scan()
+	require.Len(fs.layers, 3)
+
+	tarFile, err := ioutil.TempFile("/tmp", "makisu-test-squash.tar")
+	require.NoError(err)
+	defer os.Remove(tarFile.Name())
+	w := tar.NewWriter(tarFile)
+	require.NoError(fs.AddSquashedLayer(1, w))
+	require.NoError(w.Close())
+	require.NoError(tarFile.Close())
+	require.Len(fs.layers, 2)
+
+	tarFile, err = os.Open(tarFile.Name())
+	require.NoError(err)
+	defer tarFile.Close()
+	r := tar.NewReader(tarFile)
+	var names []string
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(err)
+		names = append(names, hdr.Name)
+	}
+	require.Equal([]string{"base/", "base/.wh.sub", "new/", "new/a.txt"}, names)
+
+	require.Error(fs.AddSquashedLayer(3, tar.NewWriter(ioutil.Discard)))
+}
+
+func TestReadFile(t *testing.T) {
+	require := require.New(t)
+
+	tmpRoot, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(tmpRoot)
+
+	fs, err := NewMemFS(clock.NewMock(), tmpRoot, nil)
+	require.NoError(err)
+
+	// Build a layer with passwd and another file, and merge it without
+	// untarring.
+	tarFile, err := ioutil.TempFile("/tmp", "makisu-test-read.tar")
+	require.NoError(err)
+	defer os.Remove(tarFile.Name())
+	w := tar.NewWriter(tarFile)
+	for _, f := range []struct {
+		name    string
+		content string
+	}{{"etc/passwd", "app:x:1000:1000::/home/app:/bin/sh\n"}, {"etc/hosts", "localhost"}} {
+		require.NoError(w.WriteHeader(&tar.Header{
+			Name:     f.name,
+			Typeflag: tar.TypeReg,
+			Mode:     0644,
+			Size:     int64(len(f.content)),
+		}))
+		_, err := w.Write([]byte(f.content))
+		require.NoError(err)
+	}
+	require.NoError(w.Close())
+	_, err = tarFile.Seek(0, io.SeekStart)
+	require.NoError(err)
+	require.NoError(fs.UpdateFromTarReader(tar.NewReader(tarFile), false))
+	require.NoError(tarFile.Close())
+
+	content, err := fs.ReadFile("/etc/passwd")
+	require.NoError(err)
+	require.Equal("app:x:1000:1000::/home/app:/bin/sh\n", string(content))
+
+	// Files that are not captured are read from disk, where they don't exist.
+	_, err = fs.ReadFile("/etc/hosts")
+	require.Error(err)
+
+	_, err = fs.ReadFile("/etc/group")
+	require.True(os.IsNotExist(err))
+
+	_, err = fs.ReadFile("/etc")
+	require.Error(err)
+
+	// Once on disk, files are read from there.
+	require.NoError(os.MkdirAll(filepath.Join(tmpRoot, "etc"), 0755))
+	require.NoError(ioutil.WriteFile(
+		filepath.Join(tmpRoot, "etc/passwd"), []byte("root:x:0:0::/root:/bin/sh\n"), 0644))
+	w = tar.NewWriter(ioutil.Discard)
+	require.NoError(fs.AddLayerByScan(w))
+	require.NoError(w.Close())
+	content, err = fs.ReadFile("/etc/passwd")
+	require.NoError(err)
+	require.Equal("root:x:0:0::/root:/bin/sh\n", string(content))
+}
+
+func TestUpdateFromTarReaderOpaqueWhiteout(t *testing.T) {
+	require := require.New(t)
+
+	tmpRoot, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(tmpRoot)
+
+	fs, err := NewMemFS(clock.NewMock(), tmpRoot, nil)
+	require.NoError(err)
+
+	writeTar := func(hdrs ...*tar.Header) *tar.Reader {
+		var b bytes.Buffer
+		w := tar.NewWriter(&b)
+		for _, hdr := range hdrs {
+			require.NoError(w.WriteHeader(hdr))
+		}
+		require.NoError(w.Close())
+		return tar.NewReader(&b)
+	}
+	dir := func(name string) *tar.Header {
+		return &tar.Header{Name: name, Typeflag: tar.TypeDir, Mode: 0755}
+	}
+	file := func(name string) *tar.Header {
+		return &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644}
+	}
+
+	require.NoError(fs.UpdateFromTarReader(writeTar(
+		dir("test/"), file("test/a"), dir("test/b/"), file("test/b/c"), file("other")), true))
+
+	// Files of the same layer are kept, whether they come before or after
+	// the opaque whiteout.
+	require.NoError(fs.UpdateFromTarReader(writeTar(
+		dir("test/"), file("test/d"), file("test/.wh..wh..opq"), file("test/e")), true))
+
+	for _, p := range []string{"/test/a", "/test/b", "/test/b/c"} {
+		_, ok := fs.lookup(p)
+		require.False(ok, p)
+		_, err := os.Lstat(filepath.Join(tmpRoot, p))
+		require.True(os.IsNotExist(err), p)
+	}
+	for _, p := range []string{"/test/d", "/test/e", "/other"} {
+		_, ok := fs.lookup(p)
+		require.True(ok, p)
+		_, err := os.Lstat(filepath.Join(tmpRoot, p))
+		require.NoError(err, p)
+	}
+
+	// Replaying the layers gives the same result.
+	l := fs.layers[len(fs.layers)-1]
+	require.Contains(l.files, "/test/.wh..wh..opq")
+	tree := newMemFSNode(fs.tree.contentMemFile)
+	for _, l := range fs.layers {
+		require.NoError(l.rangeFiles(func(f memFile) error {
+			return f.updateMemFS(tree)
+		}))
+	}
+	require.Len(tree.children["test"].children, 2)
+	require.Contains(tree.children["test"].children, "d")
+	require.Contains(tree.children["test"].children, "e")
+}
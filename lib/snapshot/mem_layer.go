@@ -31,7 +31,7 @@ import (
 // memFile represents one file in an in-memory layer.
 type memFile interface {
 	updateMemFS(tree *memFSNode) error
-	commit(w *tar.Writer) error
+	commit(w *tar.Writer, c *tario.Config) error
 }
 
 // contentMemFile represents a MemFile implementation that references on-disk contents.
@@ -39,6 +39,10 @@ type contentMemFile struct {
 	src string // Location to read content from while creating tar
 	dst string // Location to write content to. Key to layer.files
 	hdr *tar.Header
+
+	// content is set for the files MemFS needs to read, if they were merged
+	// from a tar.
+	content []byte
 }
 
 // newContentMemFile inits a new contentMemFile.
@@ -80,8 +84,8 @@ func (f *contentMemFile) updateMemFS(node *memFSNode) error {
 }
 
 // commit writes the contentMemFile's contents to the tar writer.
-func (f *contentMemFile) commit(w *tar.Writer) error {
-	if err := tario.WriteEntry(w, f.src, f.hdr); err != nil {
+func (f *contentMemFile) commit(w *tar.Writer, c *tario.Config) error {
+	if err := c.WriteEntry(w, f.src, f.hdr); err != nil {
 		return fmt.Errorf("content commit %s: %s", f.hdr.Name, err)
 	}
 	return nil
@@ -124,13 +128,51 @@ func (f *whiteoutMemFile) updateMemFS(node *memFSNode) error {
 }
 
 // commit writes an empty whiteout file to the tar writer.
-func (f *whiteoutMemFile) commit(w *tar.Writer) error {
-	if err := tario.WriteHeader(w, f.hdr); err != nil {
+func (f *whiteoutMemFile) commit(w *tar.Writer, c *tario.Config) error {
+	if err := c.WriteHeader(w, f.hdr); err != nil {
 		return fmt.Errorf("whiteout commit %s: %s", f.hdr.Name, err)
 	}
 	return nil
 }
 
+// opaqueMemFile represents a MemFile implementation that hides the contents
+// of a directory in lower layers.
+type opaqueMemFile struct {
+	dir string // Location of the opaque directory
+	hdr *tar.Header
+}
+
+// newOpaqueMemFile inits a new opaqueMemFile.
+func newOpaqueMemFile(dir string) *opaqueMemFile {
+	return &opaqueMemFile{
+		dir: dir,
+		hdr: &tar.Header{Name: pathutils.RelPath(path.Join(dir, _whiteoutOpaqueDir))},
+	}
+}
+
+// updateMemFS removes the children of the directory designated by
+// opaqueMemFile from the tree rooted at node. Other files of the layer under
+// that directory must be merged after it.
+func (f *opaqueMemFile) updateMemFS(node *memFSNode) error {
+	for _, part := range pathutils.SplitPath(f.dir) {
+		n, ok := node.children[part]
+		if !ok {
+			return fmt.Errorf("missing opaque dir %s", f.dir)
+		}
+		node = n
+	}
+	node.children = make(map[string]*memFSNode)
+	return nil
+}
+
+// commit writes an empty opaque whiteout file to the tar writer.
+func (f *opaqueMemFile) commit(w *tar.Writer, c *tario.Config) error {
+	if err := c.WriteHeader(w, f.hdr); err != nil {
+		return fmt.Errorf("opaque whiteout commit %s: %s", f.hdr.Name, err)
+	}
+	return nil
+}
+
 // memLayer is an in-memory path to tar header map for one image layer.
 type memLayer struct {
 	files map[string]memFile // Path to memFile map
@@ -149,11 +191,18 @@ func (l *memLayer) count() int {
 }
 
 // createHeader creates a new tar header from given path and file info.
+// Extended attributes of the file at src are added to the header, unless src
+// is empty.
 func (l *memLayer) createHeader(root, src, dst string, fi os.FileInfo) (*tar.Header, error) {
 	hdr, err := tar.FileInfoHeader(fi, "")
 	if err != nil {
 		return nil, fmt.Errorf("create header %s: %s", src, err)
 	}
+	if src != "" {
+		if err := tario.AddXattrs(hdr, src); err != nil {
+			return nil, fmt.Errorf("add xattrs %s: %s", src, err)
+		}
+	}
 
 	// Set name. FileInfoHeader only set name to file base name by default.
 	// Also remove leading "/" in dst. Tars produced by docker don't have it.
@@ -175,7 +224,8 @@ func (l *memLayer) createHeader(root, src, dst string, fi os.FileInfo) (*tar.Hea
 		} else if !ok {
 			return nil, fmt.Errorf("symlink in tar header but not on disk: %s", src)
 		} else {
-			if filepath.IsAbs(target) {
+			// Targets might have been created with or without root prefix.
+			if filepath.IsAbs(target) && pathutils.IsDescendantOfAny(target, []string{root}) {
 				target, err = pathutils.TrimRoot(target, root)
 				if err != nil {
 					return nil, fmt.Errorf("trim symlink root: %s", err)
@@ -227,6 +277,23 @@ func (l *memLayer) addWhiteout(p string) (memFile, error) {
 	return mf, nil
 }
 
+// addOpaque adds an opaque whiteout for the given directory.
+func (l *memLayer) addOpaque(dir string) memFile {
+	dir = pathutils.AbsPath(dir)
+	mf := newOpaqueMemFile(dir)
+	l.files[path.Join(dir, _whiteoutOpaqueDir)] = mf
+	return mf
+}
+
+// sortKey returns the key files are sorted by. Opaque whiteouts are sorted
+// right after their directory, before its other children.
+func sortKey(p string) string {
+	if path.Base(p) == _whiteoutOpaqueDir {
+		return strings.TrimSuffix(p, _whiteoutOpaqueDir) + "\x00"
+	}
+	return p
+}
+
 // range sort all files and iterate through them with given function.
 // TODO: loaded tars normally have files sorted already: avoid unnecessary work.
 func (l *memLayer) rangeFiles(f func(memFile) error) error {
@@ -234,7 +301,9 @@ func (l *memLayer) rangeFiles(f func(memFile) error) error {
 	for p := range l.files {
 		keys = append(keys, p)
 	}
-	sort.Strings(keys)
+	sort.Slice(keys, func(i, j int) bool {
+		return sortKey(keys[i]) < sortKey(keys[j])
+	})
 	for _, key := range keys {
 		if err := f(l.files[key]); err != nil {
 			return fmt.Errorf("apply f to %s: %s", key, err)
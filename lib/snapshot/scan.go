@@ -0,0 +1,257 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshot
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/uber/makisu/lib/concurrency"
+	"github.com/uber/makisu/lib/utils"
+)
+
+// _scanWorkers is the number of directories listed concurrently during scans.
+const _scanWorkers = 16
+
+// _scanCacheMinAge is how old the mtime of a directory must be for its
+// listing to be reused by the next scan. A directory modified more recently
+// could be modified again without its mtime changing.
+const _scanCacheMinAge = time.Second
+
+// scanDirStat is the state of a directory when it was last scanned. As long
+// as it doesn't change, no entries were added to or removed from the
+// directory. The inode changes if the directory was replaced, and the ctime
+// if its mtime was set explicitly.
+type scanDirStat struct {
+	modTime    time.Time
+	changeTime time.Time
+	nlink      uint64
+	ino        uint64
+}
+
+// newScanDirStat returns the scanDirStat of the given directory.
+func newScanDirStat(fi os.FileInfo) scanDirStat {
+	stat := utils.FileInfoStat(fi)
+	return scanDirStat{
+		modTime:    fi.ModTime(),
+		changeTime: changeTime(stat),
+		nlink:      uint64(stat.Nlink),
+		ino:        uint64(stat.Ino),
+	}
+}
+
+// scanEntry is a file found while listing a directory. hdr is only set if the
+// file is new or changed compared to the merged view.
+type scanEntry struct {
+	src string
+	dst string
+	fi  os.FileInfo
+	hdr *tar.Header
+}
+
+// scanResult is what was found while listing one directory.
+type scanResult struct {
+	// entries are the children that changed or need to be scanned, in
+	// lexical order.
+	entries []*scanEntry
+	// deleted are the children of the merged view that no longer exist, in
+	// lexical order.
+	deleted []string
+	// opaque is set instead of deleted when all the children of the merged
+	// view were replaced by new ones.
+	opaque bool
+}
+
+// scanLayer computes the differences between the file system and the merged
+// view. Directories are listed concurrently, one level of the tree at a time,
+// without modifying MemFS. The results are then merged into the layer in the
+// order of a serial walk, so the layer doesn't depend on scheduling.
+func (fs *MemFS) scanLayer(l *memLayer) error {
+	start := time.Now()
+	root := &scanEntry{src: fs.tree.src, dst: "/"}
+	fi, err := os.Lstat(root.src)
+	if err != nil {
+		return fmt.Errorf("lstat root: %s", err)
+	}
+	root.fi = fi
+
+	// Listings are only reused if the file system updates directory mtimes
+	// reliably.
+	cache := fs.scanCache
+	if fs.fullScan || !hasReliableDirMtimes(root.src) {
+		cache = nil
+	}
+
+	results := make(map[string]*scanResult)
+	nextCache := make(map[string]scanDirStat)
+	level := []*scanEntry{root}
+	for len(level) > 0 {
+		levelResults := make([]*scanResult, len(level))
+		levelErrs := make([]error, len(level))
+		pool := concurrency.NewWorkerPool(_scanWorkers)
+		for i, dir := range level {
+			i, dir := i, dir
+			pool.Do(func() {
+				levelResults[i], levelErrs[i] = fs.scanDir(l, dir, cache)
+			})
+		}
+		pool.Wait()
+
+		var next []*scanEntry
+		for i, dir := range level {
+			if levelErrs[i] != nil {
+				return fmt.Errorf("scan %s: %s", dir.src, levelErrs[i])
+			}
+			results[dir.dst] = levelResults[i]
+			if dir.fi.ModTime().Before(start.Add(-_scanCacheMinAge)) {
+				nextCache[dir.dst] = newScanDirStat(dir.fi)
+			}
+			for _, e := range levelResults[i].entries {
+				if e.fi.IsDir() {
+					next = append(next, e)
+				}
+			}
+		}
+		level = next
+	}
+
+	fs.indexChain = nil
+	if err := fs.mergeScanResults(l, results, "/"); err != nil {
+		return err
+	}
+	fs.scanCache = nextCache
+	return nil
+}
+
+// scanDir lists the given directory and compares its children with the merged
+// view. If the directory didn't change since the previous scan according to
+// cache, its children are taken from the merged view instead of being read
+// from disk. Only the listing is reused: the children themselves are always
+// checked, and unchanged subdirectories are still scanned, since modifying a
+// file doesn't change the mtime of its ancestors.
+// It must not modify MemFS or the layer, as it runs concurrently with the
+// scans of other directories.
+func (fs *MemFS) scanDir(
+	l *memLayer, dir *scanEntry, cache map[string]scanDirStat) (*scanResult, error) {
+
+	n, _ := fs.lookup(dir.dst)
+
+	var names []string
+	if stat, ok := cache[dir.dst]; ok && n != nil && stat == newScanDirStat(dir.fi) {
+		for name := range n.children {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	} else {
+		f, err := os.Open(dir.src)
+		if err != nil {
+			return nil, fmt.Errorf("open dir: %s", err)
+		}
+		names, err = f.Readdirnames(-1)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("read dir: %s", err)
+		}
+		sort.Strings(names)
+	}
+
+	r := &scanResult{}
+	onDisk := make(map[string]bool, len(names))
+	for _, name := range names {
+		src := filepath.Join(dir.src, name)
+		fi, err := os.Lstat(src)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("lstat %s: %s", src, err)
+		}
+		onDisk[name] = true
+
+		if skip, err := shouldSkip(src, fi, fs.blacklist); err != nil {
+			return nil, fmt.Errorf("check should skip: %s", err)
+		} else if skip {
+			continue
+		}
+
+		e := &scanEntry{src: src, dst: filepath.Join(dir.dst, name), fi: fi}
+		hdr, err := l.createHeader(fs.tree.src, e.src, e.dst, fi)
+		if err != nil {
+			return nil, fmt.Errorf("create header %s: %s", e.dst, err)
+		}
+		if updated, _, err := fs.isUpdated(e.dst, hdr); err != nil {
+			return nil, fmt.Errorf("check header %s: %s", e.dst, err)
+		} else if updated {
+			e.hdr = hdr
+		}
+		if e.hdr != nil || fi.IsDir() {
+			r.entries = append(r.entries, e)
+		}
+	}
+
+	// Only one whiteout file is needed for a deleted subtree.
+	if n != nil && dir.fi.IsDir() {
+		for name, child := range n.children {
+			if !onDisk[name] {
+				r.deleted = append(r.deleted, child.dst)
+			}
+		}
+		sort.Strings(r.deleted)
+
+		// If the directory was deleted and recreated with other contents, a
+		// single opaque whiteout hides all of them.
+		if dir.dst != "/" && len(r.deleted) > 1 && len(r.deleted) == len(n.children) &&
+			len(r.entries) > 0 {
+			r.deleted = nil
+			r.opaque = true
+		}
+	}
+	return r, nil
+}
+
+// mergeScanResults adds the differences found under the given directory to
+// the layer and the merged view, in the same order as a serial walk.
+func (fs *MemFS) mergeScanResults(l *memLayer, results map[string]*scanResult, dir string) error {
+	r, ok := results[dir]
+	if !ok {
+		return nil
+	}
+	if r.opaque {
+		if err := fs.addOpaqueToLayer(l, dir, nil); err != nil {
+			return fmt.Errorf("add opaque whiteout to layer: %s", err)
+		}
+	}
+	for _, p := range r.deleted {
+		if err := fs.addWhiteoutToLayer(l, p); err != nil {
+			return err
+		}
+	}
+	for _, e := range r.entries {
+		if e.hdr != nil {
+			if err := fs.maybeAddToLayer(l, e.src, e.dst, e.hdr); err != nil {
+				return fmt.Errorf("add to layer: %s", err)
+			}
+		}
+		if e.fi.IsDir() {
+			if err := fs.mergeScanResults(l, results, e.dst); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
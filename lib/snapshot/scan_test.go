@@ -0,0 +1,225 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshot
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber/makisu/lib/utils"
+)
+
+func TestScanLayerDeterministic(t *testing.T) {
+	require := require.New(t)
+
+	tmpRoot, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(tmpRoot)
+
+	expected := newMemLayer()
+	for i := 0; i < 20; i++ {
+		dir := fmt.Sprintf("/dir%d", i)
+		require.NoError(addDirectoryToLayer(expected, tmpRoot, dir, 0755))
+		for j := 0; j < 5; j++ {
+			subdir := fmt.Sprintf("%s/sub%d", dir, j)
+			require.NoError(addDirectoryToLayer(expected, tmpRoot, subdir, 0755))
+			file := fmt.Sprintf("%s/file", subdir)
+			require.NoError(addRegularFileToLayer(expected, tmpRoot, file, "hello", 0644))
+		}
+	}
+
+	fs1, err := NewMemFS(clock.NewMock(), tmpRoot, nil)
+	require.NoError(err)
+	l1, err := fs1.createLayerByScan()
+	require.NoError(err)
+	requireEqualLayers(require, expected, l1)
+
+	fs2, err := NewMemFS(clock.NewMock(), tmpRoot, nil)
+	require.NoError(err)
+	l2, err := fs2.createLayerByScan()
+	require.NoError(err)
+	requireEqualLayers(require, l1, l2)
+
+	// Deletions in different subtrees are all whited out.
+	require.NoError(os.RemoveAll(filepath.Join(tmpRoot, "/dir3/sub1")))
+	require.NoError(os.RemoveAll(filepath.Join(tmpRoot, "/dir17")))
+	expected = newMemLayer()
+	require.NoError(addDirectoryToLayer(expected, tmpRoot, "/dir3", 0755))
+	require.NoError(addWhiteoutToLayer(expected, "/dir3/sub1"))
+	require.NoError(addWhiteoutToLayer(expected, "/dir17"))
+	l1, err = fs1.createLayerByScan()
+	require.NoError(err)
+	requireEqualLayers(require, expected, l1)
+}
+
+func TestScanLayerCache(t *testing.T) {
+	require := require.New(t)
+
+	tmpRoot, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(tmpRoot)
+
+	if !hasReliableDirMtimes(tmpRoot) {
+		t.Skip("directory mtimes are not reliable on this file system")
+	}
+
+	fs, err := NewMemFS(clock.NewMock(), tmpRoot, nil)
+	require.NoError(err)
+
+	// Directories modified too recently are not cached.
+	l := newMemLayer()
+	require.NoError(addDirectoryToLayer(l, tmpRoot, "/test", 0755))
+	require.NoError(addRegularFileToLayer(l, tmpRoot, "/test/a.txt", "a", 0644))
+	_, err = fs.createLayerByScan()
+	require.NoError(err)
+	require.Empty(fs.scanCache)
+
+	old := time.Now().Add(-time.Hour)
+	dir := filepath.Join(tmpRoot, "test")
+	require.NoError(os.Chtimes(dir, old, old))
+	require.NoError(os.Chtimes(tmpRoot, old, old))
+	l, err = fs.createLayerByScan()
+	require.NoError(err)
+	require.Contains(fs.scanCache, "/test")
+	require.Contains(fs.scanCache, "/")
+
+	// Files of cached directories are still checked.
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte("changed"), 0644))
+	fi, err := os.Lstat(dir)
+	require.NoError(err)
+	require.Equal(fs.scanCache["/test"], newScanDirStat(fi))
+	result, err := fs.createLayerByScan()
+	require.NoError(err)
+	require.Contains(result.files, "/test/a.txt")
+	require.Equal(int64(len("changed")), result.files["/test/a.txt"].(*contentMemFile).hdr.Size)
+
+	// Files added are found even if the mtime of their directory is reset,
+	// since that changes its ctime.
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "b.txt"), []byte("b"), 0644))
+	require.NoError(os.Chtimes(dir, old, old))
+	result, err = fs.createLayerByScan()
+	require.NoError(err)
+	require.Contains(result.files, "/test/b.txt")
+
+	// Replaced directories are listed again.
+	cached := fs.scanCache["/test"]
+	require.NoError(os.Rename(dir, dir+".old"))
+	require.NoError(os.Mkdir(dir, 0755))
+	fi, err = os.Lstat(dir)
+	require.NoError(err)
+	require.NotEqual(cached.ino, newScanDirStat(fi).ino)
+
+	fs.SetFullScan(true)
+	result, err = fs.createLayerByScan()
+	require.NoError(err)
+	require.Contains(result.files, "/test.old/b.txt")
+
+	// Resetting the merged view resets the cache.
+	fs.Reset()
+	require.Nil(fs.scanCache)
+}
+
+func TestScanLayerXattrs(t *testing.T) {
+	require := require.New(t)
+
+	tmpRoot, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(tmpRoot)
+
+	fs, err := NewMemFS(clock.NewMock(), tmpRoot, nil)
+	require.NoError(err)
+
+	l := newMemLayer()
+	require.NoError(addRegularFileToLayer(l, tmpRoot, "/server", "server", 0755))
+	_, err = fs.createLayerByScan()
+	require.NoError(err)
+
+	// Setting capabilities only changes ctime, but the file is still part of
+	// the next layer.
+	src := filepath.Join(tmpRoot, "server")
+	require.NoError(utils.SetXattrs(src, map[string]string{"user.test": "value"}))
+	if xattrs, err := utils.GetXattrs(src); err != nil || len(xattrs) == 0 {
+		t.Skip("xattrs are not supported")
+	}
+	l, err = fs.createLayerByScan()
+	require.NoError(err)
+	require.Contains(l.files, "/server")
+	mf := l.files["/server"].(*contentMemFile)
+	require.Equal("value", mf.hdr.PAXRecords["SCHILY.xattr.user.test"])
+}
+
+func TestScanLayerOpaqueWhiteout(t *testing.T) {
+	require := require.New(t)
+
+	tmpRoot, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(tmpRoot)
+
+	fs, err := NewMemFS(clock.NewMock(), tmpRoot, nil)
+	require.NoError(err)
+
+	l := newMemLayer()
+	require.NoError(addDirectoryToLayer(l, tmpRoot, "/test", 0755))
+	require.NoError(addRegularFileToLayer(l, tmpRoot, "/test/a", "a", 0644))
+	require.NoError(addDirectoryToLayer(l, tmpRoot, "/test/b", 0755))
+	require.NoError(addRegularFileToLayer(l, tmpRoot, "/test/b/c", "c", 0644))
+	require.NoError(addRegularFileToLayer(l, tmpRoot, "/test/z", "z", 0644))
+	_, err = fs.createLayerByScan()
+	require.NoError(err)
+
+	// Deleting and recreating a directory produces one opaque whiteout
+	// instead of one whiteout per file.
+	require.NoError(os.RemoveAll(filepath.Join(tmpRoot, "test")))
+	l = newMemLayer()
+	require.NoError(addDirectoryToLayer(l, tmpRoot, "/test", 0755))
+	require.NoError(addRegularFileToLayer(l, tmpRoot, "/test/d", "d", 0644))
+
+	var b bytes.Buffer
+	w := tar.NewWriter(&b)
+	require.NoError(fs.AddLayerByScan(w))
+	require.NoError(w.Close())
+
+	var names []string
+	r := tar.NewReader(&b)
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(err)
+		names = append(names, hdr.Name)
+	}
+	require.Equal([]string{"test/", "test/.wh..wh..opq", "test/d"}, names)
+
+	_, ok := fs.lookup("/test/b")
+	require.False(ok)
+	_, ok = fs.lookup("/test/d")
+	require.True(ok)
+
+	// A single deleted file is still whited out by itself.
+	require.NoError(os.Remove(filepath.Join(tmpRoot, "test/d")))
+	result, err := fs.createLayerByScan()
+	require.NoError(err)
+	require.IsType(&whiteoutMemFile{}, result.files["/test/d"])
+}
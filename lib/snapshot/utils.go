@@ -204,6 +204,9 @@ func tarOneItem(root, p string, fi os.FileInfo, tw *tar.Writer, inodes map[uint6
 		return fmt.Errorf("trim root: %s", err)
 	}
 	hdr.Name = pathutils.RelPath(trimmed)
+	if err := tario.AddXattrs(hdr, p); err != nil {
+		return fmt.Errorf("add xattrs: %s", err)
+	}
 	if err := tw.WriteHeader(hdr); err != nil {
 		return fmt.Errorf("write header: %s", err)
 	}
@@ -239,6 +242,64 @@ func tarOneItem(root, p string, fi os.FileInfo, tw *tar.Writer, inodes map[uint6
 	return nil
 }
 
+// resolveInRoot returns the location on disk of path p of the file system
+// rooted at root. Symlinks in the parent directories of p are followed as if
+// root was "/", so the result is always under root. The last element of p is
+// only followed if p ends with "/".
+func resolveInRoot(root, p string) (string, error) {
+	if root == "" || root == "/" {
+		return filepath.Join(root, p), nil
+	}
+
+	var linksWalked int
+	followLast := strings.HasSuffix(p, "/")
+	resolved := "/"
+	parts := pathutils.SplitPath(p)
+	for i := 0; i < len(parts); i++ {
+		next := filepath.Join(resolved, parts[i])
+		if i == len(parts)-1 && !followLast {
+			resolved = next
+			break
+		}
+		fi, err := os.Lstat(filepath.Join(root, next))
+		if os.IsNotExist(err) {
+			resolved = filepath.Join(append([]string{next}, parts[i+1:]...)...)
+			break
+		} else if err != nil {
+			return "", fmt.Errorf("lstat: %s", err)
+		} else if fi.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		if linksWalked++; linksWalked > 255 {
+			return "", errors.New("resolve in root: too many links")
+		}
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", fmt.Errorf("read link: %s", err)
+		}
+		if filepath.IsAbs(target) {
+			if pathutils.IsDescendantOfAny(target, []string{root}) {
+				// Links created with root prefix.
+				target = strings.TrimPrefix(target, root)
+			}
+		} else {
+			target = filepath.Join(resolved, target)
+		}
+		// Start over from the link target.
+		parts = append(pathutils.SplitPath(filepath.Join("/", target)), parts[i+1:]...)
+		resolved = "/"
+		i = -1
+	}
+
+	result := filepath.Join(root, resolved)
+	if strings.HasSuffix(p, "/") && !strings.HasSuffix(result, "/") {
+		result += "/"
+	}
+	return result, nil
+}
+
 // evalSymlinks returns the path name after the evaluation of any symbolic links.
 // When actually operating on files, joins their absolute paths to srcRoot. This
 // function assumes that the path passed corresponds to a file that exists and that
@@ -146,6 +146,38 @@ func TestEvalSymlink(t *testing.T) {
 	})
 }
 
+func TestResolveInRoot(t *testing.T) {
+	require := require.New(t)
+	root, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(root)
+
+	require.NoError(os.MkdirAll(filepath.Join(root, "usr", "lib"), os.ModePerm))
+	require.NoError(os.Symlink("/usr/lib", filepath.Join(root, "lib")))
+	require.NoError(os.Symlink("../lib", filepath.Join(root, "usr", "lib64")))
+	require.NoError(os.Symlink(filepath.Join(root, "usr"), filepath.Join(root, "prefixed")))
+	require.NoError(os.Symlink("/../../..", filepath.Join(root, "escape")))
+
+	for p, expected := range map[string]string{
+		"/usr/lib/file":      "/usr/lib/file",
+		"/lib/file":          "/usr/lib/file",
+		"/lib":               "/lib",
+		"/lib/":              "/usr/lib/",
+		"/usr/lib64/file":    "/usr/lib/file",
+		"/prefixed/lib/file": "/usr/lib/file",
+		"/escape/etc/passwd": "/etc/passwd",
+		"/missing/lib/file":  "/missing/lib/file",
+	} {
+		resolved, err := resolveInRoot(root, p)
+		require.NoError(err)
+		require.Equal(root+expected, resolved, p)
+	}
+
+	resolved, err := resolveInRoot("/", "/lib/file")
+	require.NoError(err)
+	require.Equal("/lib/file", resolved)
+}
+
 func TestRemoveAll(t *testing.T) {
 	require := require.New(t)
 
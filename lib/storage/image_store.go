@@ -24,12 +24,19 @@ import (
 	"github.com/uber/makisu/lib/docker/image"
 )
 
-// ImageStore contains a manifeststore, a layertarstore, and a sandbox dir.
+const (
+	manifestListDir = "manifestlist"
+	memFSIndexDir   = "memfsindex"
+)
+
+// ImageStore contains a manifeststore, a layertarstore, a sandbox dir, and a
+// dir for the indexes of merged layers.
 type ImageStore struct {
-	RootDir    string
-	SandboxDir string
-	Manifests  *ManifestStore
-	Layers     *LayerTarStore
+	RootDir       string
+	SandboxDir    string
+	MemFSIndexDir string
+	Manifests     *ManifestStore
+	Layers        *LayerTarStore
 }
 
 // NewImageStore creates a new ImageStore.
@@ -43,6 +50,11 @@ func NewImageStore(rootDir string) (*ImageStore, error) {
 		return nil, fmt.Errorf("init sandbox dir: %s", err)
 	}
 
+	indexDir := filepath.Join(rootDir, memFSIndexDir)
+	if err := os.MkdirAll(indexDir, 0755); err != nil {
+		return nil, fmt.Errorf("init memfs index dir: %s", err)
+	}
+
 	m, err := NewManifestStore(rootDir)
 	if err != nil {
 		return nil, fmt.Errorf("init manifest store: %s", err)
@@ -53,10 +65,11 @@ func NewImageStore(rootDir string) (*ImageStore, error) {
 	}
 
 	return &ImageStore{
-		RootDir:    rootDir,
-		SandboxDir: sandboxDir,
-		Manifests:  m,
-		Layers:     l,
+		RootDir:       rootDir,
+		SandboxDir:    sandboxDir,
+		MemFSIndexDir: indexDir,
+		Manifests:     m,
+		Layers:        l,
 	}, nil
 }
 
@@ -97,3 +110,49 @@ func (store *ImageStore) SaveManifest(
 
 	return nil
 }
+
+// SaveManifestList saves the manifest list with the given name, so it can be
+// pushed later.
+func (store *ImageStore) SaveManifestList(list image.ManifestList, imageName image.Name) error {
+	listJSON, err := json.Marshal(list)
+	if err != nil {
+		return fmt.Errorf("marshal manifest list to JSON: %s", err)
+	}
+
+	listFile, err := ioutil.TempFile(store.SandboxDir, "")
+	if err != nil {
+		return fmt.Errorf("create tmp manifest list file: %s", err)
+	}
+	if _, err := listFile.Write(listJSON); err != nil {
+		return fmt.Errorf("write manifest list file: %s", err)
+	}
+	if err := listFile.Close(); err != nil {
+		return fmt.Errorf("close manifest list file: %s", err)
+	}
+
+	listDir := filepath.Join(store.RootDir, manifestListDir)
+	if err := os.MkdirAll(listDir, 0755); err != nil {
+		return fmt.Errorf("create manifest list dir: %s", err)
+	}
+	listPath := filepath.Join(
+		listDir, encodeRepoTag(imageName.GetRepository(), imageName.GetTag()))
+	if err := os.Rename(listFile.Name(), listPath); err != nil {
+		return fmt.Errorf("commit manifest list to store: %s", err)
+	}
+	return nil
+}
+
+// LoadManifestList reads the manifest list saved with the given name.
+func (store *ImageStore) LoadManifestList(imageName image.Name) (*image.ManifestList, error) {
+	listPath := filepath.Join(store.RootDir, manifestListDir,
+		encodeRepoTag(imageName.GetRepository(), imageName.GetTag()))
+	listJSON, err := ioutil.ReadFile(listPath)
+	if err != nil {
+		return nil, fmt.Errorf("read manifest list: %s", err)
+	}
+	list := new(image.ManifestList)
+	if err := json.Unmarshal(listJSON, list); err != nil {
+		return nil, fmt.Errorf("unmarshal manifest list: %s", err)
+	}
+	return list, nil
+}
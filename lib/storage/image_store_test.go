@@ -0,0 +1,51 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package storage
+
+import (
+	"testing"
+
+	"github.com/uber/makisu/lib/docker/image"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSaveManifestList(t *testing.T) {
+	require := require.New(t)
+
+	store, cleanup := StoreFixture()
+	defer cleanup()
+
+	name := image.MustParseName("localhost:5055/makisu/test:multiarch")
+	_, err := store.LoadManifestList(name)
+	require.Error(err)
+
+	list, err := image.NewManifestList(image.MediaTypeManifestList)
+	require.NoError(err)
+	require.NoError(list.Add(
+		image.Descriptor{MediaType: image.MediaTypeManifest, Size: 527, Digest: "sha256:amd64"},
+		image.Platform{OS: "linux", Architecture: "amd64"}))
+	require.NoError(store.SaveManifestList(*list, name))
+
+	loaded, err := store.LoadManifestList(name)
+	require.NoError(err)
+	require.Equal(list, loaded)
+
+	// Saving again overwrites the list.
+	list.Manifests = list.Manifests[:0]
+	require.NoError(store.SaveManifestList(*list, name))
+	loaded, err = store.LoadManifestList(name)
+	require.NoError(err)
+	require.Empty(loaded.Manifests)
+}
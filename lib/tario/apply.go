@@ -20,8 +20,8 @@ import (
 	"os"
 )
 
-// ApplyHeader updates file owner, mtime, and permission bits according to
-// header.
+// ApplyHeader updates file owner, mtime, permission bits and extended
+// attributes according to header.
 // It doesn't change size or type (i.e file to dir).
 func ApplyHeader(path string, header *tar.Header) error {
 	fi, err := os.Lstat(path)
@@ -41,6 +41,11 @@ func ApplyHeader(path string, header *tar.Header) error {
 	if err := os.Chmod(path, header.FileInfo().Mode()); err != nil {
 		return fmt.Errorf("chmod %s: %s", path, err)
 	}
+	// Note: Extended attributes need to be set after chown, otherwise file
+	// capabilities would be cleared.
+	if err := applyXattrs(path, header); err != nil {
+		return err
+	}
 	mtime := header.FileInfo().ModTime()
 	if err := os.Chtimes(path, mtime, mtime); err != nil {
 		return fmt.Errorf("chtimes %s: %s", path, err)
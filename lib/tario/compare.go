@@ -80,7 +80,8 @@ func isSimilarHardLink(h *tar.Header, nh *tar.Header, ignoreTime bool) (bool, er
 }
 
 // isSimilarDirectory returns if the given headers are describing similar
-// directories. It only checks mtime and owner, ignoring size, path and content.
+// directories. It only checks mtime, owner and extended attributes, ignoring
+// size, path and content.
 func isSimilarDirectory(h *tar.Header, nh *tar.Header, ignoreTime bool) (bool, error) {
 	timeIsEqual := true
 	if !ignoreTime {
@@ -92,15 +93,16 @@ func isSimilarDirectory(h *tar.Header, nh *tar.Header, ignoreTime bool) (bool, e
 	if timeIsEqual &&
 		h.Uid == nh.Uid &&
 		h.Gid == nh.Gid &&
-		h.FileInfo().Mode() == nh.FileInfo().Mode() {
+		h.FileInfo().Mode() == nh.FileInfo().Mode() &&
+		isSimilarXattrs(h, nh) {
 		return true, nil
 	}
 	return false, nil
 }
 
 // isSimilarRegularFile returns if the given headers are describing similar
-// regular files. It only checks mtime, size, and owner, ignoring path and
-// content.
+// regular files. It only checks mtime, size, owner and extended attributes,
+// ignoring path and content.
 func isSimilarRegularFile(h *tar.Header, nh *tar.Header, ignoreTime bool) (bool, error) {
 	timeIsEqual := true
 	if !ignoreTime {
@@ -113,8 +115,47 @@ func isSimilarRegularFile(h *tar.Header, nh *tar.Header, ignoreTime bool) (bool,
 		h.Uid == nh.Uid &&
 		h.Gid == nh.Gid &&
 		h.Size == nh.Size &&
-		h.FileInfo().Mode() == nh.FileInfo().Mode() {
+		h.FileInfo().Mode() == nh.FileInfo().Mode() &&
+		isSimilarXattrs(h, nh) {
 		return true, nil
 	}
 	return false, nil
 }
+
+// DiffHeaders returns the names of the fields that differ between the given
+// headers, among the ones compared by IsSimilarHeader: type, mode, uid, gid,
+// size, mtime, linkname and xattrs.
+func DiffHeaders(h *tar.Header, nh *tar.Header, ignoreTime bool) []string {
+	var fields []string
+	if h.Typeflag != nh.Typeflag &&
+		!(isRegularFileType(h.Typeflag) && isRegularFileType(nh.Typeflag)) {
+		fields = append(fields, "type")
+	}
+	if h.FileInfo().Mode() != nh.FileInfo().Mode() {
+		fields = append(fields, "mode")
+	}
+	if h.Uid != nh.Uid {
+		fields = append(fields, "uid")
+	}
+	if h.Gid != nh.Gid {
+		fields = append(fields, "gid")
+	}
+	if h.Size != nh.Size {
+		fields = append(fields, "size")
+	}
+	if !ignoreTime && !h.ModTime.Truncate(time.Second).Equal(nh.ModTime.Truncate(time.Second)) {
+		fields = append(fields, "mtime")
+	}
+	if h.Linkname != nh.Linkname {
+		fields = append(fields, "linkname")
+	}
+	if !isSimilarXattrs(h, nh) {
+		fields = append(fields, "xattrs")
+	}
+	return fields
+}
+
+// isRegularFileType returns if the given type flag is one of a regular file.
+func isRegularFileType(typeflag byte) bool {
+	return typeflag == tar.TypeReg || typeflag == tar.TypeRegA
+}
@@ -744,3 +744,35 @@ func TestIsSimilarRegularFile(t *testing.T) {
 		require.NoError(err)
 	})
 }
+
+func TestDiffHeaders(t *testing.T) {
+	require := require.New(t)
+
+	now := time.Now()
+	h := &tar.Header{
+		Name:     "test",
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     5,
+		ModTime:  now,
+	}
+	nh := &tar.Header{
+		Name:     "test",
+		Typeflag: tar.TypeRegA,
+		Mode:     0644,
+		Size:     5,
+		ModTime:  now,
+	}
+	require.Empty(DiffHeaders(h, nh, false))
+
+	nh.Mode = 0755
+	nh.Uid = 1000
+	nh.ModTime = now.Add(time.Hour)
+	nh.PAXRecords = map[string]string{_paxXattrPrefix + "user.test": "value"}
+	require.Equal([]string{"mode", "uid", "mtime", "xattrs"}, DiffHeaders(h, nh, false))
+	require.Equal([]string{"mode", "uid", "xattrs"}, DiffHeaders(h, nh, true))
+
+	nh = &tar.Header{Name: "test", Typeflag: tar.TypeSymlink, Mode: 0777, Linkname: "target"}
+	require.Equal(
+		[]string{"type", "mode", "size", "mtime", "linkname"}, DiffHeaders(h, nh, false))
+}
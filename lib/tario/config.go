@@ -0,0 +1,88 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tario
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/klauspost/pgzip"
+)
+
+// Config controls how image layers are written. The package level functions
+// use the config made of the package level variables, while builds embedding
+// makisu can pass their own instead.
+type Config struct {
+	// CompressionLevel is the gzip compression level of layers.
+	CompressionLevel int
+
+	// SourceDateEpoch enables reproducible tars if not nil. See the package
+	// level variable of the same name.
+	SourceDateEpoch *time.Time
+
+	// NormalizeOwners resets the owner of written entries to root. It only
+	// applies if SourceDateEpoch is set.
+	NormalizeOwners bool
+}
+
+// DefaultConfig returns the config made of the current values of the package
+// level variables.
+func DefaultConfig() *Config {
+	return &Config{
+		CompressionLevel: CompressionLevel,
+		SourceDateEpoch:  SourceDateEpoch,
+		NormalizeOwners:  NormalizeOwners,
+	}
+}
+
+// NewConfig returns a config with the default compression level, that
+// doesn't produce reproducible tars.
+func NewConfig() *Config {
+	return &Config{CompressionLevel: pgzip.DefaultCompression}
+}
+
+// SetCompressionLevel sets the compression level given its name, which could
+// be "no", "speed", "size" or "default".
+func (c *Config) SetCompressionLevel(compressionLevelStr string) error {
+	level, ok := _compressionLevelMap[compressionLevelStr]
+	if !ok {
+		return fmt.Errorf("invalid compression level %s", compressionLevelStr)
+	}
+	c.CompressionLevel = level
+	return nil
+}
+
+// SetSourceDateEpoch enables reproducible tars, using the given unix
+// timestamp as the latest mtime of written entries.
+func (c *Config) SetSourceDateEpoch(epoch int64) {
+	t := time.Unix(epoch, 0).UTC()
+	c.SourceDateEpoch = &t
+}
+
+// Now returns the current time, or SourceDateEpoch if reproducible tars are
+// enabled.
+func (c *Config) Now() time.Time {
+	if c.SourceDateEpoch != nil {
+		return *c.SourceDateEpoch
+	}
+	return time.Now()
+}
+
+// NewGzipWriter returns a new gzip writer with the compression level of the
+// config.
+func (c *Config) NewGzipWriter(w io.Writer) (io.WriteCloser, error) {
+	return pgzip.NewWriterLevel(w, c.CompressionLevel)
+}
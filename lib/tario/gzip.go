@@ -15,7 +15,6 @@
 package tario
 
 import (
-	"fmt"
 	"io"
 
 	"github.com/klauspost/pgzip"
@@ -34,17 +33,17 @@ var _compressionLevelMap = map[string]int{
 
 // SetCompressionLevel sets global var CompressionLevel.
 func SetCompressionLevel(compressionLevelStr string) error {
-	level, ok := _compressionLevelMap[compressionLevelStr]
-	if !ok {
-		return fmt.Errorf("invalid compression level %s", compressionLevelStr)
+	c := &Config{}
+	if err := c.SetCompressionLevel(compressionLevelStr); err != nil {
+		return err
 	}
-	CompressionLevel = level
+	CompressionLevel = c.CompressionLevel
 	return nil
 }
 
 // NewGzipWriter returns a new gzip writer with compression level.
 func NewGzipWriter(w io.Writer) (io.WriteCloser, error) {
-	return pgzip.NewWriterLevel(w, CompressionLevel)
+	return DefaultConfig().NewGzipWriter(w)
 }
 
 // NewGzipReader returns a new gzip reader.
@@ -0,0 +1,83 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tario
+
+import (
+	"archive/tar"
+	"time"
+)
+
+// SourceDateEpoch enables reproducible tars if not nil. Entries written by
+// WriteHeader get their mtime clamped to it, and host dependent timestamps
+// are removed from their headers.
+// Note: headers are only normalized when written, so changes to files can
+// still be detected by comparing on-disk mtimes with in-memory headers.
+var SourceDateEpoch *time.Time
+
+// NormalizeOwners resets the owner of entries written by WriteHeader to root.
+// It only applies if SourceDateEpoch is set.
+var NormalizeOwners bool
+
+// _paxTimeKeys are the PAX records holding timestamps.
+var _paxTimeKeys = []string{"atime", "ctime", "mtime"}
+
+// SetSourceDateEpoch enables reproducible tars, using the given unix timestamp
+// as the latest mtime of written entries.
+func SetSourceDateEpoch(epoch int64) {
+	c := &Config{}
+	c.SetSourceDateEpoch(epoch)
+	SourceDateEpoch = c.SourceDateEpoch
+}
+
+// Now returns the current time, or SourceDateEpoch if reproducible tars are
+// enabled.
+func Now() time.Time {
+	return DefaultConfig().Now()
+}
+
+// normalizeHeader returns a copy of the given header with host dependent
+// fields removed, if reproducible tars are enabled. Otherwise it returns the
+// header itself.
+func (c *Config) normalizeHeader(h *tar.Header) *tar.Header {
+	if c.SourceDateEpoch == nil {
+		return h
+	}
+
+	nh := *h
+	if nh.ModTime.After(*c.SourceDateEpoch) {
+		nh.ModTime = *c.SourceDateEpoch
+	}
+	nh.AccessTime = time.Time{}
+	nh.ChangeTime = time.Time{}
+	nh.Uname = ""
+	nh.Gname = ""
+	if c.NormalizeOwners {
+		nh.Uid = 0
+		nh.Gid = 0
+	}
+	if len(h.PAXRecords) > 0 {
+		nh.PAXRecords = make(map[string]string, len(h.PAXRecords))
+		for k, v := range h.PAXRecords {
+			nh.PAXRecords[k] = v
+		}
+		for _, k := range _paxTimeKeys {
+			delete(nh.PAXRecords, k)
+		}
+	}
+	// Let the writer pick the simplest format able to encode the header,
+	// instead of the one guessed when the header was read.
+	nh.Format = tar.FormatUnknown
+	return &nh
+}
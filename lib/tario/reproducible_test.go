@@ -0,0 +1,82 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tario
+
+import (
+	"archive/tar"
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteHeaderReproducible(t *testing.T) {
+	require := require.New(t)
+
+	SetSourceDateEpoch(1000)
+	NormalizeOwners = true
+	defer func() {
+		SourceDateEpoch = nil
+		NormalizeOwners = false
+	}()
+
+	newHeader := func(mtime time.Time) *tar.Header {
+		return &tar.Header{
+			Name:       "test/",
+			Typeflag:   tar.TypeDir,
+			Mode:       0755,
+			Uid:        1000,
+			Gid:        1000,
+			Uname:      "user",
+			ModTime:    mtime,
+			AccessTime: time.Now(),
+			ChangeTime: time.Now(),
+			PAXRecords: map[string]string{"atime": "123.5"},
+			Format:     tar.FormatPAX,
+		}
+	}
+
+	write := func(h *tar.Header) []byte {
+		var b bytes.Buffer
+		w := tar.NewWriter(&b)
+		require.NoError(WriteHeader(w, h))
+		require.NoError(w.Close())
+		return b.Bytes()
+	}
+
+	h1 := newHeader(time.Now())
+	b1 := write(h1)
+	b2 := write(newHeader(time.Now().Add(time.Hour)))
+	require.Equal(b1, b2)
+
+	// The given header is not modified.
+	require.Equal(1000, h1.Uid)
+	require.Equal("123.5", h1.PAXRecords["atime"])
+
+	r := tar.NewReader(bytes.NewReader(b1))
+	h, err := r.Next()
+	require.NoError(err)
+	require.Equal(int64(1000), h.ModTime.Unix())
+	require.Equal(0, h.Uid)
+	require.Equal(0, h.Gid)
+	require.Empty(h.Uname)
+
+	// Older mtimes are kept.
+	b3 := write(newHeader(time.Unix(500, 0)))
+	h, err = tar.NewReader(bytes.NewReader(b3)).Next()
+	require.NoError(err)
+	require.Equal(int64(500), h.ModTime.Unix())
+}
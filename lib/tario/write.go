@@ -26,7 +26,17 @@ import (
 // WriteEntry write the file from the local filesystem into the tar writer.
 // This function doesn't handle parent directories.
 func WriteEntry(w *tar.Writer, src string, h *tar.Header) error {
-	if err := WriteHeader(w, h); err != nil {
+	return DefaultConfig().WriteEntry(w, src, h)
+}
+
+// WriteHeader writes the header given to the tar writer.
+func WriteHeader(w *tar.Writer, h *tar.Header) error {
+	return DefaultConfig().WriteHeader(w, h)
+}
+
+// WriteEntry is the same as the package level WriteEntry, using the config.
+func (c *Config) WriteEntry(w *tar.Writer, src string, h *tar.Header) error {
+	if err := c.WriteHeader(w, h); err != nil {
 		return fmt.Errorf("write header helper: %s", err)
 	}
 
@@ -51,8 +61,9 @@ func WriteEntry(w *tar.Writer, src string, h *tar.Header) error {
 	}
 }
 
-// WriteHeader writes the header given to the tar writer.
-func WriteHeader(w *tar.Writer, h *tar.Header) error {
+// WriteHeader is the same as the package level WriteHeader, using the
+// config.
+func (c *Config) WriteHeader(w *tar.Writer, h *tar.Header) error {
 	// Remove leading "/" in dst. Tars produced by docker doesn't have it.
 	h.Name = strings.TrimLeft(h.Name, "/")
 
@@ -61,7 +72,7 @@ func WriteHeader(w *tar.Writer, h *tar.Header) error {
 	// to avoid inconsistency.
 	h.ModTime = h.ModTime.Truncate(1 * time.Second)
 
-	if err := w.WriteHeader(h); err != nil {
+	if err := w.WriteHeader(c.normalizeHeader(h)); err != nil {
 		return fmt.Errorf("write header %s: %s", h.Name, err)
 	}
 	return nil
@@ -0,0 +1,94 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tario
+
+import (
+	"archive/tar"
+	"fmt"
+	"strings"
+
+	"github.com/uber/makisu/lib/utils"
+)
+
+// _paxXattrPrefix is the prefix of the PAX records holding extended
+// attributes, like file capabilities.
+const _paxXattrPrefix = "SCHILY.xattr."
+
+// AddXattrs adds the extended attributes of the file at path to the header,
+// as PAX records. Symlinks are ignored.
+func AddXattrs(h *tar.Header, path string) error {
+	if h.Typeflag == tar.TypeSymlink {
+		return nil
+	}
+	xattrs, err := utils.GetXattrs(path)
+	if err != nil {
+		return err
+	}
+	for name, value := range xattrs {
+		if h.PAXRecords == nil {
+			h.PAXRecords = make(map[string]string)
+		}
+		h.PAXRecords[_paxXattrPrefix+name] = value
+	}
+	return nil
+}
+
+// Xattrs returns the extended attributes of the header, except host ones.
+func Xattrs(h *tar.Header) map[string]string {
+	var xattrs map[string]string
+	add := func(name, value string) {
+		if utils.IsHostXattr(name) {
+			return
+		}
+		if xattrs == nil {
+			xattrs = make(map[string]string)
+		}
+		xattrs[name] = value
+	}
+	for k, v := range h.PAXRecords {
+		if strings.HasPrefix(k, _paxXattrPrefix) {
+			add(strings.TrimPrefix(k, _paxXattrPrefix), v)
+		}
+	}
+	// Headers read by old versions of archive/tar might only have Xattrs.
+	for k, v := range h.Xattrs {
+		add(k, v)
+	}
+	return xattrs
+}
+
+// applyXattrs sets the extended attributes of the header on the file at
+// path.
+func applyXattrs(path string, h *tar.Header) error {
+	if err := utils.SetXattrs(path, Xattrs(h)); err != nil {
+		return fmt.Errorf("set xattrs %s: %s", path, err)
+	}
+	return nil
+}
+
+// isSimilarXattrs returns if the given headers have the same extended
+// attributes.
+func isSimilarXattrs(h *tar.Header, nh *tar.Header) bool {
+	x, nx := Xattrs(h), Xattrs(nh)
+	if len(x) != len(nx) {
+		return false
+	}
+	for k, v := range x {
+		if nv, ok := nx[k]; !ok || nv != v {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,87 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tario
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/uber/makisu/lib/utils"
+)
+
+// _capNetBindService is the value of security.capability for
+// cap_net_bind_service+ep.
+const _capNetBindService = "\x01\x00\x00\x02\x00\x04\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"
+
+func TestXattrs(t *testing.T) {
+	require := require.New(t)
+
+	tmpRoot, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(tmpRoot)
+
+	testFile1, err := ioutil.TempFile(tmpRoot, "test1")
+	require.NoError(err)
+	testFile1.Close()
+	testFile2, err := ioutil.TempFile(tmpRoot, "test2")
+	require.NoError(err)
+	testFile2.Close()
+
+	require.NoError(utils.SetXattrs(testFile1.Name(), map[string]string{
+		"user.test":           "value",
+		"security.capability": _capNetBindService,
+	}))
+	xattrs, err := utils.GetXattrs(testFile1.Name())
+	require.NoError(err)
+	if len(xattrs) != 2 {
+		t.Skip("xattrs are not supported")
+	}
+
+	fi, err := os.Lstat(testFile1.Name())
+	require.NoError(err)
+	header, err := tar.FileInfoHeader(fi, "")
+	require.NoError(err)
+	require.NoError(AddXattrs(header, testFile1.Name()))
+	require.Equal("value", header.PAXRecords["SCHILY.xattr.user.test"])
+	require.Equal(xattrs, Xattrs(header))
+
+	// Capabilities are kept even though the owner changes.
+	header.Uid = 1
+	require.NoError(ApplyHeader(testFile2.Name(), header))
+	xattrs2, err := utils.GetXattrs(testFile2.Name())
+	require.NoError(err)
+	require.Equal(xattrs, xattrs2)
+
+	fi2, err := os.Lstat(testFile2.Name())
+	require.NoError(err)
+	header2, err := tar.FileInfoHeader(fi2, "")
+	require.NoError(err)
+	similar, err := IsSimilarHeader(header, header2, true)
+	require.NoError(err)
+	require.False(similar)
+	require.NoError(AddXattrs(header2, testFile2.Name()))
+	similar, err = IsSimilarHeader(header, header2, true)
+	require.NoError(err)
+	require.True(similar)
+
+	// Host xattrs are ignored.
+	header2.PAXRecords["SCHILY.xattr.security.selinux"] = "system_u:object_r:container_file_t:s0"
+	similar, err = IsSimilarHeader(header, header2, true)
+	require.NoError(err)
+	require.True(similar)
+}
@@ -0,0 +1,204 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// AccountUser is an entry of a passwd file.
+type AccountUser struct {
+	Name string
+	UID  int
+	GID  int
+	Home string
+}
+
+// AccountGroup is an entry of a group file.
+type AccountGroup struct {
+	Name    string
+	GID     int
+	Members []string
+}
+
+// ResolvedUser contains the credentials and home dir of the user running a
+// command.
+type ResolvedUser struct {
+	UID    int
+	GID    int
+	Groups []int // Supplementary groups.
+	Home   string
+}
+
+// Accounts contains the users and groups of an image, parsed from its passwd
+// and group files rather than from the host's.
+type Accounts struct {
+	Users  []AccountUser
+	Groups []AccountGroup
+}
+
+// ParseAccounts parses the content of passwd and group files. Malformed lines
+// are skipped. Either content can be empty.
+func ParseAccounts(passwd, group []byte) *Accounts {
+	accounts := &Accounts{}
+	for _, fields := range splitAccountLines(passwd, 7) {
+		uid, err := strconv.Atoi(fields[2])
+		if err != nil {
+			continue
+		}
+		gid, err := strconv.Atoi(fields[3])
+		if err != nil {
+			continue
+		}
+		accounts.Users = append(accounts.Users, AccountUser{
+			Name: fields[0],
+			UID:  uid,
+			GID:  gid,
+			Home: fields[5],
+		})
+	}
+	for _, fields := range splitAccountLines(group, 4) {
+		gid, err := strconv.Atoi(fields[2])
+		if err != nil {
+			continue
+		}
+		var members []string
+		if fields[3] != "" {
+			members = strings.Split(fields[3], ",")
+		}
+		accounts.Groups = append(accounts.Groups, AccountGroup{
+			Name:    fields[0],
+			GID:     gid,
+			Members: members,
+		})
+	}
+	return accounts
+}
+
+// splitAccountLines returns the colon separated fields of the lines that have
+// exactly n fields, ignoring comments and empty lines.
+func splitAccountLines(content []byte, n int) [][]string {
+	var result [][]string
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if fields := strings.Split(line, ":"); len(fields) == n {
+			result = append(result, fields)
+		}
+	}
+	return result
+}
+
+// lookupUser returns the user with the given name or uid string.
+func (a *Accounts) lookupUser(s string) (*AccountUser, bool) {
+	uid, err := strconv.Atoi(s)
+	for i, u := range a.Users {
+		if (err == nil && u.UID == uid) || (err != nil && u.Name == s) {
+			return &a.Users[i], true
+		}
+	}
+	return nil, false
+}
+
+// lookupGroupID returns the gid of the group with the given name or gid string.
+func (a *Accounts) lookupGroupID(s string) (int, error) {
+	if gid, err := strconv.Atoi(s); err == nil {
+		return gid, nil
+	}
+	for _, g := range a.Groups {
+		if g.Name == s {
+			return g.GID, nil
+		}
+	}
+	return 0, fmt.Errorf("failed to look up group '%s': no such group", s)
+}
+
+// ResolveChown converts a chown string to uid and gid integers, in the same
+// way as the package level ResolveChown but using the accounts.
+func (a *Accounts) ResolveChown(chown string) (uid, gid int, err error) {
+	// Default to 0 for both.
+	if chown == "" {
+		return 0, 0, nil
+	}
+
+	split := strings.Split(chown, ":")
+	if len(split) > 2 {
+		return 0, 0, errors.New("failed to split on ':'")
+	}
+
+	if uid, err = strconv.Atoi(split[0]); err != nil {
+		u, ok := a.lookupUser(split[0])
+		if !ok {
+			return 0, 0, fmt.Errorf("failed to look up user '%s': no such user", split[0])
+		}
+		uid = u.UID
+	}
+
+	if len(split) == 1 {
+		return uid, uid, nil
+	}
+	if gid, err = a.lookupGroupID(split[1]); err != nil {
+		return 0, 0, err
+	}
+	return uid, gid, nil
+}
+
+// ResolveUser resolves the user of a USER directive, with format
+// <user>[:<group>]. The primary group and home dir of the user come from the
+// passwd file, and its supplementary groups from the group file.
+// Unknown numeric uids are allowed, in which case gid is set to 0 and home to
+// "/", like docker does.
+func (a *Accounts) ResolveUser(user string) (*ResolvedUser, error) {
+	split := strings.Split(user, ":")
+	if len(split) > 2 || split[0] == "" {
+		return nil, fmt.Errorf("invalid user '%s'", user)
+	}
+
+	result := &ResolvedUser{Home: "/"}
+	u, ok := a.lookupUser(split[0])
+	if ok {
+		result.UID = u.UID
+		result.GID = u.GID
+		if u.Home != "" {
+			result.Home = u.Home
+		}
+		for _, g := range a.Groups {
+			for _, member := range g.Members {
+				if member == u.Name {
+					result.Groups = append(result.Groups, g.GID)
+					break
+				}
+			}
+		}
+	} else if uid, err := strconv.Atoi(split[0]); err == nil {
+		result.UID = uid
+	} else {
+		return nil, fmt.Errorf("failed to look up user '%s': no such user", split[0])
+	}
+
+	if len(split) == 2 {
+		gid, err := a.lookupGroupID(split[1])
+		if err != nil {
+			return nil, err
+		}
+		result.GID = gid
+	}
+	return result, nil
+}
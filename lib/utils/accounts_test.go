@@ -0,0 +1,118 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	_testPasswd = `root:x:0:0:root:/root:/bin/bash
+# comment
+app:x:1000:1001:App:/srv/app:/bin/sh
+malformed:x:1002
+`
+	_testGroup = `root:x:0:
+wheel:x:10:root,app
+app:x:1001:
+docker:x:999:app
+`
+)
+
+func TestAccountsResolveChown(t *testing.T) {
+	accounts := ParseAccounts([]byte(_testPasswd), []byte(_testGroup))
+
+	tests := []struct {
+		desc    string
+		succeed bool
+		chown   string
+		uid     int
+		gid     int
+	}{
+		{"missing group", false, "app:", 0, 0},
+		{"missing user", false, ":app", 0, 0},
+		{"unknown user", false, "nobody", 0, 0},
+		{"unknown group", false, "app:nogroup", 0, 0},
+		{"malformed user", false, "malformed", 0, 0},
+		{"empty", true, "", 0, 0},
+		{"uid no group", true, "5", 5, 5},
+		{"uid and gid", true, "5:6", 5, 6},
+		{"user no group", true, "app", 1000, 1000},
+		{"user and group", true, "app:docker", 1000, 999},
+		{"uid and group", true, "7:wheel", 7, 10},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+			uid, gid, err := accounts.ResolveChown(test.chown)
+			if test.succeed {
+				require.NoError(err)
+				require.Equal(test.uid, uid)
+				require.Equal(test.gid, gid)
+			} else {
+				require.Error(err)
+			}
+		})
+	}
+}
+
+func TestAccountsResolveUser(t *testing.T) {
+	accounts := ParseAccounts([]byte(_testPasswd), []byte(_testGroup))
+
+	tests := []struct {
+		desc    string
+		succeed bool
+		user    string
+		result  *ResolvedUser
+	}{
+		{"name", true, "app", &ResolvedUser{1000, 1001, []int{10, 999}, "/srv/app"}},
+		{"uid", true, "1000", &ResolvedUser{1000, 1001, []int{10, 999}, "/srv/app"}},
+		{"root", true, "root", &ResolvedUser{0, 0, []int{10}, "/root"}},
+		{"name and group", true, "app:root", &ResolvedUser{1000, 0, []int{10, 999}, "/srv/app"}},
+		{"unknown uid", true, "4242", &ResolvedUser{4242, 0, nil, "/"}},
+		{"unknown uid and gid", true, "4242:4343", &ResolvedUser{4242, 4343, nil, "/"}},
+		{"unknown user", false, "nobody", nil},
+		{"unknown group", false, "app:nogroup", nil},
+		{"empty", false, "", nil},
+		{"too many parts", false, "app:app:app", nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+			result, err := accounts.ResolveUser(test.user)
+			if test.succeed {
+				require.NoError(err)
+				require.Equal(test.result, result)
+			} else {
+				require.Error(err)
+			}
+		})
+	}
+}
+
+func TestParseAccountsEmpty(t *testing.T) {
+	require := require.New(t)
+
+	accounts := ParseAccounts(nil, nil)
+	require.Empty(accounts.Users)
+	require.Empty(accounts.Groups)
+
+	_, _, err := accounts.ResolveChown("root")
+	require.Error(err)
+}
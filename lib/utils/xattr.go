@@ -0,0 +1,35 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import "strings"
+
+// _hostXattrPrefixes are the prefixes of extended attributes that describe
+// the host rather than the file, and are not part of images.
+var _hostXattrPrefixes = []string{
+	"security.selinux",
+	"trusted.overlay.",
+}
+
+// IsHostXattr returns true if the extended attribute with the given name
+// describes the host rather than the file, like SELinux labels.
+func IsHostXattr(name string) bool {
+	for _, prefix := range _hostXattrPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
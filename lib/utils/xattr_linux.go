@@ -0,0 +1,92 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+
+	"github.com/uber/makisu/lib/log"
+)
+
+// GetXattrs returns the extended attributes of the file at path, except host
+// ones. It follows symlinks.
+func GetXattrs(path string) (map[string]string, error) {
+	size, err := syscall.Listxattr(path, nil)
+	if err == syscall.ENOTSUP {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("list xattrs of %s: %s", path, err)
+	} else if size == 0 {
+		return nil, nil
+	}
+	buf := make([]byte, size)
+	if size, err = syscall.Listxattr(path, buf); err != nil {
+		return nil, fmt.Errorf("list xattrs of %s: %s", path, err)
+	}
+
+	var xattrs map[string]string
+	for _, name := range strings.Split(string(buf[:size]), "\x00") {
+		if name == "" || IsHostXattr(name) {
+			continue
+		}
+		value, err := getXattr(path, name)
+		if err == syscall.ENODATA {
+			// Removed since it was listed.
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("get xattr %s of %s: %s", name, path, err)
+		}
+		if xattrs == nil {
+			xattrs = make(map[string]string)
+		}
+		xattrs[name] = value
+	}
+	return xattrs, nil
+}
+
+func getXattr(path, name string) (string, error) {
+	size, err := syscall.Getxattr(path, name, nil)
+	if err != nil {
+		return "", err
+	} else if size == 0 {
+		return "", nil
+	}
+	buf := make([]byte, size)
+	if size, err = syscall.Getxattr(path, name, buf); err != nil {
+		return "", err
+	}
+	return string(buf[:size]), nil
+}
+
+// SetXattrs sets the given extended attributes on the file at path, except
+// host ones. It follows symlinks.
+// Like docker, attributes the file system doesn't support or the user isn't
+// allowed to set are skipped with a warning.
+func SetXattrs(path string, xattrs map[string]string) error {
+	for name, value := range xattrs {
+		if IsHostXattr(name) {
+			continue
+		}
+		err := syscall.Setxattr(path, name, []byte(value), 0)
+		if err == syscall.ENOTSUP || err == syscall.EPERM {
+			log.Warnf("Skipping xattr %s of %s: %s", name, path, err)
+		} else if err != nil {
+			return fmt.Errorf("set xattr %s of %s: %s", name, path, err)
+		}
+	}
+	return nil
+}
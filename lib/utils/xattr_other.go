@@ -0,0 +1,36 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !linux
+
+package utils
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// GetXattrs returns the extended attributes of the file at path. Extended
+// attributes are only supported on linux.
+func GetXattrs(path string) (map[string]string, error) {
+	return nil, nil
+}
+
+// SetXattrs sets the given extended attributes on the file at path. Extended
+// attributes are only supported on linux.
+func SetXattrs(path string, xattrs map[string]string) error {
+	if len(xattrs) > 0 {
+		return fmt.Errorf("xattrs are not supported on %s", runtime.GOOS)
+	}
+	return nil
+}
@@ -94,6 +94,21 @@ func (mr *MockClientMockRecorder) PullManifest(arg0 interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PullManifest", reflect.TypeOf((*MockClient)(nil).PullManifest), arg0)
 }
 
+// PullManifestList mocks base method
+func (m *MockClient) PullManifestList(arg0 string) (*image.ManifestList, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PullManifestList", arg0)
+	ret0, _ := ret[0].(*image.ManifestList)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// PullManifestList indicates an expected call of PullManifestList
+func (mr *MockClientMockRecorder) PullManifestList(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PullManifestList", reflect.TypeOf((*MockClient)(nil).PullManifestList), arg0)
+}
+
 // Push mocks base method
 func (m *MockClient) Push(arg0 string) error {
 	m.ctrl.T.Helper()
@@ -149,3 +164,17 @@ func (mr *MockClientMockRecorder) PushManifest(arg0, arg1 interface{}) *gomock.C
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PushManifest", reflect.TypeOf((*MockClient)(nil).PushManifest), arg0, arg1)
 }
+
+// PushManifestList mocks base method
+func (m *MockClient) PushManifestList(arg0 string, arg1 *image.ManifestList) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PushManifestList", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// PushManifestList indicates an expected call of PushManifestList
+func (mr *MockClientMockRecorder) PushManifestList(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PushManifestList", reflect.TypeOf((*MockClient)(nil).PushManifestList), arg0, arg1)
+}